@@ -0,0 +1,246 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	emptyRootDirErr = fmt.Errorf("empty root directory")
+	createDirErr    = fmt.Errorf("create directory")
+	fileWriteErr    = fmt.Errorf("file write")
+)
+
+// Local filesystem version of the storage connection. Files use the same subdirectory layout as the bucket under RootDir.
+type FileConnection struct {
+	RootDir      string
+	SubDirectory string
+	refreshSettings
+}
+
+func (fs *FileConnection) SetSubDirectory(subDirectory string) {
+	fs.SubDirectory = subDirectory
+}
+
+// Creates root directory if it doesn't exist.
+func (fs *FileConnection) CreateRootDir() (err error) {
+	if fs.RootDir == "" {
+		err = fmt.Errorf("%w error: %v. Re-enter storage path.", emptyRootDirErr, fs.RootDir)
+		return
+	}
+	if err = os.MkdirAll(fs.RootDir, 0755); err != nil {
+		err = fmt.Errorf("%w failed on %s: %v", createDirErr, fs.RootDir, err)
+		return
+	}
+	log.Printf("Directory %v ready.\n", fs.RootDir)
+	return
+}
+
+// Convert the storage filename into the path on disk.
+func (fs *FileConnection) filePath(fileName string) string {
+	return filepath.Join(fs.RootDir, filepath.FromSlash(fileName))
+}
+
+// Path of the hidden JSON file next to a stored file that holds its metadata.
+func metadataPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), ".meta-"+filepath.Base(filePath)+".json")
+}
+
+// Read the metadata saved with a stored file. Files stored without metadata return an empty map.
+func readMetadata(filePath string) (metadata map[string]string, err error) {
+	var metaBytes []byte
+
+	metadata = make(map[string]string)
+	if metaBytes, err = ioutil.ReadFile(metadataPath(filePath)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(metaBytes, &metadata)
+	return
+}
+
+// Check if file already exists.
+func (fs *FileConnection) CheckFileExists(ctx context.Context, fileName string) (exists bool) {
+	_, err := os.Stat(fs.filePath(fileName))
+	return err == nil
+}
+
+// List files already stored in the subdirectory.
+func (fs *FileConnection) ListExisting(ctx context.Context, subDirectory string) (existing map[string]ObjectInfo, err error) {
+	existing = make(map[string]ObjectInfo)
+	subDirPath := fs.filePath(subDirectory)
+
+	err = filepath.Walk(subDirPath, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		// Skip directories, files still being written and metadata files
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(fs.RootDir, path)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.ToSlash(relPath)
+		existing[name] = ObjectInfo{Name: name, Size: info.Size(), Updated: info.ModTime()}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("%w on %s: %v", listObjectsErr, subDirectory, err)
+	}
+	return
+}
+
+// Get details on the file if it is stored. The filename is formatted the same as Store.
+func (fs *FileConnection) Stat(ctx context.Context, fileName string) (info ObjectInfo, exists bool, err error) {
+	var fileInfo os.FileInfo
+	newFileName := createStorageFileName(fs.SubDirectory, fileName)
+
+	if fileInfo, err = os.Stat(fs.filePath(newFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("%w on %s: %v", statObjectErr, newFileName, err)
+		return
+	}
+	info = ObjectInfo{Name: newFileName, Size: fileInfo.Size(), Updated: fileInfo.ModTime()}
+	if info.Metadata, err = readMetadata(fs.filePath(newFileName)); err != nil {
+		err = fmt.Errorf("%w metadata on %s: %v", statObjectErr, newFileName, err)
+		return
+	}
+	return info, true, nil
+}
+
+// Read the stored content of the file. The filename is formatted the same as Store. Caller closes the reader.
+func (fs *FileConnection) Open(ctx context.Context, fileName string) (r io.ReadCloser, err error) {
+	newFileName := createStorageFileName(fs.SubDirectory, fileName)
+
+	if r, err = os.Open(fs.filePath(newFileName)); err != nil {
+		err = fmt.Errorf("%w on %s: %v", openObjectErr, newFileName, err)
+	}
+	return
+}
+
+// Move the stored file and its metadata under previous/ before it is replaced.
+func (fs *FileConnection) keepPreviousFile(fileName string) (err error) {
+	var fileInfo os.FileInfo
+
+	filePath := fs.filePath(fileName)
+	if fileInfo, err = os.Stat(filePath); err != nil {
+		err = fmt.Errorf("%w stat on %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	prevFileName := previousFileName(fileName, fileInfo.ModTime())
+	prevPath := fs.filePath(prevFileName)
+	if err = os.MkdirAll(filepath.Dir(prevPath), 0755); err != nil {
+		err = fmt.Errorf("%w failed on %s: %v", createDirErr, filepath.Dir(prevPath), err)
+		return
+	}
+	if err = os.Rename(filePath, prevPath); err != nil {
+		err = fmt.Errorf("%w rename of %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	if err = os.Rename(metadataPath(filePath), metadataPath(prevPath)); err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("%w rename metadata of %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	err = nil
+	log.Printf("Previous version of %s kept as %s.", fileName, prevFileName)
+	return
+}
+
+// Stream content from the reader into a local file. Content is written to a temp file first so partial loads are not left behind.
+// Metadata is saved in a hidden JSON file next to the stored file.
+func (fs *FileConnection) Store(ctx context.Context, fileName string, r io.Reader, meta ObjectMeta) (n int64, err error) {
+	var (
+		newFileName, filePath string
+		tmpFile               *os.File
+		metaBytes             []byte
+	)
+	contentHash := sha256.New()
+
+	if fileName == "" {
+		err = fmt.Errorf("%w", emptyFileNameErr)
+		return
+	}
+
+	//Format the filename to store
+	newFileName = createStorageFileName(fs.SubDirectory, fileName)
+
+	exists := fs.CheckFileExists(ctx, newFileName)
+	if exists && !meta.Overwrite {
+		return
+	}
+
+	filePath = fs.filePath(newFileName)
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		err = fmt.Errorf("%w failed on %s: %v", createDirErr, filepath.Dir(filePath), err)
+		return
+	}
+
+	if tmpFile, err = ioutil.TempFile(filepath.Dir(filePath), ".tmp-"+filepath.Base(filePath)); err != nil {
+		err = fmt.Errorf("%w temp file error: %v", fileWriteErr, err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if n, err = io.Copy(io.MultiWriter(tmpFile, contentHash), r); err != nil {
+		tmpFile.Close()
+		err = fmt.Errorf("%w %s: %v", storeContentErr, newFileName, err)
+		return
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		err = fmt.Errorf("%w: %v", storageCtxCloseErr, err)
+		return
+	}
+	if exists && fs.keepPrevious && !isStateFileName(newFileName) {
+		if err = fs.keepPreviousFile(newFileName); err != nil {
+			return
+		}
+	}
+
+	// Write the metadata first so a stored file always has its provenance
+	if metaBytes, err = json.MarshalIndent(addContentMetadata(meta.Metadata(), n, contentHash), "", "  "); err != nil {
+		err = fmt.Errorf("%w metadata error: %v", fileWriteErr, err)
+		return
+	}
+	if err = ioutil.WriteFile(metadataPath(filePath), metaBytes, 0644); err != nil {
+		err = fmt.Errorf("%w metadata error: %v", fileWriteErr, err)
+		return
+	}
+	if err = os.Rename(tmpFile.Name(), filePath); err != nil {
+		err = fmt.Errorf("%w rename error: %v", fileWriteErr, err)
+		return
+	}
+	log.Printf("Storage of %s complete.", newFileName)
+	return
+}
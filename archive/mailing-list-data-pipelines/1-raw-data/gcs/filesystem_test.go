@@ -0,0 +1,365 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func setupFileConnection(t *testing.T) (fs *FileConnection, cleanup func()) {
+	rootDir, err := ioutil.TempDir("", "ocean-gcs")
+	if err != nil {
+		t.Fatalf("Temp directory creation failed: %v", err)
+	}
+	fs = &FileConnection{RootDir: rootDir, SubDirectory: "mailman-Wilma-Mankiller"}
+	return fs, func() { os.RemoveAll(rootDir) }
+}
+
+func TestNewConnection(t *testing.T) {
+	ctx := context.Background()
+	rootDir, err := ioutil.TempDir("", "ocean-gcs")
+	if err != nil {
+		t.Fatalf("Temp directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	tests := []struct {
+		comparisonType string
+		storageURL     string
+		wantRootDir    string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test file storage url creates file connection",
+			storageURL:     "file://" + filepath.ToSlash(filepath.Join(rootDir, "Cherokee")),
+			wantRootDir:    filepath.Join(rootDir, "Cherokee"),
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test file storage url without a path",
+			storageURL:     "file://",
+			wantErr:        emptyRootDirErr,
+		},
+		{
+			comparisonType: "Test unsupported storage url scheme",
+			storageURL:     "ftp://Tahlequah",
+			wantErr:        storageURLErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotConn, gotErr := NewConnection(ctx, test.storageURL, "", "")
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("NewConnection response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if test.wantRootDir != "" {
+				fs, ok := gotConn.(*FileConnection)
+				if !ok || fs.RootDir != test.wantRootDir {
+					t.Errorf("NewConnection did not create the file connection.\n got: %v\nwant root directory: %v", gotConn, test.wantRootDir)
+				}
+				if _, err := os.Stat(test.wantRootDir); err != nil {
+					t.Errorf("Root directory was not created: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+
+	tests := []struct {
+		comparisonType string
+		filename       string
+		content        io.Reader
+		wantFileName   string
+		wantContent    string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test Store called without error on streamed content",
+			filename:       "1985-12.mbox.gz",
+			content:        strings.NewReader("First woman elected Principal Chief of the Cherokee Nation."),
+			wantFileName:   "mailman-Wilma-Mankiller/1985-12-mailman-Wilma-Mankiller.mbox.gz",
+			wantContent:    "First woman elected Principal Chief of the Cherokee Nation.",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test Store called without error on text content",
+			filename:       "1995-07.txt",
+			content:        strings.NewReader("Served as Principal Chief for ten years."),
+			wantFileName:   "mailman-Wilma-Mankiller/1995-07-mailman-Wilma-Mankiller.txt",
+			wantContent:    "Served as Principal Chief for ten years.",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test Store skips file that already exists",
+			filename:       "1995-07.txt",
+			content:        strings.NewReader("Overwritten."),
+			wantFileName:   "mailman-Wilma-Mankiller/1995-07-mailman-Wilma-Mankiller.txt",
+			wantContent:    "Served as Principal Chief for ten years.",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test Store error when content fails to read",
+			filename:       "1998-01.txt",
+			content:        errReader{},
+			wantErr:        storeContentErr,
+		},
+		{
+			comparisonType: "Test empty filename error",
+			filename:       "",
+			content:        strings.NewReader("Overwritten."),
+			wantErr:        emptyFileNameErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if _, gotErr := fs.Store(ctx, test.filename, test.content, ObjectMeta{}); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Store response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if test.wantFileName != "" {
+				gotContent, err := ioutil.ReadFile(filepath.Join(fs.RootDir, filepath.FromSlash(test.wantFileName)))
+				if err != nil {
+					t.Fatalf("Stored file could not be read: %v", err)
+				}
+				if strings.Compare(string(gotContent), test.wantContent) != 0 {
+					t.Errorf("Stored content does not match.\n got: %v\nwant: %v", string(gotContent), test.wantContent)
+				}
+			}
+		})
+	}
+	// A failed read should not leave a partial or temp file behind
+	if existing, _ := fs.ListExisting(ctx, "mailman-Wilma-Mankiller"); len(existing) != 2 {
+		t.Errorf("Store left unexpected files behind: %v", existing)
+	}
+}
+
+func TestFileStat(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+
+	if _, err := fs.Store(ctx, "1987-01.txt", strings.NewReader("Ms. Magazine Woman of the Year."), ObjectMeta{MailingList: "mailman", GroupName: "Wilma-Mankiller"}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantExists     bool
+		wantSize       int64
+		wantMetadata   map[string]string
+	}{
+		{
+			comparisonType: "Test stat on stored file",
+			fileName:       "1987-01.txt",
+			wantExists:     true,
+			wantSize:       31,
+			wantMetadata: map[string]string{
+				MetaMailingList: "mailman",
+				MetaGroupName:   "Wilma-Mankiller",
+				MetaBytes:       "31",
+				MetaSHA256:      "6c91924f2d47cf972874abb5faeabbc2daa4c77417950dad4590af736e8665f6",
+			},
+		},
+		{
+			comparisonType: "Test stat on missing file",
+			fileName:       "1987-02.txt",
+			wantExists:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotInfo, gotExists, gotErr := fs.Stat(ctx, test.fileName)
+			if gotErr != nil {
+				t.Fatalf("Stat error: %v", gotErr)
+			}
+			if gotExists != test.wantExists || gotInfo.Size != test.wantSize {
+				t.Errorf("Stat response does not match.\n got: %v %v\nwant: %v %v", gotExists, gotInfo.Size, test.wantExists, test.wantSize)
+			}
+			if test.wantMetadata != nil && !reflect.DeepEqual(gotInfo.Metadata, test.wantMetadata) {
+				t.Errorf("Metadata does not match.\n got: %v\nwant: %v", gotInfo.Metadata, test.wantMetadata)
+			}
+		})
+	}
+}
+
+func TestFileStoreOverwrite(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+	fs.SetRefresh(RefreshChanged, true)
+
+	for _, content := range []string{"Served as Principal Chief for ten years.", "Presidential Medal of Freedom."} {
+		if _, err := fs.Store(ctx, "1998-01.txt", strings.NewReader(content), ObjectMeta{Overwrite: true, GroupName: "Wilma-Mankiller"}); err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+	}
+
+	gotContent, err := ioutil.ReadFile(filepath.Join(fs.RootDir, "mailman-Wilma-Mankiller", "1998-01-mailman-Wilma-Mankiller.txt"))
+	if err != nil || strings.Compare(string(gotContent), "Presidential Medal of Freedom.") != 0 {
+		t.Errorf("Stored content does not match.\n got: %v %v\nwant: %v", string(gotContent), err, "Presidential Medal of Freedom.")
+	}
+
+	gotPrevious, err := fs.ListExisting(ctx, "previous/mailman-Wilma-Mankiller")
+	if err != nil || len(gotPrevious) != 1 {
+		t.Fatalf("Previous version was not kept: %v %v", gotPrevious, err)
+	}
+	for name := range gotPrevious {
+		prevPath := filepath.Join(fs.RootDir, filepath.FromSlash(name))
+		if prevContent, _ := ioutil.ReadFile(prevPath); strings.Compare(string(prevContent), "Served as Principal Chief for ten years.") != 0 {
+			t.Errorf("Previous content does not match.\n got: %v\nwant: %v", string(prevContent), "Served as Principal Chief for ten years.")
+		}
+		if prevMetadata, _ := readMetadata(prevPath); prevMetadata[MetaGroupName] != "Wilma-Mankiller" {
+			t.Errorf("Previous metadata was not kept: %v", prevMetadata)
+		}
+	}
+}
+
+func TestFileStoreState(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+	fs.SetRefresh(RefreshAlways, true)
+
+	for _, cursor := range []string{"1985", "1987"} {
+		if _, err := fs.Store(ctx, StatePrefix+"cursor.txt", strings.NewReader(cursor), ObjectMeta{Overwrite: true, Cursor: cursor}); err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+	}
+
+	info, exists, err := fs.Stat(ctx, StatePrefix+"cursor.txt")
+	if err != nil || !exists || info.Name != "state/mailman-Wilma-Mankiller/cursor.txt" || info.Metadata[MetaCursor] != "1987" {
+		t.Errorf("State does not match.\n got: %+v %v %v\nwant: %v with cursor 1987", info, exists, err, "state/mailman-Wilma-Mankiller/cursor.txt")
+	}
+	if gotExisting, _ := fs.ListExisting(ctx, "mailman-Wilma-Mankiller"); len(gotExisting) != 0 {
+		t.Errorf("State was listed in the subdirectory: %v", gotExisting)
+	}
+	if gotPrevious, _ := fs.ListExisting(ctx, "previous"); len(gotPrevious) != 0 {
+		t.Errorf("Previous state was kept: %v", gotPrevious)
+	}
+}
+
+func TestFileOpen(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+
+	if _, err := fs.Store(ctx, "1985-12.txt", strings.NewReader("First woman elected Principal Chief."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	r, err := fs.Open(ctx, "1985-12.txt")
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer r.Close()
+	if gotContent, _ := ioutil.ReadAll(r); string(gotContent) != "First woman elected Principal Chief." {
+		t.Errorf("Content does not match.\n got: %v\nwant: %v", string(gotContent), "First woman elected Principal Chief.")
+	}
+	if _, err = fs.Open(ctx, "1986-01.txt"); !errors.Is(err, openObjectErr) {
+		t.Errorf("Open response does not match.\n got: %v\nwant: %v", err, openObjectErr)
+	}
+}
+
+func TestFileCheckFileExists(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+
+	if _, err := fs.Store(ctx, "1987-01.txt", strings.NewReader("Ms. Magazine Woman of the Year."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantExists     bool
+	}{
+		{
+			comparisonType: "Test file exists",
+			fileName:       "mailman-Wilma-Mankiller/1987-01-mailman-Wilma-Mankiller.txt",
+			wantExists:     true,
+		},
+		{
+			comparisonType: "Test file does not exist",
+			fileName:       "mailman-Wilma-Mankiller/1987-02-mailman-Wilma-Mankiller.txt",
+			wantExists:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotExists := fs.CheckFileExists(ctx, test.fileName); gotExists != test.wantExists {
+				t.Errorf("CheckFileExists response does not match.\n got: %v\nwant: %v", gotExists, test.wantExists)
+			}
+		})
+	}
+}
+
+func TestFileListExisting(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := setupFileConnection(t)
+	defer cleanup()
+
+	for _, fileName := range []string{"1987-01.txt", "1987-02.txt"} {
+		if _, err := fs.Store(ctx, fileName, strings.NewReader("Ms. Magazine Woman of the Year."), ObjectMeta{}); err != nil {
+			t.Fatalf("Storage setup failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		comparisonType string
+		subDirectory   string
+		wantNames      []string
+	}{
+		{
+			comparisonType: "Test files listed for subdirectory",
+			subDirectory:   "mailman-Wilma-Mankiller",
+			wantNames:      []string{"mailman-Wilma-Mankiller/1987-01-mailman-Wilma-Mankiller.txt", "mailman-Wilma-Mankiller/1987-02-mailman-Wilma-Mankiller.txt"},
+		},
+		{
+			comparisonType: "Test missing subdirectory returns empty",
+			subDirectory:   "mailman-Charlie-Soap",
+			wantNames:      []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotExisting, gotErr := fs.ListExisting(ctx, test.subDirectory)
+			if gotErr != nil {
+				t.Fatalf("ListExisting error: %v", gotErr)
+			}
+			if len(gotExisting) != len(test.wantNames) {
+				t.Errorf("ListExisting response does not match.\n got: %v\nwant: %v", gotExisting, test.wantNames)
+			}
+			for _, name := range test.wantNames {
+				if _, ok := gotExisting[name]; !ok {
+					t.Errorf("ListExisting missing %s in %v", name, gotExisting)
+				}
+			}
+		})
+	}
+}
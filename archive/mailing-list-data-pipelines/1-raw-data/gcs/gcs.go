@@ -23,11 +23,18 @@ package gcs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
-	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
@@ -35,17 +42,222 @@ import (
 )
 
 var (
-	httpStrRespErr     = fmt.Errorf("http string")
 	clientErr          = fmt.Errorf("client creation")
 	createBucketErr    = fmt.Errorf("create bucket")
 	emptyBucketName    = fmt.Errorf("empty bucketname")
 	emptyFileNameErr   = fmt.Errorf("empty filename")
 	storageCtxCloseErr = fmt.Errorf("Failed to close storage connection")
+	storageURLErr      = fmt.Errorf("storage url")
+	listObjectsErr     = fmt.Errorf("list objects")
+	storeContentErr    = fmt.Errorf("store content")
+	statObjectErr      = fmt.Errorf("stat object")
+	updateMetadataErr  = fmt.Errorf("update metadata")
+	refreshModeErr     = fmt.Errorf("refresh mode")
+	openObjectErr      = fmt.Errorf("open object")
+	keepPreviousErr    = fmt.Errorf("keep previous")
 )
 
 type Connection interface {
-	StoreContentInBucket(ctx context.Context, fileName, content, source string) (testVerifyCopyCalled int64, err error)
+	SetSubDirectory(subDirectory string)
+	SetRefresh(mode RefreshMode, keepPrevious bool)
+	Refresh() (mode RefreshMode, keepPrevious bool)
+	Store(ctx context.Context, fileName string, r io.Reader, meta ObjectMeta) (n int64, err error)
+	Stat(ctx context.Context, fileName string) (info ObjectInfo, exists bool, err error)
+	Open(ctx context.Context, fileName string) (r io.ReadCloser, err error)
 	CheckFileExists(ctx context.Context, fileName string) (fileExists bool)
+	ListExisting(ctx context.Context, subDirectory string) (existing map[string]ObjectInfo, err error)
+}
+
+// Object metadata keys used to record where stored content came from.
+const (
+	MetaSourceURL    = "source-url"
+	MetaMailingList  = "mailing-list"
+	MetaGroupName    = "group-name"
+	MetaStartDate    = "start-date"
+	MetaEndDate      = "end-date"
+	MetaFetchedAt    = "fetched-at"
+	MetaETag         = "http-etag"
+	MetaLastModified = "http-last-modified"
+	MetaCursor       = "cursor"
+	MetaBytes        = "bytes"
+	MetaSHA256       = "sha256"
+)
+
+// How files that are already stored get refreshed.
+type RefreshMode string
+
+const (
+	// Skip files that already exist
+	RefreshNever RefreshMode = "never"
+	// Rewrite files when the upstream content changed
+	RefreshChanged RefreshMode = "changed"
+	// Rewrite files every run
+	RefreshAlways RefreshMode = "always"
+)
+
+// Convert the refresh flag value into a RefreshMode. Empty defaults to never.
+func ParseRefreshMode(mode string) (refreshMode RefreshMode, err error) {
+	switch RefreshMode(mode) {
+	case "", RefreshNever:
+		return RefreshNever, nil
+	case RefreshChanged, RefreshAlways:
+		return RefreshMode(mode), nil
+	}
+	err = fmt.Errorf("%w %s is not an option. Use changed, always or never.", refreshModeErr, mode)
+	return
+}
+
+// Refresh settings shared by the storage connections.
+type refreshSettings struct {
+	mode         RefreshMode
+	keepPrevious bool
+}
+
+// Set how existing files are refreshed and if the replaced content is kept under previous/.
+func (refresh *refreshSettings) SetRefresh(mode RefreshMode, keepPrevious bool) {
+	refresh.mode, refresh.keepPrevious = mode, keepPrevious
+}
+
+func (refresh *refreshSettings) Refresh() (mode RefreshMode, keepPrevious bool) {
+	if refresh.mode == "" {
+		return RefreshNever, refresh.keepPrevious
+	}
+	return refresh.mode, refresh.keepPrevious
+}
+
+// Name the replaced content is kept under. It sits outside the subdirectory so it is not listed as existing, and the
+// ingest function skips the previous/ prefix so replaced versions are not loaded again.
+func previousFileName(fileName string, updated time.Time) string {
+	return fmt.Sprintf("previous/%s.%s", fileName, updated.UTC().Format("20060102T150405Z"))
+}
+
+// State is rewritten by each load so earlier versions are not kept under previous/.
+func isStateFileName(fileName string) bool {
+	return strings.HasPrefix(fileName, StatePrefix)
+}
+
+// Details about the content passed to Store. Everything except ContentType and Overwrite is saved as object metadata for provenance.
+type ObjectMeta struct {
+	ContentType string
+	// Replace the file if it already exists
+	Overwrite    bool
+	SourceURL    string
+	MailingList  string
+	GroupName    string
+	StartDate    string
+	EndDate      string
+	FetchedAt    time.Time
+	ETag         string
+	LastModified string
+	// Source position to resume an incremental load from such as the last article number
+	Cursor string
+}
+
+// Details on a stored object. ListExisting maps the full object name to its info.
+type ObjectInfo struct {
+	Name     string
+	Size     int64
+	Updated  time.Time
+	Metadata map[string]string
+}
+
+// Convert the provenance details into object metadata. Empty values are left out.
+func (meta ObjectMeta) Metadata() (metadata map[string]string) {
+	metadata = make(map[string]string)
+	for key, value := range map[string]string{
+		MetaSourceURL:    meta.SourceURL,
+		MetaMailingList:  meta.MailingList,
+		MetaGroupName:    meta.GroupName,
+		MetaStartDate:    meta.StartDate,
+		MetaEndDate:      meta.EndDate,
+		MetaETag:         meta.ETag,
+		MetaLastModified: meta.LastModified,
+		MetaCursor:       meta.Cursor,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if !meta.FetchedAt.IsZero() {
+		metadata[MetaFetchedAt] = meta.FetchedAt.UTC().Format(time.RFC3339)
+	}
+	return
+}
+
+// Add the byte count and SHA-256 of the stored content to the metadata.
+func addContentMetadata(metadata map[string]string, n int64, hash hash.Hash) map[string]string {
+	metadata[MetaBytes] = strconv.FormatInt(n, 10)
+	metadata[MetaSHA256] = hex.EncodeToString(hash.Sum(nil))
+	return metadata
+}
+
+// Create and setup the storage connection based on the storage url scheme. Use gs:// or gs://[BUCKET] for Cloud Storage, s3://[BUCKET] for S3 compatible storage and file:///[PATH] for a local directory.
+func NewConnection(ctx context.Context, storageURL, projectID, bucketName string) (conn Connection, err error) {
+	var storageLocation *url.URL
+
+	if storageLocation, err = url.Parse(storageURL); err != nil {
+		err = fmt.Errorf("%w parse error: %v", storageURLErr, err)
+		return
+	}
+
+	switch storageLocation.Scheme {
+	case "gs", "":
+		if storageLocation.Host != "" {
+			bucketName = storageLocation.Host
+		}
+		gcs := &StorageConnection{
+			ProjectID:  projectID,
+			BucketName: bucketName,
+		}
+		if err = gcs.ConnectClient(ctx); err != nil {
+			return
+		}
+		//Check and create bucket if needed
+		if err = gcs.CreateBucket(ctx); err != nil {
+			return
+		}
+		conn = gcs
+	case "file":
+		fs := &FileConnection{
+			RootDir: filepath.Join(storageLocation.Host, filepath.FromSlash(storageLocation.Path)),
+		}
+		//Check and create root directory if needed
+		if err = fs.CreateRootDir(); err != nil {
+			return
+		}
+		conn = fs
+	case "s3":
+		s3 := newS3Connection(storageLocation)
+		if err = s3.ConnectClient(ctx); err != nil {
+			return
+		}
+		//Check and create bucket if needed
+		if err = s3.CreateBucket(ctx); err != nil {
+			return
+		}
+		conn = s3
+	default:
+		err = fmt.Errorf("%w scheme %s is not an option. Use gs://, s3:// or file://.", storageURLErr, storageLocation.Scheme)
+	}
+	return
+}
+
+// Prefix for source state such as the cursor of an incremental load. A filename that starts with it is stored as
+// state/[SUBDIRECTORY]/[FILENAME], outside the subdirectory so it is not listed as existing and the ingest function
+// skips it.
+const StatePrefix = "state/"
+
+// Format the filename to store so it sits in the subdirectory and includes the subdirectory name. State filenames are
+// kept under the state prefix instead.
+func createStorageFileName(subDirectory, fileName string) (newFileName string) {
+	if strings.HasPrefix(fileName, StatePrefix) {
+		return fmt.Sprintf("%s%s/%s", StatePrefix, subDirectory, strings.TrimPrefix(fileName, StatePrefix))
+	}
+	fileNameParts := strings.SplitN(fileName, ".", 2)
+	if len(fileNameParts) < 2 {
+		return fmt.Sprintf("%s/%s-%s", subDirectory, fileNameParts[0], subDirectory)
+	}
+	return fmt.Sprintf("%s/%s-%s.%s", subDirectory, fileNameParts[0], subDirectory, fileNameParts[1])
 }
 
 type StorageConnection struct {
@@ -54,6 +266,11 @@ type StorageConnection struct {
 	SubDirectory string
 	client       stiface.Client
 	bucket       stiface.BucketHandle
+	refreshSettings
+}
+
+func (gcs *StorageConnection) SetSubDirectory(subDirectory string) {
+	gcs.SubDirectory = subDirectory
 }
 
 func (gcs *StorageConnection) ConnectClient(ctx context.Context) (err error) {
@@ -103,34 +320,89 @@ func (gcs *StorageConnection) CreateBucket(ctx context.Context) (err error) {
 	}
 }
 
-//Check if file already exists. Stiface doesn't have blob.exists() like storage has where blob is bucket.Object
+// Check if file already exists with an attrs lookup on the object instead of listing the bucket. Only a missing
+// object means the file is missing so other failures are logged.
 func (gcs *StorageConnection) CheckFileExists(ctx context.Context, fileName string) (exists bool) {
-	var (
-		err   error
-		attrs *storage.ObjectAttrs
-	)
-	it := gcs.bucket.Objects(ctx, nil)
+	_, exists, err := gcs.statObject(ctx, fileName)
+	if err != nil {
+		log.Printf("Checking %s exists failed: %v", fileName, err)
+	}
+	return
+}
+
+// List objects already stored in the subdirectory in one prefix scoped pass.
+func (gcs *StorageConnection) ListExisting(ctx context.Context, subDirectory string) (existing map[string]ObjectInfo, err error) {
+	var attrs *storage.ObjectAttrs
+
+	existing = make(map[string]ObjectInfo)
+	it := gcs.bucket.Objects(ctx, &storage.Query{Prefix: subDirectory + "/"})
 	for {
 		attrs, err = it.Next()
 		if err == iterator.Done {
-			break
+			err = nil
+			return
 		}
-		if attrs.Name == fileName {
-			exists = true
+		if err != nil {
+			err = fmt.Errorf("%w on %s: %v", listObjectsErr, subDirectory, err)
 			return
 		}
+		existing[attrs.Name] = ObjectInfo{Name: attrs.Name, Size: attrs.Size, Updated: attrs.Updated, Metadata: attrs.Metadata}
+	}
+}
+
+// Get details on the file if it is stored. The filename is formatted the same as Store.
+func (gcs *StorageConnection) Stat(ctx context.Context, fileName string) (info ObjectInfo, exists bool, err error) {
+	return gcs.statObject(ctx, createStorageFileName(gcs.SubDirectory, fileName))
+}
+
+// Get details on an object by its full name with an attrs lookup.
+func (gcs *StorageConnection) statObject(ctx context.Context, name string) (info ObjectInfo, exists bool, err error) {
+	var attrs *storage.ObjectAttrs
+
+	if attrs, err = gcs.bucket.Object(name).Attrs(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("%w on %s: %v", statObjectErr, name, err)
+		return
+	}
+	return ObjectInfo{Name: attrs.Name, Size: attrs.Size, Updated: attrs.Updated, Metadata: attrs.Metadata}, true, nil
+}
+
+// Read the stored content of the file. The filename is formatted the same as Store. Caller closes the reader.
+func (gcs *StorageConnection) Open(ctx context.Context, fileName string) (r io.ReadCloser, err error) {
+	newFileName := createStorageFileName(gcs.SubDirectory, fileName)
+
+	if r, err = gcs.bucket.Object(newFileName).NewReader(ctx); err != nil {
+		err = fmt.Errorf("%w on %s: %v", openObjectErr, newFileName, err)
 	}
-	exists = false
 	return
 }
 
-// TODO pass in CheckFileExists so test on this function works
-//Store url content in storage.
-func (gcs *StorageConnection) StoreContentInBucket(ctx context.Context, fileName, content, source string) (testVerifyCopyCalled int64, err error) {
-	var (
-		response    *http.Response
-		newFileName string
-	)
+// Copy the stored object under previous/ before it is replaced.
+func (gcs *StorageConnection) keepPreviousObject(ctx context.Context, fileName string) (err error) {
+	var attrs *storage.ObjectAttrs
+
+	src := gcs.bucket.Object(fileName)
+	if attrs, err = src.Attrs(ctx); err != nil {
+		err = fmt.Errorf("%w attrs on %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	prevFileName := previousFileName(fileName, attrs.Updated)
+	if _, err = gcs.bucket.Object(prevFileName).CopierFrom(src).Run(ctx); err != nil {
+		err = fmt.Errorf("%w copy of %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	log.Printf("Previous version of %s kept as %s.", fileName, prevFileName)
+	return
+}
+
+// Stream content from the reader into storage. Files that already exist are skipped without reading unless meta.Overwrite is set.
+// The provenance metadata is set on upload and the byte count and SHA-256 are added once the content is written.
+func (gcs *StorageConnection) Store(ctx context.Context, fileName string, r io.Reader, meta ObjectMeta) (n int64, err error) {
+	var newFileName string
+	contentHash := sha256.New()
 
 	if fileName == "" {
 		// If fileName is empty this will throw runtime error: invalid memory address or nil pointer dereference. calling the bucket.Object doesn't return errors.
@@ -139,45 +411,51 @@ func (gcs *StorageConnection) StoreContentInBucket(ctx context.Context, fileName
 	}
 
 	//Format the filename to store
-	fileNameParts := strings.SplitN(fileName, ".", 2)
-	newFileName = fmt.Sprintf("%s/%s-%s.%s", gcs.SubDirectory, fileNameParts[0], gcs.SubDirectory, fileNameParts[1])
-
-	fileExists := gcs.CheckFileExists(ctx, newFileName)
-	if !fileExists {
-		obj := gcs.bucket.Object(newFileName)
-
-		// w implements io.Writer.
-		w := obj.NewWriter(ctx)
+	newFileName = createStorageFileName(gcs.SubDirectory, fileName)
 
-		if source == "url" {
-			// Get HTTP response
-			response, err = http.Get(content)
-			if err != nil {
-				err = fmt.Errorf("%w response error: %v", httpStrRespErr, err)
+	// A failed lookup stops the store rather than counting the object as missing and writing over it
+	_, exists, err := gcs.statObject(ctx, newFileName)
+	if err != nil {
+		return
+	}
+	if exists {
+		if !meta.Overwrite {
+			return
+		}
+		if gcs.keepPrevious && !isStateFileName(newFileName) {
+			if err = gcs.keepPreviousObject(ctx, newFileName); err != nil {
 				return
 			}
-			defer response.Body.Close()
-
-			if response.StatusCode == http.StatusOK {
-				// Copy file into storage
-				testVerifyCopyCalled, err = io.Copy(w, response.Body)
-			}
-		} else if source == "text" {
-			// Copy file into storage
-			testVerifyCopyCalled, err = io.Copy(w, strings.NewReader(content))
 		}
+	}
 
-		if err != nil {
-			// Note not breaking when a file does not load but logging to investigate.
-			log.Printf("Storage did not copy %v to bucket with the error: %v", fileName, err)
-		}
+	// Cancelling the writer context stops the upload without saving partial content.
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		if err = w.Close(); err != nil {
-			err = fmt.Errorf("%w: %v", storageCtxCloseErr, err)
-			return
-		}
-		log.Printf("Storage of %s complete.", newFileName)
+	// w implements io.Writer.
+	obj := gcs.bucket.Object(newFileName)
+	w := obj.NewWriter(writeCtx)
+	w.ObjectAttrs().ContentType = meta.ContentType
+	w.ObjectAttrs().Metadata = meta.Metadata()
+
+	if n, err = io.Copy(w, io.TeeReader(r, contentHash)); err != nil {
+		cancel()
+		err = fmt.Errorf("%w %s: %v", storeContentErr, newFileName, err)
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		err = fmt.Errorf("%w: %v", storageCtxCloseErr, err)
+		return
+	}
+
+	// Checksums are only known after the upload so they are added as a metadata update
+	if _, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: addContentMetadata(meta.Metadata(), n, contentHash)}); err != nil {
+		err = fmt.Errorf("%w on %s: %v", updateMetadataErr, newFileName, err)
+		return
 	}
+	log.Printf("Storage of %s complete.", newFileName)
 	return
 }
 
@@ -19,8 +19,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
@@ -39,8 +43,11 @@ type fakeBucketHandle struct {
 }
 
 type fakeBucket struct {
-	attrs   *storage.BucketAttrs
-	objects map[string][]byte
+	attrs    *storage.BucketAttrs
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	// Error returned by object attrs lookups to simulate a failing check
+	attrsErr error
 }
 
 type fakeBucketIterator struct {
@@ -49,6 +56,12 @@ type fakeBucketIterator struct {
 	next []storage.BucketAttrs
 }
 
+type fakeObjectIterator struct {
+	stiface.ObjectIterator
+	i    int
+	next []storage.ObjectAttrs
+}
+
 type fakeObjectHandle struct {
 	stiface.ObjectHandle
 	c          *fakeClient
@@ -70,8 +83,9 @@ func (c *fakeClient) Bucket(name string) stiface.BucketHandle {
 
 type fakeWriter struct {
 	stiface.Writer
-	obj fakeObjectHandle
-	buf bytes.Buffer
+	obj   fakeObjectHandle
+	buf   bytes.Buffer
+	attrs storage.ObjectAttrs
 }
 
 func (o fakeObjectHandle) NewWriter(context.Context) stiface.Writer {
@@ -82,10 +96,105 @@ func (w *fakeWriter) Write(data []byte) (int, error) {
 	return w.buf.Write(data)
 }
 
+func (w *fakeWriter) ObjectAttrs() *storage.ObjectAttrs {
+	return &w.attrs
+}
+
 func (w *fakeWriter) Close() error {
+	if bucket, ok := w.obj.c.buckets[w.obj.bucketName]; ok {
+		bucket.objects[w.obj.name] = w.buf.Bytes()
+		bucket.metadata[w.obj.name] = w.attrs.Metadata
+	}
 	return nil
 }
 
+type fakeReader struct {
+	stiface.Reader
+	r io.Reader
+}
+
+func (o fakeObjectHandle) NewReader(context.Context) (stiface.Reader, error) {
+	if bucket, ok := o.c.buckets[o.bucketName]; ok {
+		if content, ok := bucket.objects[o.name]; ok {
+			return &fakeReader{r: bytes.NewReader(content)}, nil
+		}
+	}
+	return nil, storage.ErrObjectNotExist
+}
+
+func (r *fakeReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+type fakeCopier struct {
+	stiface.Copier
+	dst, src fakeObjectHandle
+}
+
+func (o fakeObjectHandle) CopierFrom(src stiface.ObjectHandle) stiface.Copier {
+	return fakeCopier{dst: o, src: src.(fakeObjectHandle)}
+}
+
+func (c fakeCopier) Run(context.Context) (*storage.ObjectAttrs, error) {
+	if bucket, ok := c.src.c.buckets[c.src.bucketName]; ok {
+		if content, ok := bucket.objects[c.src.name]; ok {
+			bucket.objects[c.dst.name] = content
+			bucket.metadata[c.dst.name] = bucket.metadata[c.src.name]
+			return &storage.ObjectAttrs{Name: c.dst.name, Size: int64(len(content))}, nil
+		}
+	}
+	return nil, storage.ErrObjectNotExist
+}
+
+func (o fakeObjectHandle) Update(_ context.Context, attrs storage.ObjectAttrsToUpdate) (*storage.ObjectAttrs, error) {
+	if bucket, ok := o.c.buckets[o.bucketName]; ok {
+		if _, ok := bucket.objects[o.name]; ok {
+			bucket.metadata[o.name] = attrs.Metadata
+			return &storage.ObjectAttrs{Name: o.name, Metadata: attrs.Metadata}, nil
+		}
+	}
+	return nil, storage.ErrObjectNotExist
+}
+
+func (o fakeObjectHandle) Attrs(context.Context) (*storage.ObjectAttrs, error) {
+	if bucket, ok := o.c.buckets[o.bucketName]; ok {
+		if bucket.attrsErr != nil {
+			return nil, bucket.attrsErr
+		}
+		if content, ok := bucket.objects[o.name]; ok {
+			return &storage.ObjectAttrs{Name: o.name, Size: int64(len(content)), Metadata: bucket.metadata[o.name]}, nil
+		}
+	}
+	return nil, storage.ErrObjectNotExist
+}
+
+func (b fakeBucketHandle) Objects(_ context.Context, q *storage.Query) stiface.ObjectIterator {
+	it := &fakeObjectIterator{}
+	if bucket, ok := b.c.buckets[b.name]; ok {
+		for name, content := range bucket.objects {
+			if q == nil || strings.HasPrefix(name, q.Prefix) {
+				it.next = append(it.next, storage.ObjectAttrs{Name: name, Size: int64(len(content))})
+			}
+		}
+	}
+	return it
+}
+
+func (it *fakeObjectIterator) Next() (a *storage.ObjectAttrs, err error) {
+	if it.i == len(it.next) {
+		err = iterator.Done
+		return
+	}
+
+	a = &it.next[it.i]
+	it.i += 1
+	return
+}
+
 func (c *fakeClient) Buckets(ctx context.Context, projectID string) (it stiface.BucketIterator) {
 	switch projectID {
 	case "Environmentalist":
@@ -134,7 +243,7 @@ func (b fakeBucketHandle) Create(_ context.Context, _ string, attrs *storage.Buc
 		attrs = &storage.BucketAttrs{}
 	}
 	attrs.Name = b.name
-	b.c.buckets[b.name] = &fakeBucket{attrs: attrs, objects: map[string][]byte{}}
+	b.c.buckets[b.name] = &fakeBucket{attrs: attrs, objects: map[string][]byte{}, metadata: map[string]map[string]string{}}
 	return nil
 }
 
@@ -198,9 +307,17 @@ func TestCreateBucket(t *testing.T) {
 	}
 }
 
-func TestStoreContentInBucket(t *testing.T) {
+// Simulate content that fails part way through reading
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset by peer")
+}
+
+func TestStore(t *testing.T) {
 	ctx := context.Background()
 	gcs := setupGCS(t)
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
 
 	var (
 		gotVerify int64
@@ -211,50 +328,366 @@ func TestStoreContentInBucket(t *testing.T) {
 		comparisonType string
 		storage        *StorageConnection
 		filename       string
-		content        string
-		source         string
+		content        io.Reader
 		wantResponse   bool
 		wantErr        error
 	}{
-		// Need to pass in CheckFileExists to this function in order to bypass it and avoid an error on a test. However, not ideal refactor
-		//{
-		//	comparisonType: "Test Store called without error on url content",
-		//	storage:        gcs,
-		//	filename:       "environmentalist.gz",
-		//	content:        "https://en.wikipedia.org/wiki/Winona_LaDuke",
-		//	source:         "url",
-		//	wantResponse:   true,
-		//	wantErr:        nil,
-		//},
-		//{
-		//	comparisonType: "Test Store called without error on text content",
-		//	storage:        gcs,
-		//	filename:       "writer.gz",
-		//	content:        "An American environmentalist, economist, writer who found the Indigenous Women's Network.",
-		//	source:         "text",
-		//	wantResponse:   true,
-		//	wantErr:        nil,
-		//},
+		{
+			comparisonType: "Test Store called without error on text content",
+			storage:        gcs,
+			filename:       "writer.gz",
+			content:        strings.NewReader("An American environmentalist, economist, writer who found the Indigenous Women's Network."),
+			wantResponse:   true,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test Store skipped when file exists",
+			storage:        gcs,
+			filename:       "writer.gz",
+			content:        strings.NewReader("An American environmentalist, economist, writer who found the Indigenous Women's Network."),
+			wantResponse:   false,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test Store error when content fails to read",
+			storage:        gcs,
+			filename:       "economist.gz",
+			content:        errReader{},
+			wantResponse:   false,
+			wantErr:        storeContentErr,
+		},
 		{
 			comparisonType: "Test empty filename error",
 			storage:        gcs,
 			filename:       "",
-			content:        "https://en.wikipedia.org/wiki/Winona_LaDuke",
-			source:         "url",
+			content:        strings.NewReader("https://en.wikipedia.org/wiki/Winona_LaDuke"),
 			wantResponse:   false,
 			wantErr:        emptyFileNameErr,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotVerify, gotErr = gcs.StoreContentInBucket(ctx, test.filename, test.content, test.source); !errors.Is(gotErr, test.wantErr) {
-				if !strings.Contains(gotErr.Error(), test.wantErr.Error()) {
-					t.Errorf("StoreContentInBucket response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
-				}
+			if gotVerify, gotErr = test.storage.Store(ctx, test.filename, test.content, ObjectMeta{}); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Store response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
 			}
 			if test.wantResponse != (gotVerify > 0) {
 				t.Errorf("Storage Copy did not perform as expected. Returned value got: %v which does not match what was expected.", gotVerify)
 			}
 		})
 	}
+	if gcs.CheckFileExists(ctx, "/economist-.gz") {
+		t.Errorf("Store saved partial content after a read error.")
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.SubDirectory = "Honor-the-Earth"
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+
+	meta := ObjectMeta{SourceURL: "https://en.wikipedia.org/wiki/Honor_the_Earth", MailingList: "pipermail", GroupName: "Honor-the-Earth", StartDate: "1993-01-01", EndDate: "1993-02-01"}
+	if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader("Co-founded Honor the Earth."), meta); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantExists     bool
+		wantSize       int64
+		wantMetadata   map[string]string
+	}{
+		{
+			comparisonType: "Test stat on stored file",
+			fileName:       "1993-01.txt",
+			wantExists:     true,
+			wantSize:       27,
+			wantMetadata: map[string]string{
+				MetaSourceURL:   "https://en.wikipedia.org/wiki/Honor_the_Earth",
+				MetaMailingList: "pipermail",
+				MetaGroupName:   "Honor-the-Earth",
+				MetaStartDate:   "1993-01-01",
+				MetaEndDate:     "1993-02-01",
+				MetaBytes:       "27",
+				MetaSHA256:      "da0c9aaa90c2232fc60f98f9fb515107f047c81abf25519f028051b1655b2798",
+			},
+		},
+		{
+			comparisonType: "Test stat on missing file",
+			fileName:       "1993-02.txt",
+			wantExists:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotInfo, gotExists, gotErr := gcs.Stat(ctx, test.fileName)
+			if gotErr != nil {
+				t.Fatalf("Stat error: %v", gotErr)
+			}
+			if gotExists != test.wantExists || gotInfo.Size != test.wantSize {
+				t.Errorf("Stat response does not match.\n got: %v %v\nwant: %v %v", gotExists, gotInfo.Size, test.wantExists, test.wantSize)
+			}
+			for key, want := range test.wantMetadata {
+				if got := gotInfo.Metadata[key]; strings.Compare(got, want) != 0 {
+					t.Errorf("Metadata %s does not match.\n got: %v\nwant: %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectMetaMetadata(t *testing.T) {
+	fetchedAt := time.Date(1996, 11, 5, 18, 30, 0, 0, time.FixedZone("CST", -6*60*60))
+
+	tests := []struct {
+		comparisonType string
+		meta           ObjectMeta
+		wantMetadata   map[string]string
+	}{
+		{
+			comparisonType: "Test all provenance fields are set",
+			meta: ObjectMeta{
+				ContentType:  "application/x-gzip",
+				SourceURL:    "https://en.wikipedia.org/wiki/Winona_LaDuke",
+				MailingList:  "mailman",
+				GroupName:    "Green-Party",
+				StartDate:    "1996-11-01",
+				EndDate:      "1996-12-01",
+				FetchedAt:    fetchedAt,
+				ETag:         `"Ralph-Nader"`,
+				LastModified: "Tue, 05 Nov 1996 12:00:00 GMT",
+				Cursor:       "2000",
+			},
+			wantMetadata: map[string]string{
+				MetaSourceURL:    "https://en.wikipedia.org/wiki/Winona_LaDuke",
+				MetaMailingList:  "mailman",
+				MetaGroupName:    "Green-Party",
+				MetaStartDate:    "1996-11-01",
+				MetaEndDate:      "1996-12-01",
+				MetaFetchedAt:    "1996-11-06T00:30:00Z",
+				MetaETag:         `"Ralph-Nader"`,
+				MetaLastModified: "Tue, 05 Nov 1996 12:00:00 GMT",
+				MetaCursor:       "2000",
+			},
+		},
+		{
+			comparisonType: "Test empty fields are left out",
+			meta:           ObjectMeta{ContentType: "text/plain", GroupName: "Green-Party"},
+			wantMetadata:   map[string]string{MetaGroupName: "Green-Party"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotMetadata := test.meta.Metadata(); !reflect.DeepEqual(gotMetadata, test.wantMetadata) {
+				t.Errorf("Metadata does not match.\n got: %v\nwant: %v", gotMetadata, test.wantMetadata)
+			}
+		})
+	}
+}
+
+func TestParseRefreshMode(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		mode           string
+		wantMode       RefreshMode
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test empty mode defaults to never",
+			mode:           "",
+			wantMode:       RefreshNever,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test changed mode",
+			mode:           "changed",
+			wantMode:       RefreshChanged,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test always mode",
+			mode:           "always",
+			wantMode:       RefreshAlways,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test unknown mode error",
+			mode:           "sometimes",
+			wantErr:        refreshModeErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMode, gotErr := ParseRefreshMode(test.mode)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("ParseRefreshMode error does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotMode != test.wantMode {
+				t.Errorf("ParseRefreshMode response does not match.\n got: %v\nwant: %v", gotMode, test.wantMode)
+			}
+		})
+	}
+}
+
+func TestStoreOverwrite(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.SubDirectory = "Honor-the-Earth"
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+	objects := gcs.client.(*fakeClient).buckets[gcs.BucketName].objects
+	fileName := "Honor-the-Earth/1993-01-Honor-the-Earth.txt"
+	prevFileName := "previous/Honor-the-Earth/1993-01-Honor-the-Earth.txt.00010101T000000Z"
+
+	if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader("Co-founded Honor the Earth."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		content        string
+		overwrite      bool
+		keepPrevious   bool
+		wantContent    string
+		wantPrevious   string
+	}{
+		{
+			comparisonType: "Test existing file is kept without overwrite",
+			content:        "Ran for Vice President.",
+			overwrite:      false,
+			wantContent:    "Co-founded Honor the Earth.",
+		},
+		{
+			comparisonType: "Test existing file is replaced with overwrite",
+			content:        "Ran for Vice President.",
+			overwrite:      true,
+			wantContent:    "Ran for Vice President.",
+		},
+		{
+			comparisonType: "Test previous content is kept when replaced",
+			content:        "Executive director of Honor the Earth.",
+			overwrite:      true,
+			keepPrevious:   true,
+			wantContent:    "Executive director of Honor the Earth.",
+			wantPrevious:   "Ran for Vice President.",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gcs.SetRefresh(RefreshAlways, test.keepPrevious)
+			if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader(test.content), ObjectMeta{Overwrite: test.overwrite}); err != nil {
+				t.Fatalf("Store error: %v", err)
+			}
+			if gotContent := string(objects[fileName]); strings.Compare(gotContent, test.wantContent) != 0 {
+				t.Errorf("Stored content does not match.\n got: %v\nwant: %v", gotContent, test.wantContent)
+			}
+			if gotPrevious := string(objects[prevFileName]); strings.Compare(gotPrevious, test.wantPrevious) != 0 {
+				t.Errorf("Previous content does not match.\n got: %v\nwant: %v", gotPrevious, test.wantPrevious)
+			}
+		})
+	}
+}
+
+func TestCheckFileExists(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.SubDirectory = "Honor-the-Earth"
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+
+	if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader("Co-founded Honor the Earth."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantExists     bool
+	}{
+		{
+			comparisonType: "Test file exists",
+			fileName:       "Honor-the-Earth/1993-01-Honor-the-Earth.txt",
+			wantExists:     true,
+		},
+		{
+			comparisonType: "Test file does not exist",
+			fileName:       "Honor-the-Earth/1993-02-Honor-the-Earth.txt",
+			wantExists:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotExists := gcs.CheckFileExists(ctx, test.fileName); gotExists != test.wantExists {
+				t.Errorf("CheckFileExists response does not match.\n got: %v\nwant: %v", gotExists, test.wantExists)
+			}
+		})
+	}
+}
+
+func TestStoreCheckFails(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.SubDirectory = "Honor-the-Earth"
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+	fileName := "Honor-the-Earth/1996-01-Honor-the-Earth.txt"
+
+	if _, err := gcs.Store(ctx, "1996-01.txt", strings.NewReader("Ran for Vice President."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+	bucket := gcs.client.(*fakeClient).buckets[gcs.BucketName]
+	bucket.attrsErr = fmt.Errorf("service unavailable")
+
+	if _, err := gcs.Store(ctx, "1996-01.txt", strings.NewReader("White Earth Land Recovery Project."), ObjectMeta{Overwrite: true}); !errors.Is(err, statObjectErr) {
+		t.Errorf("Store response does not match.\n got: %v\nwant: %v", err, statObjectErr)
+	}
+	if gotContent := string(bucket.objects[fileName]); gotContent != "Ran for Vice President." {
+		t.Errorf("Stored content does not match.\n got: %v\nwant: %v", gotContent, "Ran for Vice President.")
+	}
+	if gcs.CheckFileExists(ctx, fileName) {
+		t.Errorf("CheckFileExists found %s when the check failed.", fileName)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.SubDirectory = "Honor-the-Earth"
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+
+	if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader("Co-founded Honor the Earth."), ObjectMeta{}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	r, err := gcs.Open(ctx, "1993-01.txt")
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer r.Close()
+	if gotContent, _ := ioutil.ReadAll(r); string(gotContent) != "Co-founded Honor the Earth." {
+		t.Errorf("Content does not match.\n got: %v\nwant: %v", string(gotContent), "Co-founded Honor the Earth.")
+	}
+	if _, err = gcs.Open(ctx, "1993-02.txt"); !errors.Is(err, openObjectErr) {
+		t.Errorf("Open response does not match.\n got: %v\nwant: %v", err, openObjectErr)
+	}
+}
+
+func TestListExisting(t *testing.T) {
+	ctx := context.Background()
+	gcs := setupGCS(t)
+	gcs.bucket.Create(ctx, gcs.ProjectID, nil)
+
+	for _, subDirectory := range []string{"Honor-the-Earth", "Honor-the-Earth-Fund"} {
+		gcs.SubDirectory = subDirectory
+		if _, err := gcs.Store(ctx, "1993-01.txt", strings.NewReader("Co-founded Honor the Earth."), ObjectMeta{}); err != nil {
+			t.Fatalf("Storage setup failed: %v", err)
+		}
+	}
+
+	gotExisting, gotErr := gcs.ListExisting(ctx, "Honor-the-Earth")
+	if gotErr != nil {
+		t.Fatalf("ListExisting error: %v", gotErr)
+	}
+	wantName := "Honor-the-Earth/1993-01-Honor-the-Earth.txt"
+	if _, ok := gotExisting[wantName]; len(gotExisting) != 1 || !ok {
+		t.Errorf("ListExisting response does not match.\n got: %v\nwant only: %v", gotExisting, wantName)
+	}
 }
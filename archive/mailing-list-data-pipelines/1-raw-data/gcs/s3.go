@@ -0,0 +1,531 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+S3 compatible object storage (AWS S3, MinIO, etc) version of the storage connection.
+
+Requests are signed with AWS Signature Version 4 using credentials from the environment:
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optionally AWS_SESSION_TOKEN.
+
+Storage url format:
+s3://[BUCKET]?endpoint=http://localhost:9000&region=us-east-1&path-style=true
+- endpoint defaults to AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL and then https://s3.amazonaws.com
+- region defaults to AWS_REGION or AWS_DEFAULT_REGION and then us-east-1
+- path-style addressing (http://host/bucket/key) is needed for most MinIO setups
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultEndpoint = "https://s3.amazonaws.com"
+	s3DefaultRegion   = "us-east-1"
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat   = "20060102T150405Z"
+	s3ScopeDateFormat = "20060102"
+	// User metadata is sent and returned with this header prefix
+	s3MetaHeaderPrefix = "x-amz-meta-"
+)
+
+var (
+	s3CredentialsErr = fmt.Errorf("s3 credentials")
+	s3RequestErr     = fmt.Errorf("s3 request")
+	s3EndpointErr    = fmt.Errorf("s3 endpoint")
+)
+
+// ListObjectsV2 response fields needed to list existing objects
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type S3Connection struct {
+	Endpoint     string
+	BucketName   string
+	Region       string
+	PathStyle    bool
+	SubDirectory string
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+	refreshSettings
+}
+
+// Create S3Connection from the s3:// storage url and environment variables.
+func newS3Connection(storageLocation *url.URL) (s3 *S3Connection) {
+	query := storageLocation.Query()
+	s3 = &S3Connection{
+		Endpoint:   firstNonEmpty(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), s3DefaultEndpoint),
+		BucketName: storageLocation.Host,
+		Region:     firstNonEmpty(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), s3DefaultRegion),
+	}
+	if pathStyle := query.Get("path-style"); pathStyle != "" {
+		s3.PathStyle = pathStyle == "true"
+	}
+	return
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (s3 *S3Connection) SetSubDirectory(subDirectory string) {
+	s3.SubDirectory = subDirectory
+}
+
+// Setup the http client and load credentials from the environment.
+func (s3 *S3Connection) ConnectClient(ctx context.Context) (err error) {
+	s3.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	s3.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	s3.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if s3.accessKeyID == "" || s3.secretKey == "" {
+		err = fmt.Errorf("%w failed: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", s3CredentialsErr)
+		return
+	}
+	if _, err = url.Parse(s3.Endpoint); err != nil {
+		err = fmt.Errorf("%w parse error: %v", s3EndpointErr, err)
+		return
+	}
+	if s3.client == nil {
+		s3.client = &http.Client{}
+	}
+	if s3.now == nil {
+		s3.now = time.Now
+	}
+	return
+}
+
+// Creates storage bucket if it doesn't exist.
+func (s3 *S3Connection) CreateBucket(ctx context.Context) (err error) {
+	var (
+		response *http.Response
+		body     []byte
+	)
+
+	if s3.BucketName == "" {
+		err = fmt.Errorf("%w error: %v. Re-enter bucketname.", emptyBucketName, s3.BucketName)
+		return
+	}
+
+	if response, err = s3.do(ctx, http.MethodHead, "", nil, nil); err != nil {
+		return
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		log.Printf("Bucket %v exists.\n", s3.BucketName)
+		return
+	case http.StatusNotFound:
+		// Regions other than us-east-1 need the location in the create request
+		if s3.Region != s3DefaultRegion {
+			body = []byte(fmt.Sprintf(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><LocationConstraint>%s</LocationConstraint></CreateBucketConfiguration>`, s3.Region))
+		}
+		if response, err = s3.do(ctx, http.MethodPut, "", bytes.NewReader(body), body); err != nil {
+			return
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("%w failed on bucket name %s: %v", createBucketErr, s3.BucketName, s3ResponseError(response))
+		}
+		log.Printf("Bucket %v created.\n", s3.BucketName)
+		return
+	default:
+		err = fmt.Errorf("%w setup issues error: %v. Double check endpoint and credentials.", createBucketErr, s3ResponseError(response))
+		return
+	}
+}
+
+// Check if file already exists. Only a 404 means the file is missing so other failures are logged.
+func (s3 *S3Connection) CheckFileExists(ctx context.Context, fileName string) (exists bool) {
+	_, exists, err := s3.statObject(ctx, fileName)
+	if err != nil {
+		log.Printf("Checking %s exists failed: %v", fileName, err)
+	}
+	return
+}
+
+// List objects already stored in the subdirectory with prefix scoped ListObjectsV2 requests.
+func (s3 *S3Connection) ListExisting(ctx context.Context, subDirectory string) (existing map[string]ObjectInfo, err error) {
+	var (
+		response *http.Response
+		result   s3ListBucketResult
+	)
+	emptyPayloadHash := sha256.Sum256(nil)
+	existing = make(map[string]ObjectInfo)
+	query := url.Values{"list-type": {"2"}, "prefix": {subDirectory + "/"}}
+
+	for {
+		if response, err = s3.send(ctx, s3Request{method: http.MethodGet, query: query, payloadHash: hex.EncodeToString(emptyPayloadHash[:])}); err != nil {
+			return
+		}
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%w on %s: %v", listObjectsErr, subDirectory, s3ResponseError(response))
+			response.Body.Close()
+			return
+		}
+		result = s3ListBucketResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			err = fmt.Errorf("%w on %s decode error: %v", listObjectsErr, subDirectory, err)
+			return
+		}
+		for _, object := range result.Contents {
+			existing[object.Key] = ObjectInfo{Name: object.Key, Size: object.Size, Updated: object.LastModified}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Get details on the file if it is stored. The filename is formatted the same as Store.
+func (s3 *S3Connection) Stat(ctx context.Context, fileName string) (info ObjectInfo, exists bool, err error) {
+	return s3.statObject(ctx, createStorageFileName(s3.SubDirectory, fileName))
+}
+
+// Get details on an object by its full key with a HEAD request.
+func (s3 *S3Connection) statObject(ctx context.Context, key string) (info ObjectInfo, exists bool, err error) {
+	var response *http.Response
+
+	if response, err = s3.do(ctx, http.MethodHead, key, nil, nil); err != nil {
+		return
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		info = ObjectInfo{Name: key, Size: response.ContentLength}
+		info.Updated, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+		info.Metadata = s3Metadata(response.Header)
+		exists = true
+	case http.StatusNotFound:
+	default:
+		err = fmt.Errorf("%w on %s: %v", statObjectErr, key, s3ResponseError(response))
+	}
+	return
+}
+
+// Read the stored content of the file with a GET request. The filename is formatted the same as Store. Caller closes
+// the reader.
+func (s3 *S3Connection) Open(ctx context.Context, fileName string) (r io.ReadCloser, err error) {
+	var response *http.Response
+	key := createStorageFileName(s3.SubDirectory, fileName)
+
+	if response, err = s3.do(ctx, http.MethodGet, key, nil, nil); err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		err = fmt.Errorf("%w on %s: %v", openObjectErr, key, s3ResponseError(response))
+		return
+	}
+	return response.Body, nil
+}
+
+// Copy the stored object under previous/ with a server side copy before it is replaced.
+func (s3 *S3Connection) keepPreviousObject(ctx context.Context, fileName string) (err error) {
+	var (
+		info     ObjectInfo
+		response *http.Response
+	)
+	emptyPayloadHash := sha256.Sum256(nil)
+
+	if info, _, err = s3.statObject(ctx, fileName); err != nil {
+		err = fmt.Errorf("%w stat on %s: %v", keepPreviousErr, fileName, err)
+		return
+	}
+	prevFileName := previousFileName(fileName, info.Updated)
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3.BucketName + "/" + s3URIEncode(fileName, false)}}
+	if response, err = s3.send(ctx, s3Request{method: http.MethodPut, key: prevFileName, header: header, payloadHash: hex.EncodeToString(emptyPayloadHash[:])}); err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w copy of %s: %v", keepPreviousErr, fileName, s3ResponseError(response))
+		return
+	}
+	log.Printf("Previous version of %s kept as %s.", fileName, prevFileName)
+	return
+}
+
+// Stream content from the reader into the bucket. Content is spooled to a temp file so the upload has a length and a signed payload hash.
+func (s3 *S3Connection) Store(ctx context.Context, fileName string, r io.Reader, meta ObjectMeta) (n int64, err error) {
+	var (
+		newFileName string
+		tmpFile     *os.File
+		response    *http.Response
+	)
+
+	if fileName == "" {
+		err = fmt.Errorf("%w", emptyFileNameErr)
+		return
+	}
+
+	//Format the filename to store
+	newFileName = createStorageFileName(s3.SubDirectory, fileName)
+
+	// Only store when the object is known to be missing so a failed check never replaces it without keeping the previous version
+	_, exists, err := s3.statObject(ctx, newFileName)
+	if err != nil {
+		return
+	}
+	if exists && !meta.Overwrite {
+		return
+	}
+
+	if tmpFile, err = ioutil.TempFile("", "ocean-s3-"); err != nil {
+		err = fmt.Errorf("%w temp file error: %v", fileWriteErr, err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	payloadHash := sha256.New()
+	if n, err = io.Copy(io.MultiWriter(tmpFile, payloadHash), r); err != nil {
+		err = fmt.Errorf("%w %s: %v", storeContentErr, newFileName, err)
+		return
+	}
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		err = fmt.Errorf("%w temp file error: %v", fileWriteErr, err)
+		return
+	}
+
+	if exists && s3.keepPrevious && !isStateFileName(newFileName) {
+		if err = s3.keepPreviousObject(ctx, newFileName); err != nil {
+			return
+		}
+	}
+
+	header := http.Header{}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	// The payload hash is the content SHA-256 so provenance is complete on upload
+	for key, value := range addContentMetadata(meta.Metadata(), n, payloadHash) {
+		header.Set(s3MetaHeaderPrefix+key, value)
+	}
+	if response, err = s3.send(ctx, s3Request{method: http.MethodPut, key: newFileName, header: header, body: tmpFile, size: n, payloadHash: hex.EncodeToString(payloadHash.Sum(nil))}); err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: %v", storageCtxCloseErr, s3ResponseError(response))
+		return
+	}
+	log.Printf("Storage of %s complete.", newFileName)
+	return
+}
+
+// Collect the user metadata returned as x-amz-meta- headers.
+func s3Metadata(header http.Header) (metadata map[string]string) {
+	metadata = make(map[string]string)
+	for key := range header {
+		if lowerKey := strings.ToLower(key); strings.HasPrefix(lowerKey, s3MetaHeaderPrefix) {
+			metadata[strings.TrimPrefix(lowerKey, s3MetaHeaderPrefix)] = header.Get(key)
+		}
+	}
+	return
+}
+
+// Build the url for a key in the bucket using path style or virtual hosted style addressing.
+func (s3 *S3Connection) objectURL(key string) (objectURL *url.URL, err error) {
+	if objectURL, err = url.Parse(s3.Endpoint); err != nil {
+		err = fmt.Errorf("%w parse error: %v", s3EndpointErr, err)
+		return
+	}
+	basePath := strings.TrimSuffix(objectURL.Path, "/")
+	if s3.PathStyle {
+		objectURL.Path = fmt.Sprintf("%s/%s/%s", basePath, s3.BucketName, key)
+	} else {
+		objectURL.Host = fmt.Sprintf("%s.%s", s3.BucketName, objectURL.Host)
+		objectURL.Path = fmt.Sprintf("%s/%s", basePath, key)
+	}
+	objectURL.RawPath = s3URIEncode(objectURL.Path, false)
+	return
+}
+
+// Parts of a signed request to the bucket. An empty key addresses the bucket itself.
+type s3Request struct {
+	method      string
+	key         string
+	query       url.Values
+	header      http.Header
+	body        io.Reader
+	size        int64
+	payloadHash string
+}
+
+// Send a signed request with an in memory payload.
+func (s3 *S3Connection) do(ctx context.Context, method, key string, body io.Reader, payload []byte) (response *http.Response, err error) {
+	hash := sha256.Sum256(payload)
+	return s3.send(ctx, s3Request{method: method, key: key, body: body, size: int64(len(payload)), payloadHash: hex.EncodeToString(hash[:])})
+}
+
+// Sign and send the request.
+func (s3 *S3Connection) send(ctx context.Context, s3Req s3Request) (response *http.Response, err error) {
+	var (
+		objectURL *url.URL
+		request   *http.Request
+	)
+
+	if objectURL, err = s3.objectURL(s3Req.key); err != nil {
+		return
+	}
+	objectURL.RawQuery = s3Req.query.Encode()
+	if request, err = http.NewRequestWithContext(ctx, s3Req.method, objectURL.String(), s3Req.body); err != nil {
+		err = fmt.Errorf("%w creation error: %v", s3RequestErr, err)
+		return
+	}
+	if s3Req.body != nil {
+		request.ContentLength = s3Req.size
+	}
+	for name, values := range s3Req.header {
+		request.Header[name] = values
+	}
+	if s3.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s3.sessionToken)
+	}
+	signS3Request(request, s3Req.payloadHash, s3.accessKeyID, s3.secretKey, s3.Region, s3.now().UTC())
+
+	if response, err = s3.client.Do(request); err != nil {
+		err = fmt.Errorf("%w %s %s error: %v", s3RequestErr, s3Req.method, objectURL.Path, err)
+	}
+	return
+}
+
+// Read the error code and message returned by S3.
+func s3ResponseError(response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("%w status %s: %s", s3RequestErr, response.Status, strings.TrimSpace(string(body)))
+}
+
+// Add AWS Signature Version 4 headers to the request. All headers already on the request are signed along with host.
+func signS3Request(request *http.Request, payloadHash, accessKeyID, secretKey, region string, signTime time.Time) {
+	amzDate := signTime.Format(s3AmzDateFormat)
+	scopeDate := signTime.Format(s3ScopeDateFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers are lowercase, sorted and include host
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	// Canonical query is sorted by key with keys and values encoded
+	query := request.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	queryParts := []string{}
+	for _, key := range queryKeys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			queryParts = append(queryParts, fmt.Sprintf("%s=%s", s3URIEncode(key, true), s3URIEncode(value, true)))
+		}
+	}
+
+	canonicalPath := request.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalPath,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", scopeDate, region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3SignAlgorithm, amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), scopeDate)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3SignAlgorithm, accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode the way S3 expects: everything except unreserved characters and optionally slash.
+func s3URIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This package loads the file that declares which mailing lists to crawl.
+
+The file is YAML or JSON based on its extension and lists one entry per mailing list group:
+
+	lists:
+	- source: pipermail
+	  base_url: https://mail.python.org
+	  group: python-dev
+	  subdirectory: pipermail-python-dev
+	  first_month: 1995-03
+	  status: frozen
+	  workers: 5
+	  rate_limit: 2
+
+Set discover instead of group to load every list the source finds on the host. First month is optional for discovered
+lists because the source limits the months to what the archive has.
+
+Subdirectory defaults to [SOURCE]-[GROUP], with any / in the group such as a GitHub [OWNER]/[REPO] replaced by _ so
+the group stays one directory, and status defaults to active. Frozen lists have no new messages and are
+skipped when loading the latest month. Workers and rate limit (requests per second) use the command line settings when 0.
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	readConfigErr  = fmt.Errorf("read config")
+	parseConfigErr = fmt.Errorf("parse config")
+	invalidListErr = fmt.Errorf("invalid list config")
+)
+
+const (
+	StatusActive = "active"
+	StatusFrozen = "frozen"
+)
+
+// One mailing list group to crawl.
+type List struct {
+	// Registered source name such as pipermail, mailman or gg
+	Source string `json:"source" yaml:"source"`
+	// Archive host url. Sources use their default host when empty.
+	BaseURL string `json:"base_url,omitempty" yaml:"base_url,omitempty"`
+	// Google Groups organization path such as /a/[DOMAIN] or the Pony Mail list domain
+	Org   string `json:"org,omitempty" yaml:"org,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Load all lists the source discovers on the host instead of one group
+	Discover     bool   `json:"discover,omitempty" yaml:"discover,omitempty"`
+	SubDirectory string `json:"subdirectory,omitempty" yaml:"subdirectory,omitempty"`
+	// First month with archive content in format of year-month and 4dig-2dig
+	FirstMonth string `json:"first_month" yaml:"first_month"`
+	// Active or frozen
+	Status    string  `json:"status,omitempty" yaml:"status,omitempty"`
+	Workers   int     `json:"workers,omitempty" yaml:"workers,omitempty"`
+	RateLimit float64 `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+}
+
+type Config struct {
+	Lists []List `json:"lists" yaml:"lists"`
+}
+
+// First day of the first archive month. Zero when not set. Call after Validate.
+func (list List) FirstDate() (firstDate time.Time) {
+	firstDate, _ = time.Parse("2006-01", list.FirstMonth)
+	return
+}
+
+// Default subdirectory for the group. A / in the group would nest the files a directory deeper than the other lists
+// so it becomes _.
+func SubDirectoryName(source, groupName string) string {
+	return fmt.Sprintf("%s-%s", source, strings.ReplaceAll(groupName, "/", "_"))
+}
+
+// List for one group found on a discover list's host. The other settings carry over.
+func (list List) Discovered(groupName string) List {
+	list.Discover = false
+	list.Group = groupName
+	list.SubDirectory = SubDirectoryName(list.Source, groupName)
+	return list
+}
+
+// Frozen lists don't get new messages.
+func (list List) Frozen() bool {
+	return list.Status == StatusFrozen
+}
+
+// Read the config file and validate it against the registered source names.
+func Load(fileName string, sourceNames []string) (config *Config, err error) {
+	var data []byte
+
+	if data, err = ioutil.ReadFile(fileName); err != nil {
+		err = fmt.Errorf("%w %s: %v", readConfigErr, fileName, err)
+		return
+	}
+	if config, err = Parse(data, filepath.Ext(fileName)); err != nil {
+		return
+	}
+	err = config.Validate(sourceNames)
+	return
+}
+
+// Parse the config from JSON when the extension is .json and YAML otherwise. Unknown fields are errors so typos don't
+// silently fall back to defaults.
+func Parse(data []byte, extension string) (config *Config, err error) {
+	config = &Config{}
+
+	if strings.EqualFold(extension, ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	} else {
+		err = yaml.UnmarshalStrict(data, config)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %v", parseConfigErr, err)
+		return
+	}
+	config.setDefaults()
+	return
+}
+
+func (config *Config) setDefaults() {
+	for idx := range config.Lists {
+		list := &config.Lists[idx]
+		if list.SubDirectory == "" && !list.Discover {
+			list.SubDirectory = SubDirectoryName(list.Source, list.Group)
+		}
+		if list.Status == "" {
+			list.Status = StatusActive
+		}
+	}
+}
+
+// Check every list and report all problems at once so the file can be fixed in one pass.
+func (config *Config) Validate(sourceNames []string) (err error) {
+	var problems []string
+	registered := make(map[string]bool)
+	subDirectories := make(map[string]int)
+
+	for _, name := range sourceNames {
+		registered[name] = true
+	}
+	if len(config.Lists) == 0 {
+		problems = append(problems, "no lists declared")
+	}
+
+	for idx, list := range config.Lists {
+		prefix := fmt.Sprintf("list %d (%s)", idx, list.SubDirectory)
+		if !registered[list.Source] {
+			problems = append(problems, fmt.Sprintf("%s source %q is not one of %v", prefix, list.Source, sourceNames))
+		}
+		if list.Discover && list.Group != "" {
+			problems = append(problems, fmt.Sprintf("%s group must be empty when discover is set", prefix))
+		}
+		if !list.Discover && list.Group == "" {
+			problems = append(problems, fmt.Sprintf("%s group is empty", prefix))
+		}
+		// Discovered lists can leave out the first month and start at the first month the archive has
+		if list.FirstMonth != "" || !list.Discover {
+			if _, dateErr := time.Parse("2006-01", list.FirstMonth); dateErr != nil {
+				problems = append(problems, fmt.Sprintf("%s first_month %q is not in format 2006-01", prefix, list.FirstMonth))
+			}
+		}
+		if list.Status != StatusActive && list.Status != StatusFrozen {
+			problems = append(problems, fmt.Sprintf("%s status %q is not %s or %s", prefix, list.Status, StatusActive, StatusFrozen))
+		}
+		if list.Workers < 0 {
+			problems = append(problems, fmt.Sprintf("%s workers %d is negative", prefix, list.Workers))
+		}
+		if list.RateLimit < 0 {
+			problems = append(problems, fmt.Sprintf("%s rate_limit %v is negative", prefix, list.RateLimit))
+		}
+		if list.Discover {
+			continue
+		}
+		if prevIdx, dup := subDirectories[list.SubDirectory]; dup {
+			problems = append(problems, fmt.Sprintf("%s subdirectory is also used by list %d", prefix, prevIdx))
+		}
+		subDirectories[list.SubDirectory] = idx
+	}
+	if len(problems) > 0 {
+		err = fmt.Errorf("%w: %s", invalidListErr, strings.Join(problems, "; "))
+	}
+	return
+}
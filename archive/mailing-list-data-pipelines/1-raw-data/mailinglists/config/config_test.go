@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testSourceNames = []string{"gg", "mailman", "pipermail"}
+
+func TestParse(t *testing.T) {
+	var (
+		gotConfig *Config
+		gotErr    error
+	)
+
+	tests := []struct {
+		comparisonType string
+		data           string
+		extension      string
+		wantLists      []List
+		wantErr        error
+	}{
+		{
+			comparisonType: "YAML with defaults",
+			data: `
+lists:
+- source: pipermail
+  base_url: https://mail.python.org
+  group: python-dev
+  first_month: 1995-03
+  status: frozen
+  workers: 5
+  rate_limit: 2.5
+- source: gg
+  group: golang-nuts
+  first_month: 2009-11
+- source: github
+  group: oceti-sakowin/treaty-council
+  first_month: 1868-04
+`,
+			extension: ".yaml",
+			wantLists: []List{
+				{Source: "pipermail", BaseURL: "https://mail.python.org", Group: "python-dev", SubDirectory: "pipermail-python-dev", FirstMonth: "1995-03", Status: StatusFrozen, Workers: 5, RateLimit: 2.5},
+				{Source: "gg", Group: "golang-nuts", SubDirectory: "gg-golang-nuts", FirstMonth: "2009-11", Status: StatusActive},
+				{Source: "github", Group: "oceti-sakowin/treaty-council", SubDirectory: "github-oceti-sakowin_treaty-council", FirstMonth: "1868-04", Status: StatusActive},
+			},
+			wantErr: nil,
+		},
+		{
+			comparisonType: "JSON with subdirectory",
+			data:           `{"lists": [{"source": "mailman", "group": "python-ideas", "subdirectory": "Maria-Tallchief", "first_month": "2006-12"}]}`,
+			extension:      ".json",
+			wantLists: []List{
+				{Source: "mailman", Group: "python-ideas", SubDirectory: "Maria-Tallchief", FirstMonth: "2006-12", Status: StatusActive},
+			},
+			wantErr: nil,
+		},
+		{
+			comparisonType: "Unknown YAML field",
+			data:           "lists:\n- source: gg\n  grup: golang-nuts\n",
+			extension:      ".yml",
+			wantErr:        parseConfigErr,
+		},
+		{
+			comparisonType: "Unknown JSON field",
+			data:           `{"lists": [{"source": "gg", "grup": "golang-nuts"}]}`,
+			extension:      ".json",
+			wantErr:        parseConfigErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotConfig, gotErr = Parse([]byte(test.data), test.extension); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotErr == nil && !reflect.DeepEqual(gotConfig.Lists, test.wantLists) {
+				t.Errorf("Lists do not match.\n got: %+v\nwant: %+v", gotConfig.Lists, test.wantLists)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := List{Source: "gg", Group: "golang-nuts", SubDirectory: "gg-golang-nuts", FirstMonth: "2009-11", Status: StatusActive}
+
+	tests := []struct {
+		comparisonType string
+		lists          []List
+		wantErr        error
+	}{
+		{
+			comparisonType: "Valid list",
+			lists:          []List{valid},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "No lists",
+			lists:          nil,
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Unregistered source",
+			lists:          []List{{Source: "Sacagawea", Group: "Lemhi-Shoshone", SubDirectory: "Sacagawea-Lemhi-Shoshone", FirstMonth: "1805-04", Status: StatusActive}},
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Bad first month",
+			lists:          []List{{Source: "gg", Group: "golang-nuts", SubDirectory: "gg-golang-nuts", FirstMonth: "2009-11-01", Status: StatusActive}},
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Bad status",
+			lists:          []List{{Source: "gg", Group: "golang-nuts", SubDirectory: "gg-golang-nuts", FirstMonth: "2009-11", Status: "thawed"}},
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Negative workers and rate limit",
+			lists:          []List{{Source: "gg", Group: "golang-nuts", SubDirectory: "gg-golang-nuts", FirstMonth: "2009-11", Status: StatusActive, Workers: -1, RateLimit: -1}},
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Duplicate subdirectory",
+			lists:          []List{valid, valid},
+			wantErr:        invalidListErr,
+		},
+		{
+			comparisonType: "Discover without group or first month",
+			lists:          []List{valid, {Source: "mailman", BaseURL: "https://lists.fedoraproject.org", Discover: true, Status: StatusActive}},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Discover with a group",
+			lists:          []List{{Source: "mailman", Group: "devel", Discover: true, Status: StatusActive}},
+			wantErr:        invalidListErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			config := &Config{Lists: test.lists}
+			if gotErr := config.Validate(testSourceNames); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDiscovered(t *testing.T) {
+	list := List{Source: "mailman", BaseURL: "https://lists.fedoraproject.org", Discover: true, Status: StatusFrozen, Workers: 3, RateLimit: 1}
+	want := List{Source: "mailman", BaseURL: "https://lists.fedoraproject.org", Group: "devel@lists.fedoraproject.org", SubDirectory: "mailman-devel@lists.fedoraproject.org", Status: StatusFrozen, Workers: 3, RateLimit: 1}
+
+	if got := list.Discovered("devel@lists.fedoraproject.org"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Discovered list does not match.\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	var gotErr error
+
+	tmpDir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Temp dir setup failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		data           string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Checked in lists are valid",
+			fileName:       filepath.Join("..", "lists.yaml"),
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Missing file",
+			fileName:       filepath.Join(tmpDir, "Osceola.yaml"),
+			wantErr:        readConfigErr,
+		},
+		{
+			comparisonType: "Invalid list",
+			fileName:       filepath.Join(tmpDir, "lists.json"),
+			data:           `{"lists": [{"source": "gg", "first_month": "2009-11"}]}`,
+			wantErr:        invalidListErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if test.data != "" {
+				if err := ioutil.WriteFile(test.fileName, []byte(test.data), 0644); err != nil {
+					t.Fatalf("Config file setup failed: %v", err)
+				}
+			}
+			if _, gotErr = Load(test.fileName, testSourceNames); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discourse
+
+/*
+Read topics and posts through the Discourse JSON API.
+
+Topics by latest activity, pinned topics first, with a more_topics_url while there are more pages:
+[FORUM URL]/latest.json?page=[PAGE]
+Topic with its first posts and the ids of every post in the stream:
+[FORUM URL]/t/[TOPIC ID].json
+Posts from the stream that didn't come with the topic:
+[FORUM URL]/t/[TOPIC ID]/posts.json?post_ids[]=[POST ID]&post_ids[]=[POST ID]
+Markdown of a post:
+[FORUM URL]/raw/[TOPIC ID]/[POST NUMBER]
+
+Forums answer 429 with Retry-After when requests come too fast.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	apiErr = errors.New("discourse api")
+)
+
+const (
+	// Rate limited requests are tried again this many times
+	maxRetries = 5
+	// Wait when a rate limited response doesn't say how long
+	retryFallback = 30 * time.Second
+	// Posts asked for in each posts.json request
+	postChunk = 20
+)
+
+type apiTopic struct {
+	ID           int       `json:"id"`
+	Title        string    `json:"title"`
+	Slug         string    `json:"slug"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastPostedAt time.Time `json:"last_posted_at"`
+	BumpedAt     time.Time `json:"bumped_at"`
+	Pinned       bool      `json:"pinned"`
+}
+
+type apiLatest struct {
+	TopicList struct {
+		MoreTopicsURL string     `json:"more_topics_url"`
+		Topics        []apiTopic `json:"topics"`
+	} `json:"topic_list"`
+}
+
+type apiPost struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	PostNumber int       `json:"post_number"`
+	// Zero when the post doesn't answer a particular post
+	ReplyToPostNumber int `json:"reply_to_post_number"`
+	TopicID           int `json:"topic_id"`
+}
+
+type apiPostStream struct {
+	Posts  []apiPost `json:"posts"`
+	Stream []int     `json:"stream"`
+}
+
+type apiTopicPosts struct {
+	ID         int           `json:"id"`
+	Title      string        `json:"title"`
+	Slug       string        `json:"slug"`
+	PostStream apiPostStream `json:"post_stream"`
+}
+
+// Last time the topic had activity
+func (topic apiTopic) activeUntil() (last time.Time) {
+	last = topic.CreatedAt
+	for _, date := range []time.Time{topic.LastPostedAt, topic.BumpedAt} {
+		if date.After(last) {
+			last = date
+		}
+	}
+	return
+}
+
+// Get the url and try again after the wait the forum asks for while it answers 429.
+func get(ctx context.Context, httpToReader utils.HttpReaderResponse, apiURL string) (body io.ReadCloser, err error) {
+	var header http.Header
+
+	for attempt := 0; ; attempt++ {
+		body, header, err = httpToReader(apiURL, nil)
+		wait, limited := utils.RetryAfter(err, header, retryFallback)
+		if !limited || attempt == maxRetries {
+			break
+		}
+		log.Printf("Discourse rate limited %s so waiting %v.", apiURL, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w get on %s: %v", apiErr, apiURL, err)
+	}
+	return
+}
+
+// Get and decode a JSON API response.
+func getAPI(ctx context.Context, httpToReader utils.HttpReaderResponse, apiURL string, value interface{}) (err error) {
+	var body io.ReadCloser
+
+	if body, err = get(ctx, httpToReader, apiURL); err != nil {
+		return
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(value); err != nil {
+		return fmt.Errorf("%w decode on %s: %v", apiErr, apiURL, err)
+	}
+	return
+}
+
+// Topics with activity on or after the start date. Pages are read until a topic that isn't pinned was last active
+// before the start date, since pinned topics come first whatever their activity.
+func listTopics(ctx context.Context, httpToReader utils.HttpReaderResponse, forumURL string, startDate time.Time) (topics []apiTopic, err error) {
+	var latest apiLatest
+
+	for page := 0; ; page++ {
+		latest = apiLatest{}
+		if err = getAPI(ctx, httpToReader, fmt.Sprintf("%s/latest.json?page=%d", forumURL, page), &latest); err != nil {
+			return
+		}
+		olderTopics := false
+		for _, topic := range latest.TopicList.Topics {
+			if !topic.activeUntil().Before(startDate) {
+				topics = append(topics, topic)
+			} else if !topic.Pinned {
+				olderTopics = true
+			}
+		}
+		if len(latest.TopicList.Topics) == 0 || latest.TopicList.MoreTopicsURL == "" || olderTopics {
+			return
+		}
+	}
+}
+
+// Topic with every post in its stream.
+func getTopicPosts(ctx context.Context, httpToReader utils.HttpReaderResponse, forumURL string, topicID int) (topic apiTopicPosts, err error) {
+	var more apiTopicPosts
+
+	if err = getAPI(ctx, httpToReader, fmt.Sprintf("%s/t/%d.json", forumURL, topicID), &topic); err != nil {
+		return
+	}
+	loaded := make(map[int]bool)
+	for _, post := range topic.PostStream.Posts {
+		loaded[post.ID] = true
+	}
+	var missing []int
+	for _, postID := range topic.PostStream.Stream {
+		if !loaded[postID] {
+			missing = append(missing, postID)
+		}
+	}
+
+	for chunkStart := 0; chunkStart < len(missing); chunkStart += postChunk {
+		chunkEnd := chunkStart + postChunk
+		if chunkEnd > len(missing) {
+			chunkEnd = len(missing)
+		}
+		query := url.Values{}
+		for _, postID := range missing[chunkStart:chunkEnd] {
+			query.Add("post_ids[]", fmt.Sprint(postID))
+		}
+		more = apiTopicPosts{}
+		if err = getAPI(ctx, httpToReader, fmt.Sprintf("%s/t/%d/posts.json?%s", forumURL, topicID, query.Encode()), &more); err != nil {
+			return
+		}
+		topic.PostStream.Posts = append(topic.PostStream.Posts, more.PostStream.Posts...)
+	}
+	return
+}
+
+// Markdown of the post.
+func getRaw(ctx context.Context, httpToReader utils.HttpReaderResponse, forumURL string, topicID, postNumber int) (markdown string, err error) {
+	var (
+		body    io.ReadCloser
+		content []byte
+	)
+
+	rawURL := fmt.Sprintf("%s/raw/%d/%d", forumURL, topicID, postNumber)
+	if body, err = get(ctx, httpToReader, rawURL); err != nil {
+		return
+	}
+	defer body.Close()
+
+	if content, err = ioutil.ReadAll(body); err != nil {
+		return "", fmt.Errorf("%w read on %s: %v", apiErr, rawURL, err)
+	}
+	return string(content), nil
+}
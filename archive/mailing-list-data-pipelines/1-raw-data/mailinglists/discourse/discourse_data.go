@@ -0,0 +1,302 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load Discourse forums, where communities such as Rust, Python and Go moved after their mailing lists.
+
+Groups are forum hosts such as discuss.python.org or users.rust-lang.org and are read over https. BaseURL replaces the
+forum url when set, such as for a forum under a path. Forums limit how fast requests can come, so set the rate limit on
+the list and the source waits and tries again when the forum still answers 429.
+
+Each post becomes an RFC 5322 style message with its markdown as the body. The Message-ID is built from the topic id
+and post number as <[TOPIC ID].[POST NUMBER]@[GROUP]>, and replies get In-Reply-To and References to the post they
+answer, or the first post of the topic when they don't answer a particular post. Discourse doesn't publish addresses
+so senders get [USERNAME]@[GROUP]. Posts are stored by the month they were created as [YEAR]-[MONTH].mbox.gz.
+*/
+
+package discourse
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr = errors.New("Storage failed")
+)
+
+func init() {
+	source.Register("discourse", NewSource)
+}
+
+// Discourse version of the mailing list source
+type discourseSource struct {
+	baseURL      string
+	groups       []string
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Topics active since the start of the load by group, listed once per source
+	topics map[string]*groupTopics
+	// Posts of each topic by group and topic id, loaded once per source since a topic can span months
+	topicPosts map[topicKey]apiTopicPosts
+}
+
+type topicKey struct {
+	groupName string
+	topicID   int
+}
+
+type groupTopics struct {
+	since  time.Time
+	topics []apiTopic
+}
+
+// Post with the topic it belongs to
+type topicPost struct {
+	topic apiTopicPosts
+	post  apiPost
+}
+
+func NewSource(config source.Config) (source.Source, error) {
+	return &discourseSource{
+		baseURL:      strings.TrimRight(config.BaseURL, "/"),
+		groups:       config.Groups,
+		httpToReader: config.HttpToReader,
+		topics:       make(map[string]*groupTopics),
+		topicPosts:   make(map[topicKey]apiTopicPosts),
+	}, nil
+}
+
+func (ds *discourseSource) Name() string {
+	return "discourse"
+}
+
+// Forums can't be discovered so only the configured groups are loaded.
+func (ds *discourseSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	return ds.groups, nil
+}
+
+func (ds *discourseSource) forumURL(groupName string) string {
+	if ds.baseURL != "" {
+		return ds.baseURL
+	}
+	return "https://" + groupName
+}
+
+// Topics active on or after the start date, listed once per group unless an earlier start date is asked for.
+func (ds *discourseSource) activeTopics(ctx context.Context, groupName string, startDate time.Time) (topics []apiTopic, err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if listed, ok := ds.topics[groupName]; ok && !startDate.Before(listed.since) {
+		return listed.topics, nil
+	}
+	if topics, err = listTopics(ctx, ds.httpToReader, ds.forumURL(groupName), startDate); err != nil {
+		return
+	}
+	log.Printf("%d discourse topics active since %s on %s.", len(topics), startDate.Format("2006-01-02"), groupName)
+	ds.topics[groupName] = &groupTopics{since: startDate, topics: topics}
+	return
+}
+
+// Topic with every post, loaded once per source.
+func (ds *discourseSource) loadTopicPosts(ctx context.Context, groupName string, topicID int) (topic apiTopicPosts, err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	key := topicKey{groupName: groupName, topicID: topicID}
+	if loaded, ok := ds.topicPosts[key]; ok {
+		return loaded, nil
+	}
+	if topic, err = getTopicPosts(ctx, ds.httpToReader, ds.forumURL(groupName), topicID); err != nil {
+		return
+	}
+	ds.topicPosts[key] = topic
+	return
+}
+
+// Topics created before the end of the month and still active in it.
+func topicsInMonth(topics []apiTopic, month time.Time) (inMonth []apiTopic) {
+	monthEnd := utils.AddMonth(month)
+	for _, topic := range topics {
+		if topic.CreatedAt.Before(monthEnd) && !topic.activeUntil().Before(month) {
+			inMonth = append(inMonth, topic)
+		}
+	}
+	return
+}
+
+// Months in the range with topic activity.
+func (ds *discourseSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var topics []apiTopic
+
+	monthRange := source.MonthRange(startDate, endDate)
+	if len(monthRange) == 0 {
+		return
+	}
+	if topics, err = ds.activeTopics(ctx, groupName, monthRange[0]); err != nil {
+		return
+	}
+	for _, month := range monthRange {
+		if len(topicsInMonth(topics, month)) > 0 {
+			months = append(months, month)
+		}
+	}
+	return
+}
+
+// Message-ID for the post in the topic.
+func messageID(groupName string, topicID, postNumber int) string {
+	return fmt.Sprintf("<%d.%d@%s>", topicID, postNumber, groupName)
+}
+
+// Write the post as an mboxrd entry with the markdown as the body. Lines that start with From after any > get one more >.
+func writePostMessage(w io.Writer, forumURL, groupName string, tp topicPost, markdown string) (err error) {
+	var sb strings.Builder
+
+	post := tp.post
+	sender := mail.Address{Name: post.Name, Address: post.Username + "@" + groupName}
+	if sender.Name == "" {
+		sender.Name = post.Username
+	}
+	subject := tp.topic.Title
+	if post.PostNumber > 1 {
+		subject = "Re: " + subject
+	}
+
+	fromLine := fmt.Sprintf("From %s %s", sender.Address, post.CreatedAt.UTC().Format(time.ANSIC))
+	fmt.Fprintf(&sb, "From: %s\n", sender.String())
+	fmt.Fprintf(&sb, "Date: %s\n", post.CreatedAt.UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&sb, "Message-ID: %s\n", messageID(groupName, post.TopicID, post.PostNumber))
+	if post.PostNumber > 1 {
+		replyTo := post.ReplyToPostNumber
+		if replyTo == 0 {
+			replyTo = 1
+		}
+		references := messageID(groupName, post.TopicID, 1)
+		if replyTo != 1 {
+			references += " " + messageID(groupName, post.TopicID, replyTo)
+		}
+		fmt.Fprintf(&sb, "In-Reply-To: %s\n", messageID(groupName, post.TopicID, replyTo))
+		fmt.Fprintf(&sb, "References: %s\n", references)
+	}
+	fmt.Fprintf(&sb, "Archived-At: <%s/t/%s/%d/%d>\n", forumURL, tp.topic.Slug, post.TopicID, post.PostNumber)
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+
+	sb.WriteString(strings.ReplaceAll(markdown, "\r\n", "\n"))
+	return utils.WriteMboxEntry(w, fromLine, sb.String())
+}
+
+// Posts created in the month from the topics active in it, in creation order.
+func (ds *discourseSource) monthPosts(ctx context.Context, groupName string, month time.Time) (posts []topicPost, err error) {
+	var (
+		topics []apiTopic
+		topic  apiTopicPosts
+	)
+
+	monthEnd := utils.AddMonth(month)
+	if topics, err = ds.activeTopics(ctx, groupName, month); err != nil {
+		return
+	}
+	for _, active := range topicsInMonth(topics, month) {
+		if topic, err = ds.loadTopicPosts(ctx, groupName, active.ID); err != nil {
+			return
+		}
+		for _, post := range topic.PostStream.Posts {
+			if !post.CreatedAt.Before(month) && post.CreatedAt.Before(monthEnd) {
+				post.TopicID = topic.ID
+				posts = append(posts, topicPost{topic: topic, post: post})
+			}
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool { return posts[i].post.CreatedAt.Before(posts[j].post.CreatedAt) })
+	return
+}
+
+// Get the markdown of each post and write the gzipped mbox to the stream.
+func (ds *discourseSource) writeMonthMbox(ctx context.Context, w io.Writer, groupName string, posts []topicPost) (err error) {
+	var markdown string
+	gz := gzip.NewWriter(w)
+	forumURL := ds.forumURL(groupName)
+
+	for _, tp := range posts {
+		if markdown, err = getRaw(ctx, ds.httpToReader, forumURL, tp.topic.ID, tp.post.PostNumber); err != nil {
+			return
+		}
+		if err = writePostMessage(gz, forumURL, groupName, tp, markdown); err != nil {
+			return
+		}
+	}
+	return gz.Close()
+}
+
+// Store the posts created in the month. Months without posts are not stored. With refresh never, a month already
+// stored is skipped before its topics are requested.
+func (ds *discourseSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		posts  []topicPost
+		exists bool
+	)
+
+	fileName := month.Format("2006-01") + ".mbox.gz"
+	if mode, _ := storage.Refresh(); mode == gcs.RefreshNever {
+		if _, exists, err = storage.Stat(ctx, fileName); err != nil {
+			return fmt.Errorf("%w: %v", storageErr, err)
+		}
+		if exists {
+			log.Printf("Discourse posts for %s in %s already stored.", groupName, month.Format("2006-01"))
+			return
+		}
+	}
+	if posts, err = ds.monthPosts(ctx, groupName, month); err != nil {
+		return
+	}
+	if len(posts) == 0 {
+		log.Printf("No discourse posts for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   ds.forumURL(groupName) + "/latest",
+		MailingList: "discourse",
+		GroupName:   groupName,
+		StartDate:   month.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(month).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+	}
+	_, err = utils.StoreWriter(ctx, storage, fileName, meta, func(w io.Writer) error {
+		return ds.writeMonthMbox(ctx, w, groupName, posts)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Stored %d discourse posts for %s in %s.", len(posts), groupName, month.Format("2006-01"))
+	return
+}
@@ -0,0 +1,307 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discourse
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+)
+
+const testGroup = "forum.nimiipuu.org"
+
+var (
+	topicPath = regexp.MustCompile(`^/t/([0-9]+)\.json$`)
+	postsPath = regexp.MustCompile(`^/t/([0-9]+)/posts\.json$`)
+	rawPath   = regexp.MustCompile(`^/raw/([0-9]+)/([0-9]+)$`)
+)
+
+// Forum serving the recorded responses in testdata. The first request for a rate limited path answers 429.
+type fakeForum struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	requests    map[string]int
+	rateLimited map[string]bool
+}
+
+func newFakeForum(rateLimited ...string) *fakeForum {
+	forum := &fakeForum{requests: make(map[string]int), rateLimited: make(map[string]bool)}
+	for _, path := range rateLimited {
+		forum.rateLimited[path] = true
+	}
+	forum.server = httptest.NewServer(http.HandlerFunc(forum.serve))
+	return forum
+}
+
+func (forum *fakeForum) serve(w http.ResponseWriter, r *http.Request) {
+	var fixture string
+
+	forum.mu.Lock()
+	forum.requests[r.URL.Path]++
+	firstRequest := forum.requests[r.URL.Path] == 1
+	forum.mu.Unlock()
+	if forum.rateLimited[r.URL.Path] && firstRequest {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/latest.json":
+		fixture = "latest_page" + r.URL.Query().Get("page") + ".json"
+	case topicPath.MatchString(r.URL.Path):
+		fixture = "topic_" + topicPath.FindStringSubmatch(r.URL.Path)[1] + ".json"
+	case postsPath.MatchString(r.URL.Path):
+		fixture = "topic_" + postsPath.FindStringSubmatch(r.URL.Path)[1] + "_posts.json"
+	case rawPath.MatchString(r.URL.Path):
+		match := rawPath.FindStringSubmatch(r.URL.Path)
+		fixture = "raw_" + match[1] + "_" + match[2] + ".md"
+	}
+	content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if fixture == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content)
+}
+
+func TestMonths(t *testing.T) {
+	forum := newFakeForum()
+	defer forum.server.Close()
+	src, _ := source.New("discourse", source.Config{BaseURL: forum.server.URL, Groups: []string{testGroup}})
+
+	gotMonths, err := src.Months(context.Background(), testGroup, time.Date(1877, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(1877, 10, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wantMonths := []time.Time{time.Date(1877, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(1877, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(1877, 8, 1, 0, 0, 0, 0, time.UTC)}
+	if !reflect.DeepEqual(gotMonths, wantMonths) {
+		t.Errorf("Months don't match.\n got: %v\nwant: %v", gotMonths, wantMonths)
+	}
+	// The second page ends with a topic active before the start so the third is never asked for
+	forum.mu.Lock()
+	defer forum.mu.Unlock()
+	if forum.requests["/latest.json"] != 2 {
+		t.Errorf("Latest pages requested %d times, want 2.", forum.requests["/latest.json"])
+	}
+}
+
+func TestWritePostMessage(t *testing.T) {
+	topic := apiTopicPosts{ID: 203, Title: "Crossing the Bitterroots", Slug: "crossing-the-bitterroots"}
+	tests := []struct {
+		comparisonType string
+		post           apiPost
+		markdown       string
+		wantMessage    string
+	}{
+		{
+			comparisonType: "First post of the topic",
+			post:           apiPost{Name: "Hinmatóowyalahtq̓it", Username: "joseph", CreatedAt: time.Date(1877, 7, 20, 15, 0, 0, 0, time.UTC), PostNumber: 1, TopicID: 203},
+			markdown:       "From the mountains we go.\r\n",
+			wantMessage: "From joseph@forum.nimiipuu.org Fri Jul 20 15:00:00 1877\n" +
+				"From: =?utf-8?q?Hinmat=C3=B3owyalahtq=CC=93it?= <joseph@forum.nimiipuu.org>\n" +
+				"Date: Fri, 20 Jul 1877 15:00:00 +0000\n" +
+				"Subject: Crossing the Bitterroots\n" +
+				"Message-ID: <203.1@forum.nimiipuu.org>\n" +
+				"Archived-At: <https://forum.nimiipuu.org/t/crossing-the-bitterroots/203/1>\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				">From the mountains we go.\n\n",
+		},
+		{
+			comparisonType: "Reply to a later post",
+			post:           apiPost{Username: "lookingglass", CreatedAt: time.Date(1877, 8, 2, 18, 30, 0, 0, time.UTC), PostNumber: 3, ReplyToPostNumber: 2, TopicID: 203},
+			markdown:       "We can rest at the **Big Hole**.",
+			wantMessage: "From lookingglass@forum.nimiipuu.org Thu Aug  2 18:30:00 1877\n" +
+				"From: \"lookingglass\" <lookingglass@forum.nimiipuu.org>\n" +
+				"Date: Thu, 02 Aug 1877 18:30:00 +0000\n" +
+				"Subject: Re: Crossing the Bitterroots\n" +
+				"Message-ID: <203.3@forum.nimiipuu.org>\n" +
+				"In-Reply-To: <203.2@forum.nimiipuu.org>\n" +
+				"References: <203.1@forum.nimiipuu.org> <203.2@forum.nimiipuu.org>\n" +
+				"Archived-At: <https://forum.nimiipuu.org/t/crossing-the-bitterroots/203/3>\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				"We can rest at the **Big Hole**.\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var sb strings.Builder
+			if err := writePostMessage(&sb, "https://"+testGroup, testGroup, topicPost{topic: topic, post: test.post}, test.markdown); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sb.String() != test.wantMessage {
+				t.Errorf("Message doesn't match.\n got: %q\nwant: %q", sb.String(), test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	forum := newFakeForum("/raw/202/2")
+	defer forum.server.Close()
+	rootDir, err := ioutil.TempDir("", "discourse")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	src, _ := source.New("discourse", source.Config{BaseURL: forum.server.URL, Groups: []string{testGroup}})
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "discourse-nimiipuu"}
+
+	tests := []struct {
+		comparisonType string
+		month          time.Time
+		wantHeaders    []string
+	}{
+		{
+			comparisonType: "Posts from two topics in creation order after a rate limited request",
+			month:          time.Date(1877, 7, 1, 0, 0, 0, 0, time.UTC),
+			wantHeaders: []string{
+				"From whitebird@forum.nimiipuu.org Sun Jul  1 09:15:00 1877", "Message-ID: <202.2@forum.nimiipuu.org>", "In-Reply-To: <202.1@forum.nimiipuu.org>",
+				"From joseph@forum.nimiipuu.org Fri Jul 20 15:00:00 1877", "Message-ID: <203.1@forum.nimiipuu.org>", ">From the mountains we go east to the buffalo country.",
+				"From ollokot@forum.nimiipuu.org Sat Jul 21 08:00:00 1877", "Message-ID: <203.2@forum.nimiipuu.org>", "In-Reply-To: <203.1@forum.nimiipuu.org>",
+			},
+		},
+		{
+			comparisonType: "Post loaded from the rest of the stream",
+			month:          time.Date(1877, 8, 1, 0, 0, 0, 0, time.UTC),
+			wantHeaders: []string{
+				"From lookingglass@forum.nimiipuu.org Thu Aug  2 18:30:00 1877", "Message-ID: <203.3@forum.nimiipuu.org>", "In-Reply-To: <203.2@forum.nimiipuu.org>",
+			},
+		},
+		{
+			comparisonType: "Month without posts not stored",
+			month:          time.Date(1877, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, testGroup, test.month); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+
+			fileName := filepath.Join(rootDir, "discourse-nimiipuu", test.month.Format("2006-01")+"-discourse-nimiipuu.mbox.gz")
+			stored, openErr := os.Open(fileName)
+			if test.wantHeaders == nil {
+				if openErr == nil {
+					stored.Close()
+					t.Errorf("Empty month stored at %s", fileName)
+				}
+				return
+			}
+			if openErr != nil {
+				t.Fatalf("Stored month missing: %v", openErr)
+			}
+			defer stored.Close()
+			gz, gzErr := gzip.NewReader(stored)
+			if gzErr != nil {
+				t.Fatalf("Stored month not gzipped: %v", gzErr)
+			}
+			mbox, _ := ioutil.ReadAll(gz)
+
+			var gotHeaders []string
+			for _, line := range strings.Split(string(mbox), "\n") {
+				for _, prefix := range []string{"From ", ">From ", "Message-ID: ", "In-Reply-To: "} {
+					if strings.HasPrefix(line, prefix) {
+						gotHeaders = append(gotHeaders, line)
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotHeaders, test.wantHeaders) {
+				t.Errorf("Headers don't match.\n got: %q\nwant: %q", gotHeaders, test.wantHeaders)
+			}
+		})
+	}
+	// Topic 203 has posts in July and August but is only requested once
+	forum.mu.Lock()
+	defer forum.mu.Unlock()
+	if forum.requests["/t/203.json"] != 1 {
+		t.Errorf("Topic 203 requested %d times, want 1.", forum.requests["/t/203.json"])
+	}
+}
+
+// Requests made to the forum for paths starting with the prefix.
+func (forum *fakeForum) requested(prefix string) (count int) {
+	forum.mu.Lock()
+	defer forum.mu.Unlock()
+	for path, n := range forum.requests {
+		if strings.HasPrefix(path, prefix) {
+			count += n
+		}
+	}
+	return
+}
+
+func TestFetchMonthStored(t *testing.T) {
+	ctx := context.Background()
+	forum := newFakeForum()
+	defer forum.server.Close()
+	rootDir, err := ioutil.TempDir("", "discourse")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	src, _ := source.New("discourse", source.Config{BaseURL: forum.server.URL, Groups: []string{testGroup}})
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "discourse-nimiipuu"}
+	july := time.Date(1877, 7, 1, 0, 0, 0, 0, time.UTC)
+	if err = src.FetchMonth(ctx, storage, testGroup, july); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType    string
+		refresh           gcs.RefreshMode
+		wantTopicRequests int
+		wantRawRequests   int
+	}{
+		{
+			comparisonType: "Stored month skipped without a request under never",
+			refresh:        gcs.RefreshNever,
+		},
+		{
+			comparisonType:  "Stored month rewritten from the topics already loaded under always",
+			refresh:         gcs.RefreshAlways,
+			wantRawRequests: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			topicRequests, rawRequests := forum.requested("/t/"), forum.requested("/raw/")
+			storage.SetRefresh(test.refresh, false)
+			if gotErr := src.FetchMonth(ctx, storage, testGroup, july); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+			if got := forum.requested("/t/") - topicRequests; got != test.wantTopicRequests {
+				t.Errorf("Topic requests don't match.\n got: %v\nwant: %v", got, test.wantTopicRequests)
+			}
+			if got := forum.requested("/raw/") - rawRequests; got != test.wantRawRequests {
+				t.Errorf("Raw requests don't match.\n got: %v\nwant: %v", got, test.wantRawRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+/*
+Read issues, issue comments and discussions through the GitHub REST and GraphQL APIs.
+
+Issues and pull requests updated on or after a date in creation order, with a Link header while there are more pages:
+[API URL]/repos/[OWNER]/[REPO]/issues?state=all&since=[DATE]&sort=created&direction=asc&per_page=100
+Issue and pull request comments updated on or after a date in creation order:
+[API URL]/repos/[OWNER]/[REPO]/issues/comments?since=[DATE]&sort=created&direction=asc&per_page=100
+Discussions by latest update with their comments and replies, posted as a GraphQL query, and the comments of a
+discussion or replies to a comment past the first page by node id:
+[GRAPHQL URL]
+
+GraphQL queries may ask for at most 500,000 nodes, counting every page size times the page sizes it is nested in, so
+discussions come 10 at a time with the first 100 comments and the first 100 replies to each.
+
+GitHub answers 429, or 403 with Retry-After, when requests come too fast and 403 with X-RateLimit-Remaining 0 when the
+hourly limit is used up until X-RateLimit-Reset.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	apiErr     = errors.New("github api")
+	graphqlErr = errors.New("github graphql")
+	nextLink   = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+)
+
+const (
+	// Rate limited requests are tried again this many times
+	maxRetries = 5
+	// Wait when a rate limited response doesn't say how long
+	retryFallback = 60 * time.Second
+	// Discussions asked for in each GraphQL page. Each brings up to 100 comments with 100 replies each.
+	discussionPage = 10
+)
+
+type apiUser struct {
+	Login string `json:"login"`
+}
+
+type apiIssue struct {
+	Number    int       `json:"number"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	HTMLURL   string    `json:"html_url"`
+	User      *apiUser  `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	// Set for pull requests, which the issues API lists with the issues
+	PullRequest *struct{} `json:"pull_request"`
+}
+
+type apiIssueComment struct {
+	ID        int64     `json:"id"`
+	Body      string    `json:"body"`
+	HTMLURL   string    `json:"html_url"`
+	User      *apiUser  `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	IssueURL  string    `json:"issue_url"`
+}
+
+type gqlPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+// Page of comments on a discussion or replies to a comment
+type gqlComments struct {
+	PageInfo gqlPageInfo  `json:"pageInfo"`
+	Nodes    []gqlComment `json:"nodes"`
+}
+
+type gqlComment struct {
+	ID         string    `json:"id"`
+	DatabaseID int64     `json:"databaseId"`
+	Body       string    `json:"body"`
+	URL        string    `json:"url"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Author     *apiUser  `json:"author"`
+	// Only comments on the discussion have replies
+	Replies gqlComments `json:"replies"`
+}
+
+type gqlDiscussion struct {
+	ID        string      `json:"id"`
+	Number    int         `json:"number"`
+	Title     string      `json:"title"`
+	Body      string      `json:"body"`
+	URL       string      `json:"url"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	Author    *apiUser    `json:"author"`
+	Comments  gqlComments `json:"comments"`
+}
+
+type gqlDiscussions struct {
+	Data struct {
+		Repository struct {
+			Discussions struct {
+				PageInfo gqlPageInfo     `json:"pageInfo"`
+				Nodes    []gqlDiscussion `json:"nodes"`
+			} `json:"discussions"`
+		} `json:"repository"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// Next page of comments or replies of a node, which the queries name items
+type gqlNodeItems struct {
+	Data struct {
+		Node struct {
+			Items gqlComments `json:"items"`
+		} `json:"node"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+const discussionsQuery = `query($owner: String!, $name: String!, $first: Int!, $after: String) {
+  repository(owner: $owner, name: $name) {
+    discussions(first: $first, after: $after, orderBy: {field: UPDATED_AT, direction: DESC}) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        id number title body url createdAt updatedAt
+        author { login }
+        comments(first: 100) {
+          pageInfo { hasNextPage endCursor }
+          nodes {
+            id databaseId body url createdAt
+            author { login }
+            replies(first: 100) {
+              pageInfo { hasNextPage endCursor }
+              nodes { id databaseId body url createdAt author { login } }
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+const commentsQuery = `query($id: ID!, $after: String) {
+  node(id: $id) {
+    ... on Discussion {
+      items: comments(first: 100, after: $after) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          id databaseId body url createdAt
+          author { login }
+          replies(first: 100) {
+            pageInfo { hasNextPage endCursor }
+            nodes { id databaseId body url createdAt author { login } }
+          }
+        }
+      }
+    }
+  }
+}`
+
+const repliesQuery = `query($id: ID!, $after: String) {
+  node(id: $id) {
+    ... on DiscussionComment {
+      items: replies(first: 100, after: $after) {
+        pageInfo { hasNextPage endCursor }
+        nodes { id databaseId body url createdAt author { login } }
+      }
+    }
+  }
+}`
+
+// Login of the user or ghost for deleted accounts, which the API returns as null.
+func login(user *apiUser) string {
+	if user == nil || user.Login == "" {
+		return "ghost"
+	}
+	return user.Login
+}
+
+// Issue number from the issue url of a comment. Zero when the url doesn't end in a number.
+func (comment apiIssueComment) issueNumber() int {
+	number, _ := strconv.Atoi(comment.IssueURL[strings.LastIndex(comment.IssueURL, "/")+1:])
+	return number
+}
+
+// How long to wait before trying a limited request again. Secondary limits say how long in Retry-After and the hourly
+// limit says when it resets in X-RateLimit-Reset.
+func rateLimitWait(header http.Header) (wait time.Duration, limited bool) {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return retryFallback, true
+	}
+	if wait = time.Until(time.Unix(reset, 0)); wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// Wait for the limit to pass or the context to end.
+func waitLimit(ctx context.Context, apiURL string, wait time.Duration) error {
+	log.Printf("GitHub rate limited %s so waiting %v.", apiURL, wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// Headers for API requests with the token when there is one.
+func requestHeader(token string) http.Header {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header
+}
+
+// Get the url and try again after the wait GitHub asks for while it limits requests. Returns the next page url from
+// the Link header, which is empty on the last page.
+func get(ctx context.Context, httpToReader utils.HttpReaderResponse, token, apiURL string) (body io.ReadCloser, next string, err error) {
+	var header http.Header
+
+	for attempt := 0; ; attempt++ {
+		body, header, err = httpToReader(apiURL, requestHeader(token))
+		wait, limited := utils.RetryAfter(err, header, retryFallback)
+		if !limited && err != nil {
+			wait, limited = rateLimitWait(header)
+		}
+		if !limited || attempt == maxRetries {
+			break
+		}
+		if err = waitLimit(ctx, apiURL, wait); err != nil {
+			return nil, "", err
+		}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%w get on %s: %v", apiErr, apiURL, err)
+	}
+	if match := nextLink.FindStringSubmatch(header.Get("Link")); match != nil {
+		next = match[1]
+	}
+	return
+}
+
+// Get every page from the url and hand each body to decode.
+func getPages(ctx context.Context, httpToReader utils.HttpReaderResponse, token, apiURL string, decode func(body io.Reader) error) (err error) {
+	var body io.ReadCloser
+
+	for apiURL != "" {
+		pageURL := apiURL
+		if body, apiURL, err = get(ctx, httpToReader, token, pageURL); err != nil {
+			return
+		}
+		err = decode(body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("%w decode on %s: %v", apiErr, pageURL, err)
+		}
+	}
+	return
+}
+
+// Query values for the lists of issues and comments updated on or after the date in creation order.
+func listQuery(since time.Time) string {
+	query := url.Values{}
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	query.Set("sort", "created")
+	query.Set("direction", "asc")
+	query.Set("per_page", "100")
+	return query.Encode()
+}
+
+// Issues and pull requests updated on or after the date.
+func listIssues(ctx context.Context, httpToReader utils.HttpReaderResponse, token, repoURL string, since time.Time) (issues []apiIssue, err error) {
+	err = getPages(ctx, httpToReader, token, repoURL+"/issues?state=all&"+listQuery(since), func(body io.Reader) error {
+		var page []apiIssue
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		issues = append(issues, page...)
+		return nil
+	})
+	return
+}
+
+// Issue and pull request comments updated on or after the date.
+func listIssueComments(ctx context.Context, httpToReader utils.HttpReaderResponse, token, repoURL string, since time.Time) (comments []apiIssueComment, err error) {
+	err = getPages(ctx, httpToReader, token, repoURL+"/issues/comments?"+listQuery(since), func(body io.Reader) error {
+		var page []apiIssueComment
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		comments = append(comments, page...)
+		return nil
+	})
+	return
+}
+
+// Post the query and decode the response, trying again after the wait GitHub asks for while it limits requests. Posts
+// go through the source rate limit like gets.
+func postGraphQL(ctx context.Context, httpPostToReader utils.HttpPostResponse, token, graphqlURL string, query map[string]interface{}, value interface{}) (err error) {
+	var (
+		payload []byte
+		body    io.ReadCloser
+		header  http.Header
+	)
+
+	if payload, err = json.Marshal(query); err != nil {
+		return fmt.Errorf("%w encode: %v", graphqlErr, err)
+	}
+	postHeader := requestHeader(token)
+	postHeader.Set("Content-Type", "application/json")
+	for attempt := 0; ; attempt++ {
+		body, header, err = httpPostToReader(graphqlURL, postHeader, payload)
+		wait, limited := utils.RetryAfter(err, header, retryFallback)
+		if !limited && err != nil {
+			wait, limited = rateLimitWait(header)
+		}
+		if !limited || attempt == maxRetries {
+			break
+		}
+		if err = waitLimit(ctx, graphqlURL, wait); err != nil {
+			return
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w post on %s: %v", graphqlErr, graphqlURL, err)
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(value); err != nil {
+		return fmt.Errorf("%w decode on %s: %v", graphqlErr, graphqlURL, err)
+	}
+	return
+}
+
+// Comments of a discussion or replies to a comment from the first page and the pages after it, asked for by node id
+// with the query.
+func listItems(ctx context.Context, httpPostToReader utils.HttpPostResponse, token, graphqlURL, query, nodeID string, first gqlComments) (items []gqlComment, err error) {
+	items = first.Nodes
+	for pageInfo := first.PageInfo; pageInfo.HasNextPage; {
+		var page gqlNodeItems
+		variables := map[string]interface{}{"id": nodeID, "after": pageInfo.EndCursor}
+		if err = postGraphQL(ctx, httpPostToReader, token, graphqlURL, map[string]interface{}{"query": query, "variables": variables}, &page); err != nil {
+			return
+		}
+		if len(page.Errors) > 0 {
+			return nil, fmt.Errorf("%w query for %s: %s", graphqlErr, nodeID, page.Errors[0].Message)
+		}
+		items = append(items, page.Data.Node.Items.Nodes...)
+		pageInfo = page.Data.Node.Items.PageInfo
+	}
+	return
+}
+
+// Discussions updated on or after the date with all their comments and replies. Pages come by latest update and are
+// read until a discussion was last updated before the date. Comments and replies past the first 100 are asked for a
+// page at a time.
+func listDiscussions(ctx context.Context, httpPostToReader utils.HttpPostResponse, token, graphqlURL, owner, repo string, since time.Time) (discussions []gqlDiscussion, err error) {
+	var after interface{}
+
+	for {
+		var page gqlDiscussions
+		variables := map[string]interface{}{"owner": owner, "name": repo, "first": discussionPage, "after": after}
+		if err = postGraphQL(ctx, httpPostToReader, token, graphqlURL, map[string]interface{}{"query": discussionsQuery, "variables": variables}, &page); err != nil {
+			return
+		}
+		if len(page.Errors) > 0 {
+			return nil, fmt.Errorf("%w query for %s/%s: %s", graphqlErr, owner, repo, page.Errors[0].Message)
+		}
+		result := page.Data.Repository.Discussions
+		for _, discussion := range result.Nodes {
+			if discussion.UpdatedAt.Before(since) {
+				return
+			}
+			if discussion.Comments.Nodes, err = listItems(ctx, httpPostToReader, token, graphqlURL, commentsQuery, discussion.ID, discussion.Comments); err != nil {
+				return
+			}
+			for i, comment := range discussion.Comments.Nodes {
+				if discussion.Comments.Nodes[i].Replies.Nodes, err = listItems(ctx, httpPostToReader, token, graphqlURL, repliesQuery, comment.ID, comment.Replies); err != nil {
+					return
+				}
+			}
+			discussions = append(discussions, discussion)
+		}
+		if !result.PageInfo.HasNextPage {
+			return
+		}
+		after = result.PageInfo.EndCursor
+	}
+}
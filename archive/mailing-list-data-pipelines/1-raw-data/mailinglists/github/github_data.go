@@ -0,0 +1,393 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load the issue threads and discussions of a GitHub repository as if they were a mailing list.
+
+Groups are repositories as [OWNER]/[REPO], or [REPO] with Org as the owner. BaseURL is the API url and defaults to
+https://api.github.com, or use https://[HOST]/api/v3 for GitHub Enterprise. The token comes from GITHUB_TOKEN and
+raises the hourly request limit. Discussions are only in the GraphQL API, which needs the token, so they are skipped
+without one. Pull requests and their comments are left out since review traffic isn't list traffic.
+
+Each issue, discussion, comment and reply becomes an RFC 5322 style message with its markdown as the body and ids in the
+form GitHub uses for its notification emails:
+<[OWNER]/[REPO]/issues/[NUMBER]@[HOST]> for an issue and <[OWNER]/[REPO]/issues/[NUMBER]/[COMMENT ID]@[HOST]> for a comment
+<[OWNER]/[REPO]/discussions/[NUMBER]@[HOST]> for a discussion and <[OWNER]/[REPO]/discussions/[NUMBER]/[COMMENT ID]@[HOST]> for a comment or reply
+Comments reply to their issue or discussion and replies to their comment, with References from the thread start, so
+reply graphs can be built the same way as for lists. GitHub doesn't publish addresses so senders get the
+[LOGIN]@users.noreply.[HOST] address GitHub uses for commits. Messages are stored by the month they were created as
+[YEAR]-[MONTH].mbox.gz, under github-[OWNER]_[REPO] unless the subdirectory is set.
+*/
+
+package github
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr = errors.New("Storage failed")
+	baseURLErr = errors.New("base url")
+	repoErr    = errors.New("github repository")
+)
+
+const defaultAPIURL = "https://api.github.com"
+
+func init() {
+	source.Register("github", NewSource)
+}
+
+// GitHub version of the mailing list source
+type githubSource struct {
+	apiURL       string
+	graphqlURL   string
+	host         string
+	owner        string
+	groups       []string
+	token        string
+	httpToReader utils.HttpReaderResponse
+	// GraphQL queries are posts
+	httpPostToReader utils.HttpPostResponse
+	mu               sync.Mutex
+	// Messages created since the start of the load by group, listed once per source
+	activity map[string]*groupActivity
+}
+
+type groupActivity struct {
+	since time.Time
+	// Messages by year-month
+	months map[string][]threadMessage
+}
+
+// Issue, discussion, comment or reply with its place in the thread
+type threadMessage struct {
+	messageID string
+	// Empty for the message that starts the thread
+	inReplyTo  string
+	references []string
+	login      string
+	createdAt  time.Time
+	subject    string
+	body       string
+	url        string
+}
+
+// Create the GitHub source. BaseURL defaults to the github.com API and Org is the owner for groups without one.
+func NewSource(config source.Config) (source.Source, error) {
+	apiURL := strings.TrimRight(config.BaseURL, "/")
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	parsed, err := url.Parse(apiURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%w %q is not a GitHub API url", baseURLErr, config.BaseURL)
+	}
+	graphqlURL := apiURL + "/graphql"
+	if strings.HasSuffix(apiURL, "/api/v3") {
+		graphqlURL = strings.TrimSuffix(apiURL, "/v3") + "/graphql"
+	}
+	return &githubSource{
+		apiURL:           apiURL,
+		graphqlURL:       graphqlURL,
+		host:             strings.TrimPrefix(parsed.Hostname(), "api."),
+		owner:            strings.Trim(config.Org, "/"),
+		groups:           config.Groups,
+		token:            os.Getenv("GITHUB_TOKEN"),
+		httpToReader:     config.HttpToReader,
+		httpPostToReader: config.HttpPostToReader,
+		activity:         make(map[string]*groupActivity),
+	}, nil
+}
+
+func (gs *githubSource) Name() string {
+	return "github"
+}
+
+// Repositories can't be discovered so only the configured groups are loaded.
+func (gs *githubSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	return gs.groups, nil
+}
+
+// Owner and repository of the group.
+func (gs *githubSource) repository(groupName string) (owner, repo string, err error) {
+	owner, repo = gs.owner, groupName
+	if parts := strings.Split(groupName, "/"); len(parts) == 2 {
+		owner, repo = parts[0], parts[1]
+	}
+	if owner == "" || repo == "" || strings.Contains(repo, "/") {
+		return "", "", fmt.Errorf("%w %q needs to be [OWNER]/[REPO] or set org to the owner", repoErr, groupName)
+	}
+	return
+}
+
+// Message-ID for the issue or discussion thread, or a comment in it when the comment id isn't zero.
+func (gs *githubSource) messageID(owner, repo, kind string, number int, commentID int64) string {
+	if commentID == 0 {
+		return fmt.Sprintf("<%s/%s/%s/%d@%s>", owner, repo, kind, number, gs.host)
+	}
+	return fmt.Sprintf("<%s/%s/%s/%d/%d@%s>", owner, repo, kind, number, commentID, gs.host)
+}
+
+// Issues and their comments created on or after the start date. Pull requests and their comments are skipped.
+func (gs *githubSource) issueMessages(ctx context.Context, owner, repo string, since time.Time) (messages []threadMessage, err error) {
+	var (
+		issues   []apiIssue
+		comments []apiIssueComment
+	)
+
+	repoURL := fmt.Sprintf("%s/repos/%s/%s", gs.apiURL, owner, repo)
+	if issues, err = listIssues(ctx, gs.httpToReader, gs.token, repoURL, since); err != nil {
+		return
+	}
+	// Commenting updates the issue so every comment since the start belongs to a listed issue
+	byNumber := make(map[int]apiIssue)
+	for _, issue := range issues {
+		byNumber[issue.Number] = issue
+		if issue.PullRequest != nil || issue.CreatedAt.Before(since) {
+			continue
+		}
+		messages = append(messages, threadMessage{
+			messageID: gs.messageID(owner, repo, "issues", issue.Number, 0),
+			login:     login(issue.User),
+			createdAt: issue.CreatedAt,
+			subject:   issue.Title,
+			body:      issue.Body,
+			url:       issue.HTMLURL,
+		})
+	}
+
+	if comments, err = listIssueComments(ctx, gs.httpToReader, gs.token, repoURL, since); err != nil {
+		return
+	}
+	for _, comment := range comments {
+		issue, ok := byNumber[comment.issueNumber()]
+		if !ok {
+			log.Printf("Skipping comment %d because its issue %s wasn't listed.", comment.ID, comment.IssueURL)
+			continue
+		}
+		if issue.PullRequest != nil || comment.CreatedAt.Before(since) {
+			continue
+		}
+		root := gs.messageID(owner, repo, "issues", issue.Number, 0)
+		messages = append(messages, threadMessage{
+			messageID:  gs.messageID(owner, repo, "issues", issue.Number, comment.ID),
+			inReplyTo:  root,
+			references: []string{root},
+			login:      login(comment.User),
+			createdAt:  comment.CreatedAt,
+			subject:    "Re: " + issue.Title,
+			body:       comment.Body,
+			url:        comment.HTMLURL,
+		})
+	}
+	return
+}
+
+// Discussions, comments and replies created on or after the start date.
+func (gs *githubSource) discussionMessages(ctx context.Context, owner, repo string, since time.Time) (messages []threadMessage, err error) {
+	var discussions []gqlDiscussion
+
+	if discussions, err = listDiscussions(ctx, gs.httpPostToReader, gs.token, gs.graphqlURL, owner, repo, since); err != nil {
+		return
+	}
+	add := func(message threadMessage) {
+		if !message.createdAt.Before(since) {
+			messages = append(messages, message)
+		}
+	}
+	for _, discussion := range discussions {
+		root := gs.messageID(owner, repo, "discussions", discussion.Number, 0)
+		subject := "Re: " + discussion.Title
+		add(threadMessage{
+			messageID: root,
+			login:     login(discussion.Author),
+			createdAt: discussion.CreatedAt,
+			subject:   discussion.Title,
+			body:      discussion.Body,
+			url:       discussion.URL,
+		})
+		for _, comment := range discussion.Comments.Nodes {
+			commentID := gs.messageID(owner, repo, "discussions", discussion.Number, comment.DatabaseID)
+			add(threadMessage{
+				messageID:  commentID,
+				inReplyTo:  root,
+				references: []string{root},
+				login:      login(comment.Author),
+				createdAt:  comment.CreatedAt,
+				subject:    subject,
+				body:       comment.Body,
+				url:        comment.URL,
+			})
+			for _, reply := range comment.Replies.Nodes {
+				add(threadMessage{
+					messageID:  gs.messageID(owner, repo, "discussions", discussion.Number, reply.DatabaseID),
+					inReplyTo:  commentID,
+					references: []string{root, commentID},
+					login:      login(reply.Author),
+					createdAt:  reply.CreatedAt,
+					subject:    subject,
+					body:       reply.Body,
+					url:        reply.URL,
+				})
+			}
+		}
+	}
+	return
+}
+
+// Messages created on or after the start date by year-month, listed once per group unless an earlier start date is
+// asked for.
+func (gs *githubSource) monthMessages(ctx context.Context, groupName string, startDate time.Time) (months map[string][]threadMessage, err error) {
+	var (
+		owner, repo string
+		messages    []threadMessage
+		discussions []threadMessage
+	)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if listed, ok := gs.activity[groupName]; ok && !startDate.Before(listed.since) {
+		return listed.months, nil
+	}
+	if owner, repo, err = gs.repository(groupName); err != nil {
+		return
+	}
+	if messages, err = gs.issueMessages(ctx, owner, repo, startDate); err != nil {
+		return
+	}
+	if gs.token == "" {
+		log.Printf("Skipping discussions on %s/%s because GITHUB_TOKEN isn't set.", owner, repo)
+	} else {
+		if discussions, err = gs.discussionMessages(ctx, owner, repo, startDate); err != nil {
+			return
+		}
+		messages = append(messages, discussions...)
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].createdAt.Before(messages[j].createdAt) })
+
+	months = make(map[string][]threadMessage)
+	for _, message := range messages {
+		yearMonth := message.createdAt.UTC().Format("2006-01")
+		months[yearMonth] = append(months[yearMonth], message)
+	}
+	log.Printf("%d github messages created since %s on %s/%s.", len(messages), startDate.Format("2006-01-02"), owner, repo)
+	gs.activity[groupName] = &groupActivity{since: startDate, months: months}
+	return
+}
+
+// Months in the range with messages.
+func (gs *githubSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var byMonth map[string][]threadMessage
+
+	monthRange := source.MonthRange(startDate, endDate)
+	if len(monthRange) == 0 {
+		return
+	}
+	if byMonth, err = gs.monthMessages(ctx, groupName, monthRange[0]); err != nil {
+		return
+	}
+	for _, month := range monthRange {
+		if len(byMonth[month.Format("2006-01")]) > 0 {
+			months = append(months, month)
+		}
+	}
+	return
+}
+
+// Write the message as an mboxrd entry with the markdown as the body. Lines that start with From after any > get one
+// more >.
+func (gs *githubSource) writeMessage(w io.Writer, message threadMessage) (err error) {
+	var sb strings.Builder
+
+	sender := mail.Address{Name: message.login, Address: message.login + "@users.noreply." + gs.host}
+	createdAt := message.createdAt.UTC()
+
+	fromLine := fmt.Sprintf("From %s %s", sender.Address, createdAt.Format(time.ANSIC))
+	fmt.Fprintf(&sb, "From: %s\n", sender.String())
+	fmt.Fprintf(&sb, "Date: %s\n", createdAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Subject: %s\n", mime.QEncoding.Encode("utf-8", message.subject))
+	fmt.Fprintf(&sb, "Message-ID: %s\n", message.messageID)
+	if message.inReplyTo != "" {
+		fmt.Fprintf(&sb, "In-Reply-To: %s\n", message.inReplyTo)
+		fmt.Fprintf(&sb, "References: %s\n", strings.Join(message.references, " "))
+	}
+	fmt.Fprintf(&sb, "Archived-At: <%s>\n", message.url)
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+
+	sb.WriteString(strings.ReplaceAll(message.body, "\r\n", "\n"))
+	return utils.WriteMboxEntry(w, fromLine, sb.String())
+}
+
+// Write the gzipped mbox to the stream.
+func (gs *githubSource) writeMonthMbox(w io.Writer, messages []threadMessage) (err error) {
+	gz := gzip.NewWriter(w)
+
+	for _, message := range messages {
+		if err = gs.writeMessage(gz, message); err != nil {
+			return
+		}
+	}
+	return gz.Close()
+}
+
+// Store the messages created in the month. Months without messages are not stored.
+func (gs *githubSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var byMonth map[string][]threadMessage
+
+	if byMonth, err = gs.monthMessages(ctx, groupName, month); err != nil {
+		return
+	}
+	messages := byMonth[month.Format("2006-01")]
+	if len(messages) == 0 {
+		log.Printf("No github messages for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	owner, repo, _ := gs.repository(groupName)
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   fmt.Sprintf("https://%s/%s/%s", gs.host, owner, repo),
+		MailingList: "github",
+		GroupName:   groupName,
+		StartDate:   month.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(month).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+	}
+	_, err = utils.StoreWriter(ctx, storage, month.Format("2006-01")+".mbox.gz", meta, func(w io.Writer) error {
+		return gs.writeMonthMbox(w, messages)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Stored %d github messages for %s in %s.", len(messages), groupName, month.Format("2006-01"))
+	return
+}
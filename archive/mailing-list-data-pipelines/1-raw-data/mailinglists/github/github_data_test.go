@@ -0,0 +1,363 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/config"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+)
+
+const (
+	testGroup = "oceti-sakowin/treaty-council"
+	repoPath  = "/repos/oceti-sakowin/treaty-council"
+)
+
+// API serving the recorded responses in testdata. The first request for a rate limited path is refused, comments with
+// the hourly limit used up and GraphQL with a secondary limit.
+type fakeAPI struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+	// Authorization header of the last request
+	authorization string
+}
+
+func newFakeAPI() *fakeAPI {
+	api := &fakeAPI{requests: make(map[string]int)}
+	api.server = httptest.NewServer(http.HandlerFunc(api.serve))
+	return api
+}
+
+func (api *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	var fixture string
+
+	api.mu.Lock()
+	api.requests[r.URL.Path]++
+	firstRequest := api.requests[r.URL.Path] == 1
+	api.authorization = r.Header.Get("Authorization")
+	api.mu.Unlock()
+
+	switch {
+	case r.URL.Path == repoPath+"/issues" && r.URL.Query().Get("page") == "":
+		fixture = "issues_page1.json"
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s/issues?page=2>; rel="next", <%s%s/issues?page=2>; rel="last"`, api.server.URL, repoPath, api.server.URL, repoPath))
+	case r.URL.Path == repoPath+"/issues":
+		fixture = "issues_page" + r.URL.Query().Get("page") + ".json"
+	case r.URL.Path == repoPath+"/issues/comments" && firstRequest:
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Unix()))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case r.URL.Path == repoPath+"/issues/comments":
+		fixture = "issue_comments.json"
+	case r.URL.Path == "/graphql" && firstRequest:
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case r.URL.Path == "/graphql" && r.Method == http.MethodPost:
+		var query struct {
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&query)
+		fixture = "discussions.json"
+		// Later pages of comments and replies are asked for by node id
+		if nodeID, ok := query.Variables["id"].(string); ok {
+			fixture = "node_" + nodeID + ".json"
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if fixture == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content)
+}
+
+func TestNewSource(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		config         source.Config
+		groupName      string
+		wantGraphqlURL string
+		wantMessageID  string
+		wantErr        bool
+	}{
+		{
+			comparisonType: "github.com with the owner in the group",
+			config:         source.Config{},
+			groupName:      "oceti-sakowin/treaty-council",
+			wantGraphqlURL: "https://api.github.com/graphql",
+			wantMessageID:  "<oceti-sakowin/treaty-council/issues/1@github.com>",
+		},
+		{
+			comparisonType: "GitHub Enterprise with the owner from org",
+			config:         source.Config{BaseURL: "https://git.lakota.example/api/v3/", Org: "oceti-sakowin"},
+			groupName:      "treaty-council",
+			wantGraphqlURL: "https://git.lakota.example/api/graphql",
+			wantMessageID:  "<oceti-sakowin/treaty-council/issues/1@git.lakota.example>",
+		},
+		{
+			comparisonType: "Group without an owner",
+			config:         source.Config{},
+			groupName:      "treaty-council",
+			wantGraphqlURL: "https://api.github.com/graphql",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, err := NewSource(test.config)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			gs := src.(*githubSource)
+			if gs.graphqlURL != test.wantGraphqlURL {
+				t.Errorf("GraphQL url doesn't match.\n got: %s\nwant: %s", gs.graphqlURL, test.wantGraphqlURL)
+			}
+			owner, repo, gotErr := gs.repository(test.groupName)
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if gotMessageID := gs.messageID(owner, repo, "issues", 1, 0); gotMessageID != test.wantMessageID {
+				t.Errorf("Message-ID doesn't match.\n got: %s\nwant: %s", gotMessageID, test.wantMessageID)
+			}
+		})
+	}
+}
+
+func TestMonths(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		token          string
+		wantMonths     []time.Time
+	}{
+		{
+			comparisonType: "Issues and discussions with a token",
+			token:          "wakan",
+			wantMonths:     []time.Time{time.Date(1868, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(1868, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(1868, 11, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			comparisonType: "Only issues without a token",
+			wantMonths:     []time.Time{time.Date(1868, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(1868, 5, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			api := newFakeAPI()
+			defer api.server.Close()
+			os.Setenv("GITHUB_TOKEN", test.token)
+			defer os.Unsetenv("GITHUB_TOKEN")
+			src, _ := source.New("github", source.Config{BaseURL: api.server.URL, Groups: []string{testGroup}})
+
+			gotMonths, err := src.Months(context.Background(), testGroup, time.Date(1868, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(1868, 12, 1, 0, 0, 0, 0, time.UTC))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months don't match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+			api.mu.Lock()
+			defer api.mu.Unlock()
+			if gotAuthorization, wantAuthorization := api.authorization != "", test.token != ""; gotAuthorization != wantAuthorization {
+				t.Errorf("Authorization sent %v, want %v.", gotAuthorization, wantAuthorization)
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	gs := &githubSource{host: "github.com"}
+	tests := []struct {
+		comparisonType string
+		message        threadMessage
+		wantMessage    string
+	}{
+		{
+			comparisonType: "Issue that starts a thread",
+			message: threadMessage{
+				messageID: "<oceti-sakowin/treaty-council/issues/1@github.com>",
+				login:     "redcloud",
+				createdAt: time.Date(1868, 4, 2, 16, 0, 0, 0, time.UTC),
+				subject:   "Close the forts on the Bozeman Trail",
+				body:      "The soldiers must leave.\r\nFrom Fort Phil Kearny first.",
+				url:       "https://github.com/oceti-sakowin/treaty-council/issues/1",
+			},
+			wantMessage: "From redcloud@users.noreply.github.com Thu Apr  2 16:00:00 1868\n" +
+				"From: \"redcloud\" <redcloud@users.noreply.github.com>\n" +
+				"Date: Thu, 02 Apr 1868 16:00:00 +0000\n" +
+				"Subject: Close the forts on the Bozeman Trail\n" +
+				"Message-ID: <oceti-sakowin/treaty-council/issues/1@github.com>\n" +
+				"Archived-At: <https://github.com/oceti-sakowin/treaty-council/issues/1>\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				"The soldiers must leave.\n>From Fort Phil Kearny first.\n\n",
+		},
+		{
+			comparisonType: "Reply to a discussion comment",
+			message: threadMessage{
+				messageID:  "<oceti-sakowin/treaty-council/discussions/4/2002@github.com>",
+				inReplyTo:  "<oceti-sakowin/treaty-council/discussions/4/2001@github.com>",
+				references: []string{"<oceti-sakowin/treaty-council/discussions/4@github.com>", "<oceti-sakowin/treaty-council/discussions/4/2001@github.com>"},
+				login:      "redcloud",
+				createdAt:  time.Date(1868, 11, 6, 17, 0, 0, 0, time.UTC),
+				subject:    "Re: Hunting on the Republican Fork",
+				body:       "I sign at Fort Laramie today.",
+				url:        "https://github.com/oceti-sakowin/treaty-council/discussions/4#discussioncomment-2002",
+			},
+			wantMessage: "From redcloud@users.noreply.github.com Fri Nov  6 17:00:00 1868\n" +
+				"From: \"redcloud\" <redcloud@users.noreply.github.com>\n" +
+				"Date: Fri, 06 Nov 1868 17:00:00 +0000\n" +
+				"Subject: Re: Hunting on the Republican Fork\n" +
+				"Message-ID: <oceti-sakowin/treaty-council/discussions/4/2002@github.com>\n" +
+				"In-Reply-To: <oceti-sakowin/treaty-council/discussions/4/2001@github.com>\n" +
+				"References: <oceti-sakowin/treaty-council/discussions/4@github.com> <oceti-sakowin/treaty-council/discussions/4/2001@github.com>\n" +
+				"Archived-At: <https://github.com/oceti-sakowin/treaty-council/discussions/4#discussioncomment-2002>\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				"I sign at Fort Laramie today.\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var sb strings.Builder
+			if err := gs.writeMessage(&sb, test.message); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sb.String() != test.wantMessage {
+				t.Errorf("Message doesn't match.\n got: %q\nwant: %q", sb.String(), test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	defer api.server.Close()
+	rootDir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	os.Setenv("GITHUB_TOKEN", "wakan")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	src, _ := source.New("github", source.Config{BaseURL: api.server.URL, Groups: []string{testGroup}})
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: config.SubDirectoryName("github", testGroup)}
+	// Messages carry the host of the stub API
+	threadID := func(path string) string {
+		return "<oceti-sakowin/treaty-council/" + path + "@127.0.0.1>"
+	}
+
+	tests := []struct {
+		comparisonType string
+		month          time.Time
+		wantHeaders    []string
+	}{
+		{
+			comparisonType: "Issue and comment after the limits pass without pull requests or earlier comments",
+			month:          time.Date(1868, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantHeaders: []string{
+				"From redcloud@users.noreply.127.0.0.1 Thu Apr  2 16:00:00 1868", "Message-ID: " + threadID("issues/1"),
+				"From spottedtail@users.noreply.127.0.0.1 Wed Apr 29 14:00:00 1868", "Message-ID: " + threadID("issues/1/1002"), "In-Reply-To: " + threadID("issues/1"),
+			},
+		},
+		{
+			comparisonType: "Issues and discussions merged in creation order with a deleted user",
+			month:          time.Date(1868, 5, 1, 0, 0, 0, 0, time.UTC),
+			wantHeaders: []string{
+				"From spottedtail@users.noreply.127.0.0.1 Sun May 10 09:30:00 1868", "Message-ID: " + threadID("issues/3"),
+				"From ghost@users.noreply.127.0.0.1 Mon May 11 11:00:00 1868", "Message-ID: " + threadID("issues/3/1004"), "In-Reply-To: " + threadID("issues/3"),
+				"From sittingbull@users.noreply.127.0.0.1 Wed May 20 13:00:00 1868", "Message-ID: " + threadID("discussions/4"),
+				"From crazyhorse@users.noreply.127.0.0.1 Thu May 21 09:00:00 1868", "Message-ID: " + threadID("discussions/4/2001"), "In-Reply-To: " + threadID("discussions/4"),
+			},
+		},
+		{
+			comparisonType: "Replies and comments past the first page of a discussion",
+			month:          time.Date(1868, 11, 1, 0, 0, 0, 0, time.UTC),
+			wantHeaders: []string{
+				"From redcloud@users.noreply.127.0.0.1 Fri Nov  6 17:00:00 1868", "Message-ID: " + threadID("discussions/4/2002"), "In-Reply-To: " + threadID("discussions/4/2001"),
+				"From spottedtail@users.noreply.127.0.0.1 Sat Nov  7 10:00:00 1868", "Message-ID: " + threadID("discussions/4/2003"), "In-Reply-To: " + threadID("discussions/4"),
+				"From crazyhorse@users.noreply.127.0.0.1 Sun Nov  8 12:00:00 1868", "Message-ID: " + threadID("discussions/4/2004"), "In-Reply-To: " + threadID("discussions/4/2001"),
+			},
+		},
+		{
+			comparisonType: "Month without messages not stored",
+			month:          time.Date(1868, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, testGroup, test.month); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+
+			// The owner and repo share one subdirectory
+			fileName := filepath.Join(rootDir, "github-oceti-sakowin_treaty-council", test.month.Format("2006-01")+"-github-oceti-sakowin_treaty-council.mbox.gz")
+			stored, openErr := os.Open(fileName)
+			if test.wantHeaders == nil {
+				if openErr == nil {
+					stored.Close()
+					t.Errorf("Empty month stored at %s", fileName)
+				}
+				return
+			}
+			if openErr != nil {
+				t.Fatalf("Stored month missing: %v", openErr)
+			}
+			defer stored.Close()
+			gz, gzErr := gzip.NewReader(stored)
+			if gzErr != nil {
+				t.Fatalf("Stored month not gzipped: %v", gzErr)
+			}
+			mbox, _ := ioutil.ReadAll(gz)
+
+			var gotHeaders []string
+			for _, line := range strings.Split(string(mbox), "\n") {
+				for _, prefix := range []string{"From ", "Message-ID: ", "In-Reply-To: "} {
+					if strings.HasPrefix(line, prefix) {
+						gotHeaders = append(gotHeaders, line)
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotHeaders, test.wantHeaders) {
+				t.Errorf("Headers don't match.\n got: %q\nwant: %q", gotHeaders, test.wantHeaders)
+			}
+		})
+	}
+	// Both pages of issues were read, the discussions stopped at the first one updated before the start and the second
+	// pages of comments and replies were asked for after the rate limited first request
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.requests[repoPath+"/issues"] != 2 || api.requests["/graphql"] != 4 {
+		t.Errorf("Requests don't match.\n got: %v", api.requests)
+	}
+}
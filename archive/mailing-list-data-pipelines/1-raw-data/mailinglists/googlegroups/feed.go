@@ -0,0 +1,406 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package googlegroups
+
+/*
+Incremental Google Groups loads from the message feeds, registered as the ggfeed source.
+
+Newest messages first, Atom and then RSS when Atom fails:
+https://groups.google.com[ORG]/forum/feed/[GROUP NAME]/msgs/atom.xml?num=100
+https://groups.google.com[ORG]/forum/feed/[GROUP NAME]/msgs/rss.xml?num=100
+
+The newest message date stored for the group is recorded in the metadata of feed-state.txt under the state prefix,
+outside the group subdirectory. Each run adds only the feed messages after it to the end of the [YEAR]-[MONTH].txt
+file for the month, which records its newest message date too so a run that stopped before the group date was
+recorded doesn't add them twice. When there is no recorded date or the feed doesn't reach back to it, the months are
+loaded with the conversation crawler instead. The crawler walks the group once for the rest of the range and later
+months use that crawl. With refresh never, months already stored at the ends of the range are skipped so use
+changed or always to add new messages to the current month.
+*/
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const (
+	// Message feed | org, group, atom.xml or rss.xml, number of messages
+	feedURLFormat = "https://groups.google.com%s/forum/feed/%s/msgs/%s?num=%d"
+	feedSize      = 100
+	feedStateFile = gcs.StatePrefix + "feed-state.txt"
+)
+
+var (
+	feedErr      = errors.New("feed")
+	feedStateErr = errors.New("feed state")
+)
+
+type atomFeed struct {
+	Entries []struct {
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+		Links     []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+type rssFeed struct {
+	Items []struct {
+		Link    string `xml:"link"`
+		GUID    string `xml:"guid"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+// Message from the feed
+type feedItem struct {
+	rawURL string
+	date   time.Time
+}
+
+// Conversation crawl of a group from the first month the feed didn't reach
+type feedCrawl struct {
+	msgURLs   map[string][]string
+	crawledAt time.Time
+}
+
+// Raw message url for a message link in the feed. Both the current /g/[GROUP]/c/[TOPIC]/m/[MSG] links and the older
+// /d/msg/[GROUP]/[TOPIC]/[MSG] links are supported. Empty when the link isn't to a message.
+func rawMsgURLFromLink(link string) (rawURL string) {
+	msgURL, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || msgURL.Host == "" {
+		return
+	}
+	msgURL.RawQuery, msgURL.Fragment = "", ""
+
+	if idAfter(msgURL.Path, "/c/") != "" && idAfter(msgURL.Path, "/m/") != "" {
+		msgURL.Path = strings.TrimSuffix(msgURL.Path, "/") + "/raw"
+		return msgURL.String()
+	}
+	if idx := strings.Index(msgURL.Path, "/d/msg/"); idx >= 0 {
+		msgPath := msgURL.Path[idx+len("/d/msg/"):]
+		msgURL.Path = msgURL.Path[:idx] + "/forum/message/raw"
+		return msgURL.String() + "?msg=" + msgPath
+	}
+	return
+}
+
+// Parse the Atom feed. Entries use the published date when there is one.
+func parseAtomFeed(data []byte) (items []feedItem, err error) {
+	var feed atomFeed
+
+	if err = xml.Unmarshal(data, &feed); err != nil {
+		return
+	}
+	for _, entry := range feed.Entries {
+		var item feedItem
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				item.rawURL = rawMsgURLFromLink(link.Href)
+				break
+			}
+		}
+		dateText := entry.Published
+		if dateText == "" {
+			dateText = entry.Updated
+		}
+		date, dateErr := time.Parse(time.RFC3339, strings.TrimSpace(dateText))
+		if item.rawURL == "" || dateErr != nil {
+			log.Printf("Skipping feed entry without a message link or date: %q %q", item.rawURL, dateText)
+			continue
+		}
+		item.date = date.UTC()
+		items = append(items, item)
+	}
+	return
+}
+
+// Parse the RSS feed. Items use the guid when the link isn't to a message.
+func parseRSSFeed(data []byte) (items []feedItem, err error) {
+	var feed rssFeed
+
+	if err = xml.Unmarshal(data, &feed); err != nil {
+		return
+	}
+	for _, rssItem := range feed.Items {
+		item := feedItem{rawURL: rawMsgURLFromLink(rssItem.Link)}
+		if item.rawURL == "" {
+			item.rawURL = rawMsgURLFromLink(rssItem.GUID)
+		}
+		date, dateErr := mail.ParseDate(strings.TrimSpace(rssItem.PubDate))
+		if item.rawURL == "" || dateErr != nil {
+			log.Printf("Skipping feed item without a message link or date: %q %q", rssItem.Link, rssItem.PubDate)
+			continue
+		}
+		item.date = date.UTC()
+		items = append(items, item)
+	}
+	return
+}
+
+func init() {
+	source.Register("ggfeed", NewFeedSource)
+}
+
+// Google Groups feed version of the mailing list source. The conversation crawler loads what the feed can't.
+type feedSource struct {
+	crawler      *googleGroupsSource
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Feed messages for each group, oldest first
+	items map[string][]feedItem
+	// End of the date range for each group so a crawl covers the months left
+	ends   map[string]time.Time
+	crawls map[string]feedCrawl
+}
+
+// Create the Google Groups feed source.
+func NewFeedSource(config source.Config) (source.Source, error) {
+	crawler, err := NewSource(config)
+	if err != nil {
+		return nil, err
+	}
+	return &feedSource{
+		crawler:      crawler.(*googleGroupsSource),
+		httpToReader: config.HttpToReader,
+		items:        make(map[string][]feedItem),
+		ends:         make(map[string]time.Time),
+		crawls:       make(map[string]feedCrawl),
+	}, nil
+}
+
+func (feed *feedSource) Name() string {
+	return "ggfeed"
+}
+
+// Google Groups are not discovered so the configured groups are returned.
+func (feed *feedSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	return feed.crawler.groups, nil
+}
+
+// Every month in the range. Which messages are new is decided against the recorded date in FetchMonth.
+func (feed *feedSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	feed.mu.Lock()
+	feed.ends[groupName] = endDate
+	feed.mu.Unlock()
+	return source.MonthRange(startDate, endDate), nil
+}
+
+// Crawl the group conversations from the date to the end of the range, or to the month end when Months wasn't
+// called. The crawl is done once per group and kept for the later months.
+func (feed *feedSource) crawl(groupName string, from, monthEnd time.Time) (crawl feedCrawl, err error) {
+	feed.mu.Lock()
+	crawl, ok := feed.crawls[groupName]
+	end := feed.ends[groupName]
+	feed.mu.Unlock()
+	if ok {
+		return
+	}
+	if end.Before(monthEnd) {
+		end = monthEnd
+	}
+
+	crawl.crawledAt = time.Now().UTC()
+	if crawl.msgURLs, err = listRawMsgURLsByMonth(feed.crawler.org, groupName, from, end, feed.crawler.workers, feed.crawler.httpToDom, feed.crawler.httpToString); err != nil {
+		return
+	}
+	feed.mu.Lock()
+	feed.crawls[groupName] = crawl
+	feed.mu.Unlock()
+	return
+}
+
+// Get the feed body.
+func (feed *feedSource) getFeed(feedURL string) (data []byte, err error) {
+	var body io.ReadCloser
+
+	if body, _, err = feed.httpToReader(feedURL, nil); err != nil {
+		return
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// Feed messages for the group oldest first, polled once per source. Falls back to RSS when Atom fails.
+func (feed *feedSource) feedItems(groupName string) (items []feedItem, err error) {
+	var data []byte
+
+	feed.mu.Lock()
+	items, ok := feed.items[groupName]
+	feed.mu.Unlock()
+	if ok {
+		return
+	}
+
+	atomURL := fmt.Sprintf(feedURLFormat, feed.crawler.org, groupName, "atom.xml", feedSize)
+	if data, err = feed.getFeed(atomURL); err == nil {
+		items, err = parseAtomFeed(data)
+	}
+	if err != nil {
+		log.Printf("Atom feed failed for %s so trying RSS: %v", groupName, err)
+		rssURL := fmt.Sprintf(feedURLFormat, feed.crawler.org, groupName, "rss.xml", feedSize)
+		if data, err = feed.getFeed(rssURL); err == nil {
+			items, err = parseRSSFeed(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w on %s: %v", feedErr, rssURL, err)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].date.Before(items[j].date) })
+
+	feed.mu.Lock()
+	feed.items[groupName] = items
+	feed.mu.Unlock()
+	return
+}
+
+// Newest message date recorded for the group subdirectory. Not seen before the first run.
+func readWatermark(ctx context.Context, storage gcs.Connection) (watermark time.Time, seen bool, err error) {
+	var info gcs.ObjectInfo
+
+	if info, seen, err = storage.Stat(ctx, feedStateFile); err != nil || !seen {
+		return
+	}
+	if watermark, err = time.Parse(time.RFC3339, info.Metadata[gcs.MetaEndDate]); err != nil {
+		err = fmt.Errorf("%w date on %s: %v", feedStateErr, info.Name, err)
+	}
+	return
+}
+
+// Newest message date recorded on the stored month file. Zero when the month isn't stored yet.
+func readMonthCursor(ctx context.Context, storage gcs.Connection, fileName string) (cursor time.Time, err error) {
+	info, exists, err := storage.Stat(ctx, fileName)
+	if err != nil || !exists || info.Metadata[gcs.MetaCursor] == "" {
+		return
+	}
+	if cursor, err = time.Parse(time.RFC3339, info.Metadata[gcs.MetaCursor]); err != nil {
+		err = fmt.Errorf("%w cursor on %s: %v", feedStateErr, info.Name, err)
+	}
+	return
+}
+
+// Record the newest message date stored for the group subdirectory.
+func writeWatermark(ctx context.Context, storage gcs.Connection, org, groupName string, watermark time.Time) (err error) {
+	meta := gcs.ObjectMeta{
+		ContentType: "text/plain",
+		Overwrite:   true,
+		SourceURL:   forumURL(org, groupName),
+		MailingList: "ggfeed",
+		GroupName:   groupName,
+		EndDate:     watermark.UTC().Format(time.RFC3339),
+		FetchedAt:   time.Now(),
+	}
+	if _, err = storage.Store(ctx, feedStateFile, strings.NewReader(meta.EndDate+"\n"), meta); err != nil {
+		err = fmt.Errorf("%w store: %v", feedStateErr, err)
+	}
+	return
+}
+
+// Store the month's messages after the recorded date and move the recorded date forward. Uses the feed when it reaches
+// back far enough and the conversation crawler otherwise.
+func (feed *feedSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		watermark, recorded, cursor, newest time.Time
+		seen                                bool
+		items                               []feedItem
+		msgURLs                             []string
+		meta                                gcs.ObjectMeta
+	)
+	// The 1st of the next month. AddMonth lands on March 3rd for February.
+	monthEnd := month.AddDate(0, 1, 0)
+	fileName := month.Format("2006-01") + ".txt"
+
+	if watermark, seen, err = readWatermark(ctx, storage); err != nil {
+		return
+	}
+	recorded = watermark
+	// The month can be ahead of the group when a run stopped between storing the month and recording the date
+	if cursor, err = readMonthCursor(ctx, storage, fileName); err != nil {
+		return
+	}
+	if cursor.After(watermark) {
+		watermark, seen, newest = cursor, true, cursor
+	}
+	if seen && !watermark.Before(monthEnd) {
+		log.Printf("Googlegroups feed for %s already has %s.", groupName, month.Format("2006-01"))
+		return
+	}
+	// Messages are new from the month start or after the recorded date, whichever is later
+	from := month
+	if seen && watermark.After(month) {
+		from = watermark
+	}
+
+	if items, err = feed.feedItems(groupName); err != nil {
+		return
+	}
+	if len(items) < feedSize || !items[0].date.After(from) {
+		for _, item := range items {
+			if item.date.Before(month) || !item.date.Before(monthEnd) || (seen && !item.date.After(watermark)) {
+				continue
+			}
+			msgURLs = append(msgURLs, item.rawURL)
+			newest = item.date
+		}
+		meta.SourceURL = fmt.Sprintf(feedURLFormat, feed.crawler.org, groupName, "atom.xml", feedSize)
+	} else {
+		log.Printf("Googlegroups feed for %s doesn't reach back to %s so crawling the month.", groupName, from.Format(time.RFC3339))
+		var crawl feedCrawl
+		if crawl, err = feed.crawl(groupName, from, monthEnd); err != nil {
+			return
+		}
+		msgURLs = crawl.msgURLs[getFileName(month)]
+		if newest = monthEnd; crawl.crawledAt.Before(monthEnd) {
+			newest = crawl.crawledAt
+		}
+		meta.SourceURL = forumURL(feed.crawler.org, groupName)
+	}
+
+	if len(msgURLs) == 0 {
+		log.Printf("No new googlegroups feed messages for %s in %s.", groupName, month.Format("2006-01"))
+	} else {
+		meta.ContentType, meta.MailingList, meta.GroupName = "text/plain", "ggfeed", groupName
+		meta.StartDate, meta.EndDate = month.Format("2006-01-02"), monthEnd.Format("2006-01-02")
+		meta.Cursor, meta.FetchedAt = newest.UTC().Format(time.RFC3339), time.Now()
+		_, err = utils.StoreAppend(ctx, storage, fileName, meta, func(w io.Writer) error {
+			return writeMonthText(w, fileName, msgURLs, feed.crawler.workers, feed.crawler.httpToString)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", storageErr, err)
+		}
+		log.Printf("Added %d new googlegroups messages for %s to %s.", len(msgURLs), groupName, fileName)
+	}
+	if newest.After(recorded) {
+		err = writeWatermark(ctx, storage, feed.crawler.org, groupName, newest)
+	}
+	return
+}
@@ -0,0 +1,335 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package googlegroups
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const groupsHost = "https://groups.google.com"
+
+// Serve the recorded feeds, the Groups UI fixtures and the raw messages with their links pointed at the test server.
+// The /a/kingdom org has a full feed that starts after January 1893 so the crawler loads that month.
+func fakeGroupsServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	pages := make(map[string]string)
+
+	fixtures := map[string]string{
+		"/forum/feed/Liliuokalani/msgs/atom.xml?num=100": "feed_atom.xml",
+		"/forum/feed/Kaiulani/msgs/rss.xml?num=100":      "feed_rss.xml",
+	}
+	for pageURL, fileName := range groupsUIFixtures {
+		fixtures[strings.TrimPrefix(pageURL, groupsHost)] = fileName
+	}
+	for path, fileName := range fixtures {
+		page, err := ioutil.ReadFile(filepath.Join("testdata", fileName))
+		if err != nil {
+			t.Fatalf("Fixture failed: %v", err)
+		}
+		pages[path] = string(page)
+	}
+	for msgURL, msg := range groupsUIRawMsgs {
+		pages[strings.TrimPrefix(msgURL, groupsHost)] = msg
+	}
+	pages["/g/Liliuokalani/c/Hawaii-1893/m/Reply-0214/raw"] = "Date: Tue, 14 Feb 1893 09:03:00 -1030\nSubject: Re: Protest\n\nAwaiting the reply.\n"
+	pages["/forum/message/raw?msg=Liliuokalani/Iolani-1893/Constitution-0114"] = pages["/g/Liliuokalani/c/Iolani-1893/m/Constitution-0114/raw"]
+
+	var fullFeed bytes.Buffer
+	fullFeed.WriteString(`<feed xmlns="http://www.w3.org/2005/Atom">`)
+	for i := 0; i < feedSize; i++ {
+		fmt.Fprintf(&fullFeed, `<entry><updated>1893-02-20T00:%02d:00Z</updated><link href="%s/g/Liliuokalani/c/Later/m/Msg-%d"/></entry>`, i%60, groupsHost, i)
+	}
+	fullFeed.WriteString(`</feed>`)
+	pages["/forum/feed/Liliuokalani/msgs/atom.xml?num=100"+"&org=kingdom"] = fullFeed.String()
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.RequestURI()
+		if strings.HasPrefix(path, "/a/kingdom/") {
+			path = strings.TrimPrefix(path, "/a/kingdom")
+			if strings.HasPrefix(path, "/forum/feed/") {
+				path += "&org=kingdom"
+			}
+		}
+		page, ok := pages[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, strings.Replace(page, groupsHost, server.URL, -1))
+	}))
+	return server
+}
+
+// Live http funcs with the Groups host pointed at the test server.
+func testServerConfig(server *httptest.Server, org string) source.Config {
+	toServer := func(url string) string { return strings.Replace(url, groupsHost, server.URL, 1) }
+	return source.Config{
+		Org:     org,
+		Groups:  []string{"Liliuokalani"},
+		Workers: 2,
+		HttpToDom: func(url string) (*goquery.Document, error) {
+			return utils.DomResponse(toServer(url))
+		},
+		HttpToReader: func(url string, header http.Header) (io.ReadCloser, http.Header, error) {
+			return utils.ReaderResponse(toServer(url), header)
+		},
+		HttpToString: func(url string) (string, error) {
+			return utils.StringResponse(toServer(url))
+		},
+	}
+}
+
+func TestRawMsgURLFromLink(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		link           string
+		wantRawURL     string
+	}{
+		{
+			comparisonType: "Test conversation message link",
+			link:           "https://groups.google.com/a/hawaii.gov/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117?hl=en",
+			wantRawURL:     "https://groups.google.com/a/hawaii.gov/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw",
+		},
+		{
+			comparisonType: "Test older message link",
+			link:           "https://groups.google.com/d/msg/Liliuokalani/Iolani-1893/Constitution-0114",
+			wantRawURL:     "https://groups.google.com/forum/message/raw?msg=Liliuokalani/Iolani-1893/Constitution-0114",
+		},
+		{
+			comparisonType: "Test group link",
+			link:           "https://groups.google.com/g/Liliuokalani",
+			wantRawURL:     "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotRawURL := rawMsgURLFromLink(test.link); gotRawURL != test.wantRawURL {
+				t.Errorf("Raw url does not match.\n got: %v\nwant: %v", gotRawURL, test.wantRawURL)
+			}
+		})
+	}
+}
+
+func TestParseFeeds(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		parse          func([]byte) ([]feedItem, error)
+		wantItems      []feedItem
+	}{
+		{
+			comparisonType: "Test Atom feed",
+			fileName:       "feed_atom.xml",
+			parse:          parseAtomFeed,
+			wantItems: []feedItem{
+				{rawURL: "https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Reply-0214/raw", date: time.Date(1893, 2, 14, 19, 33, 0, 0, time.UTC)},
+				{rawURL: "https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw", date: time.Date(1893, 1, 18, 4, 30, 0, 0, time.UTC)},
+				{rawURL: "https://groups.google.com/forum/message/raw?msg=Liliuokalani/Iolani-1893/Constitution-0114", date: time.Date(1893, 1, 15, 2, 45, 0, 0, time.UTC)},
+			},
+		},
+		{
+			comparisonType: "Test RSS feed with a guid link and a bad date",
+			fileName:       "feed_rss.xml",
+			parse:          parseRSSFeed,
+			wantItems: []feedItem{
+				{rawURL: "https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Reply-0214/raw", date: time.Date(1893, 2, 14, 19, 33, 0, 0, time.UTC)},
+				{rawURL: "https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw", date: time.Date(1893, 1, 18, 4, 30, 0, 0, time.UTC)},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", test.fileName))
+			if err != nil {
+				t.Fatalf("Fixture failed: %v", err)
+			}
+			gotItems, err := test.parse(data)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotItems, test.wantItems) {
+				t.Errorf("Items do not match.\n got: %+v\nwant: %+v", gotItems, test.wantItems)
+			}
+		})
+	}
+}
+
+// Stored file names in the subdirectory and the number of messages in them.
+func storedFeedFiles(t *testing.T, storage *gcs.FileConnection) (fileNames []string, msgCount int) {
+	existing, err := storage.ListExisting(context.Background(), storage.SubDirectory)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	for fileName := range existing {
+		fileNames = append(fileNames, fileName)
+		content, err := ioutil.ReadFile(filepath.Join(storage.RootDir, fileName))
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		msgCount += strings.Count(string(content), "original_url: ")
+	}
+	sort.Strings(fileNames)
+	return
+}
+
+func TestFeedSourceFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	server := fakeGroupsServer(t)
+	defer server.Close()
+	january := time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC)
+	february := time.Date(1893, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType string
+		org            string
+		groupName      string
+		months         []time.Time
+		dropState      bool
+		wantFiles      []string
+		wantMsgCount   int
+		wantWatermark  time.Time
+		wantForumPages int
+	}{
+		{
+			comparisonType: "Test first run stores the feed messages by month",
+			groupName:      "Liliuokalani",
+			months:         []time.Time{january, february},
+			wantFiles: []string{
+				"ggfeed-Liliuokalani/1893-01-ggfeed-Liliuokalani.txt",
+				"ggfeed-Liliuokalani/1893-02-ggfeed-Liliuokalani.txt",
+			},
+			wantMsgCount:  3,
+			wantWatermark: time.Date(1893, 2, 14, 19, 33, 0, 0, time.UTC),
+		},
+		{
+			comparisonType: "Test month date keeps messages from being added twice when the group date is lost",
+			groupName:      "Liliuokalani",
+			months:         []time.Time{january, february},
+			dropState:      true,
+			wantFiles: []string{
+				"ggfeed-Liliuokalani/1893-01-ggfeed-Liliuokalani.txt",
+				"ggfeed-Liliuokalani/1893-02-ggfeed-Liliuokalani.txt",
+			},
+			wantMsgCount:  3,
+			wantWatermark: time.Date(1893, 2, 14, 19, 33, 0, 0, time.UTC),
+		},
+		{
+			comparisonType: "Test RSS when there is no Atom feed",
+			groupName:      "Kaiulani",
+			months:         []time.Time{january},
+			wantFiles:      []string{"ggfeed-Kaiulani/1893-01-ggfeed-Kaiulani.txt"},
+			wantMsgCount:   1,
+			wantWatermark:  time.Date(1893, 1, 18, 4, 30, 0, 0, time.UTC),
+		},
+		{
+			comparisonType: "Test crawler when the feed doesn't reach back to the month",
+			org:            "/a/kingdom",
+			groupName:      "Liliuokalani",
+			months:         []time.Time{january},
+			wantFiles:      []string{"ggfeed-Liliuokalani/1893-01-ggfeed-Liliuokalani.txt"},
+			wantMsgCount:   2,
+			wantWatermark:  february,
+			wantForumPages: 2,
+		},
+		{
+			comparisonType: "Test crawler walks the group once for all the months",
+			org:            "/a/kingdom",
+			groupName:      "Liliuokalani",
+			months:         []time.Time{january, february},
+			wantFiles: []string{
+				"ggfeed-Liliuokalani/1893-01-ggfeed-Liliuokalani.txt",
+				"ggfeed-Liliuokalani/1893-02-ggfeed-Liliuokalani.txt",
+			},
+			wantMsgCount:   3,
+			wantWatermark:  time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantForumPages: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			rootDir, err := ioutil.TempDir("", "googlegroups")
+			if err != nil {
+				t.Fatalf("Temp dir failed: %v", err)
+			}
+			defer os.RemoveAll(rootDir)
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "ggfeed-" + test.groupName}
+			config := testServerConfig(server, test.org)
+			gotForumPages := 0
+			httpToDom := config.HttpToDom
+			config.HttpToDom = func(url string) (*goquery.Document, error) {
+				if !strings.Contains(url, "/c/") {
+					gotForumPages++
+				}
+				return httpToDom(url)
+			}
+
+			// A second run has nothing new to store
+			for run := 0; run < 2; run++ {
+				if run > 0 && test.dropState {
+					os.Remove(filepath.Join(rootDir, "state", storage.SubDirectory, "feed-state.txt"))
+				}
+				src, err := NewFeedSource(config)
+				if err != nil {
+					t.Fatalf("Source failed: %v", err)
+				}
+				months, err := src.Months(ctx, test.groupName, test.months[0], test.months[len(test.months)-1].AddDate(0, 1, 0))
+				if err != nil {
+					t.Fatalf("Months failed: %v", err)
+				}
+				for _, month := range months {
+					if err = src.FetchMonth(ctx, storage, test.groupName, month); err != nil {
+						t.Errorf("FetchMonth failed for %v: %v", month, err)
+					}
+				}
+			}
+
+			gotFiles, gotMsgCount := storedFeedFiles(t, storage)
+			if !reflect.DeepEqual(gotFiles, test.wantFiles) {
+				t.Errorf("Stored files do not match.\n got: %v\nwant: %v", gotFiles, test.wantFiles)
+			}
+			if gotMsgCount != test.wantMsgCount {
+				t.Errorf("Stored messages do not match.\n got: %v\nwant: %v", gotMsgCount, test.wantMsgCount)
+			}
+			gotWatermark, seen, err := readWatermark(ctx, storage)
+			if err != nil || !seen || !gotWatermark.Equal(test.wantWatermark) {
+				t.Errorf("Watermark does not match.\n got: %v %v %v\nwant: %v", gotWatermark, seen, err, test.wantWatermark)
+			}
+			if info, _, _ := storage.Stat(ctx, feedStateFile); info.Name != "state/ggfeed-"+test.groupName+"/feed-state.txt" {
+				t.Errorf("Watermark file does not match.\n got: %v\nwant: %v", info.Name, "state/ggfeed-"+test.groupName+"/feed-state.txt")
+			}
+			if gotForumPages != test.wantForumPages {
+				t.Errorf("Conversation list pages fetched do not match.\n got: %v\nwant: %v", gotForumPages, test.wantForumPages)
+			}
+		})
+	}
+}
@@ -14,28 +14,20 @@
 
 /*
 This package loads Google Groups mailing list data types into Cloud Storage.
-It loops over pages that list topics and pulls the topic ids.
-As it pulls each topic id, it explores the related link to get the message id.
-Then it pulls the raw message content and groups that by month and year.
-Then it stores the text on GCS.
+It walks the pages that list conversations and keeps the ones with a last post on or after the start date.
+For each of those it opens the conversation page to get the id of every message in the thread.
+Then it reads the date shown for each message on that page and groups the messages by that month and year.
+Then it pulls the raw message content and stores the text on GCS.
 
-List of all topics / threads url format| LIFO:
-topicListURLBase = "https://groups.google.com%s/forum/?_escaped_fragment_=forum/%s"
-https://groups.google.com/forum/?_escaped_fragment_=forum/[GROUP NAME]
-Pass in numbers [1-100] to get list of results
-- Note keep between 1-100 in size and grow accordingly 10-110, 201-300, etc
-- Link only to topic and not post
+List of all conversations url format | newest activity first, with a Next page link:
+https://groups.google.com[ORG]/g/[GROUP NAME]
 
-List of all messages in a topic url format | FIFO:
-topicDetailURLBase = "https://groups.google.com%s/forum/?_escaped_fragment_=topic/%s/%s"
-https://groups.google.com/forum/?_escaped_fragment_=topic/[GROUP NAME]/[TOPIC ID]
-
-Topic pages contain results in this format with message id which we want:
-"https://groups.google.com/d/msg/%s/%s/%s" // group, topic, msg id
+Conversation url format with links to each message:
+https://groups.google.com[ORG]/g/[GROUP NAME]/c/[TOPIC ID]
+https://groups.google.com[ORG]/g/[GROUP NAME]/c/[TOPIC ID]/m/[MSG ID]
 
 Raw mail message url format:
-messageURLBase = "https://groups.google.com%s/forum/message/raw?msg=%s/%s/%s"
-https://groups.google.com/forum/message/raw?msg=[GROUP NAME]/[TOPIC ID]/[MSG ID]
+https://groups.google.com[ORG]/g/[GROUP NAME]/c/[TOPIC ID]/m/[MSG ID]/raw
 
 Atom links:
 - Gets similar information where msgs focus on msg content and topics pulls labeled sections like Approvals
@@ -46,12 +38,7 @@ RSS link with link to msg and topic:
 https://groups.google.com/forum/feed/[GROUP NAME]/msgs/rss.xml?num=50
 https://groups.google.com/forum/feed/[GROUP NAME]/topics/rss.xml?num=50
 
-Note Ajax crawling and escaped_fragment is deprecated and this will need to be revised to align to current approaches
-
-Currently, it grabs all topics before assessing dates or it takes a percentage of them which is a hacky workaround. Better design is to look at date on topic page before grabbing message details.
-
-ERRORS - This will hang and lock if workerNum is set to 1. Set it to at least 20 but beware connection reset by peer errors.
-
+ORG is empty for public groups and /a/[DOMAIN] for groups in an organization.
 */
 
 package googlegroups
@@ -60,33 +47,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math"
-	"path"
-	"regexp"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
-type urlResults struct {
-	urlMap map[string][]string
-	err    error
-}
-
 type jobsData struct {
 	topicURLList []string
 	fileName     string
+	meta         gcs.ObjectMeta
 }
 
 var (
 	dateTimeParseErr = errors.New("string to DateTime")
-	fileNameErr      = errors.New("defining filename")
 	emptyFileNameErr = errors.New("empty filename")
 	rawMsgWorkerErr  = errors.New("raw message worker")
 	topicCaptureErr  = errors.New("topic capture")
@@ -130,317 +110,221 @@ func getFileName(date time.Time) (fileName string) {
 
 }
 
-// Get the total topics posted at the top of the list to track all are pulled
-func getTotalTopics(dom *goquery.Document) (totalTopics int) {
-	regTotal, _ := regexp.Compile("[^<]*?([0-9]+) *- *([0-9]+) of ([0-9]+)[^<]*?")
+// Fetch the raw messages a batch of fetchers at a time and write them to the month text stream in order.
+func writeMonthText(w io.Writer, fileName string, msgURLList []string, fetchers int, httpToString utils.HttpStringResponse) (err error) {
+	var wg sync.WaitGroup
 
-	text := dom.Find("i").Text()
-
-	if regTotal.MatchString(text) {
-		match := regTotal.FindStringSubmatch(text)
-		num1, _ := strconv.Atoi(match[1])
-		num2, _ := strconv.Atoi(match[2])
-		num3, _ := strconv.Atoi(match[3])
-		numList := []int{num1, num2, num3}
-		sort.Ints(numList)
-		totalTopics = numList[2]
+	if fetchers < 1 {
+		fetchers = 1
 	}
-	return
-}
-
-// Get message ids from topic pages and create list of raw msg urls by month
-func getMsgIDsFromDom(org, topicId, groupName string, dom *goquery.Document) (rawMsgUrl string) {
-	regTopicURL := regexp.MustCompile(fmt.Sprintf("/d/msg/%s", groupName))
-
-	var msgId string
+	for start := 0; start < len(msgURLList); start += fetchers {
+		end := start + fetchers
+		if end > len(msgURLList) {
+			end = len(msgURLList)
+		}
+		batch := msgURLList[start:end]
+		responses := make([]string, len(batch))
+		errs := make([]error, len(batch))
+		for i, msgURL := range batch {
+			wg.Add(1)
+			go func(i int, msgURL string) {
+				defer wg.Done()
+				responses[i], errs[i] = httpToString(msgURL)
+			}(i, msgURL)
+		}
+		wg.Wait()
 
-	msgUrl, _ := dom.Find("a").Attr("href")
-	if regTopicURL.MatchString(msgUrl) {
-		msgId = path.Base(msgUrl)
-		rawMsgUrl = fmt.Sprintf("https://groups.google.com%s/forum/message/raw?msg=%s/%s/%s", org, groupName, topicId, msgId)
-	} else {
-		log.Printf("No message ID found in topicId: %s.", topicId)
+		for i, msgURL := range batch {
+			if errs[i] != nil {
+				return fmt.Errorf("HTTP error: %v", errs[i])
+			}
+			if responses[i] == "" && msgURL == "" {
+				log.Printf("Url and response was empty for filename: %s", fileName)
+			} else if responses[i] == "" {
+				log.Printf("Response was empty for url: %s", msgURL)
+			}
+			if _, err = io.WriteString(w, "/n"+responses[i]+"\n"+fmt.Sprintf("original_url: %s", msgURL)+"\n"); err != nil {
+				return
+			}
+		}
 	}
 	return
 }
 
-type TopicIDToRawMsgUrlMap func(string, string, time.Time, time.Time, *goquery.Document) (rawMsgUrlMap map[string][]string, err error)
-
-// Parse topic ids from dom, get message ids and create raw message url map by year-month filename
-func topicIDToRawMsgUrlMap(org, groupName string, startDateTime, endDateTime time.Time, topicDom *goquery.Document) (rawMsgUrlMap map[string][]string, err error) {
-
-	var (
-		msgDom   *goquery.Document
-		fileDate time.Time
-	)
-
-	rawMsgUrlMap = make(map[string][]string)
-
-	regTopicURL, _ := regexp.Compile(fmt.Sprintf("/d/topic/%s", groupName))
-	// Alternate time option [0-9]{1,2}:[0-9]{2}\s(AM|PM)
-	regTime, _ := regexp.Compile("[0-1]{0,1}[0-9]{1,2}:[0-5][0-9] (AM|PM)")
-	regDate, _ := regexp.Compile("[0-9]{1,2}/[0-9]{1,2}/[0-9]{2,4}")
-
-	var fileName, dateToParse, topicID, msgURL, rawMsgURL string
-
-	topicDom.Find("tr").Each(func(i int, row *goquery.Selection) {
-		fileName = ""
-		row.Find("td").Each(func(i int, cell *goquery.Selection) {
-			topicIdURL, ok := cell.Find("a").Attr("href")
-			abuse, _ := cell.Find("a").Attr("title")
-			if ok {
-				// Get topic id
-				if regTopicURL.MatchString(topicIdURL) {
-					// Capture topic id
-					topicID = path.Base(topicIdURL)
-					msgURL = fmt.Sprintf("https://groups.google.com/forum/?_escaped_fragment_=topic/%s/%s", groupName, topicID)
-					if msgDom, err = utils.DomResponse(msgURL); err != nil {
-						return
-					}
-					// Get the message ids from the links associated with each topic id
-					rawMsgURL = getMsgIDsFromDom(org, topicID, groupName, msgDom)
-
-					// Capture flagged for abuse messages. They do not have a date class but do create a raw url.
-					// TODO determine if better way to handle
-					if abuse == "This topic has been hidden because it was flagged for abuse." {
-						rawMsgUrlMap["abuse.txt"] = append(rawMsgUrlMap["abuse.txt"], rawMsgURL)
-					}
-				}
-			}
-
-			// Capture date topic posted and convert to year-month text filename for grouping
-			dateClass, _ := cell.Attr("class")
-			if dateClass == "lastPostDate" {
-				matchDate := cell.Text()
-				// If the date is a time then its today otherwise parse the date
-				if regTime.MatchString(matchDate) {
-					dateToParse = time.Now().Format("01/02/06")
-				} else if regDate.MatchString(matchDate) {
-					dateToParse = matchDate
-				}
-				if fileDate, err = getFileDate(dateToParse); err != nil {
-					err = fmt.Errorf("%w error: %v", fileNameErr, err)
-					return
-				}
-				if utils.InTimeSpan(fileDate, startDateTime, endDateTime) {
-					// Store the urls for the raw message content into a map grouped by year-month
-					fileName = getFileName(fileDate)
-					rawMsgUrlMap[fileName] = append(rawMsgUrlMap[fileName], rawMsgURL)
-				}
-			}
-		})
+// Stream the raw messages into one text file in storage, fetching up to fetchers messages at once.
+func storeMsgText(ctx context.Context, storage gcs.Connection, httpToString utils.HttpStringResponse, fetchers int, urls jobsData) (err error) {
+	if urls.fileName == "" {
+		return fmt.Errorf("URL map filename threw an error: %w", emptyFileNameErr)
+	}
+	meta := urls.meta
+	meta.ContentType = "text/plain"
+	meta.FetchedAt = time.Now()
+	// Stream messages into storage a batch at a time so a month is never held in memory
+	_, err = utils.StoreWriter(ctx, storage, urls.fileName, meta, func(w io.Writer) error {
+		return writeMonthText(w, urls.fileName, urls.topicURLList, fetchers, httpToString)
 	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
 	return
 }
 
-// Worker converting list of topic id urls to dom objects and converting topic ids into the raw message urls
-func getRawMsgURLWorker(org, groupName string, startDateTime, endDateTime time.Time, httpToDom utils.HttpDomResponse, topictoMsgMap TopicIDToRawMsgUrlMap, topicURLJobs <-chan string, results chan<- urlResults) {
-	var (
-		topicDom                 *goquery.Document
-		topicResults, tmpResults map[string][]string
-		err                      error
-	)
-	topicResults = make(map[string][]string)
-	tmpResults = make(map[string][]string)
-
-	// Get the dom structure for the topic url page
-	for topicUrl := range topicURLJobs {
-		if topicDom, err = httpToDom(topicUrl); err != nil {
-			results <- urlResults{err: err}
-			return
-		}
-
-		// Get partial results with raw message urls grouped by year-month filename
-		// Output map includes all urls from that page which can be up to 100 values
-		if tmpResults, err = topictoMsgMap(org, groupName, startDateTime, endDateTime, topicDom); err != nil {
-			results <- urlResults{err: fmt.Errorf("%w error: %v", rawMsgWorkerErr, err)}
+// Worker to stream text blobs by year-month text filename into GCS
+func storeTextWorker(ctx context.Context, storage gcs.Connection, httpToString utils.HttpStringResponse, fetchers int, rawMsgsUrlJobs <-chan jobsData, results chan<- error) {
+	for urls := range rawMsgsUrlJobs {
+		if err := storeMsgText(ctx, storage, httpToString, fetchers, urls); err != nil {
+			results <- err
 			return
 		}
-
-		//Combine all raw msg urls results if there are more than one topicURL page reviewed
-		for fileName, rawMsgURL := range tmpResults {
-			topicResults[fileName] = append(topicResults[fileName], rawMsgURL...)
-			//log.Printf("%d filename results grabbed for file, %s, from googlegroup mailinglist: %s.", len(rawMsgURL), fileName, groupName)
-		}
 	}
-	results <- urlResults{urlMap: topicResults, err: nil}
+	results <- nil
+
 	return
 }
 
-// Goroutine setup to get/consolidate list of raw message urls by year-month text filename for pages with lists of topic urls.
-func listRawMsgURLsByMonth(org, groupName string, startDateTime, endDateTime time.Time, worker int, httpToDom utils.HttpDomResponse, topicToMsgMap TopicIDToRawMsgUrlMap, allDateRun bool) (rawMsgUrlMap map[string][]string, err error) {
-	var (
-		urlTopicList                        string
-		pageIndex, countMsgs, totalMessages int
-		dom                                 *goquery.Document
-		//wg                                  sync.WaitGroup
-	)
-
-	pageIndex, countMsgs = 0, 0
-	rawMsgUrlMap = make(map[string][]string)
-
-	urlTopicList = fmt.Sprintf("https://groups.google.com%s/forum/?_escaped_fragment_=forum/%s", org, groupName)
-
-	//Get total topics to track all topics (e.g. messages) are pulled
-	if dom, err = httpToDom(urlTopicList); err != nil {
-		return
+// Create the provenance metadata for a year-month text filename. Files without a date only get the group details.
+func monthMeta(org, groupName, fileName string) (meta gcs.ObjectMeta) {
+	meta = gcs.ObjectMeta{
+		SourceURL:   forumURL(org, groupName),
+		MailingList: "gg",
+		GroupName:   groupName,
 	}
+	if fileDate, err := time.Parse("2006-01", strings.TrimSuffix(fileName, ".txt")); err == nil {
+		meta.StartDate = fileDate.Format("2006-01-02")
+		meta.EndDate = utils.AddMonth(fileDate).Format("2006-01-02")
+	}
+	return
+}
 
-	totalMessages = getTotalTopics(dom)
+// Goroutine to process getting full text and storing into GCS. The workers are shared between the files so each file
+// fetches its messages with the workers left over.
+func storeRawMsgByMonth(ctx context.Context, storage gcs.Connection, org, groupName string, worker int, msgResults map[string][]string, httpToString utils.HttpStringResponse) (err error) {
 
-	// TODO find a better way to avoid pulling all data. Hit connection reset by peer error that inspired this
-	if !allDateRun {
-		totalMessages = int(float64(totalMessages) * .07)
-		log.Printf("Googlegroups message total review limited to %d because getting a limited duration.", totalMessages)
-	}
+	rawMsgsUrlJobs := make(chan jobsData, len(msgResults))
+	results := make(chan error, len(msgResults))
 
-	// Lower worker # if its greater than totalMessages / 100 or % 100
-	if totalMessages >= 100 {
-		worker = int(math.Min(float64(worker), float64(totalMessages/100+1)))
-	} else {
-		worker = int(math.Min(float64(worker), float64(totalMessages%100)))
+	var fetchers int
+	if len(msgResults) > 0 {
+		fetchers = worker / len(msgResults)
 	}
-	if worker == 0 {
-		worker = 1
+	if worker > len(msgResults) {
+		worker = len(msgResults)
 	}
 
-	topicURLJobs := make(chan string, int(totalMessages/100)+1)
-	results := make(chan urlResults, int(totalMessages/100)+1)
-
-	defer close(results)
-
 	for i := 0; i < worker; i++ {
-		go getRawMsgURLWorker(org, groupName, startDateTime, endDateTime, httpToDom, topicToMsgMap, topicURLJobs, results)
+		go storeTextWorker(ctx, storage, httpToString, fetchers, rawMsgsUrlJobs, results)
 	}
 
-	// Loop over each page to pull all topic urls and setup jobs
-	for i := 0; i < int(totalMessages/100); i++ {
-		topicURLJobs <- fmt.Sprintf("%s[%d-%d]", urlTopicList, pageIndex+1, pageIndex+100)
-		pageIndex = pageIndex + 100
-	}
-	if totalMessages%100 > 0 {
-		topicURLJobs <- fmt.Sprintf("%s[%d-%d]", urlTopicList, totalMessages-totalMessages%100+1, totalMessages)
+	for fileName, urlList := range msgResults {
+		rawMsgsUrlJobs <- jobsData{urlList, fileName, monthMeta(org, groupName, fileName)}
 	}
-	close(topicURLJobs)
+	close(rawMsgsUrlJobs)
 
-	// Combine all raw msg urls under the same year month filename
+	// Read every worker's result so none is left sending after an error is returned
 	for i := 0; i < worker; i++ {
-		rawMsgURLListOutput := <-results
-		if rawMsgURLListOutput.err != nil {
-			err = rawMsgURLListOutput.err
-			return
-		}
-		for fileName, rawMsgURL := range rawMsgURLListOutput.urlMap {
-			rawMsgUrlMap[fileName] = append(rawMsgUrlMap[fileName], rawMsgURL...)
-			countMsgs = countMsgs + len(rawMsgURL)
-			//log.Printf("Worker %d result in final: %d filename results grabbed for file: %s.", i, len(rawMsgURL), fileName)
+		if output := <-results; output != nil && err == nil {
+			err = output
 		}
 	}
-
-	if totalMessages == countMsgs || totalMessages+1 == countMsgs {
-		log.Printf("All topics captured: total topics captured are %d.", totalMessages)
-
-	} else {
-		//Warns but does not throw an error because it may run a full data load or a partial load based on restricted start and end date.
-		log.Printf("%d topics captured out of %d total topics. If running a load of all topics this is an error; otherwise, probably limited by a shorter timespan being captured.", countMsgs, totalMessages)
-	}
 	return
 }
 
-// Worker to get text blobs by year-month text filename and store into GCS
-func storeTextWorker(ctx context.Context, storage gcs.Connection, httpToString utils.HttpStringResponse, rawMsgsUrlJobs <-chan jobsData, results chan<- error) {
-	var (
-		response string
-		err      error
-	)
-
-	for urls := range rawMsgsUrlJobs {
-		textStore := ""
-		for _, msgURL := range urls.topicURLList {
-			if response, err = httpToString(msgURL); err != nil {
-				results <- fmt.Errorf("HTTP error: %v", err)
-				return
-			}
-			if response == "" && msgURL == "" {
-				log.Printf("Url and response was empty for filename: %s", urls.fileName)
-			} else if response == "" {
-				log.Printf("Response was empty for url: %s", msgURL)
-			}
-			textStore = textStore + "/n" + response + "\n" + fmt.Sprintf("original_url: %s", msgURL) + "\n"
-		}
-		if urls.fileName == "" {
-			results <- fmt.Errorf("URL map filename threw an error: %w", emptyFileNameErr)
-			return
-		}
-		if _, err = storage.StoreContentInBucket(ctx, urls.fileName, textStore, "text"); err != nil {
-			results <- fmt.Errorf("%w: %v", storageErr, err)
-			return
-		}
-	}
-	results <- nil
+func init() {
+	source.Register("gg", NewSource)
+}
 
-	return
+// Google Groups version of the mailing list source
+type googleGroupsSource struct {
+	org          string
+	groups       []string
+	workers      int
+	httpToDom    utils.HttpDomResponse
+	httpToString utils.HttpStringResponse
+	mu           sync.Mutex
+	// Raw message urls listed for each group by year-month text filename
+	msgURLs map[string]map[string][]string
+	// Groups whose abuse file was stored with one of their months
+	abuseStored map[string]bool
 }
 
-// Goroutine to process getting full text and storing into GCS
-func storeRawMsgByMonth(ctx context.Context, storage gcs.Connection, worker int, msgResults map[string][]string, httpToString utils.HttpStringResponse) (err error) {
+// Create the Google Groups source. Org is the organization path for groups outside of groups.google.com/forum.
+func NewSource(config source.Config) (source.Source, error) {
+	return &googleGroupsSource{
+		org:          config.Org,
+		groups:       config.Groups,
+		workers:      config.Workers,
+		httpToDom:    config.HttpToDom,
+		httpToString: config.HttpToString,
+		msgURLs:      make(map[string]map[string][]string),
+		abuseStored:  make(map[string]bool),
+	}, nil
+}
 
-	rawMsgsUrlJobs := make(chan jobsData, len(msgResults))
-	results := make(chan error, len(msgResults))
-	defer close(results)
+func (gg *googleGroupsSource) Name() string {
+	return "gg"
+}
 
-	if worker > len(msgResults) {
-		worker = len(msgResults)
-	}
+// Google Groups are not discovered so the configured groups are returned.
+func (gg *googleGroupsSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	return gg.groups, nil
+}
 
-	for i := 0; i < worker; i++ {
-		go storeTextWorker(ctx, storage, httpToString, rawMsgsUrlJobs, results)
-	}
+// List raw message urls for the date range and return the months that have messages. The urls are kept for FetchMonth.
+// The abuse file isn't a month so it is stored with the first month fetched. The start month is listed when only
+// hidden conversations were found so the abuse file still gets stored.
+func (gg *googleGroupsSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var messageURLResults map[string][]string
 
-	for fileName, urlList := range msgResults {
-		rawMsgsUrlJobs <- jobsData{urlList, fileName}
+	if messageURLResults, err = listRawMsgURLsByMonth(gg.org, groupName, startDate, endDate, gg.workers, gg.httpToDom, gg.httpToString); err != nil {
+		return
 	}
-	close(rawMsgsUrlJobs)
 
-	for i := 0; i < worker; i++ {
-		output := <-results
-		if output != nil {
-			err = output
-			return
+	for fileName := range messageURLResults {
+		fileDate, parseErr := time.Parse("2006-01", strings.TrimSuffix(fileName, ".txt"))
+		if parseErr != nil {
+			continue
 		}
+		months = append(months, fileDate)
+	}
+	if len(months) == 0 && len(messageURLResults[abuseFileName]) > 0 {
+		months = append(months, time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, time.UTC))
 	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+
+	gg.mu.Lock()
+	gg.msgURLs[groupName] = messageURLResults
+	gg.mu.Unlock()
 	return
 }
 
-// Main function to run the script
-func GetGoogleGroupsData(ctx context.Context, org, groupName, startDateString, endDateString string, storage gcs.Connection, workerNum int, allDateRun bool) (err error) {
-
-	var (
-		messageURLResults          map[string][]string
-		httpToDom                  utils.HttpDomResponse
-		httpToString               utils.HttpStringResponse
-		topicToMsgMap              TopicIDToRawMsgUrlMap
-		startDateTime, endDateTime time.Time
-	)
-	httpToDom = utils.DomResponse
-	httpToString = utils.StringResponse
-	topicToMsgMap = topicIDToRawMsgUrlMap
-	log.Printf("GOOGLEGROUPS loading %s:", groupName)
-
-	// Setup start and end date times to limit what is loaded
-	if startDateTime, err = utils.GetDateTimeType(startDateString); err != nil {
-		return fmt.Errorf("Start date in GoogleGroups error: %v", err)
-	}
-	if endDateTime, err = utils.GetDateTimeType(endDateString); err != nil {
-		return fmt.Errorf("End date in GoogleGroups error: %v", err)
+// Get full text for the month's raw messages and store it in GCS. Lists the month first if Months was not called for the group.
+// The group's abuse file is stored alongside the first month fetched.
+func (gg *googleGroupsSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	fileName := getFileName(month)
+
+	gg.mu.Lock()
+	messageURLResults, ok := gg.msgURLs[groupName]
+	gg.mu.Unlock()
+	if !ok {
+		if messageURLResults, err = listRawMsgURLsByMonth(gg.org, groupName, month, utils.AddMonth(month), gg.workers, gg.httpToDom, gg.httpToString); err != nil {
+			return
+		}
 	}
 
-	if messageURLResults, err = listRawMsgURLsByMonth(org, groupName, startDateTime, endDateTime, workerNum, httpToDom, topicToMsgMap, allDateRun); err != nil {
-		return
+	msgResults := make(map[string][]string)
+	if len(messageURLResults[fileName]) > 0 {
+		msgResults[fileName] = messageURLResults[fileName]
 	}
+	gg.mu.Lock()
+	if len(messageURLResults[abuseFileName]) > 0 && !gg.abuseStored[groupName] {
+		msgResults[abuseFileName] = messageURLResults[abuseFileName]
+		gg.abuseStored[groupName] = true
+	}
+	gg.mu.Unlock()
 
-	if err = storeRawMsgByMonth(ctx, storage, workerNum, messageURLResults, httpToString); err != nil {
+	if len(msgResults) == 0 {
+		log.Printf("No googlegroups messages for %s in %s.", groupName, fileName)
 		return
 	}
-	return
+	return storeRawMsgByMonth(ctx, storage, gg.org, groupName, gg.workers, msgResults, gg.httpToString)
 }
@@ -18,11 +18,12 @@ import (
 	"context"
 	"errors"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
@@ -162,249 +163,6 @@ func TestGetFileName(t *testing.T) {
 	}
 }
 
-func TestGetTotalTopics(t *testing.T) {
-	exCorrectDom100, _ := utils.FakeHttpDomResponse("https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopics100")
-	exCorrectDomLess, _ := utils.FakeHttpDomResponse("https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopicsLess")
-	exMissingDom, _ := utils.FakeHttpDomResponse("https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopicsMissBody")
-
-	var (
-		gotTotalTopics int
-	)
-
-	tests := []struct {
-		comparisonType  string
-		dom             *goquery.Document
-		wantTotalTopics int
-	}{
-		{
-			comparisonType:  "Test regex to read total topics more than 100.",
-			dom:             exCorrectDom100,
-			wantTotalTopics: 100,
-		},
-		{
-			comparisonType:  "Test regex to read total topics less than 100.",
-			dom:             exCorrectDomLess,
-			wantTotalTopics: 1,
-		},
-		{
-			comparisonType:  "Test regex if info does not exist.",
-			dom:             exMissingDom,
-			wantTotalTopics: 0,
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.comparisonType, func(t *testing.T) {
-			gotTotalTopics = getTotalTopics(test.dom)
-			if gotTotalTopics != test.wantTotalTopics {
-				t.Errorf("Total topic response does not match.\n got: %v\nwant: %v", gotTotalTopics, test.wantTotalTopics)
-			}
-		})
-	}
-}
-
-func TestGetMsgIDsFromDom(t *testing.T) {
-
-	exMsgIdDom, _ := utils.FakeHttpDomResponse("msgIdsFromDom")
-
-	var (
-		gotRawMsgUrl string
-	)
-	tests := []struct {
-		comparisonType string
-		org            string
-		topicId        string
-		group          string
-		dom            *goquery.Document
-		wantRawMsgUrl  string
-	}{
-		{
-			comparisonType: "Output raw msg url",
-			topicId:        "Kamakaʻeha",
-			group:          "queen",
-			dom:            exMsgIdDom,
-			wantRawMsgUrl:  "https://groups.google.com/forum/message/raw?msg=queen/Kamakaʻeha/1891",
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.comparisonType, func(t *testing.T) {
-			gotRawMsgUrl = getMsgIDsFromDom(test.org, test.topicId, test.group, test.dom)
-			if strings.Compare(gotRawMsgUrl, test.wantRawMsgUrl) != 0 {
-				t.Errorf("DateKey response does not match.\n got: %v\nwant: %v", gotRawMsgUrl, test.wantRawMsgUrl)
-			}
-		})
-	}
-}
-
-func TestTopicIDToRawMsgUrlMap(t *testing.T) {
-	now := time.Now()
-
-	exTopicIdDomTime, _ := utils.FakeHttpDomResponse("topicIDToRawMsgUrlMapTime")
-	exTopicIdDomDate, _ := utils.FakeHttpDomResponse("topicIDToRawMsgUrlMapDate")
-	exAbuseHiddenMsg, _ := utils.FakeHttpDomResponse("abuseHiddenMsg")
-	startDateTimeIdsTime, _ := utils.GetDateTimeType(now.Format("2006-01-02"))
-	endDateTimeIdsTime, _ := utils.GetDateTimeType(now.Format("2006-01-02"))
-	startDateTimeIdsDate, _ := utils.GetDateTimeType("2018-09-01")
-	endDateTimeIdsDate, _ := utils.GetDateTimeType("2018-09-30")
-
-	var (
-		gotRawMsgURLMap map[string][]string
-		gotErr          error
-	)
-	tests := []struct {
-		comparisonType   string
-		org              string
-		groupName        string
-		startDateTime    time.Time
-		endDateTime      time.Time
-		dom              *goquery.Document
-		wantRawMsgURLMap map[string][]string
-		wantErr          error
-	}{
-		{
-			comparisonType:   "Pull topic ids for time which would fall outside timespan and return empty.",
-			org:              "",
-			groupName:        "golang-checkins",
-			startDateTime:    startDateTimeIdsTime,
-			endDateTime:      endDateTimeIdsTime,
-			dom:              exTopicIdDomTime,
-			wantRawMsgURLMap: map[string][]string{},
-			wantErr:          nil,
-		},
-		{
-			comparisonType: "Pull topic ids for date",
-			org:            "",
-			groupName:      "golang-checkins",
-			startDateTime:  startDateTimeIdsDate,
-			endDateTime:    endDateTimeIdsDate,
-			dom:            exTopicIdDomDate,
-			wantRawMsgURLMap: map[string][]string{
-				"2018-09.txt": []string{"https://groups.google.com/forum/message/raw?msg=golang-checkins/8sv65_WCOS4/3Fc-diD_AwAJ"}},
-			wantErr: nil,
-		},
-		{
-			comparisonType: "Capture abuse flagged messages that were hidden.",
-			org:            "",
-			groupName:      "golang-checkins",
-			dom:            exAbuseHiddenMsg,
-			wantRawMsgURLMap: map[string][]string{
-				"abuse.txt": []string{"https://groups.google.com/forum/message/raw?msg=golang-checkins/8sv65_WCOS4/3Fc-diD_AwAJ"}},
-			wantErr: nil,
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotRawMsgURLMap, gotErr = topicIDToRawMsgUrlMap(test.org, test.groupName, test.startDateTime, test.endDateTime, test.dom); !errors.Is(gotErr, test.wantErr) {
-				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
-			}
-			if !reflect.DeepEqual(gotRawMsgURLMap, test.wantRawMsgURLMap) {
-				t.Errorf("Result response does not match.\n got: %v\nwant: %v", gotRawMsgURLMap, test.wantRawMsgURLMap)
-			}
-		})
-	}
-}
-
-// TODO verify the temp map is needed
-func TestGetRawMsgURLWorker(t *testing.T) {
-	var startDateTime, endDateTime time.Time
-
-	tests := []struct {
-		comparisonType string
-		org            string
-		groupName      string
-		httpToDom      utils.HttpDomResponse
-		topicToMsgMap  TopicIDToRawMsgUrlMap
-		wantUrlMap     map[string][]string
-		wantErr        error
-	}{
-		{
-			comparisonType: "Test worker call and getting url map result.",
-			groupName:      "totalTopicsLess",
-			httpToDom:      utils.FakeHttpDomResponse,
-			topicToMsgMap:  utils.FakeTopicIDToRawMsgUrlMap,
-			wantUrlMap:     map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}},
-			wantErr:        nil,
-		},
-	}
-	for _, test := range tests {
-		topicURLJobs := make(chan string, 1)
-		results := make(chan urlResults, 1)
-
-		t.Run(test.comparisonType, func(t *testing.T) {
-			go getRawMsgURLWorker(test.org, test.groupName, startDateTime, endDateTime, test.httpToDom, test.topicToMsgMap, topicURLJobs, results)
-
-			topicURLJobs <- "rawMsgUrlWorker"
-			close(topicURLJobs)
-
-			gotResult := <-results
-
-			if !errors.Is(gotResult.err, test.wantErr) {
-				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotResult.err, test.wantErr)
-			}
-			if !reflect.DeepEqual(gotResult.urlMap, test.wantUrlMap) {
-				t.Errorf("Raw message url response does not match.\n got: %v\nwant: %v", gotResult.urlMap, test.wantUrlMap)
-			}
-		})
-	}
-}
-
-func TestListRawMsgURLsByMonth(t *testing.T) {
-	var startDateTime, endDateTime time.Time
-	rawMsg100 := map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}}
-	for i := 0; i < 100; i++ {
-		rawMsg100["1893-01.txt"] = append(rawMsg100["1893-01.txt"], "https://en.wikipedia.org/wiki/Lili%CA%BBuokalani")
-	}
-
-	var (
-		gotRawMsgURLMap map[string][]string
-		gotErr          error
-	)
-
-	tests := []struct {
-		comparisonType   string
-		org              string
-		groupName        string
-		worker           int
-		httpToDom        utils.HttpDomResponse
-		topicToMsgMap    TopicIDToRawMsgUrlMap
-		allDateRun       bool
-		wantRawMsgURLMap map[string][]string
-		wantErr          error
-	}{
-		{
-			comparisonType:   "Pull topic ids for date 100+",
-			org:              "",
-			groupName:        "totalTopics100",
-			worker:           1,
-			httpToDom:        utils.FakeHttpDomResponse,
-			topicToMsgMap:    utils.FakeTopicIDToRawMsgUrlMap,
-			allDateRun:       true,
-			wantRawMsgURLMap: rawMsg100,
-			wantErr:          nil,
-		},
-		{
-			comparisonType:   "Pull topic ids for date under 100",
-			org:              "",
-			groupName:        "totalTopicsLess",
-			worker:           1,
-			httpToDom:        utils.FakeHttpDomResponse,
-			topicToMsgMap:    utils.FakeTopicIDToRawMsgUrlMap,
-			allDateRun:       true,
-			wantRawMsgURLMap: map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}},
-			wantErr:          nil,
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotRawMsgURLMap, gotErr = listRawMsgURLsByMonth(test.org, test.groupName, startDateTime, endDateTime, test.worker, test.httpToDom, test.topicToMsgMap, test.allDateRun); !errors.Is(gotErr, test.wantErr) {
-				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
-			}
-			if !reflect.DeepEqual(gotRawMsgURLMap, test.wantRawMsgURLMap) {
-				t.Errorf("Result response does not match.\n got: %v\nwant: %v", gotRawMsgURLMap, test.wantRawMsgURLMap)
-			}
-		})
-	}
-}
-
 func TestStoreTextWorker(t *testing.T) {
 
 	ctx := context.Background()
@@ -439,13 +197,20 @@ func TestStoreTextWorker(t *testing.T) {
 			chanInput:      jobsData{topicURLList: []string{"Lili'uokalani", "rawMsgUrlWorker"}, fileName: ""},
 			wantErr:        emptyFileNameErr,
 		},
+		{
+			comparisonType: "Test storage error on streamed text.",
+			groupName:      "",
+			httpToString:   utils.FakeHttpstringResponse,
+			chanInput:      jobsData{topicURLList: []string{"rawMsgUrlWorker", "https://en.wikipedia.org/wiki/Susan_La_Flesche_Picotte"}, fileName: "Lili'uokalani"},
+			wantErr:        storageErr,
+		},
 	}
 	for _, test := range tests {
 		rawMsgsUrlJobs := make(chan jobsData, 1)
 		results := make(chan error, 1)
 
 		t.Run(test.comparisonType, func(t *testing.T) {
-			go storeTextWorker(ctx, storage, test.httpToString, rawMsgsUrlJobs, results)
+			go storeTextWorker(ctx, storage, test.httpToString, 2, rawMsgsUrlJobs, results)
 
 			rawMsgsUrlJobs <- test.chanInput
 			close(rawMsgsUrlJobs)
@@ -459,6 +224,42 @@ func TestStoreTextWorker(t *testing.T) {
 	}
 }
 
+func TestMonthMeta(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantMeta       gcs.ObjectMeta
+	}{
+		{
+			comparisonType: "Test month filename sets the covered dates",
+			fileName:       "1893-01.txt",
+			wantMeta: gcs.ObjectMeta{
+				SourceURL:   "https://groups.google.com/g/Liliuokalani",
+				MailingList: "gg",
+				GroupName:   "Liliuokalani",
+				StartDate:   "1893-01-01",
+				EndDate:     "1893-02-01",
+			},
+		},
+		{
+			comparisonType: "Test filename without a date",
+			fileName:       "abuse.txt",
+			wantMeta: gcs.ObjectMeta{
+				SourceURL:   "https://groups.google.com/g/Liliuokalani",
+				MailingList: "gg",
+				GroupName:   "Liliuokalani",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotMeta := monthMeta("", "Liliuokalani", test.fileName); !reflect.DeepEqual(gotMeta, test.wantMeta) {
+				t.Errorf("Metadata does not match.\n got: %+v\nwant: %+v", gotMeta, test.wantMeta)
+			}
+		})
+	}
+}
+
 func TestStoreRawMsgByMonth(t *testing.T) {
 
 	ctx := context.Background()
@@ -486,13 +287,92 @@ func TestStoreRawMsgByMonth(t *testing.T) {
 			msgResults:     map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani", "https://www.biography.com/royalty/liliuokalani"}},
 			wantErr:        nil,
 		},
+		{
+			comparisonType: "Test every worker result is read when files fail",
+			org:            "",
+			groupName:      "totalTopicsLess",
+			worker:         2,
+			httpToString:   utils.FakeHttpstringResponse,
+			msgResults: map[string][]string{
+				"1893-02.txt": []string{"rawMsgUrlWorker", "https://en.wikipedia.org/wiki/Susan_La_Flesche_Picotte"},
+				"abuse.txt":   []string{"rawMsgUrlWorker", "https://en.wikipedia.org/wiki/Susan_La_Flesche_Picotte"},
+			},
+			wantErr: storageErr,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotErr = storeRawMsgByMonth(ctx, storage, test.worker, test.msgResults, test.httpToString); !errors.Is(gotErr, test.wantErr) {
+			if gotErr = storeRawMsgByMonth(ctx, storage, test.org, test.groupName, test.worker, test.msgResults, test.httpToString); !errors.Is(gotErr, test.wantErr) {
 				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
 			}
 
 		})
 	}
 }
+
+func TestSourceMonthsAndFetch(t *testing.T) {
+	ctx := context.Background()
+	startDateTime, _ := time.Parse("2006-01-02", "1893-01-01")
+	endDateTime, _ := time.Parse("2006-01-02", "1893-03-01")
+
+	var (
+		gotMonths []time.Time
+		gotErr    error
+	)
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		listFirst      bool
+		wantMonths     []time.Time
+		wantStored     []string
+		wantErr        error
+	}{
+		{
+			comparisonType: "List months then fetch from the cached urls with the abuse file",
+			groupName:      "Liliuokalani",
+			listFirst:      true,
+			wantMonths:     []time.Time{startDateTime, utils.AddMonth(startDateTime)},
+			wantStored:     []string{"1893-01.txt", "abuse.txt"},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Fetch month without listing first",
+			groupName:      "Liliuokalani",
+			listFirst:      false,
+			wantStored:     []string{"1893-01.txt", "abuse.txt"},
+			wantErr:        nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			storage := utils.NewFakeStorageConnection("googlegroups")
+			src := &googleGroupsSource{
+				workers:      4,
+				httpToDom:    fakeGroupsUIDom,
+				httpToString: utils.FakeHttpstringResponse,
+				msgURLs:      make(map[string]map[string][]string),
+				abuseStored:  make(map[string]bool),
+			}
+			if test.listFirst {
+				if gotMonths, gotErr = src.Months(ctx, test.groupName, startDateTime, endDateTime); !errors.Is(gotErr, test.wantErr) {
+					t.Errorf("Months error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+				}
+				if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+					t.Errorf("Months do not match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+				}
+			}
+			if gotErr = src.FetchMonth(ctx, storage, test.groupName, startDateTime); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("FetchMonth error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			var gotStored []string
+			for fileName := range storage.StoredMeta {
+				gotStored = append(gotStored, fileName)
+			}
+			sort.Strings(gotStored)
+			if !reflect.DeepEqual(gotStored, test.wantStored) {
+				t.Errorf("Stored files do not match.\n got: %v\nwant: %v", gotStored, test.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package googlegroups
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const (
+	// Conversation list for a group, newest activity first | org, group
+	forumURLFormat = "https://groups.google.com%s/g/%s"
+	// Conversation with all its messages | org, group, topic id
+	conversationURLFormat = "https://groups.google.com%s/g/%s/c/%s"
+	// Original message with full headers | org, group, topic id, message id
+	rawMsgURLFormat = "https://groups.google.com%s/g/%s/c/%s/m/%s/raw"
+	// Messages of conversations hidden for abuse, which have no date to file them by
+	abuseFileName = "abuse.txt"
+)
+
+var (
+	// Dates shown on the conversation list. Times are for today and dates without a year are for this year.
+	fullDateLayouts = []string{"Jan 2, 2006, 3:04:05 PM", "Jan 2, 2006, 3:04 PM", "Jan 2, 2006"}
+	yearDateLayout  = "Jan 2"
+	todayLayout     = "3:04 PM"
+)
+
+// Conversation row from a conversation list page
+type conversation struct {
+	topicID  string
+	subject  string
+	lastPost time.Time
+	// Rows hidden for abuse or without a readable date have no last post date
+	hasDate bool
+}
+
+// Url of the conversation list for the group.
+func forumURL(org, groupName string) string {
+	return fmt.Sprintf(forumURLFormat, org, groupName)
+}
+
+// Topic or message id that follows the marker in a link such as ./c/[TOPIC ID] or ./c/[TOPIC ID]/m/[MSG ID].
+func idAfter(href, marker string) (id string) {
+	idx := strings.Index(href, marker)
+	if idx < 0 {
+		return
+	}
+	id = href[idx+len(marker):]
+	if end := strings.IndexAny(id, "/?#"); end >= 0 {
+		id = id[:end]
+	}
+	return
+}
+
+// Parse the last post date shown on a conversation row. The title holds the full date when the text is shortened.
+func parseLastPostDate(title, text string, now time.Time) (lastPost time.Time, ok bool) {
+	for _, value := range []string{strings.TrimSpace(title), strings.TrimSpace(text)} {
+		if value == "" {
+			continue
+		}
+		for _, layout := range fullDateLayouts {
+			if lastPost, err := time.Parse(layout, value); err == nil {
+				return lastPost, true
+			}
+		}
+		if lastPost, err := time.Parse(yearDateLayout, value); err == nil {
+			return lastPost.AddDate(now.Year(), 0, 0), true
+		}
+		if _, err := time.Parse(todayLayout, value); err == nil {
+			return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), true
+		}
+		// Older pages show numeric dates such as 9/27/18
+		if strings.Count(value, "/") != 2 {
+			continue
+		}
+		if lastPost, err := getFileDate(value); err == nil && !lastPost.IsZero() {
+			return lastPost, true
+		}
+	}
+	return
+}
+
+// Parse the conversation rows on a list page.
+func parseConversationList(dom *goquery.Document, now time.Time) (conversations []conversation) {
+	dom.Find(`[role="row"]`).Each(func(i int, row *goquery.Selection) {
+		var conv conversation
+
+		link := row.Find(`a[href*="/c/"]`).First()
+		href, _ := link.Attr("href")
+		if conv.topicID = idAfter(href, "/c/"); conv.topicID == "" {
+			return
+		}
+		conv.subject = strings.TrimSpace(link.Text())
+
+		date := row.Find(`[role="gridcell"]`).Last().Find("span").Last()
+		title, _ := date.Attr("title")
+		conv.lastPost, conv.hasDate = parseLastPostDate(title, date.Text(), now)
+		conversations = append(conversations, conv)
+	})
+	return
+}
+
+// Absolute url of the next conversation list page. Empty on the last page. Links are relative to the page's base
+// element when it has one.
+func nextPageURL(pageURL string, dom *goquery.Document) (nextURL string) {
+	href, ok := dom.Find(`a[aria-label="Next page"]`).First().Attr("href")
+	if !ok || href == "" {
+		return
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return
+	}
+	if baseHref, ok := dom.Find("base").First().Attr("href"); ok {
+		if baseURL, err := url.Parse(baseHref); err == nil {
+			base = base.ResolveReference(baseURL)
+		}
+	}
+	next, err := url.Parse(href)
+	if err != nil {
+		return
+	}
+	return base.ResolveReference(next).String()
+}
+
+// Message from a conversation page
+type conversationMsg struct {
+	msgID string
+	date  time.Time
+	// Hidden messages and links without a readable date have no date
+	hasDate bool
+}
+
+// Messages on a conversation page in page order. The date is the one shown on the link to the message.
+func parseConversationMsgs(dom *goquery.Document, now time.Time) (msgs []conversationMsg) {
+	index := make(map[string]int)
+
+	dom.Find(`a[href*="/m/"]`).Each(func(i int, link *goquery.Selection) {
+		href, _ := link.Attr("href")
+		msgID := idAfter(href, "/m/")
+		if msgID == "" {
+			return
+		}
+		if _, ok := index[msgID]; !ok {
+			index[msgID] = len(msgs)
+			msgs = append(msgs, conversationMsg{msgID: msgID})
+		}
+		title, _ := link.Attr("title")
+		if msg := &msgs[index[msgID]]; !msg.hasDate {
+			msg.date, msg.hasDate = parseLastPostDate(title, link.Text(), now)
+		}
+	})
+	return
+}
+
+// Walk the conversation list pages and keep the conversations with a last post on or after the start date. Later
+// conversations are kept too because their earlier messages can be in range. Conversations hidden for abuse have no
+// date and are kept from every page walked. Pages list the newest activity first so paging stops once the last dated
+// conversation on a page is before the start date.
+func listConversations(org, groupName string, startDateTime time.Time, httpToDom utils.HttpDomResponse) (conversations []conversation, err error) {
+	var (
+		dom      *goquery.Document
+		lastPost time.Time
+	)
+	now := time.Now().UTC()
+	seen := make(map[string]bool)
+
+	for pageURL := forumURL(org, groupName); pageURL != "" && !seen[pageURL]; pageURL = nextPageURL(pageURL, dom) {
+		seen[pageURL] = true
+		if dom, err = httpToDom(pageURL); err != nil {
+			err = fmt.Errorf("%w on %s: %v", topicCaptureErr, pageURL, err)
+			return
+		}
+		lastPost = time.Time{}
+		for _, conv := range parseConversationList(dom, now) {
+			if !conv.hasDate {
+				log.Printf("Keeping conversation %s in %s for %s because it has no date.", conv.topicID, groupName, abuseFileName)
+				conversations = append(conversations, conv)
+				continue
+			}
+			lastPost = conv.lastPost
+			if !conv.lastPost.Before(startDateTime) {
+				conversations = append(conversations, conv)
+			}
+		}
+		// Pinned conversations can be older than the rest of the page so only the last one decides
+		if !lastPost.IsZero() && lastPost.Before(startDateTime) {
+			log.Printf("Stopped paging %s at %s because conversations are before %s.", groupName, pageURL, startDateTime.Format("2006-01-02"))
+			break
+		}
+	}
+	return
+}
+
+// Raw message urls by year-month text filename, shared by the conversation workers. Each message is kept once even
+// when conversations are listed again or a thread spans several months.
+type monthMessages struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	byMonth map[string][]rawMessage
+}
+
+type rawMessage struct {
+	url  string
+	date time.Time
+}
+
+// Mark the url as seen and report whether it was new.
+func (mm *monthMessages) claim(msgURL string) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.seen[msgURL] {
+		return false
+	}
+	mm.seen[msgURL] = true
+	return true
+}
+
+func (mm *monthMessages) add(msg rawMessage) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	fileName := getFileName(msg.date)
+	mm.byMonth[fileName] = append(mm.byMonth[fileName], msg)
+}
+
+// Keep the url of a message from a conversation hidden for abuse.
+func (mm *monthMessages) addAbuse(msgURL string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.byMonth[abuseFileName] = append(mm.byMonth[abuseFileName], rawMessage{url: msgURL})
+}
+
+// Urls for each month in message date order.
+func (mm *monthMessages) urlMap() (rawMsgUrlMap map[string][]string) {
+	rawMsgUrlMap = make(map[string][]string)
+	for fileName, msgs := range mm.byMonth {
+		sort.Slice(msgs, func(i, j int) bool {
+			if msgs[i].date.Equal(msgs[j].date) {
+				return msgs[i].url < msgs[j].url
+			}
+			return msgs[i].date.Before(msgs[j].date)
+		})
+		for _, msg := range msgs {
+			rawMsgUrlMap[fileName] = append(rawMsgUrlMap[fileName], msg.url)
+		}
+	}
+	return
+}
+
+// The conversation page shows dates in the viewer's timezone, so a message shown within a day of a month boundary can
+// belong to the month next to it.
+func nearMonthBoundary(date time.Time) bool {
+	return date.AddDate(0, 0, 1).Month() != date.Month() || date.AddDate(0, 0, -1).Month() != date.Month()
+}
+
+// Date from the Date header of the raw message in UTC.
+func rawMsgDate(msgURL string, httpToString utils.HttpStringResponse) (date time.Time, err error) {
+	var (
+		raw string
+		msg *mail.Message
+	)
+
+	if raw, err = httpToString(msgURL); err != nil {
+		return
+	}
+	if msg, err = mail.ReadMessage(strings.NewReader(raw)); err != nil {
+		return
+	}
+	if date, err = msg.Header.Date(); err != nil {
+		return
+	}
+	return date.UTC(), nil
+}
+
+// Get every raw message url on each conversation page and keep the ones in the date range by their own month. The
+// date on the page files most messages. Messages near a month boundary or without a date on the page are filed by the
+// Date header of the raw message, and use the conversation's last post date when that fails. Messages of
+// conversations hidden for abuse are all kept in the abuse file.
+func conversationMsgWorker(org, groupName string, startDateTime, endDateTime time.Time, httpToDom utils.HttpDomResponse, httpToString utils.HttpStringResponse, jobs <-chan conversation, results chan<- error, msgs *monthMessages) {
+	now := time.Now().UTC()
+
+	for conv := range jobs {
+		convURL := fmt.Sprintf(conversationURLFormat, org, groupName, conv.topicID)
+		dom, err := httpToDom(convURL)
+		if err != nil {
+			results <- fmt.Errorf("%w on %s: %v", rawMsgWorkerErr, convURL, err)
+			return
+		}
+		for _, convMsg := range parseConversationMsgs(dom, now) {
+			msgURL := fmt.Sprintf(rawMsgURLFormat, org, groupName, conv.topicID, convMsg.msgID)
+			if !msgs.claim(msgURL) {
+				continue
+			}
+			if !conv.hasDate {
+				msgs.addAbuse(msgURL)
+				continue
+			}
+			msgDate := convMsg.date
+			if !convMsg.hasDate || nearMonthBoundary(msgDate) {
+				headerDate, err := rawMsgDate(msgURL, httpToString)
+				switch {
+				case err == nil:
+					msgDate = headerDate
+				case convMsg.hasDate:
+					log.Printf("Using the page date for %s because the Date header failed: %v", msgURL, err)
+				default:
+					log.Printf("Using the conversation date for %s because the Date header failed: %v", msgURL, err)
+					msgDate = conv.lastPost
+				}
+			}
+			if utils.InTimeSpan(msgDate, startDateTime, endDateTime) {
+				msgs.add(rawMessage{url: msgURL, date: msgDate})
+			}
+		}
+	}
+	results <- nil
+}
+
+// List raw message urls by year-month text filename of each message's date for the messages in the date range.
+func listRawMsgURLsByMonth(org, groupName string, startDateTime, endDateTime time.Time, worker int, httpToDom utils.HttpDomResponse, httpToString utils.HttpStringResponse) (rawMsgUrlMap map[string][]string, err error) {
+	var conversations []conversation
+	msgs := &monthMessages{seen: make(map[string]bool), byMonth: make(map[string][]rawMessage)}
+
+	if conversations, err = listConversations(org, groupName, startDateTime, httpToDom); err != nil {
+		return
+	}
+	log.Printf("%d googlegroups conversations with activity since %s for %s.", len(conversations), startDateTime.Format("2006-01-02"), groupName)
+	if len(conversations) == 0 {
+		return msgs.urlMap(), nil
+	}
+	if worker > len(conversations) {
+		worker = len(conversations)
+	}
+
+	jobs := make(chan conversation, len(conversations))
+	results := make(chan error, worker)
+	for i := 0; i < worker; i++ {
+		go conversationMsgWorker(org, groupName, startDateTime, endDateTime, httpToDom, httpToString, jobs, results, msgs)
+	}
+	for _, conv := range conversations {
+		jobs <- conv
+	}
+	close(jobs)
+
+	for i := 0; i < worker; i++ {
+		if output := <-results; output != nil && err == nil {
+			err = output
+		}
+	}
+	rawMsgUrlMap = msgs.urlMap()
+	return
+}
@@ -0,0 +1,421 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package googlegroups
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+// Pages saved from the current Groups UI for the Liliuokalani test group
+var groupsUIFixtures = map[string]string{
+	"https://groups.google.com/g/Liliuokalani":                   "forum_page1.html",
+	"https://groups.google.com/g/Liliuokalani?page=2":            "forum_page2.html",
+	"https://groups.google.com/g/Liliuokalani/c/Hawaii-1893":     "conversation.html",
+	"https://groups.google.com/g/Liliuokalani/c/Iolani-1893":     "conversation_iolani.html",
+	"https://groups.google.com/g/Liliuokalani/c/Hidden-1892":     "conversation_hidden.html",
+	"https://groups.google.com/g/Liliuokalani/c/Abdication-1893": "conversation_abdication.html",
+	"https://groups.google.com/a/hawaii.gov/g/Liliuokalani":      "forum_page2.html",
+}
+
+// Serve the fixture for the url. Urls without a fixture fail like a missing page.
+func fakeGroupsUIDom(url string) (dom *goquery.Document, err error) {
+	var page []byte
+
+	fileName, ok := groupsUIFixtures[url]
+	if !ok {
+		return nil, fmt.Errorf("%s", "HTTP")
+	}
+	if page, err = ioutil.ReadFile(filepath.Join("testdata", fileName)); err != nil {
+		return
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(page))
+}
+
+// Raw messages for the fixture conversations served by the test Groups server.
+var groupsUIRawMsgs = map[string]string{
+	"https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw":      "From: Lydia Kamakaʻeha <queen@hawaii.gov>\nDate: Tue, 17 Jan 1893 18:00:00 -1030\nSubject: Protest to the Provisional Government\n\nI yield to the superior force of the United States.\n",
+	"https://groups.google.com/g/Liliuokalani/c/Iolani-1893/m/Constitution-0114/raw": "From: Lydia Kamakaʻeha <queen@hawaii.gov>\nDate: Sat, 14 Jan 1893 16:15:00 -1030\nSubject: Proposed constitution\n\nA new constitution.\n",
+}
+
+func TestParseLastPostDate(t *testing.T) {
+	now := time.Date(1893, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType string
+		title          string
+		text           string
+		wantDate       time.Time
+		wantOk         bool
+	}{
+		{
+			comparisonType: "Test full date and time in the title",
+			title:          "Jan 17, 1893, 6:00:00 PM",
+			text:           "Jan 17",
+			wantDate:       time.Date(1893, 1, 17, 18, 0, 0, 0, time.UTC),
+			wantOk:         true,
+		},
+		{
+			comparisonType: "Test full date in the text",
+			text:           "Feb 14, 1893",
+			wantDate:       time.Date(1893, 2, 14, 0, 0, 0, 0, time.UTC),
+			wantOk:         true,
+		},
+		{
+			comparisonType: "Test date without a year is this year",
+			text:           "Jan 17",
+			wantDate:       time.Date(1893, 1, 17, 0, 0, 0, 0, time.UTC),
+			wantOk:         true,
+		},
+		{
+			comparisonType: "Test time is today",
+			text:           "9:03 AM",
+			wantDate:       time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantOk:         true,
+		},
+		{
+			comparisonType: "Test numeric date from older pages",
+			text:           "9/27/18",
+			wantDate:       time.Date(2018, 9, 27, 0, 0, 0, 0, time.UTC),
+			wantOk:         true,
+		},
+		{
+			comparisonType: "Test no date",
+			text:           "Lydia Kamakaʻeha",
+			wantOk:         false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotDate, gotOk := parseLastPostDate(test.title, test.text, now)
+			if gotOk != test.wantOk || !gotDate.Equal(test.wantDate) {
+				t.Errorf("Date does not match.\n got: %v %v\nwant: %v %v", gotDate, gotOk, test.wantDate, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestParseConversationList(t *testing.T) {
+	now := time.Date(1893, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType    string
+		url               string
+		wantConversations []conversation
+	}{
+		{
+			comparisonType: "Test first page rows",
+			url:            "https://groups.google.com/g/Liliuokalani",
+			wantConversations: []conversation{
+				{topicID: "Hawaii-1893", subject: "Protest to the Provisional Government", lastPost: time.Date(1893, 2, 14, 9, 3, 0, 0, time.UTC), hasDate: true},
+				{topicID: "Iolani-1893", subject: "Proposed constitution", lastPost: time.Date(1893, 1, 14, 16, 15, 0, 0, time.UTC), hasDate: true},
+			},
+		},
+		{
+			comparisonType: "Test hidden row without a date",
+			url:            "https://groups.google.com/g/Liliuokalani?page=2",
+			wantConversations: []conversation{
+				{topicID: "Hidden-1892", subject: "This conversation has been hidden because it was flagged for abuse."},
+				{topicID: "Aloha-1878", subject: "Aloha ʻOe", lastPost: time.Date(1878, 12, 2, 0, 0, 0, 0, time.UTC), hasDate: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			dom, err := fakeGroupsUIDom(test.url)
+			if err != nil {
+				t.Fatalf("Fixture failed: %v", err)
+			}
+			if gotConversations := parseConversationList(dom, now); !reflect.DeepEqual(gotConversations, test.wantConversations) {
+				t.Errorf("Conversations do not match.\n got: %+v\nwant: %+v", gotConversations, test.wantConversations)
+			}
+		})
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		url            string
+		wantNextURL    string
+	}{
+		{
+			comparisonType: "Test next page link resolved against the base",
+			url:            "https://groups.google.com/g/Liliuokalani",
+			wantNextURL:    "https://groups.google.com/g/Liliuokalani?page=2",
+		},
+		{
+			comparisonType: "Test last page",
+			url:            "https://groups.google.com/g/Liliuokalani?page=2",
+			wantNextURL:    "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			dom, err := fakeGroupsUIDom(test.url)
+			if err != nil {
+				t.Fatalf("Fixture failed: %v", err)
+			}
+			if gotNextURL := nextPageURL(test.url, dom); gotNextURL != test.wantNextURL {
+				t.Errorf("Next page does not match.\n got: %v\nwant: %v", gotNextURL, test.wantNextURL)
+			}
+		})
+	}
+}
+
+func TestParseConversationMsgs(t *testing.T) {
+	now := time.Date(1893, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType string
+		url            string
+		wantMsgs       []conversationMsg
+	}{
+		{
+			comparisonType: "Test messages with the dates on their links",
+			url:            "https://groups.google.com/g/Liliuokalani/c/Hawaii-1893",
+			wantMsgs: []conversationMsg{
+				{msgID: "Protest-0117", date: time.Date(1893, 1, 17, 18, 0, 0, 0, time.UTC), hasDate: true},
+				{msgID: "Reply-0214", date: time.Date(1893, 2, 14, 9, 3, 0, 0, time.UTC), hasDate: true},
+			},
+		},
+		{
+			comparisonType: "Test hidden message without a date",
+			url:            "https://groups.google.com/g/Liliuokalani/c/Hidden-1892",
+			wantMsgs:       []conversationMsg{{msgID: "Flagged-1892"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			dom, err := fakeGroupsUIDom(test.url)
+			if err != nil {
+				t.Fatalf("Fixture failed: %v", err)
+			}
+			if gotMsgs := parseConversationMsgs(dom, now); !reflect.DeepEqual(gotMsgs, test.wantMsgs) {
+				t.Errorf("Messages do not match.\n got: %+v\nwant: %+v", gotMsgs, test.wantMsgs)
+			}
+		})
+	}
+}
+
+func TestMonthMessages(t *testing.T) {
+	msgs := &monthMessages{seen: make(map[string]bool), byMonth: make(map[string][]rawMessage)}
+
+	if !msgs.claim("Kaiulani") {
+		t.Errorf("First claim of the url failed.")
+	}
+	if msgs.claim("Kaiulani") {
+		t.Errorf("Second claim of the url should fail.")
+	}
+
+	msgs.add(rawMessage{url: "Kaiulani", date: time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC)})
+	msgs.add(rawMessage{url: "Kapiolani", date: time.Date(1893, 2, 1, 0, 0, 0, 0, time.UTC)})
+	msgs.add(rawMessage{url: "Kalakaua", date: time.Date(1893, 2, 1, 0, 0, 0, 0, time.UTC)})
+	wantRawMsgURLMap := map[string][]string{
+		"1893-02.txt": {"Kalakaua", "Kapiolani"},
+		"1893-03.txt": {"Kaiulani"},
+	}
+	if gotRawMsgURLMap := msgs.urlMap(); !reflect.DeepEqual(gotRawMsgURLMap, wantRawMsgURLMap) {
+		t.Errorf("Result response does not match.\n got: %v\nwant: %v", gotRawMsgURLMap, wantRawMsgURLMap)
+	}
+}
+
+func TestConversationMsgWorkerMonthBoundary(t *testing.T) {
+	// Only the messages shown near the end of January have their raw message read. The Abdication message was sent
+	// on the evening of January 31 in Honolulu, which is February 1 in UTC.
+	rawMsgs := map[string]string{
+		"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Abdication-0131/raw": "From: Lydia Kamakaʻeha <queen@hawaii.gov>\nDate: Tue, 31 Jan 1893 17:00:00 -1030\nSubject: Abdication\n\nA protest under duress.\n",
+	}
+	var gotRawURLs []string
+	httpToString := func(url string) (string, error) {
+		gotRawURLs = append(gotRawURLs, url)
+		if raw, ok := rawMsgs[url]; ok {
+			return raw, nil
+		}
+		return "", fmt.Errorf("%s", "HTTP")
+	}
+	msgs := &monthMessages{seen: make(map[string]bool), byMonth: make(map[string][]rawMessage)}
+	jobs := make(chan conversation, 1)
+	results := make(chan error, 1)
+
+	jobs <- conversation{topicID: "Abdication-1893", lastPost: time.Date(1893, 1, 31, 18, 0, 0, 0, time.UTC), hasDate: true}
+	close(jobs)
+	conversationMsgWorker("", "Liliuokalani", time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC), fakeGroupsUIDom, httpToString, jobs, results, msgs)
+	if gotErr := <-results; gotErr != nil {
+		t.Fatalf("Unexpected error: %v", gotErr)
+	}
+
+	wantRawMsgURLMap := map[string][]string{
+		"1893-01.txt": {
+			"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Annexation-0115/raw",
+			"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Envoy-0131/raw",
+		},
+		"1893-02.txt": {"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Abdication-0131/raw"},
+	}
+	if gotRawMsgURLMap := msgs.urlMap(); !reflect.DeepEqual(gotRawMsgURLMap, wantRawMsgURLMap) {
+		t.Errorf("Result response does not match.\n got: %v\nwant: %v", gotRawMsgURLMap, wantRawMsgURLMap)
+	}
+	wantRawURLs := []string{
+		"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Abdication-0131/raw",
+		"https://groups.google.com/g/Liliuokalani/c/Abdication-1893/m/Envoy-0131/raw",
+	}
+	if !reflect.DeepEqual(gotRawURLs, wantRawURLs) {
+		t.Errorf("Raw messages read do not match.\n got: %v\nwant: %v", gotRawURLs, wantRawURLs)
+	}
+}
+
+func TestListRawMsgURLsByMonth(t *testing.T) {
+	tests := []struct {
+		comparisonType   string
+		org              string
+		groupName        string
+		startDateTime    time.Time
+		endDateTime      time.Time
+		worker           int
+		wantRawMsgURLMap map[string][]string
+		wantErr          error
+	}{
+		{
+			comparisonType: "Test messages in range by their own month across pages",
+			groupName:      "Liliuokalani",
+			startDateTime:  time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:    time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC),
+			worker:         5,
+			wantRawMsgURLMap: map[string][]string{
+				"1893-01.txt": {
+					"https://groups.google.com/g/Liliuokalani/c/Iolani-1893/m/Constitution-0114/raw",
+					"https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw",
+				},
+				"1893-02.txt": {"https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Reply-0214/raw"},
+				"abuse.txt":   {"https://groups.google.com/g/Liliuokalani/c/Hidden-1892/m/Flagged-1892/raw"},
+			},
+		},
+		{
+			comparisonType: "Test thread with a later last post keeps its messages in range",
+			groupName:      "Liliuokalani",
+			startDateTime:  time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:    time.Date(1893, 2, 1, 0, 0, 0, 0, time.UTC),
+			worker:         1,
+			wantRawMsgURLMap: map[string][]string{
+				"1893-01.txt": {
+					"https://groups.google.com/g/Liliuokalani/c/Iolani-1893/m/Constitution-0114/raw",
+					"https://groups.google.com/g/Liliuokalani/c/Hawaii-1893/m/Protest-0117/raw",
+				},
+				"abuse.txt": {"https://groups.google.com/g/Liliuokalani/c/Hidden-1892/m/Flagged-1892/raw"},
+			},
+		},
+		{
+			comparisonType: "Capture abuse flagged messages that were hidden.",
+			groupName:      "Liliuokalani",
+			startDateTime:  time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:    time.Date(1893, 1, 16, 0, 0, 0, 0, time.UTC),
+			worker:         2,
+			wantRawMsgURLMap: map[string][]string{
+				"1893-01.txt": {"https://groups.google.com/g/Liliuokalani/c/Iolani-1893/m/Constitution-0114/raw"},
+				"abuse.txt":   {"https://groups.google.com/g/Liliuokalani/c/Hidden-1892/m/Flagged-1892/raw"},
+			},
+		},
+		{
+			comparisonType:   "Test no conversations in range",
+			groupName:        "Liliuokalani",
+			startDateTime:    time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:      time.Date(1900, 2, 1, 0, 0, 0, 0, time.UTC),
+			worker:           5,
+			wantRawMsgURLMap: map[string][]string{},
+		},
+		{
+			comparisonType: "Test conversation page error",
+			org:            "/a/hawaii.gov",
+			groupName:      "Liliuokalani",
+			startDateTime:  time.Date(1878, 12, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:    time.Date(1879, 1, 1, 0, 0, 0, 0, time.UTC),
+			worker:         1,
+			wantErr:        rawMsgWorkerErr,
+		},
+		{
+			comparisonType: "Test missing group",
+			groupName:      "Kaiulani",
+			startDateTime:  time.Date(1893, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDateTime:    time.Date(1893, 3, 1, 0, 0, 0, 0, time.UTC),
+			worker:         1,
+			wantErr:        topicCaptureErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotRawMsgURLMap, gotErr := listRawMsgURLsByMonth(test.org, test.groupName, test.startDateTime, test.endDateTime, test.worker, fakeGroupsUIDom, utils.FakeHttpstringResponse)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr == nil && !reflect.DeepEqual(gotRawMsgURLMap, test.wantRawMsgURLMap) {
+				t.Errorf("Result response does not match.\n got: %v\nwant: %v", gotRawMsgURLMap, test.wantRawMsgURLMap)
+			}
+		})
+	}
+}
+
+func TestListConversationsPaging(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		startDateTime  time.Time
+		wantTopicIDs   []string
+		wantPages      []string
+	}{
+		{
+			comparisonType: "Test paging stops at conversations before the start date",
+			startDateTime:  time.Date(1893, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantTopicIDs:   []string{"Hawaii-1893"},
+			wantPages:      []string{"https://groups.google.com/g/Liliuokalani"},
+		},
+		{
+			comparisonType: "Test paging continues while the page ends after the start date",
+			startDateTime:  time.Date(1878, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantTopicIDs:   []string{"Hawaii-1893", "Iolani-1893", "Hidden-1892", "Aloha-1878"},
+			wantPages:      []string{"https://groups.google.com/g/Liliuokalani", "https://groups.google.com/g/Liliuokalani?page=2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var gotPages, gotTopicIDs []string
+			httpToDom := func(url string) (*goquery.Document, error) {
+				gotPages = append(gotPages, url)
+				return fakeGroupsUIDom(url)
+			}
+
+			conversations, err := listConversations("", "Liliuokalani", test.startDateTime, httpToDom)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			for _, conv := range conversations {
+				gotTopicIDs = append(gotTopicIDs, conv.topicID)
+			}
+			if !reflect.DeepEqual(gotTopicIDs, test.wantTopicIDs) {
+				t.Errorf("Conversations do not match.\n got: %v\nwant: %v", gotTopicIDs, test.wantTopicIDs)
+			}
+			if !reflect.DeepEqual(gotPages, test.wantPages) {
+				t.Errorf("Pages fetched do not match.\n got: %v\nwant: %v", gotPages, test.wantPages)
+			}
+		})
+	}
+}
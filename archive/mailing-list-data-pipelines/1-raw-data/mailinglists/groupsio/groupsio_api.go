@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groupsio
+
+/*
+Read topics and messages through the groups.io API.
+
+Messages of a group oldest first, a page at a time, with has_more and the next_page_token to ask for the page after:
+[API URL]/getmessages?group_name=[GROUP]&sort_dir=asc&limit=100&page_token=[PAGE TOKEN]
+Messages of a topic oldest first, used to find the message that started it:
+[API URL]/getmessages?topic_id=[TOPIC ID]&sort_dir=asc&limit=1
+
+Every answer is a list object with the items in data. The API answers 429 with Retry-After when requests come too fast.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	apiErr = errors.New("groups.io api")
+)
+
+const (
+	// Rate limited requests are tried again this many times
+	maxRetries = 5
+	// Wait when a rate limited response doesn't say how long
+	retryFallback = 30 * time.Second
+	// Messages asked for in each page
+	pageLimit = 100
+)
+
+type apiMessage struct {
+	ID         int64     `json:"id"`
+	Created    time.Time `json:"created"`
+	UserID     int64     `json:"user_id"`
+	TopicID    int64     `json:"topic_id"`
+	MsgNum     int       `json:"msg_num"`
+	Subject    string    `json:"subject"`
+	IsReply    bool      `json:"is_reply"`
+	IsPlain    bool      `json:"is_plain_text"`
+	Body       string    `json:"body"`
+	SenderName string    `json:"name"`
+}
+
+type apiMessageList struct {
+	HasMore       bool         `json:"has_more"`
+	NextPageToken int64        `json:"next_page_token"`
+	Data          []apiMessage `json:"data"`
+}
+
+// Get and decode a JSON API response, trying again after the wait the API asks for while it answers 429.
+func getAPI(ctx context.Context, httpToReader utils.HttpReaderResponse, token, apiURL string, value interface{}) (err error) {
+	var (
+		body   io.ReadCloser
+		header http.Header
+	)
+
+	requestHeader := http.Header{}
+	if token != "" {
+		requestHeader.Set("Authorization", "Bearer "+token)
+	}
+	for attempt := 0; ; attempt++ {
+		body, header, err = httpToReader(apiURL, requestHeader)
+		wait, limited := utils.RetryAfter(err, header, retryFallback)
+		if !limited || attempt == maxRetries {
+			break
+		}
+		log.Printf("Groups.io rate limited %s so waiting %v.", apiURL, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w get on %s: %v", apiErr, apiURL, err)
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(value); err != nil {
+		return fmt.Errorf("%w decode on %s: %v", apiErr, apiURL, err)
+	}
+	return
+}
+
+// Page of the group messages oldest first. The first page has token zero.
+func getMessagePage(ctx context.Context, httpToReader utils.HttpReaderResponse, token, apiURL, groupName string, pageToken int64) (page apiMessageList, err error) {
+	query := url.Values{}
+	query.Set("group_name", groupName)
+	query.Set("sort_dir", "asc")
+	query.Set("limit", strconv.Itoa(pageLimit))
+	if pageToken != 0 {
+		query.Set("page_token", strconv.FormatInt(pageToken, 10))
+	}
+	err = getAPI(ctx, httpToReader, token, apiURL+"/getmessages?"+query.Encode(), &page)
+	return
+}
+
+// Id of the message that started the topic. Zero when the topic has no messages left.
+func getTopicStarter(ctx context.Context, httpToReader utils.HttpReaderResponse, token, apiURL string, topicID int64) (messageID int64, err error) {
+	var page apiMessageList
+
+	query := url.Values{}
+	query.Set("topic_id", strconv.FormatInt(topicID, 10))
+	query.Set("sort_dir", "asc")
+	query.Set("limit", "1")
+	if err = getAPI(ctx, httpToReader, token, apiURL+"/getmessages?"+query.Encode(), &page); err != nil || len(page.Data) == 0 {
+		return
+	}
+	return page.Data[0].ID, nil
+}
@@ -0,0 +1,511 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load groups.io groups, where many hardware and open hardware communities keep their lists.
+
+Groups are group names such as beagleboard or a subgroup such as beagleboard+dev. BaseURL is the API url and defaults
+to https://groups.io/api/v1. The API token comes from GROUPSIO_TOKEN and is needed for groups whose archives aren't
+public.
+
+Messages are read in id order a page at a time. The token of the page being read and the id of the last message
+already passed are kept as [PAGE TOKEN]:[MESSAGE ID] in the cursor metadata of groupsio-state.txt under the state
+prefix, outside the group subdirectory. Loading a month stores the new messages created in it up to the first message
+created after it, storing and moving the cursor after each page, so later months and later runs, including a run after
+an interrupted crawl, ask for the page they stopped on and resume there without storing anything twice. Messages that
+arrive late with an earlier date, messages created after the month that come before its last message on the page and
+messages dated in the future are stored in their own month.
+
+The first run passes over the messages created before its first month without storing them and keeps that month in the
+start date metadata of groupsio-state.txt. Messages up to the cursor are stored from the start date on, so a later run
+that starts earlier reads the pages up to the cursor again and stores the months before the start date from them
+without moving the cursor.
+
+Each message becomes an RFC 5322 style message with the body as groups.io has it, plain text or HTML. The Message-ID is
+built from the message id as <[MESSAGE ID]@groups.io>, and replies get In-Reply-To and References to the message that
+started their topic, which is looked up through the topic when it was stored by an earlier run. Groups.io doesn't
+publish addresses so senders get [USER ID]@users.groups.io.
+
+New messages are added to the end of the [YEAR]-[MONTH].mbox.gz file for their month, which records the id of the last
+message passed when it was stored in its cursor metadata. Messages up to that id are left out when a run stopped before
+moving the cursor for the group. With refresh never, months already stored at the ends of the range are skipped so use
+changed or always to add new messages to the current month.
+*/
+
+package groupsio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr = errors.New("Storage failed")
+	baseURLErr = errors.New("base url")
+	stateErr   = errors.New("groups.io state")
+)
+
+const (
+	defaultAPIURL = "https://groups.io/api/v1"
+	stateFile     = gcs.StatePrefix + "groupsio-state.txt"
+)
+
+func init() {
+	source.Register("groupsio", NewSource)
+}
+
+// Groups.io version of the mailing list source
+type groupsioSource struct {
+	apiURL       string
+	webURL       string
+	groups       []string
+	token        string
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Cursor and cached page by group, read once per source
+	groupStates map[string]*groupState
+}
+
+// Where the group's messages resume and what is known about them
+type groupState struct {
+	cursor
+	// Cursor was read from storage rather than starting fresh
+	seen bool
+	// First month stored. Messages up to the cursor created before it were passed over without storing them.
+	start time.Time
+	// Last page asked for, kept so the next month doesn't ask for it again
+	lastPage      apiMessageList
+	lastPageToken int64
+	lastPageRead  bool
+	// Id of the message that started each topic
+	starters map[int64]int64
+}
+
+// Token of the page being read and the id of the last message stored from it. The first page has token zero.
+type cursor struct {
+	pageToken int64
+	lastID    int64
+}
+
+// Message with the message that started its topic. The starter is zero when it can't be found.
+type threadMessage struct {
+	apiMessage
+	starterID int64
+}
+
+// Create the groups.io source. BaseURL defaults to the groups.io API.
+func NewSource(config source.Config) (source.Source, error) {
+	apiURL := strings.TrimRight(config.BaseURL, "/")
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	parsed, err := url.Parse(apiURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%w %q is not a groups.io API url", baseURLErr, config.BaseURL)
+	}
+	return &groupsioSource{
+		apiURL:       apiURL,
+		webURL:       fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host),
+		groups:       config.Groups,
+		token:        os.Getenv("GROUPSIO_TOKEN"),
+		httpToReader: config.HttpToReader,
+		groupStates:  make(map[string]*groupState),
+	}, nil
+}
+
+func (gs *groupsioSource) Name() string {
+	return "groupsio"
+}
+
+// Groups can't be discovered without joining them so only the configured groups are loaded.
+func (gs *groupsioSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	return gs.groups, nil
+}
+
+// Every month in the range. The messages after the cursor are only known once storage is read when fetching.
+func (gs *groupsioSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	return source.MonthRange(startDate, endDate), nil
+}
+
+func (gs *groupsioSource) groupURL(groupName string) string {
+	return fmt.Sprintf("%s/g/%s", gs.webURL, groupName)
+}
+
+// Parse the cursor as [PAGE TOKEN]:[MESSAGE ID].
+func parseCursor(value string) (c cursor, err error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return c, fmt.Errorf("%w cursor %q is not [PAGE TOKEN]:[MESSAGE ID]", stateErr, value)
+	}
+	if c.pageToken, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+		c.lastID, err = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w cursor %q: %v", stateErr, value, err)
+	}
+	return
+}
+
+func (c cursor) String() string {
+	return fmt.Sprintf("%d:%d", c.pageToken, c.lastID)
+}
+
+// Cursor and first month stored for the group subdirectory. Not seen before the first run. State stored before the
+// start date was kept has a zero start.
+func readCursor(ctx context.Context, storage gcs.Connection) (c cursor, start time.Time, seen bool, err error) {
+	var info gcs.ObjectInfo
+
+	if info, seen, err = storage.Stat(ctx, stateFile); err != nil || !seen {
+		return
+	}
+	if c, err = parseCursor(info.Metadata[gcs.MetaCursor]); err != nil {
+		return
+	}
+	if startDate := info.Metadata[gcs.MetaStartDate]; startDate != "" {
+		if start, err = time.Parse("2006-01-02", startDate); err != nil {
+			err = fmt.Errorf("%w start date on %s: %v", stateErr, info.Name, err)
+		}
+	}
+	return
+}
+
+// Record the cursor and first month stored for the group subdirectory.
+func (gs *groupsioSource) writeCursor(ctx context.Context, storage gcs.Connection, groupName string, c cursor, start time.Time) (err error) {
+	meta := gcs.ObjectMeta{
+		ContentType: "text/plain",
+		Overwrite:   true,
+		SourceURL:   gs.groupURL(groupName),
+		MailingList: "groupsio",
+		GroupName:   groupName,
+		FetchedAt:   time.Now(),
+		Cursor:      c.String(),
+	}
+	if !start.IsZero() {
+		meta.StartDate = start.Format("2006-01-02")
+	}
+	if _, err = storage.Store(ctx, stateFile, strings.NewReader(meta.Cursor+"\n"), meta); err != nil {
+		err = fmt.Errorf("%w store: %v", stateErr, err)
+	}
+	return
+}
+
+// Read the cursor once per group.
+func (gs *groupsioSource) groupState(ctx context.Context, storage gcs.Connection, groupName string) (state *groupState, err error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if state, ok := gs.groupStates[groupName]; ok {
+		return state, nil
+	}
+
+	state = &groupState{starters: make(map[int64]int64)}
+	if state.cursor, state.start, state.seen, err = readCursor(ctx, storage); err != nil {
+		return nil, err
+	}
+	if state.seen {
+		log.Printf("Resuming groups.io %s at page %d after message %d.", groupName, state.cursor.pageToken, state.cursor.lastID)
+	}
+	gs.groupStates[groupName] = state
+	return
+}
+
+// Page of messages at the token, asked for again only when it isn't the last page read.
+func (gs *groupsioSource) page(ctx context.Context, state *groupState, groupName string, pageToken int64) (page apiMessageList, err error) {
+	if state.lastPageRead && state.lastPageToken == pageToken {
+		return state.lastPage, nil
+	}
+	if page, err = getMessagePage(ctx, gs.httpToReader, gs.token, gs.apiURL, groupName, pageToken); err != nil {
+		return
+	}
+	state.lastPage, state.lastPageToken, state.lastPageRead = page, pageToken, true
+	return
+}
+
+// Id of the message that started the topic, looked up once for topics started before this run.
+func (gs *groupsioSource) starter(ctx context.Context, state *groupState, topicID int64) (starterID int64, err error) {
+	if starterID, ok := state.starters[topicID]; ok {
+		return starterID, nil
+	}
+	if starterID, err = getTopicStarter(ctx, gs.httpToReader, gs.token, gs.apiURL, topicID); err != nil {
+		return
+	}
+	state.starters[topicID] = starterID
+	return
+}
+
+// Message with the message that started its topic, filed by the year-month it was created in.
+func (gs *groupsioSource) addMessage(ctx context.Context, state *groupState, byMonth map[string][]threadMessage, message apiMessage) (err error) {
+	tm := threadMessage{apiMessage: message}
+	if message.IsReply {
+		if tm.starterID, err = gs.starter(ctx, state, message.TopicID); err != nil {
+			return
+		}
+	}
+	yearMonth := message.Created.UTC().Format("2006-01")
+	byMonth[yearMonth] = append(byMonth[yearMonth], tm)
+	return
+}
+
+// Messages on the page after the cursor up to the first one created on or after the end of the month, by year-month,
+// and the new cursor, which moves to the next page when the whole page was read. Messages created after the month are
+// passed and stored in their own month while a later message on the page is created in the month or when they are
+// dated after now, so they never hold the cursor back. Messages created before the start are passed over for a later run
+// that starts earlier. Done is set at the first message left for a later month or on the last page.
+func (gs *groupsioSource) pageMessages(ctx context.Context, state *groupState, page apiMessageList, month, now time.Time) (byMonth map[string][]threadMessage, next cursor, done bool, err error) {
+	monthEnd := month.AddDate(0, 1, 0)
+	byMonth = make(map[string][]threadMessage)
+	next = state.cursor
+
+	lastInMonth := -1
+	for i, message := range page.Data {
+		if !message.Created.Before(month) && message.Created.Before(monthEnd) {
+			lastInMonth = i
+		}
+	}
+	for i, message := range page.Data {
+		if message.ID <= next.lastID {
+			continue
+		}
+		if !message.Created.Before(monthEnd) && !message.Created.After(now) && i > lastInMonth {
+			return byMonth, next, true, nil
+		}
+		next.lastID = message.ID
+		if !message.IsReply {
+			state.starters[message.TopicID] = message.ID
+		}
+		if message.Created.Before(state.start) {
+			continue
+		}
+		if err = gs.addMessage(ctx, state, byMonth, message); err != nil {
+			return
+		}
+	}
+	if !page.HasMore || page.NextPageToken == 0 {
+		return byMonth, next, true, nil
+	}
+	next.pageToken = page.NextPageToken
+	return
+}
+
+// Write the message as an mboxrd entry. Lines that start with From after any > get one more >.
+func (gs *groupsioSource) writeMessage(w io.Writer, groupName string, message threadMessage) (err error) {
+	var sb strings.Builder
+
+	sender := mail.Address{Name: message.SenderName, Address: fmt.Sprintf("%d@users.groups.io", message.UserID)}
+	created := message.Created.UTC()
+	contentType := "text/html"
+	if message.IsPlain {
+		contentType = "text/plain"
+	}
+
+	fromLine := fmt.Sprintf("From %s %s", sender.Address, created.Format(time.ANSIC))
+	fmt.Fprintf(&sb, "From: %s\n", sender.String())
+	fmt.Fprintf(&sb, "Date: %s\n", created.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Subject: %s\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&sb, "Message-ID: <%d@groups.io>\n", message.ID)
+	if message.starterID != 0 && message.starterID != message.ID {
+		fmt.Fprintf(&sb, "In-Reply-To: <%d@groups.io>\n", message.starterID)
+		fmt.Fprintf(&sb, "References: <%d@groups.io>\n", message.starterID)
+	}
+	fmt.Fprintf(&sb, "Archived-At: <%s/message/%d>\n", gs.groupURL(groupName), message.MsgNum)
+	fmt.Fprintf(&sb, "Content-Type: %s; charset=utf-8\n\n", contentType)
+
+	sb.WriteString(strings.ReplaceAll(message.Body, "\r\n", "\n"))
+	return utils.WriteMboxEntry(w, fromLine, sb.String())
+}
+
+// Write the mbox to the stream.
+func (gs *groupsioSource) writeMonthMbox(w io.Writer, groupName string, messages []threadMessage) (err error) {
+	for _, message := range messages {
+		if err = gs.writeMessage(w, groupName, message); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Id of the last message passed when the stored month file was stored. Zero when the month isn't stored yet.
+func storedLastID(ctx context.Context, storage gcs.Connection, fileName string) (lastID int64, err error) {
+	info, exists, err := storage.Stat(ctx, fileName)
+	if err != nil || !exists || info.Metadata[gcs.MetaCursor] == "" {
+		return
+	}
+	if lastID, err = strconv.ParseInt(info.Metadata[gcs.MetaCursor], 10, 64); err != nil {
+		err = fmt.Errorf("%w cursor on %s: %v", stateErr, info.Name, err)
+	}
+	return
+}
+
+// Add the messages to the file for their year-month and record the last message id of the cursor on it. Messages up to
+// the id the file was stored up to are already in it.
+func (gs *groupsioSource) storeMonths(ctx context.Context, storage gcs.Connection, groupName string, byMonth map[string][]threadMessage, c cursor) (err error) {
+	var monthLastID int64
+
+	yearMonths := make([]string, 0, len(byMonth))
+	for yearMonth := range byMonth {
+		yearMonths = append(yearMonths, yearMonth)
+	}
+	sort.Strings(yearMonths)
+
+	for _, yearMonth := range yearMonths {
+		fileName := yearMonth + ".mbox.gz"
+		if monthLastID, err = storedLastID(ctx, storage, fileName); err != nil {
+			return
+		}
+		var messages []threadMessage
+		for _, message := range byMonth[yearMonth] {
+			if message.ID > monthLastID {
+				messages = append(messages, message)
+			}
+		}
+		if len(messages) == 0 {
+			log.Printf("Groups.io messages for %s in %s already stored.", groupName, yearMonth)
+			continue
+		}
+		messageMonth, _ := time.Parse("2006-01", yearMonth)
+		meta := gcs.ObjectMeta{
+			ContentType: "application/x-gzip",
+			SourceURL:   gs.groupURL(groupName),
+			MailingList: "groupsio",
+			GroupName:   groupName,
+			StartDate:   messageMonth.Format("2006-01-02"),
+			EndDate:     messageMonth.AddDate(0, 1, 0).Format("2006-01-02"),
+			FetchedAt:   time.Now(),
+			Cursor:      strconv.FormatInt(c.lastID, 10),
+		}
+		_, err = utils.StoreAppend(ctx, storage, fileName, meta, func(w io.Writer) error {
+			return gs.writeMonthMbox(w, groupName, messages)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", storageErr, err)
+		}
+		log.Printf("Added %d groups.io messages for %s to %s.", len(messages), groupName, yearMonth)
+	}
+	return
+}
+
+// Read the pages up to the cursor again and store the messages created from the month up to the start. Each page
+// records its last message on the month files so an interrupted run leaves out what it already stored, and the start
+// moves back once every page is read. The cursor doesn't move.
+func (gs *groupsioSource) storeEarlierMonths(ctx context.Context, storage gcs.Connection, state *groupState, groupName string, month time.Time) (err error) {
+	var (
+		page      apiMessageList
+		pageToken int64
+	)
+
+	for {
+		if page, err = getMessagePage(ctx, gs.httpToReader, gs.token, gs.apiURL, groupName, pageToken); err != nil {
+			return
+		}
+		byMonth := make(map[string][]threadMessage)
+		var lastID int64
+		for _, message := range page.Data {
+			if message.ID > state.cursor.lastID {
+				break
+			}
+			if !message.IsReply {
+				state.starters[message.TopicID] = message.ID
+			}
+			if message.Created.Before(month) || !message.Created.Before(state.start) {
+				continue
+			}
+			if err = gs.addMessage(ctx, state, byMonth, message); err != nil {
+				return
+			}
+			lastID = message.ID
+		}
+		if err = gs.storeMonths(ctx, storage, groupName, byMonth, cursor{pageToken: pageToken, lastID: lastID}); err != nil {
+			return
+		}
+		if pageToken == state.cursor.pageToken || !page.HasMore || page.NextPageToken == 0 {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	if err = gs.writeCursor(ctx, storage, groupName, state.cursor, month); err != nil {
+		return
+	}
+	gs.mu.Lock()
+	state.start = month
+	gs.mu.Unlock()
+	return
+}
+
+// Store the new messages for the month, and earlier months they arrived late for, a page at a time, moving the cursor
+// after each page. Months before the start of earlier runs are stored from the pages already read first.
+func (gs *groupsioSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		state   *groupState
+		page    apiMessageList
+		byMonth map[string][]threadMessage
+		next    cursor
+		done    bool
+	)
+
+	if state, err = gs.groupState(ctx, storage, groupName); err != nil {
+		return
+	}
+	gs.mu.Lock()
+	if !state.seen && state.start.IsZero() {
+		state.start = month
+	}
+	gs.mu.Unlock()
+	if state.seen && month.Before(state.start) {
+		if err = gs.storeEarlierMonths(ctx, storage, state, groupName, month); err != nil {
+			return
+		}
+	}
+
+	first, now := state.cursor, time.Now()
+	for !done {
+		if page, err = gs.page(ctx, state, groupName, state.cursor.pageToken); err != nil {
+			return
+		}
+		if byMonth, next, done, err = gs.pageMessages(ctx, state, page, month, now); err != nil {
+			return
+		}
+		if next == state.cursor {
+			continue
+		}
+		if err = gs.storeMonths(ctx, storage, groupName, byMonth, next); err != nil {
+			return
+		}
+		if err = gs.writeCursor(ctx, storage, groupName, next, state.start); err != nil {
+			return
+		}
+		gs.mu.Lock()
+		state.cursor, state.seen = next, true
+		gs.mu.Unlock()
+	}
+	if state.cursor == first {
+		log.Printf("No new groups.io messages for %s through %s.", groupName, month.Format("2006-01"))
+	}
+	return
+}
@@ -0,0 +1,308 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groupsio
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const testGroup = "wiigwaas"
+
+// API serving the recorded responses in testdata. The first request for a page is rate limited and the requests in
+// failing fail until they are taken out.
+type fakeAPI struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+	failing  map[string]bool
+}
+
+func newFakeAPI() *fakeAPI {
+	api := &fakeAPI{requests: make(map[string]int), failing: make(map[string]bool)}
+	api.server = httptest.NewServer(http.HandlerFunc(api.serve))
+	return api
+}
+
+func (api *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	var fixture string
+
+	query := r.URL.Query()
+	switch {
+	case r.URL.Path != "/getmessages":
+	case query.Get("topic_id") != "":
+		fixture = "topic_" + query.Get("topic_id") + ".json"
+	case query.Get("group_name") == testGroup && query.Get("sort_dir") == "asc":
+		fixture = "messages_page" + query.Get("page_token") + ".json"
+		if query.Get("page_token") == "" {
+			fixture = "messages_page0.json"
+		}
+	}
+
+	api.mu.Lock()
+	api.requests[fixture]++
+	firstRequest := api.requests[fixture] == 1
+	failing := api.failing[fixture]
+	api.mu.Unlock()
+	if failing {
+		http.Error(w, `{"object":"error","type":"internal_error"}`, http.StatusInternalServerError)
+		return
+	}
+	if firstRequest && strings.HasPrefix(fixture, "messages_page") {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if fixture == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content)
+}
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		value          string
+		wantCursor     cursor
+		wantErr        bool
+	}{
+		{
+			comparisonType: "First page",
+			value:          "0:100",
+			wantCursor:     cursor{pageToken: 0, lastID: 100},
+		},
+		{
+			comparisonType: "Later page",
+			value:          "102:103",
+			wantCursor:     cursor{pageToken: 102, lastID: 103},
+		},
+		{
+			comparisonType: "Message id only",
+			value:          "103",
+			wantErr:        true,
+		},
+		{
+			comparisonType: "Token that isn't a number",
+			value:          "birch:103",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotCursor, gotErr := parseCursor(test.value)
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if gotCursor != test.wantCursor || gotCursor.String() != test.value {
+				t.Errorf("Cursor doesn't match.\n got: %v\nwant: %v", gotCursor, test.wantCursor)
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	src, _ := NewSource(source.Config{})
+	gs := src.(*groupsioSource)
+	tests := []struct {
+		comparisonType string
+		message        threadMessage
+		wantMessage    string
+	}{
+		{
+			comparisonType: "HTML message that starts a topic",
+			message: threadMessage{apiMessage: apiMessage{
+				ID: 101, Created: time.Date(1850, 4, 2, 9, 0, 0, 0, time.UTC), UserID: 7, TopicID: 11, MsgNum: 2,
+				Subject: "Birch bark for the spring build", Body: "<p>The bark peels best after the first warm rain.</p>", SenderName: "Waabojiig",
+			}},
+			wantMessage: "From 7@users.groups.io Tue Apr  2 09:00:00 1850\n" +
+				"From: \"Waabojiig\" <7@users.groups.io>\n" +
+				"Date: Tue, 02 Apr 1850 09:00:00 +0000\n" +
+				"Subject: Birch bark for the spring build\n" +
+				"Message-ID: <101@groups.io>\n" +
+				"Archived-At: <https://groups.io/g/wiigwaas/message/2>\n" +
+				"Content-Type: text/html; charset=utf-8\n\n" +
+				"<p>The bark peels best after the first warm rain.</p>\n\n",
+		},
+		{
+			comparisonType: "Plain text reply",
+			message: threadMessage{apiMessage: apiMessage{
+				ID: 102, Created: time.Date(1850, 4, 15, 18, 30, 0, 0, time.UTC), UserID: 8, TopicID: 11, MsgNum: 3, IsReply: true, IsPlain: true,
+				Subject: "Re: Birch bark for the spring build", Body: "From the north shore.\r\n", SenderName: "Keeshkemun",
+			}, starterID: 101},
+			wantMessage: "From 8@users.groups.io Mon Apr 15 18:30:00 1850\n" +
+				"From: \"Keeshkemun\" <8@users.groups.io>\n" +
+				"Date: Mon, 15 Apr 1850 18:30:00 +0000\n" +
+				"Subject: Re: Birch bark for the spring build\n" +
+				"Message-ID: <102@groups.io>\n" +
+				"In-Reply-To: <101@groups.io>\n" +
+				"References: <101@groups.io>\n" +
+				"Archived-At: <https://groups.io/g/wiigwaas/message/3>\n" +
+				"Content-Type: text/plain; charset=utf-8\n\n" +
+				">From the north shore.\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var sb strings.Builder
+			if err := gs.writeMessage(&sb, testGroup, test.message); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sb.String() != test.wantMessage {
+				t.Errorf("Message doesn't match.\n got: %q\nwant: %q", sb.String(), test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestIncrementalLoads(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	defer api.server.Close()
+	rootDir, err := ioutil.TempDir("", "groupsio")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	subDir := filepath.Join(rootDir, "groupsio-"+testGroup)
+	aprilLines := []string{
+		"Subject: Birch bark for the spring build",
+		"Subject: Re: Birch bark for the spring build", "In-Reply-To: <101@groups.io>", ">From the north shore the sheets come wider.",
+	}
+
+	interrupted := map[string][]string{
+		"1850-04-groupsio-wiigwaas.mbox.gz": aprilLines,
+		"1850-05-groupsio-wiigwaas.mbox.gz": {"Subject: Re: Spruce root lashing", "In-Reply-To: <100@groups.io>"},
+	}
+	// The late April reply is added to the end of the April file
+	resumed := map[string][]string{
+		"1850-04-groupsio-wiigwaas.mbox.gz": append(append([]string{}, aprilLines...), "Subject: Re: Birch bark for the spring build", "In-Reply-To: <101@groups.io>"),
+		"1850-05-groupsio-wiigwaas.mbox.gz": interrupted["1850-05-groupsio-wiigwaas.mbox.gz"],
+		"1850-06-groupsio-wiigwaas.mbox.gz": {"Subject: Pitch from pine gum"},
+		"2037-01-groupsio-wiigwaas.mbox.gz": {"Subject: Canoe frames"},
+	}
+	earlier := map[string][]string{"1850-03-groupsio-wiigwaas.mbox.gz": {"Subject: Spruce root lashing"}}
+	for name, lines := range resumed {
+		earlier[name] = lines
+	}
+
+	tests := []struct {
+		comparisonType string
+		startDate      string
+		failing        []string
+		dropState      bool
+		wantErr        bool
+		wantCursor     string
+		wantStart      string
+		wantLines      map[string][]string
+		wantRequests   map[string]int
+	}{
+		{
+			comparisonType: "Crawl interrupted in May keeps the pages read and the cursor after each",
+			startDate:      "1850-04-01",
+			failing:        []string{"messages_page103.json"},
+			wantErr:        true,
+			wantCursor:     "103:103",
+			wantStart:      "1850-04-01",
+			wantLines:      interrupted,
+			wantRequests:   map[string]int{"messages_page0.json": 2, "messages_page102.json": 2, "messages_page103.json": 1},
+		},
+		{
+			comparisonType: "Next crawl resumes at the stored page, passes a message dated after the load and looks up earlier topic starters",
+			startDate:      "1850-04-01",
+			wantCursor:     "103:106",
+			wantStart:      "1850-04-01",
+			wantLines:      resumed,
+			wantRequests:   map[string]int{"messages_page0.json": 2, "messages_page102.json": 2, "messages_page103.json": 2, "topic_11.json": 1},
+		},
+		{
+			comparisonType: "Crawl that starts earlier reads the pages again for the months before the first crawl without moving the cursor",
+			startDate:      "1850-03-01",
+			wantCursor:     "103:106",
+			wantStart:      "1850-03-01",
+			wantLines:      earlier,
+			wantRequests:   map[string]int{"messages_page0.json": 3, "messages_page102.json": 3, "messages_page103.json": 4, "topic_11.json": 1},
+		},
+		{
+			comparisonType: "Crawl after the state is lost leaves out the messages stored in each month",
+			startDate:      "1850-04-01",
+			dropState:      true,
+			wantCursor:     "103:106",
+			wantStart:      "1850-04-01",
+			wantLines:      earlier,
+			wantRequests:   map[string]int{"messages_page0.json": 4, "messages_page102.json": 4, "messages_page103.json": 5, "topic_11.json": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			api.mu.Lock()
+			api.failing = make(map[string]bool)
+			for _, fixture := range test.failing {
+				api.failing[fixture] = true
+			}
+			api.mu.Unlock()
+			src, err := source.New("groupsio", source.Config{BaseURL: api.server.URL, Groups: []string{testGroup}})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "groupsio-" + testGroup}
+			if test.dropState {
+				os.Remove(filepath.Join(rootDir, "state", "groupsio-"+testGroup, "groupsio-state.txt"))
+			}
+
+			gotErr := source.Load(ctx, src, storage, testGroup, test.startDate, "1850-07-01")
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+
+			gotCursor, gotStart, _, _ := readCursor(ctx, storage)
+			if gotCursor.String() != test.wantCursor {
+				t.Errorf("Cursor doesn't match.\n got: %v\nwant: %s", gotCursor, test.wantCursor)
+			}
+			if gotStart.Format("2006-01-02") != test.wantStart {
+				t.Errorf("Start doesn't match.\n got: %v\nwant: %s", gotStart, test.wantStart)
+			}
+			gotLines, err := utils.StoredMboxLines(subDir, "Subject: ", "In-Reply-To: ", ">")
+			if err != nil {
+				t.Fatalf("Stored messages failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotLines, test.wantLines) {
+				t.Errorf("Stored messages don't match.\n got: %q\nwant: %q", gotLines, test.wantLines)
+			}
+			api.mu.Lock()
+			defer api.mu.Unlock()
+			if !reflect.DeepEqual(api.requests, test.wantRequests) {
+				t.Errorf("Requests don't match.\n got: %v\nwant: %v", api.requests, test.wantRequests)
+			}
+		})
+	}
+}
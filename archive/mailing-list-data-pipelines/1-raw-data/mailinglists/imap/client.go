@@ -0,0 +1,315 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imap
+
+/*
+Minimal read only IMAP4rev1 client for the commands the source needs (RFC 3501).
+
+Greeting: * OK
+[TAG] LOGIN [USER] [PASSWORD]
+[TAG] LIST "" "*": * LIST ([FLAGS]) [DELIMITER] [FOLDER]
+[TAG] EXAMINE [FOLDER]: * OK [UIDVALIDITY [NUMBER]]
+[TAG] UID SEARCH [CRITERIA]: * SEARCH [UID] [UID]
+[TAG] UID FETCH [UIDS] (UID INTERNALDATE BODY.PEEK[]): * [N] FETCH (UID [UID] INTERNALDATE "[DATE]" BODY[] {[SIZE]}
+followed by the message as a literal of SIZE bytes and the rest of the response
+Each command ends with [TAG] OK, NO or BAD.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	imapErr = errors.New("imap")
+
+	literalSize = regexp.MustCompile(`\{([0-9]+)\}$`)
+	// Literals are swapped for a placeholder with their index in the response line
+	literalRef     = regexp.MustCompile("\x00([0-9]+)")
+	listResponse   = regexp.MustCompile(`^\* LIST \(([^)]*)\) (?:NIL|"(?:[^"\\]|\\.)*") (.+)$`)
+	uidValidity    = regexp.MustCompile(`\[UIDVALIDITY ([0-9]+)\]`)
+	fetchUID       = regexp.MustCompile(`[( ]UID ([0-9]+)`)
+	fetchDate      = regexp.MustCompile(`INTERNALDATE "([^"]+)"`)
+	fetchBody      = regexp.MustCompile("BODY\\[\\] \x00([0-9]+)")
+	quotedSpecials = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+const (
+	// Date layout for SEARCH SINCE and BEFORE
+	searchDateLayout = "2-Jan-2006"
+	// INTERNALDATE layout where the day can be padded with a space
+	internalDateLayout = "_2-Jan-2006 15:04:05 -0700"
+)
+
+// Untagged response line with any literals it carried
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+// Message from a UID FETCH
+type fetchedMsg struct {
+	uid          uint32
+	internalDate time.Time
+	body         []byte
+}
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// Connect to the server and read its greeting. The connection follows the context deadline when it has one.
+func dial(ctx context.Context, address string, useTLS bool) (c *client, err error) {
+	var (
+		conn     net.Conn
+		dialer   net.Dialer
+		greeting response
+	)
+
+	if conn, err = dialer.DialContext(ctx, "tcp", address); err != nil {
+		return nil, fmt.Errorf("%w dial %s: %v", imapErr, address, err)
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c = &client{conn: conn, r: bufio.NewReader(conn)}
+	if greeting, err = c.readResponse(); err == nil && !strings.HasPrefix(greeting.line, "* OK") {
+		err = fmt.Errorf("greeting %q", greeting.line)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w greeting from %s: %v", imapErr, address, err)
+	}
+	return
+}
+
+// Quote a string argument.
+func quote(value string) string {
+	return `"` + quotedSpecials.Replace(value) + `"`
+}
+
+// Read one response line. Literals announced with {SIZE} at the end of a line are read and the line continues after
+// them.
+func (c *client) readResponse() (resp response, err error) {
+	var (
+		sb   strings.Builder
+		line string
+	)
+
+	for {
+		if line, err = c.r.ReadString('\n'); err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		match := literalSize.FindStringSubmatchIndex(line)
+		if match == nil {
+			sb.WriteString(line)
+			resp.line = sb.String()
+			return
+		}
+		size, _ := strconv.Atoi(line[match[2]:match[3]])
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(c.r, literal); err != nil {
+			return
+		}
+		fmt.Fprintf(&sb, "%s\x00%d", line[:match[0]], len(resp.literals))
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// Send the command and collect the untagged responses until its tagged status. Status other than OK is an error.
+func (c *client) cmd(format string, args ...interface{}) (untagged []response, err error) {
+	var resp response
+
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	command := fmt.Sprintf(format, args...)
+	if _, err = fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", imapErr, strings.Fields(command)[0], err)
+	}
+	for {
+		if resp, err = c.readResponse(); err != nil {
+			return nil, fmt.Errorf("%w %s read: %v", imapErr, strings.Fields(command)[0], err)
+		}
+		if !strings.HasPrefix(resp.line, tag+" ") {
+			untagged = append(untagged, resp)
+			continue
+		}
+		if status := strings.TrimPrefix(resp.line, tag+" "); !strings.HasPrefix(status, "OK") {
+			return nil, fmt.Errorf("%w %s: %s", imapErr, strings.Fields(command)[0], status)
+		}
+		return
+	}
+}
+
+func (c *client) login(user, password string) (err error) {
+	_, err = c.cmd("LOGIN %s %s", quote(user), quote(password))
+	return
+}
+
+// Folders that can be selected, sorted by name.
+func (c *client) listFolders() (folders []string, err error) {
+	var untagged []response
+
+	if untagged, err = c.cmd(`LIST "" "*"`); err != nil {
+		return
+	}
+	for _, resp := range untagged {
+		match := listResponse.FindStringSubmatch(resp.line)
+		if match == nil || strings.Contains(strings.ToLower(match[1]), `\noselect`) {
+			continue
+		}
+		folder := match[2]
+		if ref := literalRef.FindStringSubmatch(folder); ref != nil {
+			idx, _ := strconv.Atoi(ref[1])
+			folder = string(resp.literals[idx])
+		} else if unquoted, unquoteErr := strconv.Unquote(folder); unquoteErr == nil {
+			folder = unquoted
+		}
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	return
+}
+
+// Open the folder read only and return its UIDVALIDITY. UIDs are only comparable while it stays the same.
+func (c *client) examine(folder string) (validity uint32, err error) {
+	var untagged []response
+
+	if untagged, err = c.cmd("EXAMINE %s", quote(folder)); err != nil {
+		return
+	}
+	for _, resp := range untagged {
+		if match := uidValidity.FindStringSubmatch(resp.line); match != nil {
+			value, _ := strconv.ParseUint(match[1], 10, 32)
+			return uint32(value), nil
+		}
+	}
+	return
+}
+
+// UIDs in the open folder after the UID that match the criteria, in order.
+func (c *client) uidSearch(afterUID uint32, criteria string) (uids []uint32, err error) {
+	var untagged []response
+
+	command := fmt.Sprintf("UID SEARCH UID %d:*", afterUID+1)
+	if criteria != "" {
+		command += " " + criteria
+	}
+	if untagged, err = c.cmd("%s", command); err != nil {
+		return
+	}
+	for _, resp := range untagged {
+		if !strings.HasPrefix(resp.line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(resp.line, "* SEARCH")) {
+			// UID [N]:* always includes the last message even when its UID is lower
+			if uid, parseErr := strconv.ParseUint(field, 10, 32); parseErr == nil && uint32(uid) > afterUID {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return
+}
+
+// Criteria for messages received on or after the since date and before the before date. Zero dates are left out.
+func dateCriteria(since, before time.Time) string {
+	var criteria []string
+
+	if !since.IsZero() {
+		criteria = append(criteria, "SINCE "+since.Format(searchDateLayout))
+	}
+	if !before.IsZero() {
+		criteria = append(criteria, "BEFORE "+before.Format(searchDateLayout))
+	}
+	return strings.Join(criteria, " ")
+}
+
+// Parse a FETCH response into the message. The body is nil when it wasn't asked for.
+func parseFetch(resp response) (msg fetchedMsg, err error) {
+	match := fetchUID.FindStringSubmatch(resp.line)
+	if match == nil {
+		return msg, fmt.Errorf("%w fetch without UID: %q", imapErr, resp.line)
+	}
+	uid, _ := strconv.ParseUint(match[1], 10, 32)
+	msg.uid = uint32(uid)
+	if match = fetchDate.FindStringSubmatch(resp.line); match != nil {
+		if msg.internalDate, err = time.Parse(internalDateLayout, match[1]); err != nil {
+			return msg, fmt.Errorf("%w fetch INTERNALDATE %q: %v", imapErr, match[1], err)
+		}
+	}
+	if match = fetchBody.FindStringSubmatch(resp.line); match != nil {
+		idx, _ := strconv.Atoi(match[1])
+		msg.body = resp.literals[idx]
+	}
+	return
+}
+
+// Fetch the messages for the UIDs from the open folder in UID order. Without the body only UID and INTERNALDATE come
+// back. Messages removed since the search are left out.
+func (c *client) uidFetch(uids []uint32, withBody bool) (msgs []fetchedMsg, err error) {
+	var (
+		untagged []response
+		msg      fetchedMsg
+	)
+
+	items := "UID INTERNALDATE"
+	if withBody {
+		items += " BODY.PEEK[]"
+	}
+	uidSet := make([]string, len(uids))
+	for idx, uid := range uids {
+		uidSet[idx] = strconv.FormatUint(uint64(uid), 10)
+	}
+	if untagged, err = c.cmd("UID FETCH %s (%s)", strings.Join(uidSet, ","), items); err != nil {
+		return
+	}
+	for _, resp := range untagged {
+		if !strings.Contains(resp.line, " FETCH ") {
+			continue
+		}
+		if msg, err = parseFetch(resp); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+	return
+}
+
+// Log out and close the connection.
+func (c *client) logout() {
+	c.cmd("LOGOUT")
+	c.conn.Close()
+}
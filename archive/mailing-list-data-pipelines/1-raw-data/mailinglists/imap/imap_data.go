@@ -0,0 +1,526 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load private mailing lists from an IMAP archive account where each list is delivered to its own folder.
+
+BaseURL is the server as imaps://[USER]@[HOST]:[PORT] or imap://[USER]@[HOST]:[PORT] without TLS. The user can also come
+from IMAP_USERNAME and the password comes from IMAP_PASSWORD so it stays out of the command line. Groups are folder
+names such as Lists/engineering. When no groups are configured every folder that can be selected is loaded.
+
+Messages are read in UID order after the last UID already passed, which is kept with the folder UIDVALIDITY as
+[UIDVALIDITY]:[UID] in the cursor metadata of imap-state.txt under the state prefix, outside the group subdirectory. Loading a month searches the
+new messages received in it with SEARCH SINCE and BEFORE, stores them up to the first new message received after it and
+moves the last UID to that point, so later months and later runs resume there without storing anything twice. Messages
+that arrive late with an earlier date, messages received after the month that come before its last message and
+messages dated in the future are stored in their own month. When the folder UIDVALIDITY changes the folder is loaded
+again from the start.
+
+The first run passes over the messages received before its first month without storing them and keeps that month in
+the start date metadata of imap-state.txt. Messages up to the last UID are stored from the start date on, so a later run
+that starts earlier stores the months before the start date from the messages up to the last UID without moving it.
+
+New messages are added to the end of the [YEAR]-[MONTH].mbox.gz file for their month, which records the last UID it
+was stored up to in its cursor metadata. Messages up to that UID are left out when a run stopped before moving the last
+UID for the group. A month stored with another UIDVALIDITY is replaced instead, since its UIDs no longer match the
+folder. With refresh never, months already stored at the ends of the range are skipped so use changed or always to
+add new messages to the current month.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr     = errors.New("Storage failed")
+	baseURLErr     = errors.New("base url")
+	credentialsErr = errors.New("imap credentials")
+	stateErr       = errors.New("imap state")
+)
+
+const (
+	stateFile = gcs.StatePrefix + "imap-state.txt"
+	// Messages asked for in each fetch
+	fetchChunk = 100
+)
+
+func init() {
+	source.Register("imap", NewSource)
+}
+
+// IMAP version of the mailing list source
+type imapSource struct {
+	address  string
+	useTLS   bool
+	user     string
+	password string
+	groups   []string
+}
+
+// Last UID stored for a folder and the UIDVALIDITY it belongs to
+type folderMark struct {
+	validity uint32
+	uid      uint32
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Create the IMAP source. BaseURL names the server and the standard port for the scheme is used when it has none.
+func NewSource(config source.Config) (source.Source, error) {
+	var port string
+
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("%w is required for imap as imaps://[USER]@[HOST]", baseURLErr)
+	}
+	baseURL := config.BaseURL
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "imaps://" + baseURL
+	}
+	serverURL, err := url.Parse(baseURL)
+	if err != nil || serverURL.Hostname() == "" {
+		return nil, fmt.Errorf("%w %q needs a host: %v", baseURLErr, config.BaseURL, err)
+	}
+	switch serverURL.Scheme {
+	case "imap":
+		port = "143"
+	case "imaps":
+		port = "993"
+	default:
+		return nil, fmt.Errorf("%w %q scheme is not imap or imaps", baseURLErr, config.BaseURL)
+	}
+	if serverURL.Port() != "" {
+		port = serverURL.Port()
+	}
+
+	urlPassword, _ := serverURL.User.Password()
+	is := &imapSource{
+		address:  net.JoinHostPort(serverURL.Hostname(), port),
+		useTLS:   serverURL.Scheme == "imaps",
+		user:     firstNonEmpty(serverURL.User.Username(), os.Getenv("IMAP_USERNAME")),
+		password: firstNonEmpty(urlPassword, os.Getenv("IMAP_PASSWORD")),
+		groups:   config.Groups,
+	}
+	if is.user == "" || is.password == "" {
+		return nil, fmt.Errorf("%w failed: set IMAP_USERNAME or the base url user and IMAP_PASSWORD", credentialsErr)
+	}
+	return is, nil
+}
+
+func (is *imapSource) Name() string {
+	return "imap"
+}
+
+// Connect and log in.
+func (is *imapSource) connect(ctx context.Context) (c *client, err error) {
+	if c, err = dial(ctx, is.address, is.useTLS); err != nil {
+		return
+	}
+	if err = c.login(is.user, is.password); err != nil {
+		c.logout()
+		return nil, err
+	}
+	return
+}
+
+// Configured groups or every folder the account can select when none are configured.
+func (is *imapSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	var c *client
+
+	if len(is.groups) > 0 {
+		return is.groups, nil
+	}
+	if c, err = is.connect(ctx); err != nil {
+		return
+	}
+	defer c.logout()
+
+	if groupNames, err = c.listFolders(); err != nil {
+		return
+	}
+	log.Printf("Discovered %d folders on %s.", len(groupNames), is.address)
+	return
+}
+
+// Every month in the range. The messages after the last UID are only known once storage is read when fetching.
+func (is *imapSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	return source.MonthRange(startDate, endDate), nil
+}
+
+// Last UID passed and the first month stored for the group subdirectory. Not seen before the first run. State stored
+// before the start date was kept has a zero start.
+func readMark(ctx context.Context, storage gcs.Connection) (mark folderMark, start time.Time, seen bool, err error) {
+	var info gcs.ObjectInfo
+
+	if info, seen, err = storage.Stat(ctx, stateFile); err != nil || !seen {
+		return
+	}
+	if mark, err = parseMark(info.Name, info.Metadata[gcs.MetaCursor]); err != nil {
+		return
+	}
+	if startDate := info.Metadata[gcs.MetaStartDate]; startDate != "" {
+		if start, err = time.Parse("2006-01-02", startDate); err != nil {
+			return mark, start, seen, fmt.Errorf("%w start date on %s: %v", stateErr, info.Name, err)
+		}
+	}
+	return
+}
+
+// Parse the [UIDVALIDITY]:[UID] cursor stored on the named file.
+func parseMark(fileName, cursor string) (mark folderMark, err error) {
+	var (
+		validity, uid  uint64
+		validityErr    error
+		validityAndUID []string
+	)
+
+	if validityAndUID = strings.SplitN(cursor, ":", 2); len(validityAndUID) != 2 {
+		return mark, fmt.Errorf("%w cursor on %s is %q", stateErr, fileName, cursor)
+	}
+	validity, validityErr = strconv.ParseUint(validityAndUID[0], 10, 32)
+	if uid, err = strconv.ParseUint(validityAndUID[1], 10, 32); err == nil {
+		err = validityErr
+	}
+	if err != nil {
+		return mark, fmt.Errorf("%w cursor on %s: %v", stateErr, fileName, err)
+	}
+	return folderMark{validity: uint32(validity), uid: uint32(uid)}, nil
+}
+
+// Last UID and UIDVALIDITY the stored month file was stored up to. Not stored when the month isn't stored yet.
+func storedMark(ctx context.Context, storage gcs.Connection, fileName string) (mark folderMark, stored bool, err error) {
+	var info gcs.ObjectInfo
+
+	if info, stored, err = storage.Stat(ctx, fileName); err != nil || !stored || info.Metadata[gcs.MetaCursor] == "" {
+		return
+	}
+	mark, err = parseMark(info.Name, info.Metadata[gcs.MetaCursor])
+	return
+}
+
+func (mark folderMark) String() string {
+	return fmt.Sprintf("%d:%d", mark.validity, mark.uid)
+}
+
+// Record the last UID passed and the first month stored for the group subdirectory.
+func (is *imapSource) writeMark(ctx context.Context, storage gcs.Connection, groupName string, mark folderMark, start time.Time) (err error) {
+	meta := gcs.ObjectMeta{
+		ContentType: "text/plain",
+		Overwrite:   true,
+		SourceURL:   is.folderURL(groupName),
+		MailingList: "imap",
+		GroupName:   groupName,
+		FetchedAt:   time.Now(),
+		Cursor:      mark.String(),
+	}
+	if !start.IsZero() {
+		meta.StartDate = start.Format("2006-01-02")
+	}
+	if _, err = storage.Store(ctx, stateFile, strings.NewReader(meta.Cursor+"\n"), meta); err != nil {
+		err = fmt.Errorf("%w store: %v", stateErr, err)
+	}
+	return
+}
+
+// Folder address without the user so the metadata never holds credentials.
+func (is *imapSource) folderURL(groupName string) string {
+	scheme := "imap"
+	if is.useTLS {
+		scheme = "imaps"
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, is.address, url.PathEscape(groupName))
+}
+
+// UIDs by year-month of their received date.
+func uidsByMonth(c *client, uids []uint32) (byMonth map[string][]uint32, err error) {
+	var msgs []fetchedMsg
+
+	byMonth = make(map[string][]uint32)
+	for chunkStart := 0; chunkStart < len(uids); chunkStart += fetchChunk {
+		chunkEnd := chunkStart + fetchChunk
+		if chunkEnd > len(uids) {
+			chunkEnd = len(uids)
+		}
+		if msgs, err = c.uidFetch(uids[chunkStart:chunkEnd], false); err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			yearMonth := msg.internalDate.Format("2006-01")
+			byMonth[yearMonth] = append(byMonth[yearMonth], msg.uid)
+		}
+	}
+	return
+}
+
+// New messages to store for the month by year-month of their received date and the new last UID. Messages received
+// after the month are passed and stored in their own month while a later message is received in the month or when they
+// are dated after now, so they never hold the last UID back. Messages received before the start are passed over for a
+// later run that starts earlier.
+func monthMessages(c *client, mark uint32, start, month, now time.Time) (byMonth map[string][]uint32, newMark uint32, err error) {
+	var allUIDs, monthUIDs, laterUIDs, uids []uint32
+
+	monthEnd := month.AddDate(0, 1, 0)
+	newMark = mark
+
+	// Searched in this order so messages that arrive in between have higher UIDs and wait for the next load
+	if allUIDs, err = c.uidSearch(mark, ""); err != nil || len(allUIDs) == 0 {
+		return
+	}
+	if monthUIDs, err = c.uidSearch(mark, dateCriteria(month, monthEnd)); err != nil {
+		return
+	}
+	// SEARCH only compares days so the day after now keeps messages from today
+	if laterUIDs, err = c.uidSearch(mark, dateCriteria(monthEnd, now.AddDate(0, 0, 1))); err != nil {
+		return
+	}
+	newMark = allUIDs[len(allUIDs)-1]
+	var lastInMonth uint32
+	if len(monthUIDs) > 0 {
+		lastInMonth = monthUIDs[len(monthUIDs)-1]
+	}
+	for _, uid := range laterUIDs {
+		if uid > lastInMonth {
+			if uid-1 < newMark {
+				newMark = uid - 1
+			}
+			break
+		}
+	}
+
+	if uids, err = c.uidSearch(mark, dateCriteria(start, time.Time{})); err != nil {
+		return
+	}
+	stored := uids[:0]
+	for _, uid := range uids {
+		if uid <= newMark {
+			stored = append(stored, uid)
+		}
+	}
+	byMonth, err = uidsByMonth(c, stored)
+	return
+}
+
+// Messages up to the last UID received from the month to the start by year-month of their received date, for a run
+// that starts before earlier runs.
+func earlierMessages(c *client, mark uint32, start, month time.Time) (byMonth map[string][]uint32, err error) {
+	var uids []uint32
+
+	if uids, err = c.uidSearch(0, dateCriteria(month, start)); err != nil {
+		return
+	}
+	earlier := uids[:0]
+	for _, uid := range uids {
+		if uid <= mark {
+			earlier = append(earlier, uid)
+		}
+	}
+	return uidsByMonth(c, earlier)
+}
+
+// Write the message as an mboxrd entry with its sender and received date. Lines that start with From after any > get
+// one more >.
+func writeMboxMessage(w io.Writer, msg fetchedMsg) (err error) {
+	sender := "MAILER-DAEMON"
+	if header, headerErr := mail.ReadMessage(bytes.NewReader(msg.body)); headerErr == nil {
+		if address, addrErr := mail.ParseAddress(header.Header.Get("From")); addrErr == nil {
+			sender = address.Address
+		}
+	}
+	fromLine := fmt.Sprintf("From %s %s", sender, msg.internalDate.UTC().Format(time.ANSIC))
+	return utils.WriteMboxEntry(w, fromLine, strings.ReplaceAll(string(msg.body), "\r\n", "\n"))
+}
+
+// Fetch the messages in chunks and write the mbox to the stream.
+func writeMonthMbox(w io.Writer, c *client, uids []uint32) (err error) {
+	var msgs []fetchedMsg
+
+	for chunkStart := 0; chunkStart < len(uids); chunkStart += fetchChunk {
+		chunkEnd := chunkStart + fetchChunk
+		if chunkEnd > len(uids) {
+			chunkEnd = len(uids)
+		}
+		if msgs, err = c.uidFetch(uids[chunkStart:chunkEnd], true); err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			if err = writeMboxMessage(w, msg); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Add the messages for one year-month to its file and record the last UID on it. Messages up to the last UID the file
+// was stored up to are already in it. A file stored with another UIDVALIDITY is replaced.
+func (is *imapSource) storeMonth(ctx context.Context, storage gcs.Connection, c *client, groupName, yearMonth string, mark folderMark, uids []uint32) (err error) {
+	var (
+		monthMark folderMark
+		stored    bool
+		newUIDs   []uint32
+	)
+	msgMonth, _ := time.Parse("2006-01", yearMonth)
+	fileName := yearMonth + ".mbox.gz"
+
+	if monthMark, stored, err = storedMark(ctx, storage, fileName); err != nil {
+		return
+	}
+	replace := stored && monthMark.validity != mark.validity
+	for _, uid := range uids {
+		if replace || uid > monthMark.uid {
+			newUIDs = append(newUIDs, uid)
+		}
+	}
+	if len(newUIDs) == 0 {
+		log.Printf("Imap messages for %s in %s already stored.", groupName, yearMonth)
+		return
+	}
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   is.folderURL(groupName),
+		MailingList: "imap",
+		GroupName:   groupName,
+		StartDate:   msgMonth.Format("2006-01-02"),
+		EndDate:     msgMonth.AddDate(0, 1, 0).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+		Cursor:      mark.String(),
+	}
+	if replace {
+		log.Printf("Replacing imap messages for %s in %s because they were stored with UIDVALIDITY %d.", groupName, yearMonth, monthMark.validity)
+		meta.Overwrite = true
+		_, err = utils.StoreWriter(ctx, storage, fileName, meta, func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+			if err := writeMonthMbox(gz, c, newUIDs); err != nil {
+				return err
+			}
+			return gz.Close()
+		})
+	} else {
+		_, err = utils.StoreAppend(ctx, storage, fileName, meta, func(w io.Writer) error {
+			return writeMonthMbox(w, c, newUIDs)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Added %d imap messages for %s to %s.", len(newUIDs), groupName, yearMonth)
+	return
+}
+
+// Store the months from the month up to the start from the messages up to the last UID, newest first, and move the
+// start back after each so an interrupted run picks up where it stopped. The last UID doesn't move.
+func (is *imapSource) storeEarlierMonths(ctx context.Context, storage gcs.Connection, c *client, groupName string, mark folderMark, start, month time.Time) (err error) {
+	var byMonth map[string][]uint32
+
+	if byMonth, err = earlierMessages(c, mark.uid, start, month); err != nil {
+		return
+	}
+	for earlier := start.AddDate(0, -1, 0); !earlier.Before(month); earlier = earlier.AddDate(0, -1, 0) {
+		yearMonth := earlier.Format("2006-01")
+		if len(byMonth[yearMonth]) > 0 {
+			if err = is.storeMonth(ctx, storage, c, groupName, yearMonth, mark, byMonth[yearMonth]); err != nil {
+				return
+			}
+		}
+		if err = is.writeMark(ctx, storage, groupName, mark, earlier); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Store the new messages for the month, and earlier months they arrived late for, then move the last UID. Months before
+// the start of earlier runs are stored from the messages already passed first.
+func (is *imapSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		c        *client
+		validity uint32
+		mark     folderMark
+		start    time.Time
+		seen     bool
+		byMonth  map[string][]uint32
+		newUID   uint32
+	)
+
+	if c, err = is.connect(ctx); err != nil {
+		return
+	}
+	defer c.logout()
+	if validity, err = c.examine(groupName); err != nil {
+		return
+	}
+	if mark, start, seen, err = readMark(ctx, storage); err != nil {
+		return
+	}
+	if seen && mark.validity != validity {
+		log.Printf("Loading %s from the start because its UIDVALIDITY changed from %d to %d.", groupName, mark.validity, validity)
+		mark, seen = folderMark{}, false
+	}
+	if !seen {
+		start = month
+	} else if month.Before(start) {
+		if err = is.storeEarlierMonths(ctx, storage, c, groupName, mark, start, month); err != nil {
+			return
+		}
+		start = month
+	}
+
+	if byMonth, newUID, err = monthMessages(c, mark.uid, start, month, time.Now()); err != nil {
+		return
+	}
+	if seen && newUID == mark.uid {
+		log.Printf("No new imap messages for %s through %s.", groupName, month.Format("2006-01"))
+		return
+	}
+	newMark := folderMark{validity: validity, uid: newUID}
+	yearMonths := make([]string, 0, len(byMonth))
+	for yearMonth := range byMonth {
+		yearMonths = append(yearMonths, yearMonth)
+	}
+	sort.Strings(yearMonths)
+
+	for _, yearMonth := range yearMonths {
+		if err = is.storeMonth(ctx, storage, c, groupName, yearMonth, newMark, byMonth[yearMonth]); err != nil {
+			return
+		}
+	}
+
+	return is.writeMark(ctx, storage, groupName, newMark, start)
+}
@@ -0,0 +1,522 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const (
+	testFolder   = "Lists/cherokee"
+	testUser     = "sequoyah"
+	testPassword = "syllabary"
+)
+
+type stubMessage struct {
+	internalDate time.Time
+	body         string
+}
+
+// In-process IMAP server with one folder of messages.
+type stubServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	validity uint32
+	messages map[uint32]stubMessage
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	stub := &stubServer{listener: listener, validity: 1821, messages: make(map[uint32]stubMessage)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (stub *stubServer) addMessage(uid uint32, date, body string) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	internalDate, _ := time.Parse(internalDateLayout, date)
+	stub.messages[uid] = stubMessage{internalDate: internalDate, body: strings.ReplaceAll(body, "\n", "\r\n")}
+}
+
+func (stub *stubServer) uids() (uids []uint32) {
+	for uid := range stub.messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return
+}
+
+// Split the arguments at spaces outside quotes and strip the quotes.
+func stubArgs(line string) (args []string) {
+	var (
+		sb     strings.Builder
+		quoted bool
+	)
+
+	for idx := 0; idx < len(line); idx++ {
+		switch {
+		case line[idx] == '"':
+			quoted = !quoted
+		case line[idx] == '\\' && quoted:
+			idx++
+			sb.WriteByte(line[idx])
+		case line[idx] == ' ' && !quoted:
+			args = append(args, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(line[idx])
+		}
+	}
+	return append(args, sb.String())
+}
+
+// UIDs matching UID [LOW]:*, SINCE and BEFORE. As on real servers [LOW]:* always matches the last message.
+func (stub *stubServer) search(criteria []string) (found []string) {
+	var (
+		low           uint64
+		since, before time.Time
+	)
+
+	for idx := 0; idx+1 < len(criteria); idx += 2 {
+		switch criteria[idx] {
+		case "UID":
+			low, _ = strconv.ParseUint(strings.TrimSuffix(criteria[idx+1], ":*"), 10, 32)
+		case "SINCE":
+			since, _ = time.Parse(searchDateLayout, criteria[idx+1])
+		case "BEFORE":
+			before, _ = time.Parse(searchDateLayout, criteria[idx+1])
+		}
+	}
+	uids := stub.uids()
+	for _, uid := range uids {
+		if uid < uint32(low) && uid != uids[len(uids)-1] {
+			continue
+		}
+		// Dates are compared without the time or zone
+		date := stub.messages[uid].internalDate
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		if (!since.IsZero() && day.Before(since)) || (!before.IsZero() && !day.Before(before)) {
+			continue
+		}
+		found = append(found, strconv.FormatUint(uint64(uid), 10))
+	}
+	return
+}
+
+func (stub *stubServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK stub ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := stubArgs(strings.TrimRight(line, "\r\n"))
+		tag, command := args[0], strings.ToUpper(args[1])
+		stub.mu.Lock()
+		switch {
+		case command == "LOGIN":
+			if args[2] != testUser || args[3] != testPassword {
+				fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n", tag)
+				break
+			}
+			fmt.Fprintf(conn, "%s OK logged in\r\n", tag)
+		case command == "LIST":
+			fmt.Fprint(conn, "* LIST (\\HasNoChildren) \"/\" INBOX\r\n")
+			fmt.Fprint(conn, "* LIST (\\Noselect \\HasChildren) \"/\" \"Lists\"\r\n")
+			fmt.Fprintf(conn, "* LIST (\\HasNoChildren) \"/\" \"%s\"\r\n", testFolder)
+			fmt.Fprintf(conn, "* LIST (\\HasNoChildren) \"/\" {14}\r\nLists/Muscogee\r\n")
+			fmt.Fprintf(conn, "%s OK list done\r\n", tag)
+		case command == "EXAMINE":
+			if args[2] != testFolder {
+				fmt.Fprintf(conn, "%s NO no such folder\r\n", tag)
+				break
+			}
+			fmt.Fprintf(conn, "* %d EXISTS\r\n* OK [UIDVALIDITY %d] UIDs valid\r\n", len(stub.messages), stub.validity)
+			fmt.Fprintf(conn, "%s OK [READ-ONLY] examine done\r\n", tag)
+		case command == "UID" && strings.ToUpper(args[2]) == "SEARCH":
+			fmt.Fprintf(conn, "* SEARCH %s\r\n", strings.Join(stub.search(args[3:]), " "))
+			fmt.Fprintf(conn, "%s OK search done\r\n", tag)
+		case command == "UID" && strings.ToUpper(args[2]) == "FETCH":
+			withBody := strings.Contains(line, "BODY.PEEK[]")
+			for seq, field := range strings.Split(args[3], ",") {
+				uid, _ := strconv.ParseUint(field, 10, 32)
+				msg, ok := stub.messages[uint32(uid)]
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(conn, "* %d FETCH (UID %d INTERNALDATE \"%s\"", seq+1, uid, msg.internalDate.Format(internalDateLayout))
+				if withBody {
+					fmt.Fprintf(conn, " BODY[] {%d}\r\n%s", len(msg.body), msg.body)
+				}
+				fmt.Fprint(conn, ")\r\n")
+			}
+			fmt.Fprintf(conn, "%s OK fetch done\r\n", tag)
+		case command == "LOGOUT":
+			fmt.Fprintf(conn, "* BYE stub closing\r\n%s OK logout done\r\n", tag)
+			stub.mu.Unlock()
+			return
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+		stub.mu.Unlock()
+	}
+}
+
+func TestParseFetch(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		resp           response
+		wantMsg        fetchedMsg
+		wantErr        bool
+	}{
+		{
+			comparisonType: "Fetch with a body",
+			resp:           response{line: "* 1 FETCH (UID 42 INTERNALDATE \" 3-Jun-1821 10:00:00 -0500\" BODY[] \x000)", literals: [][]byte{[]byte("Subject: Syllabary")}},
+			wantMsg:        fetchedMsg{uid: 42, internalDate: time.Date(1821, 6, 3, 10, 0, 0, 0, time.FixedZone("", -5*60*60)), body: []byte("Subject: Syllabary")},
+		},
+		{
+			comparisonType: "Fetch without a body",
+			resp:           response{line: "* 2 FETCH (INTERNALDATE \"20-Jun-1821 10:00:00 +0000\" UID 43)"},
+			wantMsg:        fetchedMsg{uid: 43, internalDate: time.Date(1821, 6, 20, 10, 0, 0, 0, time.FixedZone("", 0))},
+		},
+		{
+			comparisonType: "Fetch without a UID",
+			resp:           response{line: "* 3 FETCH (FLAGS (\\Seen))"},
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMsg, gotErr := parseFetch(test.resp)
+			if (gotErr != nil) != test.wantErr {
+				t.Errorf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if gotMsg.uid != test.wantMsg.uid || !gotMsg.internalDate.Equal(test.wantMsg.internalDate) || string(gotMsg.body) != string(test.wantMsg.body) {
+				t.Errorf("Message doesn't match.\n got: %+v\nwant: %+v", gotMsg, test.wantMsg)
+			}
+		})
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	os.Setenv("IMAP_PASSWORD", testPassword)
+	defer os.Unsetenv("IMAP_PASSWORD")
+
+	tests := []struct {
+		comparisonType string
+		baseURL        string
+		wantAddress    string
+		wantTLS        bool
+		wantUser       string
+		wantErr        bool
+	}{
+		{
+			comparisonType: "TLS server by default",
+			baseURL:        "sequoyah@mail.cherokee.org",
+			wantAddress:    "mail.cherokee.org:993",
+			wantTLS:        true,
+			wantUser:       testUser,
+		},
+		{
+			comparisonType: "Server without TLS on its own port",
+			baseURL:        "imap://sequoyah@mail.cherokee.org:1143",
+			wantAddress:    "mail.cherokee.org:1143",
+			wantUser:       testUser,
+		},
+		{
+			comparisonType: "Missing user",
+			baseURL:        "imaps://mail.cherokee.org",
+			wantErr:        true,
+		},
+		{
+			comparisonType: "Missing server",
+			wantErr:        true,
+		},
+		{
+			comparisonType: "Unknown scheme",
+			baseURL:        "https://sequoyah@mail.cherokee.org",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, gotErr := NewSource(source.Config{BaseURL: test.baseURL})
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			is := src.(*imapSource)
+			if is.address != test.wantAddress || is.useTLS != test.wantTLS || is.user != test.wantUser {
+				t.Errorf("Server doesn't match.\n got: %s tls %v user %s\nwant: %s tls %v user %s", is.address, is.useTLS, is.user, test.wantAddress, test.wantTLS, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestListGroups(t *testing.T) {
+	stub := newStubServer(t)
+	defer stub.listener.Close()
+
+	tests := []struct {
+		comparisonType string
+		password       string
+		wantGroups     []string
+		wantErr        bool
+	}{
+		{
+			comparisonType: "Folders that can be selected",
+			password:       testPassword,
+			wantGroups:     []string{"INBOX", "Lists/Muscogee", testFolder},
+		},
+		{
+			comparisonType: "Login refused",
+			password:       "talking leaves",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			baseURL := fmt.Sprintf("imap://%s:%s@%s", testUser, url.QueryEscape(test.password), stub.listener.Addr())
+			src, err := source.New("imap", source.Config{BaseURL: baseURL})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			gotGroups, gotErr := src.ListGroups(context.Background())
+			if (gotErr != nil) != test.wantErr {
+				t.Errorf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("Groups don't match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestIncrementalLoads(t *testing.T) {
+	ctx := context.Background()
+	stub := newStubServer(t)
+	defer stub.listener.Close()
+	rootDir, err := ioutil.TempDir("", "imap")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	subDir := filepath.Join(rootDir, "imap-cherokee")
+	os.Setenv("IMAP_USERNAME", testUser)
+	os.Setenv("IMAP_PASSWORD", testPassword)
+	defer os.Unsetenv("IMAP_USERNAME")
+	defer os.Unsetenv("IMAP_PASSWORD")
+
+	message := func(uid int, body string) string {
+		return fmt.Sprintf("From: Sequoyah <sequoyah@cherokee.org>\nSubject: Message %d\n\n%s\n", uid, body)
+	}
+	stub.addMessage(1, "20-May-1821 10:00:00 +0000", message(1, "Before the load."))
+	stub.addMessage(2, " 3-Jun-1821 10:00:00 +0000", message(2, "Council at New Echota."))
+	stub.addMessage(3, "20-Jun-1821 10:00:00 +0000", message(3, "From each sound a letter.\n>From the council too."))
+	stub.addMessage(4, " 2-Jul-1821 10:00:00 +0000", message(4, "Summer council."))
+	stub.addMessage(5, "30-Jun-1821 23:00:00 +0000", message(5, "Arrived late."))
+	stub.addMessage(7, " 1-Aug-1821 10:00:00 +0000", message(7, "August."))
+
+	firstLoad := map[string][]string{
+		"1821-06-imap-cherokee.mbox.gz": {
+			"From sequoyah@cherokee.org Sun Jun  3 10:00:00 1821", "Subject: Message 2",
+			"From sequoyah@cherokee.org Wed Jun 20 10:00:00 1821", "Subject: Message 3", ">From each sound a letter.", ">>From the council too.",
+			"From sequoyah@cherokee.org Sat Jun 30 23:00:00 1821", "Subject: Message 5",
+		},
+		"1821-07-imap-cherokee.mbox.gz": {"From sequoyah@cherokee.org Mon Jul  2 10:00:00 1821", "Subject: Message 4"},
+	}
+	nextLoad := map[string][]string{
+		"1821-08-imap-cherokee.mbox.gz": {
+			"From sequoyah@cherokee.org Wed Aug  1 10:00:00 1821", "Subject: Message 7",
+			"From sequoyah@cherokee.org Wed Aug 15 10:00:00 1821", "Subject: Message 8",
+		},
+	}
+	for name, lines := range firstLoad {
+		nextLoad[name] = lines
+	}
+	laterLoad := map[string][]string{
+		"1821-09-imap-cherokee.mbox.gz": {"From sequoyah@cherokee.org Thu Sep 13 10:00:00 1821", "Subject: Message 10"},
+		"2037-01-imap-cherokee.mbox.gz": {"From sequoyah@cherokee.org Thu Jan  1 10:00:00 2037", "Subject: Message 9"},
+	}
+	for name, lines := range nextLoad {
+		laterLoad[name] = lines
+	}
+	// After the UIDVALIDITY change the first run starts in August so the months before it are replaced, not added to
+	earlierLoad := map[string][]string{
+		"1821-04-imap-cherokee.mbox.gz": {"From sequoyah@cherokee.org Sun Apr 15 10:00:00 1821", "Subject: Message 11"},
+		"1821-05-imap-cherokee.mbox.gz": {"From sequoyah@cherokee.org Sun May 20 10:00:00 1821", "Subject: Message 1"},
+	}
+	for name, lines := range laterLoad {
+		earlierLoad[name] = lines
+	}
+
+	tests := []struct {
+		comparisonType string
+		newMessages    map[uint32]string
+		validity       uint32
+		dropState      bool
+		startDate      string
+		endDate        string
+		wantMark       folderMark
+		wantStart      string
+		wantSubjects   map[string][]string
+	}{
+		{
+			comparisonType: "First load skips messages before the load and keeps the month past a message received after it",
+			startDate:      "1821-06-01",
+			endDate:        "1821-08-01",
+			wantMark:       folderMark{validity: 1821, uid: 6},
+			wantStart:      "1821-06-01",
+			wantSubjects:   firstLoad,
+		},
+		{
+			comparisonType: "Next load resumes after the last UID",
+			newMessages:    map[uint32]string{8: "15-Aug-1821 10:00:00 +0000"},
+			startDate:      "1821-08-01",
+			endDate:        "1821-10-01",
+			wantMark:       folderMark{validity: 1821, uid: 8},
+			wantStart:      "1821-06-01",
+			wantSubjects:   nextLoad,
+		},
+		{
+			comparisonType: "Load without new messages stores nothing",
+			startDate:      "1821-08-01",
+			endDate:        "1821-10-01",
+			wantMark:       folderMark{validity: 1821, uid: 8},
+			wantStart:      "1821-06-01",
+			wantSubjects:   nextLoad,
+		},
+		{
+			comparisonType: "Changed UIDVALIDITY loads the folder again",
+			validity:       1828,
+			startDate:      "1821-08-01",
+			endDate:        "1821-10-01",
+			wantMark:       folderMark{validity: 1828, uid: 8},
+			wantStart:      "1821-08-01",
+			wantSubjects:   nextLoad,
+		},
+		{
+			comparisonType: "Message dated after the load is stored in its own month and passed",
+			newMessages:    map[uint32]string{9: " 1-Jan-2037 10:00:00 +0000", 10: "13-Sep-1821 10:00:00 +0000"},
+			startDate:      "1821-09-01",
+			endDate:        "1821-10-01",
+			wantMark:       folderMark{validity: 1828, uid: 10},
+			wantStart:      "1821-08-01",
+			wantSubjects:   laterLoad,
+		},
+		{
+			comparisonType: "Load that starts earlier stores the months before the first load without moving the last UID",
+			newMessages:    map[uint32]string{11: "15-Apr-1821 10:00:00 +0000"},
+			startDate:      "1821-04-01",
+			endDate:        "1821-05-01",
+			wantMark:       folderMark{validity: 1828, uid: 11},
+			wantStart:      "1821-04-01",
+			wantSubjects:   earlierLoad,
+		},
+		{
+			comparisonType: "Load that starts earlier again stores nothing",
+			startDate:      "1821-04-01",
+			endDate:        "1821-06-01",
+			wantMark:       folderMark{validity: 1828, uid: 11},
+			wantStart:      "1821-04-01",
+			wantSubjects:   earlierLoad,
+		},
+		{
+			comparisonType: "Load after the state is lost leaves out the messages stored in each month",
+			dropState:      true,
+			startDate:      "1821-06-01",
+			endDate:        "1821-10-01",
+			wantMark:       folderMark{validity: 1828, uid: 11},
+			wantStart:      "1821-06-01",
+			wantSubjects:   earlierLoad,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			for uid, date := range test.newMessages {
+				stub.addMessage(uid, date, message(int(uid), "More August."))
+			}
+			if test.validity != 0 {
+				stub.mu.Lock()
+				stub.validity = test.validity
+				stub.mu.Unlock()
+			}
+			src, err := source.New("imap", source.Config{BaseURL: "imap://" + stub.listener.Addr().String(), Groups: []string{testFolder}})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "imap-cherokee"}
+			if test.dropState {
+				os.Remove(filepath.Join(rootDir, "state", "imap-cherokee", "imap-state.txt"))
+			}
+
+			if err = source.Load(ctx, src, storage, testFolder, test.startDate, test.endDate); err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			gotMark, gotStart, _, _ := readMark(ctx, storage)
+			if gotMark != test.wantMark {
+				t.Errorf("Mark doesn't match.\n got: %v\nwant: %v", gotMark, test.wantMark)
+			}
+			if gotStart.Format("2006-01-02") != test.wantStart {
+				t.Errorf("Start doesn't match.\n got: %v\nwant: %s", gotStart, test.wantStart)
+			}
+			gotSubjects, err := utils.StoredMboxLines(subDir, "From ", "Subject: ", ">")
+			if err != nil {
+				t.Fatalf("Stored messages failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotSubjects, test.wantSubjects) {
+				t.Errorf("Stored messages don't match.\n got: %v\nwant: %v", gotSubjects, test.wantSubjects)
+			}
+		})
+	}
+}
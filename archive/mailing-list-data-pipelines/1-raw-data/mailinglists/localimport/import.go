@@ -0,0 +1,372 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Load mailing list dumps from local disk into storage the same way the sources store crawled lists.
+
+Paths can be mbox files, gzipped mbox files or Maildir directories with cur and new subdirectories. Messages are split
+into months by their Date header, or the date on the mbox From line when the header can't be read, and each month is
+stored as [YEAR]-[MONTH].mbox.gz in the storage subdirectory. Messages from every path are gathered before storing so
+dumps that cover the same month end up in one file. Quoted From lines in mbox input are unquoted and every message is
+written again as mboxrd, so mbox and Maildir input are stored the same way. Messages are spooled to a file per month in
+a temp directory rather than held in memory, and each month is gzipped as it is streamed into storage. Messages without
+any readable date are skipped and logged. With refresh never, months already stored are skipped and logged with the
+number of messages left out.
+*/
+
+package localimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr = errors.New("Storage failed")
+	importErr  = errors.New("import")
+)
+
+// Message handed over by a reader. The From line is empty for messages that don't come from an mbox.
+type message struct {
+	fromLine string
+	raw      []byte
+}
+
+// Messages gathered by year-month in a spool file per month in the temp directory
+type importer struct {
+	dir     string
+	counts  map[string]int
+	skipped int
+	// Spool file of the month written last, kept open while messages stay in that month
+	spoolMonth string
+	spool      *os.File
+}
+
+// Open the mbox and decompress it when it starts with the gzip header.
+func openMbox(path string) (r io.Reader, closer io.Closer, err error) {
+	var (
+		file  *os.File
+		magic []byte
+	)
+
+	if file, err = os.Open(path); err != nil {
+		return nil, nil, fmt.Errorf("%w open %s: %v", importErr, path, err)
+	}
+	buffered := bufio.NewReader(file)
+	if magic, err = buffered.Peek(2); err != nil && err != io.EOF {
+		file.Close()
+		return nil, nil, fmt.Errorf("%w read %s: %v", importErr, path, err)
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(buffered); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("%w gzip %s: %v", importErr, path, err)
+		}
+		return r, file, nil
+	}
+	return buffered, file, nil
+}
+
+// Split the mbox into raw messages. A message starts at a From line at the start of the file or after a blank line.
+// Lines that start with From after one or more > lose one > as mboxrd quotes them. Line endings become newlines.
+func readMbox(r io.Reader, each func(msg message) error) (err error) {
+	var (
+		line    string
+		readErr error
+		current *message
+		body    bytes.Buffer
+	)
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		current.raw = append([]byte(nil), body.Bytes()...)
+		return each(*current)
+	}
+
+	buffered := bufio.NewReader(r)
+	previousBlank := true
+	for readErr == nil {
+		if line, readErr = buffered.ReadString('\n'); readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("%w mbox read: %v", importErr, readErr)
+		}
+		if line == "" {
+			continue
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if previousBlank && strings.HasPrefix(trimmed, "From ") {
+			if err = flush(); err != nil {
+				return
+			}
+			current = &message{fromLine: trimmed}
+			body.Reset()
+		} else if current != nil {
+			if strings.HasPrefix(trimmed, ">") && strings.HasPrefix(strings.TrimLeft(trimmed, ">"), "From ") {
+				trimmed = trimmed[1:]
+			}
+			body.WriteString(trimmed + "\n")
+		}
+		previousBlank = trimmed == ""
+	}
+	return flush()
+}
+
+// Hand over each message in the cur and new directories of the Maildir in file name order.
+func readMaildir(dir string, each func(msg message) error) (err error) {
+	var (
+		files []os.FileInfo
+		paths []string
+		raw   []byte
+	)
+
+	for _, subDir := range []string{"cur", "new"} {
+		if files, err = ioutil.ReadDir(filepath.Join(dir, subDir)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w Maildir %s: %v", importErr, dir, err)
+		}
+		for _, file := range files {
+			if !file.IsDir() {
+				paths = append(paths, filepath.Join(dir, subDir, file.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if raw, err = ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("%w Maildir message %s: %v", importErr, path, err)
+		}
+		if err = each(message{raw: bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))}); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// True for directories that hold a Maildir.
+func isMaildir(dir string) bool {
+	for _, subDir := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(dir, subDir)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// Date from the Date header or the mbox From line after the sender. Zero when neither can be read.
+func messageDate(msg message) (date time.Time) {
+	if parsed, err := mail.ReadMessage(bytes.NewReader(msg.raw)); err == nil {
+		if date, err = parsed.Header.Date(); err == nil {
+			return date.UTC()
+		}
+	}
+	if fields := strings.SplitN(msg.fromLine, " ", 3); len(fields) == 3 {
+		if date, err := time.Parse(time.ANSIC, strings.TrimSpace(fields[2])); err == nil {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// From line for messages that didn't come with one, using the sender and date.
+func fromLine(raw []byte, date time.Time) string {
+	sender := "MAILER-DAEMON"
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if address, err := mail.ParseAddress(parsed.Header.Get("From")); err == nil {
+			sender = address.Address
+		}
+	}
+	return fmt.Sprintf("From %s %s", sender, date.Format(time.ANSIC))
+}
+
+// Add the message to the mbox for the month it is dated in. Messages keep their mbox From line and others get one.
+func (im *importer) add(msg message) (err error) {
+	date := messageDate(msg)
+	if date.IsZero() {
+		im.skipped++
+		log.Printf("Skipping message %q because its date can't be read.", msg.fromLine)
+		return nil
+	}
+	yearMonth := date.Format("2006-01")
+	if err = im.openSpool(yearMonth); err != nil {
+		return
+	}
+
+	im.counts[yearMonth]++
+	msgFromLine := msg.fromLine
+	if msgFromLine == "" {
+		msgFromLine = fromLine(msg.raw, date)
+	}
+	if err = utils.WriteMboxEntry(im.spool, msgFromLine, string(msg.raw)); err != nil {
+		err = fmt.Errorf("%w spool %s: %v", importErr, yearMonth, err)
+	}
+	return
+}
+
+func (im *importer) spoolPath(yearMonth string) string {
+	return filepath.Join(im.dir, yearMonth+".mbox")
+}
+
+// Open the spool file of the month to append to. Dumps are mostly in date order so the file stays open until a message
+// from another month comes along.
+func (im *importer) openSpool(yearMonth string) (err error) {
+	if im.spool != nil && im.spoolMonth == yearMonth {
+		return nil
+	}
+	if err = im.closeSpool(); err != nil {
+		return
+	}
+	if im.spool, err = os.OpenFile(im.spoolPath(yearMonth), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return fmt.Errorf("%w spool %s: %v", importErr, yearMonth, err)
+	}
+	im.spoolMonth = yearMonth
+	return
+}
+
+func (im *importer) closeSpool() (err error) {
+	if im.spool == nil {
+		return nil
+	}
+	err = im.spool.Close()
+	im.spool = nil
+	if err != nil {
+		err = fmt.Errorf("%w spool %s: %v", importErr, im.spoolMonth, err)
+	}
+	return
+}
+
+// Write the spooled month gzipped to the stream.
+func (im *importer) writeMonth(w io.Writer, yearMonth string) (err error) {
+	var spool *os.File
+
+	if spool, err = os.Open(im.spoolPath(yearMonth)); err != nil {
+		return fmt.Errorf("%w spool %s: %v", importErr, yearMonth, err)
+	}
+	defer spool.Close()
+	gz := gzip.NewWriter(w)
+	if _, err = io.Copy(gz, spool); err != nil {
+		return
+	}
+	return gz.Close()
+}
+
+// Read the mbox file or Maildir directory at the path.
+func (im *importer) read(path string) (err error) {
+	var (
+		info   os.FileInfo
+		r      io.Reader
+		closer io.Closer
+	)
+
+	if info, err = os.Stat(path); err != nil {
+		return fmt.Errorf("%w %s: %v", importErr, path, err)
+	}
+	if info.IsDir() {
+		if !isMaildir(path) {
+			return fmt.Errorf("%w %s is a directory without Maildir cur or new subdirectories", importErr, path)
+		}
+		return readMaildir(path, im.add)
+	}
+	if r, closer, err = openMbox(path); err != nil {
+		return
+	}
+	defer closer.Close()
+	return readMbox(r, im.add)
+}
+
+// Import the mbox files, gzipped mbox files and Maildir directories into the storage subdirectory one month per file.
+// How months already stored are handled follows the storage refresh mode.
+func Import(ctx context.Context, storage gcs.Connection, groupName string, paths []string) (err error) {
+	var (
+		stored        bool
+		storedMonths  []string
+		storedSkipped int
+	)
+	im := &importer{counts: make(map[string]int)}
+	mode, _ := storage.Refresh()
+
+	if im.dir, err = ioutil.TempDir("", "import"); err != nil {
+		return fmt.Errorf("%w spool directory: %v", importErr, err)
+	}
+	defer os.RemoveAll(im.dir)
+	for _, path := range paths {
+		if err = im.read(path); err != nil {
+			im.closeSpool()
+			return
+		}
+	}
+	if err = im.closeSpool(); err != nil {
+		return
+	}
+	yearMonths := make([]string, 0, len(im.counts))
+	for yearMonth := range im.counts {
+		yearMonths = append(yearMonths, yearMonth)
+	}
+	sort.Strings(yearMonths)
+
+	for _, yearMonth := range yearMonths {
+		if mode == gcs.RefreshNever {
+			if _, stored, err = storage.Stat(ctx, yearMonth+".mbox.gz"); err != nil {
+				return fmt.Errorf("%w: %v", storageErr, err)
+			}
+			if stored {
+				log.Printf("Month %s is already stored for %s so its %d imported messages were left out.", yearMonth, groupName, im.counts[yearMonth])
+				storedMonths = append(storedMonths, yearMonth)
+				storedSkipped += im.counts[yearMonth]
+				continue
+			}
+		}
+		monthStart, _ := time.Parse("2006-01", yearMonth)
+		meta := gcs.ObjectMeta{
+			ContentType: "application/x-gzip",
+			SourceURL:   "file://" + strings.Join(paths, " file://"),
+			MailingList: "import",
+			GroupName:   groupName,
+			StartDate:   monthStart.Format("2006-01-02"),
+			EndDate:     utils.AddMonth(monthStart).Format("2006-01-02"),
+			FetchedAt:   time.Now(),
+		}
+		_, err = utils.StoreWriter(ctx, storage, yearMonth+".mbox.gz", meta, func(w io.Writer) error {
+			return im.writeMonth(w, yearMonth)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", storageErr, err)
+		}
+		// Free the disk as the import goes rather than at the end
+		os.Remove(im.spoolPath(yearMonth))
+		log.Printf("Imported %d messages for %s in %s.", im.counts[yearMonth], groupName, yearMonth)
+	}
+	if im.skipped > 0 {
+		log.Printf("Skipped %d messages without a readable date.", im.skipped)
+	}
+	if len(storedMonths) > 0 {
+		log.Printf("Left out %d messages in months already stored: %s. Import with refresh changed or always to replace them.", storedSkipped, strings.Join(storedMonths, " "))
+	}
+	return
+}
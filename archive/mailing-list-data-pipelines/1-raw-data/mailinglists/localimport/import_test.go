@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localimport
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const testMbox = `From tecumseh@shawnee.org Mon Aug 20 10:00:00 1810
+From: Tecumseh <tecumseh@shawnee.org>
+Date: Mon, 20 Aug 1810 10:00:00 -0500
+Subject: Council at Vincennes
+
+>From the lakes to the gulf we are one.
+>>From the river we speak.
+
+From tenskwatawa@shawnee.org Sat Sep  1 12:00:00 1810
+From: Tenskwatawa <tenskwatawa@shawnee.org>
+Date: sometime
+Subject: Prophetstown
+
+The date line can't be read.
+From the From line date instead.
+
+From nobody Thu Jan  1 00:00:00 xxxx
+Subject: No date anywhere
+
+Lost.
+`
+
+func TestReadMbox(t *testing.T) {
+	var got []message
+
+	err := readMbox(strings.NewReader(testMbox), func(msg message) error {
+		got = append(got, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []message{
+		{
+			fromLine: "From tecumseh@shawnee.org Mon Aug 20 10:00:00 1810",
+			raw:      []byte("From: Tecumseh <tecumseh@shawnee.org>\nDate: Mon, 20 Aug 1810 10:00:00 -0500\nSubject: Council at Vincennes\n\nFrom the lakes to the gulf we are one.\n>From the river we speak.\n\n"),
+		},
+		{
+			fromLine: "From tenskwatawa@shawnee.org Sat Sep  1 12:00:00 1810",
+			raw:      []byte("From: Tenskwatawa <tenskwatawa@shawnee.org>\nDate: sometime\nSubject: Prophetstown\n\nThe date line can't be read.\nFrom the From line date instead.\n\n"),
+		},
+		{
+			fromLine: "From nobody Thu Jan  1 00:00:00 xxxx",
+			raw:      []byte("Subject: No date anywhere\n\nLost.\n"),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages don't match.\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		msg            message
+		wantDate       time.Time
+	}{
+		{
+			comparisonType: "Date header in UTC",
+			msg:            message{raw: []byte("Date: Mon, 31 Dec 1810 22:00:00 -0500\n\nBody\n")},
+			wantDate:       time.Date(1811, 1, 1, 3, 0, 0, 0, time.UTC),
+		},
+		{
+			comparisonType: "From line date when the header can't be read",
+			msg:            message{fromLine: "From tenskwatawa@shawnee.org  Sat Sep  1 12:00:00 1810", raw: []byte("Date: sometime\n\nBody\n")},
+			wantDate:       time.Date(1810, 9, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			comparisonType: "No readable date",
+			msg:            message{raw: []byte("Subject: Lost\n\nBody\n")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotDate := messageDate(test.msg); !gotDate.Equal(test.wantDate) {
+				t.Errorf("Date doesn't match.\n got: %v\nwant: %v", gotDate, test.wantDate)
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	dumpDir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	// Plain mbox, gzipped mbox without the extension and a Maildir with CRLF line endings
+	mboxPath := filepath.Join(dumpDir, "shawnee.mbox")
+	ioutil.WriteFile(mboxPath, []byte(testMbox), 0644)
+	gzPath := filepath.Join(dumpDir, "shawnee-1811")
+	gzFile, _ := os.Create(gzPath)
+	gz := gzip.NewWriter(gzFile)
+	gz.Write([]byte("From tecumseh@shawnee.org Thu Nov  7 06:00:00 1811\nFrom: Tecumseh <tecumseh@shawnee.org>\nDate: Thu, 7 Nov 1811 06:00:00 +0000\nSubject: Tippecanoe\n\nHold the town.\n"))
+	gz.Close()
+	gzFile.Close()
+	maildirPath := filepath.Join(dumpDir, "Maildir")
+	os.MkdirAll(filepath.Join(maildirPath, "cur"), 0755)
+	os.MkdirAll(filepath.Join(maildirPath, "new"), 0755)
+	ioutil.WriteFile(filepath.Join(maildirPath, "cur", "1810.1.shawnee:2,S"), []byte("From: Tecumseh <tecumseh@shawnee.org>\r\nDate: Wed, 22 Aug 1810 09:00:00 -0500\r\nSubject: Answer to Harrison\r\n\r\nFrom Vincennes we return.\r\n"), 0644)
+	ioutil.WriteFile(filepath.Join(maildirPath, "new", "1811.2.shawnee"), []byte("From: Tenskwatawa <tenskwatawa@shawnee.org>\nDate: Fri, 8 Nov 1811 08:00:00 +0000\nSubject: After the battle\n\nWe leave Prophetstown.\n"), 0644)
+
+	tests := []struct {
+		comparisonType string
+		paths          []string
+		wantErr        bool
+		wantLines      map[string][]string
+	}{
+		{
+			comparisonType: "Directory that isn't a Maildir",
+			paths:          []string{dumpDir},
+			wantErr:        true,
+		},
+		{
+			comparisonType: "Dumps split into months and merged",
+			paths:          []string{mboxPath, gzPath, maildirPath},
+			wantLines: map[string][]string{
+				"1810-08-shawnee.mbox.gz": {
+					"From tecumseh@shawnee.org Mon Aug 20 10:00:00 1810", "Subject: Council at Vincennes", ">From the lakes to the gulf we are one.", ">>From the river we speak.",
+					"From tecumseh@shawnee.org Wed Aug 22 14:00:00 1810", "Subject: Answer to Harrison", ">From Vincennes we return.",
+				},
+				"1810-09-shawnee.mbox.gz": {"From tenskwatawa@shawnee.org Sat Sep  1 12:00:00 1810", "Subject: Prophetstown", ">From the From line date instead."},
+				"1811-11-shawnee.mbox.gz": {
+					"From tecumseh@shawnee.org Thu Nov  7 06:00:00 1811", "Subject: Tippecanoe",
+					"From tenskwatawa@shawnee.org Fri Nov  8 08:00:00 1811", "Subject: After the battle",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			rootDir, err := ioutil.TempDir("", "import")
+			if err != nil {
+				t.Fatalf("Temp dir failed: %v", err)
+			}
+			defer os.RemoveAll(rootDir)
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "shawnee"}
+
+			gotErr := Import(ctx, storage, "shawnee", test.paths)
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			gotLines, err := utils.StoredMboxLines(filepath.Join(rootDir, "shawnee"), "From ", "Subject: ", ">")
+			if err != nil {
+				t.Fatalf("Stored months failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotLines, test.wantLines) {
+				t.Errorf("Stored months don't match.\n got: %q\nwant: %q", gotLines, test.wantLines)
+			}
+		})
+	}
+}
+
+func TestImportStoredMonth(t *testing.T) {
+	ctx := context.Background()
+	dumpDir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	rootDir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "shawnee"}
+
+	firstPath := filepath.Join(dumpDir, "vincennes.mbox")
+	ioutil.WriteFile(firstPath, []byte("From tecumseh@shawnee.org Mon Aug 20 10:00:00 1810\nFrom: Tecumseh <tecumseh@shawnee.org>\nDate: Mon, 20 Aug 1810 10:00:00 -0500\nSubject: Council at Vincennes\n\nWe are one.\n"), 0644)
+	nextPath := filepath.Join(dumpDir, "harrison.mbox")
+	ioutil.WriteFile(nextPath, []byte("From tecumseh@shawnee.org Wed Aug 22 09:00:00 1810\nFrom: Tecumseh <tecumseh@shawnee.org>\nDate: Wed, 22 Aug 1810 09:00:00 -0500\nSubject: Answer to Harrison\n\nWe return.\n"), 0644)
+	if err = Import(ctx, storage, "shawnee", []string{firstPath}); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType string
+		refresh        gcs.RefreshMode
+		wantLines      map[string][]string
+	}{
+		{
+			comparisonType: "Month already stored is left out under never",
+			refresh:        gcs.RefreshNever,
+			wantLines:      map[string][]string{"1810-08-shawnee.mbox.gz": {"Subject: Council at Vincennes"}},
+		},
+		{
+			comparisonType: "Month already stored is replaced under always",
+			refresh:        gcs.RefreshAlways,
+			wantLines:      map[string][]string{"1810-08-shawnee.mbox.gz": {"Subject: Answer to Harrison"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			storage.SetRefresh(test.refresh, false)
+			if err := Import(ctx, storage, "shawnee", []string{nextPath}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			gotLines, err := utils.StoredMboxLines(filepath.Join(rootDir, "shawnee"), "Subject: ")
+			if err != nil {
+				t.Fatalf("Stored months failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotLines, test.wantLines) {
+				t.Errorf("Stored months don't match.\n got: %q\nwant: %q", gotLines, test.wantLines)
+			}
+		})
+	}
+}
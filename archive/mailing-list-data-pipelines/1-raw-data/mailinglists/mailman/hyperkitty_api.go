@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailman
+
+/*
+Discover lists and their active months through the HyperKitty REST API.
+
+Lists on the host, paginated with limit and offset and a next link:
+[BASE URL]/archives/api/lists/
+Emails for a list where count is the total and each result has a date:
+[BASE URL]/archives/api/list/[LIST ADDRESS]/emails/?limit=1&offset=[N]
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	apiErr = errors.New("hyperkitty api")
+)
+
+// Page of results from the API
+type apiPage struct {
+	Count   int             `json:"count"`
+	Next    string          `json:"next"`
+	Results json.RawMessage `json:"results"`
+}
+
+type apiList struct {
+	// List address
+	Name string `json:"name"`
+}
+
+type apiEmail struct {
+	Date string `json:"date"`
+}
+
+// First and last months with emails for a list. Empty lists have no months.
+type listActivity struct {
+	firstMonth, lastMonth time.Time
+	empty                 bool
+}
+
+// Get and decode one page of API results.
+func getAPIPage(httpToReader utils.HttpReaderResponse, url string) (page apiPage, err error) {
+	var body io.ReadCloser
+
+	if body, _, err = httpToReader(url, nil); err != nil {
+		err = fmt.Errorf("%w get on %s: %v", apiErr, url, err)
+		return
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(&page); err != nil {
+		err = fmt.Errorf("%w decode on %s: %v", apiErr, url, err)
+	}
+	return
+}
+
+// List addresses of all lists on the host by following the next page links.
+func (mm *mailmanSource) discoverLists(ctx context.Context) (listAddresses []string, err error) {
+	var page apiPage
+	seen := make(map[string]bool)
+
+	for url := fmt.Sprintf("%s/archives/api/lists/", mm.baseURL); url != "" && !seen[url]; url = page.Next {
+		seen[url] = true
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if page, err = getAPIPage(mm.httpToReader, url); err != nil {
+			return
+		}
+
+		var lists []apiList
+		if err = json.Unmarshal(page.Results, &lists); err != nil {
+			err = fmt.Errorf("%w lists on %s: %v", apiErr, url, err)
+			return
+		}
+		for _, list := range lists {
+			listAddresses = append(listAddresses, list.Name)
+		}
+	}
+	log.Printf("Discovered %d lists on %s.", len(listAddresses), mm.baseURL)
+	return
+}
+
+// Date of the email at the offset in the list's email results.
+func (mm *mailmanSource) emailDateAt(listAddress string, offset int) (date time.Time, count int, err error) {
+	var (
+		page   apiPage
+		emails []apiEmail
+	)
+
+	url := fmt.Sprintf("%s/archives/api/list/%s/emails/?limit=1&offset=%d", mm.baseURL, listAddress, offset)
+	if page, err = getAPIPage(mm.httpToReader, url); err != nil {
+		return
+	}
+	count = page.Count
+	if err = json.Unmarshal(page.Results, &emails); err != nil {
+		err = fmt.Errorf("%w emails on %s: %v", apiErr, url, err)
+		return
+	}
+	if len(emails) == 0 {
+		return
+	}
+	if date, err = time.Parse(time.RFC3339, emails[0].Date); err != nil {
+		err = fmt.Errorf("%w email date on %s: %v", apiErr, url, err)
+	}
+	return
+}
+
+// Find the first and last months with emails from the first and last email results. Both ends are compared so the
+// result doesn't depend on the sort order the host uses.
+func (mm *mailmanSource) findActivity(listAddress string) (activity listActivity, err error) {
+	var (
+		firstDate, lastDate time.Time
+		count               int
+	)
+
+	if firstDate, count, err = mm.emailDateAt(listAddress, 0); err != nil {
+		return
+	}
+	if count == 0 {
+		activity.empty = true
+		return
+	}
+	if lastDate, _, err = mm.emailDateAt(listAddress, count-1); err != nil {
+		return
+	}
+	if lastDate.Before(firstDate) {
+		firstDate, lastDate = lastDate, firstDate
+	}
+	activity.firstMonth = time.Date(firstDate.UTC().Year(), firstDate.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	activity.lastMonth = time.Date(lastDate.UTC().Year(), lastDate.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+// Activity for the list, looked up once per source.
+func (mm *mailmanSource) listActivity(listAddress string) (activity listActivity, err error) {
+	mm.mu.Lock()
+	activity, ok := mm.activity[listAddress]
+	mm.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if activity, err = mm.findActivity(listAddress); err != nil {
+		return
+	}
+	mm.mu.Lock()
+	mm.activity[listAddress] = activity
+	mm.mu.Unlock()
+	return
+}
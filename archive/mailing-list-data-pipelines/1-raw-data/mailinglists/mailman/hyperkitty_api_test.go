@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+// HyperKitty style REST API with two pages of lists and email results sorted newest first
+func fakeHyperKittyAPIServer() *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	emailDates := map[string][]string{
+		"wampum@haudenosaunee.org":    {"2021-03-04T15:04:05Z", "2020-11-30T23:00:00-05:00", "2019-07-01T00:00:00+00:00"},
+		"longhouse@haudenosaunee.org": {},
+	}
+
+	mux.HandleFunc("/archives/api/lists/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") == "" {
+			fmt.Fprintf(w, `{"count": 3, "next": "%s/archives/api/lists/?limit=2&offset=2", "results": [{"name": "wampum@haudenosaunee.org"}, {"name": "longhouse@haudenosaunee.org"}]}`, server.URL)
+			return
+		}
+		fmt.Fprint(w, `{"count": 3, "next": null, "results": [{"name": "hiawatha@haudenosaunee.org"}]}`)
+	})
+	mux.HandleFunc("/archives/api/list/", func(w http.ResponseWriter, r *http.Request) {
+		var offset int
+		listAddress := r.URL.Path[len("/archives/api/list/") : len(r.URL.Path)-len("/emails/")]
+		dates, ok := emailDates[listAddress]
+		if !ok {
+			http.Error(w, "list not found", http.StatusNotFound)
+			return
+		}
+		fmt.Sscanf(r.URL.Query().Get("offset"), "%d", &offset)
+		if offset >= len(dates) {
+			fmt.Fprintf(w, `{"count": %d, "next": null, "results": []}`, len(dates))
+			return
+		}
+		fmt.Fprintf(w, `{"count": %d, "next": null, "results": [{"date": "%s"}]}`, len(dates), dates[offset])
+	})
+	return server
+}
+
+func TestListGroups(t *testing.T) {
+	ctx := context.Background()
+	server := fakeHyperKittyAPIServer()
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		groups         []string
+		wantGroups     []string
+	}{
+		{
+			comparisonType: "Configured groups are kept",
+			groups:         []string{"wampum"},
+			wantGroups:     []string{"wampum"},
+		},
+		{
+			comparisonType: "Lists discovered across pages",
+			groups:         nil,
+			wantGroups:     []string{"wampum@haudenosaunee.org", "longhouse@haudenosaunee.org", "hiawatha@haudenosaunee.org"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, _ := NewSource(source.Config{BaseURL: server.URL, Groups: test.groups, HttpToReader: utils.ReaderResponse})
+			gotGroups, gotErr := src.ListGroups(ctx)
+			if gotErr != nil {
+				t.Errorf("Unexpected error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("Groups don't match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestMonths(t *testing.T) {
+	ctx := context.Background()
+	server := fakeHyperKittyAPIServer()
+	defer server.Close()
+	src, _ := NewSource(source.Config{BaseURL: server.URL, HttpToReader: utils.ReaderResponse})
+
+	month := func(year int, month time.Month) time.Time { return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		startDate      time.Time
+		endDate        time.Time
+		wantMonths     []time.Time
+	}{
+		{
+			comparisonType: "Months limited to the list's first and last emails",
+			groupName:      "wampum@haudenosaunee.org",
+			startDate:      month(2019, time.May),
+			endDate:        month(2021, time.June),
+			wantMonths:     source.MonthRange(month(2019, time.July), month(2021, time.April)),
+		},
+		{
+			comparisonType: "Range inside the active months is kept",
+			groupName:      "wampum@haudenosaunee.org",
+			startDate:      month(2020, time.January),
+			endDate:        month(2020, time.March),
+			wantMonths:     []time.Time{month(2020, time.January), month(2020, time.February)},
+		},
+		{
+			comparisonType: "List without emails has no months",
+			groupName:      "longhouse@haudenosaunee.org",
+			startDate:      month(2019, time.May),
+			endDate:        month(2021, time.June),
+			wantMonths:     nil,
+		},
+		{
+			comparisonType: "Every month requested when the API fails",
+			groupName:      "hiawatha@haudenosaunee.org",
+			startDate:      month(2019, time.May),
+			endDate:        month(2019, time.August),
+			wantMonths:     []time.Time{month(2019, time.May), month(2019, time.June), month(2019, time.July)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMonths, gotErr := src.Months(ctx, test.groupName, test.startDate, test.endDate)
+			if gotErr != nil {
+				t.Errorf("Unexpected error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months don't match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+		})
+	}
+}
+
+func TestFindActivity(t *testing.T) {
+	server := fakeHyperKittyAPIServer()
+	defer server.Close()
+	src, _ := NewSource(source.Config{BaseURL: server.URL, HttpToReader: utils.ReaderResponse})
+
+	tests := []struct {
+		comparisonType string
+		listAddress    string
+		wantActivity   listActivity
+		wantErr        error
+	}{
+		{
+			comparisonType: "First and last months in UTC",
+			listAddress:    "wampum@haudenosaunee.org",
+			wantActivity:   listActivity{firstMonth: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), lastMonth: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Empty list",
+			listAddress:    "longhouse@haudenosaunee.org",
+			wantActivity:   listActivity{empty: true},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Missing list",
+			listAddress:    "hiawatha@haudenosaunee.org",
+			wantErr:        apiErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotActivity, gotErr := src.(*mailmanSource).findActivity(test.listAddress)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if !reflect.DeepEqual(gotActivity, test.wantActivity) {
+				t.Errorf("Activity doesn't match.\n got: %+v\nwant: %+v", gotActivity, test.wantActivity)
+			}
+		})
+	}
+}
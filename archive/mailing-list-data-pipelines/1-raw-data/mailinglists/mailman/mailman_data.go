@@ -13,7 +13,13 @@
 // limitations under the License.
 
 /*
-Access and load Mailman data.
+Access and load Mailman 3 data through the HyperKitty archive export on any host.
+
+Groups are entered as the full list address such as devel@lists.fedoraproject.org. A group without a domain gets the
+domain of the base URL host, or python.org on the default host, so python-dev still loads python-dev@python.org.
+
+Monthly export url format:
+[BASE URL]/archives/list/[LIST ADDRESS]/export/[LIST ADDRESS]-[YEAR-MONTH].mbox.gz?start=[START DATE]&end=[END DATE]
 */
 
 package mailman
@@ -23,17 +29,23 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
 var (
 	storageErr = errors.New("Storage failed")
+	baseURLErr = errors.New("base url")
 )
 
+const defaultBaseURL = "https://mail.python.org"
+
 // Create filename to save Mailman data.
 func createMailmanFilename(currentStart string) (fileName string) {
 	yearMonth := strings.Split(currentStart, "-")[0:2]
@@ -41,52 +53,103 @@ func createMailmanFilename(currentStart string) (fileName string) {
 }
 
 // Create URL needed for Mailman with specific dates and filename for output. Forces start to first of month and end to end of month unless current date.
-func createMailmanURL(mailingListURL, filename, startDate, endDate string) (url string) {
-	return fmt.Sprintf("%vexport/python-dev@python.org-%v?start=%v&end=%v", mailingListURL, filename, startDate, endDate)
+func createMailmanURL(mailingListURL, listAddress, filename, startDate, endDate string) (url string) {
+	return fmt.Sprintf("%vexport/%v-%v?start=%v&end=%v", mailingListURL, listAddress, filename, startDate, endDate)
+}
+
+func init() {
+	source.Register("mailman", NewSource)
+}
+
+// Mailman version of the mailing list source
+type mailmanSource struct {
+	baseURL string
+	// Domain added to groups entered without one
+	listDomain   string
+	groups       []string
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Active months found through the API by list address
+	activity map[string]listActivity
 }
 
-// Get, parse and store mailman data in GCS.
-func GetMailmanData(ctx context.Context, storage gcs.Connection, groupName, startDate, endDate string) (err error) {
-	var startDateResult, endDateResult string
-	var startDateTime, endDateTime time.Time
-	var filename, url string
-	mailingListURL := fmt.Sprintf("https://mail.python.org/archives/list/%s@python.org/", groupName)
-	log.Printf("MAILMAN loading %s:", groupName)
-
-	orgEndDate := endDate
-	startDateResult = startDate
-	if startDateTime, err = utils.GetDateTimeType(startDateResult); err != nil {
-		err = fmt.Errorf("Start date in Mailman error: %v", err)
+// Create the Mailman source. BaseURL defaults to the python.org host.
+func NewSource(config source.Config) (source.Source, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("%w %q needs a scheme and host: %v", baseURLErr, baseURL, err)
 	}
-	// Cycle through dates 1 month at a time from start date
-	endDateResult = utils.AddMonth(startDateTime).Format("2006-01-02")
 
-	// Cycle and capture content by month
-	for startDateResult < orgEndDate {
-		filename = createMailmanFilename(startDateResult)
+	listDomain := parsedURL.Hostname()
+	if baseURL == defaultBaseURL {
+		listDomain = "python.org"
+	}
+	return &mailmanSource{
+		baseURL:      baseURL,
+		listDomain:   listDomain,
+		groups:       config.Groups,
+		httpToReader: config.HttpToReader,
+		activity:     make(map[string]listActivity),
+	}, nil
+}
 
-		url = createMailmanURL(mailingListURL, filename, startDateResult, endDateResult)
-		if _, err = storage.StoreContentInBucket(ctx, filename, url, "url"); err != nil {
-			return fmt.Errorf("%w: %v", storageErr, err)
-		}
+// Full list address for the group.
+func (mm *mailmanSource) listAddress(groupName string) string {
+	if strings.Contains(groupName, "@") {
+		return groupName
+	}
+	return groupName + "@" + mm.listDomain
+}
 
-		//Update the dates for the loop to continue if endDate is less
-		if startDateTime, err = utils.GetDateTimeType(startDateResult); err != nil {
-			err = fmt.Errorf("Start date in Mailman error: %v", err)
-		}
-		startDateResult = utils.ChangeFirstMonth(utils.AddMonth(startDateTime)).Format("2006-01-02")
-		if endDateResult < orgEndDate {
-			if endDateTime, err = utils.GetDateTimeType(endDateResult); err != nil {
-				err = fmt.Errorf("End date in Mailman error: %v", err)
-			}
-			endDateResult = utils.ChangeFirstMonth(utils.AddMonth(endDateTime)).Format("2006-01-02")
+func (mm *mailmanSource) Name() string {
+	return "mailman"
+}
+
+// Configured groups or all lists on the host from the HyperKitty API when none are configured.
+func (mm *mailmanSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	if len(mm.groups) > 0 {
+		return mm.groups, nil
+	}
+	return mm.discoverLists(ctx)
+}
+
+// Months in the range between the list's first and last emails. Every month in the range is returned when the API
+// can't be read so hosts without it still load.
+func (mm *mailmanSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	activity, activityErr := mm.listActivity(mm.listAddress(groupName))
+	if activityErr != nil {
+		log.Printf("Requesting every month for %s because active months were not found: %v", groupName, activityErr)
+		return source.MonthRange(startDate, endDate), nil
+	}
+	if activity.empty {
+		log.Printf("No emails archived for %s.", groupName)
+		return
+	}
+
+	for _, month := range source.MonthRange(startDate, endDate) {
+		if !month.Before(activity.firstMonth) && !month.After(activity.lastMonth) {
+			months = append(months, month)
 		}
 	}
+	return
+}
+
+// Get and store the mailman export for the month in GCS.
+func (mm *mailmanSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	listAddress := mm.listAddress(groupName)
+	mailingListURL := fmt.Sprintf("%s/archives/list/%s/", mm.baseURL, listAddress)
+	startDate := month.Format("2006-01-02")
+	endDate := utils.AddMonth(month).Format("2006-01-02")
 
-	//Check that it went through all the dates
-	if endDateResult < orgEndDate {
-		log.Printf("Did not copy all dates. Stopped at %v vs. orginal date: %v", endDateResult, orgEndDate)
-		return fmt.Errorf("%w to get all the dates, stopped at: %v when expected to stop at: %v", storageErr, endDateResult, orgEndDate)
+	filename := createMailmanFilename(startDate)
+	exportURL := createMailmanURL(mailingListURL, listAddress, filename, startDate, endDate)
+	meta := gcs.ObjectMeta{ContentType: "application/x-gzip", MailingList: "mailman", GroupName: groupName, StartDate: startDate, EndDate: endDate}
+	if _, err = utils.StoreURL(ctx, storage, mm.httpToReader, filename, exportURL, meta); err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
 	}
 	return
 }
@@ -15,12 +15,21 @@
 package mailman
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
@@ -51,6 +60,7 @@ func TestCreateMailManURL(t *testing.T) {
 	tests := []struct {
 		comparisonType string
 		url            string
+		listAddress    string
 		filename       string
 		startDate      string
 		endDate        string
@@ -58,6 +68,7 @@ func TestCreateMailManURL(t *testing.T) {
 		{
 			comparisonType: "Create url",
 			url:            "https://en.wikipedia.org/wiki/Susan_La_Flesche_Picotte",
+			listAddress:    "omaha@en.wikipedia.org",
 			filename:       "susan_la_flesche_picotte.mbox.gz",
 			startDate:      "1865-06-17",
 			endDate:        "1915-09-18",
@@ -65,8 +76,8 @@ func TestCreateMailManURL(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.comparisonType, func(t *testing.T) {
-			want := fmt.Sprintf("%vexport/python-dev@python.org-%v?start=%v&end=%v", test.url, test.filename, test.startDate, test.endDate)
-			got := createMailmanURL(test.url, test.filename, test.startDate, test.endDate)
+			want := fmt.Sprintf("%vexport/%v-%v?start=%v&end=%v", test.url, test.listAddress, test.filename, test.startDate, test.endDate)
+			got := createMailmanURL(test.url, test.listAddress, test.filename, test.startDate, test.endDate)
 			if strings.Compare(got, want) != 0 {
 				t.Errorf("CreateMMURL response does not match.\n got: %v\nwant: %v", got, want)
 			}
@@ -74,18 +85,186 @@ func TestCreateMailManURL(t *testing.T) {
 	}
 }
 
-func TestGetMailmanData(t *testing.T) {
+func TestFetchMonth(t *testing.T) {
 	ctx := context.Background()
-	//currentDate := time.Now()
+	storage := utils.NewFakeStorageConnection("mailman")
+	src, _ := NewSource(source.Config{HttpToReader: utils.FakeHttpReaderResponse})
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		month          time.Time
+		wantURL        string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test StoreInBucket is called and returns storage error",
+			groupName:      "Susan_La_Flesche_Picotte",
+			month:          time.Date(1915, 9, 1, 0, 0, 0, 0, time.UTC),
+			wantErr:        storageErr,
+		},
+		{
+			comparisonType: "Test current date to check month export url",
+			groupName:      "Katalin Karikó",
+			month:          time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantURL:        "https://mail.python.org/archives/list/Katalin Karikó@python.org/export/Katalin Karikó@python.org-2021-03.mbox.gz?start=2021-03-01&end=2021-04-01",
+			wantErr:        nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, test.groupName, test.month); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if test.wantURL != "" {
+				if gotMeta := storage.StoredMeta[createMailmanFilename(test.month.Format("2006-01-02"))]; strings.Compare(gotMeta.SourceURL, test.wantURL) != 0 {
+					t.Errorf("Export url doesn't match.\n got: %v\nwant: %v", gotMeta.SourceURL, test.wantURL)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	tests := []struct {
+		comparisonType  string
+		baseURL         string
+		groupName       string
+		wantListAddress string
+		wantErr         error
+	}{
+		{
+			comparisonType:  "Default host keeps python.org addresses",
+			baseURL:         "",
+			groupName:       "python-dev",
+			wantListAddress: "python-dev@python.org",
+			wantErr:         nil,
+		},
+		{
+			comparisonType:  "Other host uses its domain",
+			baseURL:         "https://lists.fedoraproject.org/",
+			groupName:       "devel",
+			wantListAddress: "devel@lists.fedoraproject.org",
+			wantErr:         nil,
+		},
+		{
+			comparisonType:  "Full list address is kept",
+			baseURL:         "https://lists.gnu.org",
+			groupName:       "Elizabeth-Peratrovich@tlingit.org",
+			wantListAddress: "Elizabeth-Peratrovich@tlingit.org",
+			wantErr:         nil,
+		},
+		{
+			comparisonType: "Base url without a host",
+			baseURL:        "Juneau",
+			wantErr:        baseURLErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, gotErr := NewSource(source.Config{BaseURL: test.baseURL})
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotErr == nil {
+				if got := src.(*mailmanSource).listAddress(test.groupName); strings.Compare(got, test.wantListAddress) != 0 {
+					t.Errorf("List address doesn't match.\n got: %v\nwant: %v", got, test.wantListAddress)
+				}
+			}
+		})
+	}
+}
+
+// HyperKitty style export endpoint that serves a gzipped mbox for the requested month
+func fakeHyperKittyServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/archives/list/devel@lists.fedoraproject.org/export/devel@lists.fedoraproject.org-2021-03.mbox.gz", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("start") != "2021-03-01" || r.URL.Query().Get("end") != "2021-04-01" {
+			http.Error(w, "bad date range", http.StatusBadRequest)
+			return
+		}
+		gz := gzip.NewWriter(w)
+		fmt.Fprintf(gz, "From zitkala-sa@lists.fedoraproject.org Mon Mar  1 00:00:00 2021\nSubject: American Indian Stories\n\n")
+		gz.Close()
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFetchMonthHyperKitty(t *testing.T) {
+	ctx := context.Background()
+	server := fakeHyperKittyServer()
+	defer server.Close()
+
+	rootDir, err := ioutil.TempDir("", "mailman")
+	if err != nil {
+		t.Fatalf("Temp dir setup failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "mailman-fedora-devel"}
+
+	src, err := NewSource(source.Config{BaseURL: server.URL, HttpToReader: utils.ReaderResponse})
+	if err != nil {
+		t.Fatalf("Source setup failed: %v", err)
+	}
 
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		month          time.Time
+		wantFile       string
+		wantContent    string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Export for the list address is stored",
+			groupName:      "devel@lists.fedoraproject.org",
+			month:          time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantFile:       "mailman-fedora-devel/2021-03-mailman-fedora-devel.mbox.gz",
+			wantContent:    "Subject: American Indian Stories",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Missing export returns storage error",
+			groupName:      "devel@lists.fedoraproject.org",
+			month:          time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantErr:        storageErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, test.groupName, test.month); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if test.wantFile == "" {
+				return
+			}
+			f, err := os.Open(filepath.Join(rootDir, test.wantFile))
+			if err != nil {
+				t.Fatalf("Stored file missing: %v", err)
+			}
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("Stored file is not gzip: %v", err)
+			}
+			gotContent, _ := ioutil.ReadAll(gz)
+			if !strings.Contains(string(gotContent), test.wantContent) {
+				t.Errorf("Stored content doesn't match.\n got: %s\nwant: %v", gotContent, test.wantContent)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
 	storage := utils.NewFakeStorageConnection("mailman")
+	src, _ := source.New("mailman", source.Config{HttpToReader: utils.FakeHttpReaderResponse})
 
 	tests := []struct {
 		comparisonType string
 		groupName      string
 		startDate      string
 		endDate        string
-		numMonths      int
 		wantErr        error
 	}{
 		{
@@ -93,15 +272,6 @@ func TestGetMailmanData(t *testing.T) {
 			groupName:      "Susan_La_Flesche_Picotte",
 			startDate:      "1915-09-01",
 			endDate:        "1915-09-30",
-			numMonths:      1,
-			wantErr:        storageErr,
-		},
-		{
-			comparisonType: "SetDate error StartDate wrong format",
-			groupName:      "Susan_La_Flesche_Picotte",
-			startDate:      "06-17",
-			endDate:        "1915-09-30",
-			numMonths:      1,
 			wantErr:        storageErr,
 		},
 		{
@@ -109,16 +279,13 @@ func TestGetMailmanData(t *testing.T) {
 			groupName:      "Katalin Karikó",
 			startDate:      "2021-03-31",
 			endDate:        "2021-04-01",
-			numMonths:      1,
 			wantErr:        nil,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotErr := GetMailmanData(ctx, storage, test.groupName, test.startDate, test.endDate); !errors.Is(gotErr, test.wantErr) {
-				if gotErr == nil || !strings.Contains(gotErr.Error(), test.wantErr.Error()) {
-					t.Errorf("Error doesn't match.\n got: %v\nwant it to contain: %v", gotErr, test.wantErr)
-				}
+			if gotErr := source.Load(ctx, src, storage, test.groupName, test.startDate, test.endDate); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
 			}
 		})
 	}
@@ -23,21 +23,37 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/google/project-OCEAN/1-raw-data/gcs"
-	"github.com/google/project-OCEAN/1-raw-data/mailinglists/googlegroups"
-	"github.com/google/project-OCEAN/1-raw-data/mailinglists/mailman"
-	"github.com/google/project-OCEAN/1-raw-data/mailinglists/pipermail"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/config"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/localimport"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
+
+	// Sources register themselves by name in init
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/discourse"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/github"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/googlegroups"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/groupsio"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/imap"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/mailman"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/mhonarc"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/nntp"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/pipermail"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/ponymail"
+	_ "github.com/google/project-OCEAN/1-raw-data/mailinglists/publicinbox"
 )
 
 var (
 	//Variables required for build run
-	codeRunType = flag.String("code-run-type", "buildTestRun", "Use flag to define which type configuration to run. Options are buildAllData, buildAllLatestMonthData, buildAllRangeDatesData, buildTestRun, manualRun.")
+	codeRunType = flag.String("code-run-type", "buildTestRun", "Use flag to define which type configuration to run. Options are buildAllData, buildAllLatestMonthData, buildAllRangeDatesData, buildTestRun, manualRun, import.")
 	projectID   = flag.String("project-id", "", "GCP Project id.")
 	bucketName  = flag.String("bucket-name", "mailinglists", "Bucket name to store files.")
+	storageURL  = flag.String("storage", "gs://", "Storage to load files into. Use gs:// for the bucket-name bucket, gs://[BUCKET], s3://[BUCKET]?endpoint=[URL]&region=[REGION]&path-style=true or file:///[PATH] for a local directory.")
+	configFile  = flag.String("config", "", "YAML or JSON file that declares the mailing lists to load. Required for the buildAll run types.")
 
 	//Optional variables depending on build or command line setup
 	startDate = flag.String("start-date", "", "Start date in format of year-month-date and 4dig-2dig-2dig.")
@@ -45,84 +61,151 @@ var (
 	numMonths = flag.Int("months", 1, "Number of months to cover between start and end dates.")
 	workerNum = flag.Int("workers", 20, "Number of workers to use for goroutines.")
 
+	//Optional variables to refresh files already stored
+	refresh      = flag.String("refresh", "never", "How to handle files already stored. Options are never (skip them), changed (rewrite when upstream content changed) and always.")
+	keepPrevious = flag.Bool("keep-previous", false, "Keep the replaced content under previous/ when a refresh rewrites a file.")
+
 	//Optional variables and best used with command line
 	subDirectory = flag.String("subdirectory", "", "Subdirectory to store files. Enter 1 or more and use spaces to identify. CAUTION also enter the groupNames to load to in the same order.")
-	mailingList  = flag.String("mailinglist", "", "Choose which mailing list to process either pipermail (default), mailman, googlegroups")
+	mailingList  = flag.String("mailinglist", "", "Choose which mailing list to process either pipermail (default), discourse, github, groupsio, imap, mailman, mhonarc, nntp, ponymail, publicinbox, gg or ggfeed for Google Groups feed updates")
 	groupNames   = flag.String("groupname", "", "Mailing list group name. Enter 1 or more and use spaces to identify. CAUTION also enter the buckets to load to in the same order.")
+	baseURL      = flag.String("base-url", "", "Archive host url such as https://mail.python.org, nntp://news.gmane.io or imaps://[USER]@[HOST] with IMAP_PASSWORD set. The mailing list type's default host is used when empty.")
 	subDirNames  []string
 
-	mailListSubDirMap = map[string]string{
-		"gg-angular":                     "2009-09-01",
-		"gg-golang-announce":             "2011-05-01",
-		"gg-golang-checkins":             "2009-11-01",
-		"gg-golang-codereviews":          "2013-12-01",
-		"gg-golang-dev":                  "2009-11-01",
-		"gg-golang-nuts":                 "2009-11-01",
-		"gg-nodejs":                      "2009-06-01",
-		"mailman-python-announce-list":   "1999-04-01",
-		"mailman-python-dev":             "1999-04-01",
-		"mailman-python-ideas":           "2006-12-01",
-		"pipermail-python-announce-list": "1999-04-01",
-		"pipermail-python-dev":           "1995-03-01",
-		"pipermail-python-ideas":         "2006-12-01",
-		"pipermail-python-list":          "1999-02-01"}
+	//Optional variables for the import run type
+	importPaths = flag.String("import-path", "", "Local mbox, mbox.gz or Maildir paths to load into the subdirectory with the import run type. Enter 1 or more and use spaces to identify.")
 )
 
-func getData(ctx context.Context, storage gcs.Connection, httpToDom utils.HttpDomResponse, workerNum int, mailingList, groupName, startDateString, endDateString string, allDateRun bool) {
-	switch mailingList {
-	case "pipermail":
-		if err := pipermail.GetPipermailData(ctx, storage, groupName, startDateString, endDateString, httpToDom); err != nil {
-			log.Fatalf("Pipermail load failed: %v", err)
+// Source settings for a group entered on the command line.
+func flagSourceConfig(groupName string, allDateRun bool) source.Config {
+	return source.Config{BaseURL: *baseURL, Groups: []string{groupName}, Workers: *workerNum, AllDateRun: allDateRun}
+}
+
+// Source settings for a list declared in the config file. Workers fall back to the command line when not set.
+func listSourceConfig(list config.List, allDateRun bool) source.Config {
+	srcConfig := source.Config{
+		BaseURL:    list.BaseURL,
+		Org:        list.Org,
+		Groups:     []string{list.Group},
+		Workers:    list.Workers,
+		AllDateRun: allDateRun,
+		RateLimit:  list.RateLimit,
+	}
+	if srcConfig.Workers == 0 {
+		srcConfig.Workers = *workerNum
+	}
+	return srcConfig
+}
+
+// Replace lists marked discover with one list for each group the source finds. Groups that are declared on their own are
+// not added twice.
+func expandDiscoveredLists(ctx context.Context, lists []config.List) (expanded []config.List, err error) {
+	var (
+		src         source.Source
+		foundGroups []string
+	)
+	declared := make(map[string]bool)
+
+	for _, list := range lists {
+		if !list.Discover {
+			declared[list.SubDirectory] = true
+			expanded = append(expanded, list)
 		}
-	case "mailman":
-		if err := mailman.GetMailmanData(ctx, storage, groupName, startDateString, endDateString); err != nil {
-			log.Fatalf("Mailman load failed: %v", err)
+	}
+	for _, list := range lists {
+		if !list.Discover {
+			continue
 		}
-	case "gg":
-		if err := googlegroups.GetGoogleGroupsData(ctx, "", groupName, startDateString, endDateString, storage, workerNum, allDateRun); err != nil {
-			log.Fatalf("GoogleGroups load failed: %v", err)
+		srcConfig := listSourceConfig(list, true)
+		srcConfig.Groups = nil
+		if src, err = source.New(list.Source, srcConfig); err != nil {
+			return
+		}
+		if foundGroups, err = src.ListGroups(ctx); err != nil {
+			err = fmt.Errorf("Discovering %s lists on %s failed: %v", list.Source, list.BaseURL, err)
+			return
+		}
+		for _, groupName := range foundGroups {
+			found := list.Discovered(groupName)
+			if !declared[found.SubDirectory] {
+				declared[found.SubDirectory] = true
+				expanded = append(expanded, found)
+			}
 		}
-	default:
-		log.Fatalf("Mailing list %v is not an option. Change the option submitted.", mailingList)
 	}
+	return
 }
 
-func reviewFileNamesAndFixDates(ctx context.Context, mailingList, groupName, startDate, endDate string, storageConn gcs.Connection) (fileExists bool, startDateResult, endDateResult string, err error) {
+func getData(ctx context.Context, storage gcs.Connection, srcConfig source.Config, mailingList, groupName, startDateString, endDateString string) {
+	src, err := source.New(mailingList, srcConfig)
+	if err != nil {
+		log.Fatalf("Mailing list setup failed: %v", err)
+	}
+	if err = source.Load(ctx, src, storage, groupName, startDateString, endDateString); err != nil {
+		log.Fatalf("%s load failed: %v", mailingList, err)
+	}
+}
+
+func reviewFileNamesAndFixDates(ctx context.Context, mailingList, subDir, startDate, endDate string, storageConn gcs.Connection) (fileExists bool, startDateResult, endDateResult string, err error) {
+	var (
+		fileName string
+		existing map[string]gcs.ObjectInfo
+	)
 
 	fileExists = true
 	startDateResult, endDateResult = startDate, endDate
 
+	//Existing files are checked again by the sources when refreshing so keep the full date range
+	if mode, _ := storageConn.Refresh(); mode != gcs.RefreshNever {
+		fileExists = false
+		return
+	}
+
+	//List what is stored for the group once and check each month against it
+	if fileName, err = utils.CreateSubDirFileName(mailingList, subDir, startDate); err != nil {
+		err = fmt.Errorf("Filename error: %v", err)
+		return
+	}
+	if existing, err = storageConn.ListExisting(ctx, path.Dir(fileName)); err != nil {
+		err = fmt.Errorf("Listing existing files threw an error: %v", err)
+		return
+	}
+
 	for startDateResult < endDateResult && fileExists {
 		//Advance start date if file exists
-		if fileExists, startDateResult, err = createAndCheckFileNames(ctx, mailingList, groupName, startDateResult, true, storageConn); err != nil {
+		if fileExists, startDateResult, err = createAndCheckFileNames(mailingList, subDir, startDateResult, true, existing); err != nil {
 			err = fmt.Errorf("Looping start dates threw an error: %v", err)
+			return
 		}
 
 		//Reduce end date if file exists
-		if fileExists, endDateResult, err = createAndCheckFileNames(ctx, mailingList, groupName, endDateResult, false, storageConn); err != nil {
+		if fileExists, endDateResult, err = createAndCheckFileNames(mailingList, subDir, endDateResult, false, existing); err != nil {
 			err = fmt.Errorf("Looping end dates threw an error: %v", err)
+			return
 		}
 	}
 	return
 }
 
-func createAndCheckFileNames(ctx context.Context, mailingList, groupName, dateToCheck string, forwardDate bool, storageConn gcs.Connection) (fileExists bool, dateResult string, err error) {
+func createAndCheckFileNames(mailingList, subDir, dateToCheck string, forwardDate bool, existing map[string]gcs.ObjectInfo) (fileExists bool, dateResult string, err error) {
 	var (
 		fileName string
 		dateT    time.Time
 	)
 
-	if fileName, err = utils.CreateFileName(mailingList, groupName, dateToCheck); err != nil {
+	if fileName, err = utils.CreateSubDirFileName(mailingList, subDir, dateToCheck); err != nil {
 		err = fmt.Errorf("Filename error: %v", err)
+		return
 	}
 
 	//Check if file exists
-	fileExists = storageConn.CheckFileExists(ctx, fileName)
+	_, fileExists = existing[fileName]
 
 	//Increase startDate by a month if file exists
 	if fileExists {
 		if dateT, err = utils.GetDateTimeType(dateToCheck); err != nil {
 			err = fmt.Errorf("Date in Main error: %v", err)
+			return
 		}
 		//Add or subtract a month depending on if start or end
 		if forwardDate {
@@ -142,26 +225,31 @@ func main() {
 	var (
 		err        error
 		fileExists bool
+		lists      *config.Config
 	)
-	httpToDom := utils.DomResponse
 	startDateResult, endDateResult := "", ""
 	now := time.Now()
 	flag.Parse()
 
+	//Validate the declared lists before any loading starts
+	if *configFile != "" {
+		if lists, err = config.Load(*configFile, source.Names()); err != nil {
+			log.Fatalf("Config setup failed: %v", err)
+		}
+	}
+
 	//Setup Storage connection
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	storageConn := gcs.StorageConnection{
-		ProjectID:  *projectID,
-		BucketName: *bucketName,
-	}
-	if err := storageConn.ConnectClient(ctx); err != nil {
-		log.Fatalf("Connect GCS failes: %v", err)
+	storageConn, err := gcs.NewConnection(ctx, *storageURL, *projectID, *bucketName)
+	if err != nil {
+		log.Fatalf("Storage setup failed: %v", err)
 	}
-	//Check and create bucket if needed
-	if err := storageConn.CreateBucket(ctx); err != nil {
-		log.Fatalf("Create GCS Bucket failed: %v", err)
+	refreshMode, err := gcs.ParseRefreshMode(*refresh)
+	if err != nil {
+		log.Fatalf("Refresh setup failed: %v", err)
 	}
+	storageConn.SetRefresh(refreshMode, *keepPrevious)
 
 	switch *codeRunType {
 	case "buildTestRun":
@@ -170,29 +258,38 @@ func main() {
 
 		groupName := "python-announce-list"
 		subDirName := "mailman-python-announce-list"
-		storageConn.SubDirectory = subDirName
+		storageConn.SetSubDirectory(subDirName)
 		*startDate = now.AddDate(0, -1, 0).Format("2006-01-02")
 		*endDate = now.AddDate(0, -1, 1).Format("2006-01-02")
 
-		if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, groupName, startDateResult, endDateResult, &storageConn); err != nil {
+		if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, subDirName, startDateResult, endDateResult, storageConn); err != nil {
 			log.Fatalf("Checking fileName exists error: %v", err)
 		}
 		if !fileExists && startDateResult < endDateResult {
-			if err := mailman.GetMailmanData(ctx, &storageConn, groupName, *startDate, *endDate); err != nil {
-				log.Fatalf("Mailman test build load failed: %v", err)
-			}
+			getData(ctx, storageConn, flagSourceConfig(groupName, false), "mailman", groupName, *startDate, *endDate)
 		}
 		return
 	case "buildAllData", "buildAllLatestMonthData", "buildAllRangeDatesData":
 		log.Printf("Build all mailing lists.")
-		groupName := ""
 		allDateRun := true
+		if lists == nil {
+			log.Fatalf("Build all runs need the lists to load. Enter the file with -config.")
+		}
+		var crawlLists []config.List
+		if crawlLists, err = expandDiscoveredLists(ctx, lists.Lists); err != nil {
+			log.Fatalf("List discovery failed: %v", err)
+		}
 
-		for subName, origStartDate := range mailListSubDirMap {
-			storageConn.SubDirectory = subName
-			*mailingList = strings.SplitN(subName, "-", 2)[0]
-			groupName = strings.SplitN(subName, "-", 2)[1]
-			// Set end date to 1st of current month
+		for _, list := range crawlLists {
+			//Skip lists that don't get new messages when loading the latest month
+			if *codeRunType == "buildAllLatestMonthData" && list.Frozen() {
+				log.Printf("Skipping %s because it is frozen.", list.SubDirectory)
+				continue
+			}
+			storageConn.SetSubDirectory(list.SubDirectory)
+			*mailingList = list.Source
+			groupName := list.Group
+			origStartDate := list.FirstDate().Format("2006-01-02")
 
 			switch *codeRunType {
 			case "buildAllData":
@@ -207,10 +304,6 @@ func main() {
 				//Run Build to load most current month for all mailing lists
 				log.Printf("Load last month.")
 				*numMonths = 1
-				//Remove pipermail-python-dev, .pipermail-python-announce-list, pipermail-python-ideas because no new data
-				delete(mailListSubDirMap, "pipermail-python-dev")
-				delete(mailListSubDirMap, "pipermail-python-announce-list")
-				delete(mailListSubDirMap, "pipermail-python-ideas")
 				//Set start and end dates split by one month
 				*endDate = utils.ChangeFirstMonth(now).Format("2006-01-02")
 				if startDateResult, endDateResult, err = utils.SplitDatesByMonth(*startDate, *endDate, *numMonths); err != nil {
@@ -224,12 +317,12 @@ func main() {
 				}
 			}
 			// Check and skip if file exists. Adjusts dates where files don't exist
-			if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, groupName, startDateResult, endDateResult, &storageConn); err != nil {
+			if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, list.SubDirectory, startDateResult, endDateResult, storageConn); err != nil {
 				log.Fatalf("Checking fileName exists error: %v", err)
 			}
 			//Get mailinglist data and store
 			if !fileExists && startDateResult < endDateResult {
-				getData(ctx, &storageConn, httpToDom, *workerNum, *mailingList, groupName, startDateResult, endDateResult, allDateRun)
+				getData(ctx, storageConn, listSourceConfig(list, allDateRun), *mailingList, groupName, startDateResult, endDateResult)
 			}
 		}
 		return
@@ -245,19 +338,36 @@ func main() {
 		}
 
 		for idx, groupName := range strings.Split(*groupNames, " ") {
+			subDirName := config.SubDirectoryName(*mailingList, groupName)
 			//Apply sub directory name to storageConn if it exists
 			if *subDirectory != "" {
-				storageConn.SubDirectory = subDirNames[idx]
+				subDirName = subDirNames[idx]
+				storageConn.SetSubDirectory(subDirName)
 			}
 			// Check and skip if file exists. Adjusts dates where files don't exist
-			if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, groupName, startDateResult, endDateResult, &storageConn); err != nil {
+			if fileExists, startDateResult, endDateResult, err = reviewFileNamesAndFixDates(ctx, *mailingList, subDirName, startDateResult, endDateResult, storageConn); err != nil {
 				log.Fatalf("Checking fileName exists error: %v", err)
 			}
 			//Get mailinglist data and store
 			if !fileExists && startDateResult < endDateResult {
-				getData(ctx, &storageConn, httpToDom, *workerNum, *mailingList, groupName, startDateResult, endDateResult, allDateRun)
+				getData(ctx, storageConn, flagSourceConfig(groupName, allDateRun), *mailingList, groupName, startDateResult, endDateResult)
 			}
 		}
 		return
+	case "import":
+		//Import pulls mbox and Maildir dumps from local disk into one subdirectory
+		log.Printf("Import local mailing list dumps.")
+		if *subDirectory == "" || *importPaths == "" {
+			log.Fatalf("Import runs need the files to load and where to store them. Enter -import-path and -subdirectory.")
+		}
+		storageConn.SetSubDirectory(*subDirectory)
+		groupName := *groupNames
+		if groupName == "" {
+			groupName = *subDirectory
+		}
+		if err = localimport.Import(ctx, storageConn, groupName, strings.Fields(*importPaths)); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		return
 	}
 }
@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mhonarc
+
+/*
+Recover the message from a MHonArc message page.
+
+MHonArc keeps the original headers in comments at the top of each page:
+<!--X-Subject: [SUBJECT] -->
+<!--X-From-R13: [FROM WITH LETTERS AND @ ROTATED] -->
+<!--X-Date: [DATE] -->
+<!--X-Message-Id: [MESSAGE ID] -->
+<!--X-Reference: [MESSAGE ID] -->
+The displayed headers are list items between <!--X-Head-of-Message--> and <!--X-Head-of-Message-End--> and the body
+is between <!--X-Body-of-Message--> and <!--X-Body-of-Message-End-->. Comment values are HTML escaped.
+*/
+
+import (
+	"fmt"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var (
+	headerComment = regexp.MustCompile(`<!--X-([A-Za-z0-9-]+): ?(.*?) ?-->`)
+	// Displayed headers kept when the page has them, as the name shown and the mbox header name
+	displayedHeaders = [][2]string{{"To", "To"}, {"Cc", "Cc"}, {"In-reply-to", "In-Reply-To"}}
+)
+
+// Message details from a MHonArc message page
+type htmlMessage struct {
+	url        string
+	subject    string
+	from       string
+	date       string
+	messageID  string
+	references []string
+	// Displayed headers by name such as To
+	headers map[string]string
+	body    string
+}
+
+// Undo MHonArc's R13 obfuscation. Letters rotate by 13 and @, A-Z and [ rotate by 14 as one 28 character alphabet.
+func decodeR13(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return 'a' + (r-'a'+13)%26
+		case r >= '@' && r <= '[':
+			return '@' + (r-'@'+14)%28
+		}
+		return r
+	}, value)
+}
+
+// Html between the start and end comments. Empty when either is missing.
+func pageSection(page, start, end string) string {
+	startIdx := strings.Index(page, start)
+	if startIdx < 0 {
+		return ""
+	}
+	section := page[startIdx+len(start):]
+	endIdx := strings.Index(section, end)
+	if endIdx < 0 {
+		return ""
+	}
+	return section[:endIdx]
+}
+
+// Text of an html fragment.
+func sectionText(fragment string) (text string) {
+	dom, err := goquery.NewDocumentFromReader(strings.NewReader(fragment))
+	if err != nil {
+		return
+	}
+	return dom.Text()
+}
+
+// Pull the message details from the page.
+func parseMessagePage(msgURL, page string) (msg htmlMessage) {
+	msg = htmlMessage{url: msgURL, headers: make(map[string]string)}
+
+	// Only the comments before the page head are headers
+	headerComments := page
+	if idx := strings.Index(page, "<!--X-Head-End-->"); idx >= 0 {
+		headerComments = page[:idx]
+	}
+	for _, match := range headerComment.FindAllStringSubmatch(headerComments, -1) {
+		value := html.UnescapeString(strings.TrimSpace(match[2]))
+		switch match[1] {
+		case "Subject":
+			msg.subject = value
+		case "From-R13":
+			msg.from = decodeR13(value)
+		case "From":
+			msg.from = value
+		case "Date":
+			msg.date = value
+		case "Message-Id":
+			msg.messageID = value
+		case "Reference":
+			msg.references = append(msg.references, value)
+		}
+	}
+
+	head, err := goquery.NewDocumentFromReader(strings.NewReader(pageSection(page, "<!--X-Head-of-Message-->", "<!--X-Head-of-Message-End-->")))
+	if err == nil {
+		head.Find("li").Each(func(i int, s *goquery.Selection) {
+			// Items read [NAME]: [VALUE] with the name in em
+			if parts := strings.SplitN(s.Text(), ":", 2); len(parts) == 2 {
+				msg.headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		})
+	}
+	// Older pages without header comments still show the sender
+	if msg.from == "" {
+		msg.from = msg.headers["From"]
+	}
+	msg.body = sectionText(pageSection(page, "<!--X-Body-of-Message-->", "<!--X-Body-of-Message-End-->"))
+	return
+}
+
+// Format the message as an mbox entry. Body lines that start with From are quoted.
+func (msg htmlMessage) mbox() string {
+	var sb strings.Builder
+
+	sender := msg.from
+	if address, err := mail.ParseAddress(msg.from); err == nil {
+		sender = address.Address
+	}
+	fromLineDate, dateHeader := msg.date, msg.date
+	if msgDate, err := mail.ParseDate(msg.date); err == nil {
+		fromLineDate = msgDate.UTC().Format(time.ANSIC)
+		dateHeader = msgDate.Format(time.RFC1123Z)
+	}
+
+	fmt.Fprintf(&sb, "From %s  %s\n", sender, fromLineDate)
+	fmt.Fprintf(&sb, "From: %s\n", msg.from)
+	for _, names := range displayedHeaders {
+		if value := msg.headers[names[0]]; value != "" {
+			fmt.Fprintf(&sb, "%s: %s\n", names[1], value)
+		}
+	}
+	fmt.Fprintf(&sb, "Date: %s\n", dateHeader)
+	fmt.Fprintf(&sb, "Subject: %s\n", msg.subject)
+	if msg.messageID != "" {
+		fmt.Fprintf(&sb, "Message-ID: <%s>\n", msg.messageID)
+	}
+	if len(msg.references) > 0 {
+		fmt.Fprintf(&sb, "References: <%s>\n", strings.Join(msg.references, "> <"))
+	}
+	fmt.Fprintf(&sb, "Archived-At: <%s>\n\n", msg.url)
+
+	for _, line := range strings.Split(strings.TrimRight(strings.TrimLeft(msg.body, "\n"), "\n"), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			sb.WriteString(">")
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
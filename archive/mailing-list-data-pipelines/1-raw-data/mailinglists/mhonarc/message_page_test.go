@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mhonarc
+
+import (
+	"reflect"
+	"testing"
+)
+
+const fakeMessagePage = `<!-- MHonArc v2.6.19+ -->
+<!--X-Subject: Re: Council at Standing Rock &#45;&#45; camp -->
+<!--X-From-R13: Fngnaxn Wlbgnxr <fvggvatohyyNynxbgn.bet> -->
+<!--X-Date: Sun, 25 Jun 1876 14:30:00 &#45;0600 -->
+<!--X-Message-Id: 1876.0625.2&#64;lakota.org -->
+<!--X-Content-Type: text/plain -->
+<!--X-Reference: 1876.0625.1&#64;lakota.org -->
+<!--X-Head-End-->
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01 Transitional//EN">
+<html>
+<head><title>Re: Council at Standing Rock -- camp</title></head>
+<body>
+<!--X-Body-Begin-->
+<!--X-User-Header-->
+<!--X-User-Header-End-->
+<!--X-TopPNI-->
+<a href="msg00001.html">Date Prev</a>
+<!--X-TopPNI-End-->
+<!--X-MsgBody-->
+<!--X-Subject-Header-Begin-->
+<h1>Re: Council at Standing Rock -- camp</h1>
+<!--X-Subject-Header-End-->
+<!--X-Head-of-Message-->
+<ul>
+<li><em>From</em>: Tatanka Iyotake &lt;<a href="mailto:sittingbull@DOMAIN.HIDDEN">sittingbull@DOMAIN.HIDDEN</a>&gt;</li>
+<li><em>To</em>: council@lakota.org</li>
+<li><em>Date</em>: Sun, 25 Jun 1876 14:30:00 -0600</li>
+<li><em>In-reply-to</em>: &lt;<a href="msg00001.html">1876.0625.1@lakota.org</a>&gt;</li>
+</ul>
+<!--X-Head-of-Message-End-->
+<!--X-Head-Body-Sep-Begin-->
+<hr>
+<!--X-Head-Body-Sep-End-->
+<!--X-Body-of-Message-->
+<pre>We camp by the Greasy Grass.
+From there we ride &lt;together&gt;.
+</pre>
+<!--X-Body-of-Message-End-->
+<!--X-MsgBody-End-->
+</body>
+</html>`
+
+func TestDecodeR13(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		value          string
+		want           string
+	}{
+		{
+			comparisonType: "Name and address",
+			value:          "Fnfhaxr Ivgxb <penmlubefrNbtynyn.bet>",
+			want:           "Tasunke Witko <crazyhorse@oglala.org>",
+		},
+		{
+			comparisonType: "Decoding twice restores the value",
+			value:          "Tasunke Witko <crazyhorse@oglala.org>",
+			want:           "Fnfhaxr Ivgxb <penmlubefrNbtynyn.bet>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if got := decodeR13(test.value); got != test.want {
+				t.Errorf("Decoded value does not match.\n got: %v\nwant: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMessagePage(t *testing.T) {
+	msgURL := "https://lists.lakota.org/council/1876-06/msg00002.html"
+	want := htmlMessage{
+		url:        msgURL,
+		subject:    "Re: Council at Standing Rock -- camp",
+		from:       "Tatanka Iyotake <sittingbull@lakota.org>",
+		date:       "Sun, 25 Jun 1876 14:30:00 -0600",
+		messageID:  "1876.0625.2@lakota.org",
+		references: []string{"1876.0625.1@lakota.org"},
+		headers: map[string]string{
+			"From":        "Tatanka Iyotake <sittingbull@DOMAIN.HIDDEN>",
+			"To":          "council@lakota.org",
+			"Date":        "Sun, 25 Jun 1876 14:30:00 -0600",
+			"In-reply-to": "<1876.0625.1@lakota.org>",
+		},
+		body: "We camp by the Greasy Grass.\nFrom there we ride <together>.\n\n",
+	}
+
+	if got := parseMessagePage(msgURL, fakeMessagePage); !reflect.DeepEqual(got, want) {
+		t.Errorf("Message does not match.\n got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestMessageMbox(t *testing.T) {
+	msgURL := "https://lists.lakota.org/council/1876-06/msg00002.html"
+	want := `From sittingbull@lakota.org  Sun Jun 25 20:30:00 1876
+From: Tatanka Iyotake <sittingbull@lakota.org>
+To: council@lakota.org
+In-Reply-To: <1876.0625.1@lakota.org>
+Date: Sun, 25 Jun 1876 14:30:00 -0600
+Subject: Re: Council at Standing Rock -- camp
+Message-ID: <1876.0625.2@lakota.org>
+References: <1876.0625.1@lakota.org>
+Archived-At: <https://lists.lakota.org/council/1876-06/msg00002.html>
+
+We camp by the Greasy Grass.
+>From there we ride <together>.
+
+`
+
+	if got := parseMessagePage(msgURL, fakeMessagePage).mbox(); got != want {
+		t.Errorf("Mbox does not match.\n got: %q\nwant: %q", got, want)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load MHonArc HTML archives such as lists.gnu.org and lists.debian.org. These hosts have no mbox files so each
+month is rebuilt from its message pages.
+
+Group index with a link to each month's indexes, where the month directory is [YEAR]-[MONTH] on lists.gnu.org and
+[YEAR]/[MONTH] on lists.debian.org:
+[BASE URL]/[GROUP NAME]/
+Month date and thread indexes, paginated as mail2.html or thrd2.html on larger months:
+[BASE URL]/[GROUP NAME]/[MONTH DIRECTORY]/index.html, maillist.html or threads.html
+Message pages in date order:
+[BASE URL]/[GROUP NAME]/[MONTH DIRECTORY]/msg[NUMBER].html
+
+BaseURL defaults to https://lists.gnu.org/archive/html. Use https://lists.debian.org for Debian lists. Months are
+stored as [YEAR]-[MONTH].mbox.gz.
+*/
+
+package mhonarc
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr   = errors.New("Storage failed")
+	discoveryErr = errors.New("list discovery")
+	indexErr     = errors.New("mhonarc index")
+
+	// Relative links to a list directory on the archive index such as bug-gnu-emacs/
+	archiveDirLink = regexp.MustCompile(`^[^/?#:]+/$`)
+	// Links to a month's indexes on the group index such as 2021-03/index.html or 2021/03/threads.html
+	monthDirLink = regexp.MustCompile(`^(?:\./)?([0-9]{4})[-/]([0-9]{2})/`)
+	// Date and thread index pages in a month directory
+	indexPageLink   = regexp.MustCompile(`^(?:index[0-9]*|maillist|mail[0-9]+|threads[0-9]*|thrd[0-9]+)\.html$`)
+	messagePageLink = regexp.MustCompile(`^msg([0-9]+)\.html$`)
+)
+
+const defaultBaseURL = "https://lists.gnu.org/archive/html"
+
+func init() {
+	source.Register("mhonarc", NewSource)
+}
+
+// MHonArc version of the mailing list source
+type mhonarcSource struct {
+	baseURL      string
+	groups       []string
+	httpToDom    utils.HttpDomResponse
+	httpToString utils.HttpStringResponse
+	mu           sync.Mutex
+	// Month index links from each group index by year-month
+	links map[string]map[string]string
+}
+
+// Create the MHonArc source. BaseURL defaults to the lists.gnu.org archive.
+func NewSource(config source.Config) (source.Source, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	return &mhonarcSource{
+		baseURL:      baseURL,
+		groups:       config.Groups,
+		httpToDom:    config.HttpToDom,
+		httpToString: config.HttpToString,
+		links:        make(map[string]map[string]string),
+	}, nil
+}
+
+func (mh *mhonarcSource) Name() string {
+	return "mhonarc"
+}
+
+func (mh *mhonarcSource) groupURL(groupName string) string {
+	return fmt.Sprintf("%s/%s/", mh.baseURL, groupName)
+}
+
+// Configured groups or the list directories on the archive index when none are configured.
+func (mh *mhonarcSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	var dom *goquery.Document
+
+	if len(mh.groups) > 0 {
+		return mh.groups, nil
+	}
+	indexURL := mh.baseURL + "/"
+	if dom, err = mh.httpToDom(indexURL); err != nil {
+		return nil, fmt.Errorf("%w on %s: %v", discoveryErr, indexURL, err)
+	}
+	seen := make(map[string]bool)
+	dom.Find("a").Each(func(i int, s *goquery.Selection) {
+		href, ok := s.Attr("href")
+		if !ok || !archiveDirLink.MatchString(href) {
+			return
+		}
+		// Skip year directories on hosts that list them next to the lists
+		if name := strings.TrimSuffix(href, "/"); !seen[name] && !isNumber(name) {
+			seen[name] = true
+			groupNames = append(groupNames, name)
+		}
+	})
+	log.Printf("Discovered %d lists on %s.", len(groupNames), mh.baseURL)
+	return
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.Atoi(value)
+	return err == nil
+}
+
+// Resolve a link on the page to an absolute url.
+func resolveLink(pageURL, href string) (linkURL string, err error) {
+	var base, link *url.URL
+
+	if base, err = url.Parse(pageURL); err != nil {
+		return
+	}
+	if link, err = url.Parse(href); err != nil {
+		return
+	}
+	return base.ResolveReference(link).String(), nil
+}
+
+// Get the first index link for each month from the group index page. The index is only loaded once per group.
+func (mh *mhonarcSource) monthLinks(groupName string) (links map[string]string, err error) {
+	var dom *goquery.Document
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if links, ok := mh.links[groupName]; ok {
+		return links, nil
+	}
+
+	groupURL := mh.groupURL(groupName)
+	if dom, err = mh.httpToDom(groupURL); err != nil {
+		return nil, fmt.Errorf("%w group index %s: %v", indexErr, groupURL, err)
+	}
+	links = make(map[string]string)
+	dom.Find("a").Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		match := monthDirLink.FindStringSubmatch(href)
+		if match == nil {
+			return
+		}
+		yearMonth := match[1] + "-" + match[2]
+		if _, ok := links[yearMonth]; ok {
+			return
+		}
+		if linkURL, linkErr := resolveLink(groupURL, href); linkErr == nil {
+			links[yearMonth] = linkURL
+		}
+	})
+	mh.links[groupName] = links
+	return
+}
+
+// Months with an index link on the group index page in the date range.
+func (mh *mhonarcSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var links map[string]string
+
+	if links, err = mh.monthLinks(groupName); err != nil {
+		return
+	}
+	for yearMonth := range links {
+		if fileDate, dateErr := time.Parse("2006-01", yearMonth); dateErr == nil && utils.InTimeSpan(fileDate, startDate, endDate) {
+			months = append(months, fileDate)
+		}
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+	return
+}
+
+// Walk the month's index pages from the first one and collect the message page urls in message number order, which
+// is the order MHonArc received them.
+func (mh *mhonarcSource) messagePageURLs(ctx context.Context, firstIndexURL string) (msgURLs []string, err error) {
+	var dom *goquery.Document
+	msgNumbers := make(map[string]int)
+	seen := map[string]bool{firstIndexURL: true}
+
+	for queue := []string{firstIndexURL}; len(queue) > 0; queue = queue[1:] {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		indexURL := queue[0]
+		if dom, err = mh.httpToDom(indexURL); err != nil {
+			return nil, fmt.Errorf("%w month index %s: %v", indexErr, indexURL, err)
+		}
+		dom.Find("a").Each(func(i int, s *goquery.Selection) {
+			href, _ := s.Attr("href")
+			linkURL, linkErr := resolveLink(indexURL, href)
+			if linkErr != nil {
+				return
+			}
+			if match := messagePageLink.FindStringSubmatch(href); match != nil {
+				msgNumbers[linkURL], _ = strconv.Atoi(match[1])
+			} else if indexPageLink.MatchString(href) && !seen[linkURL] {
+				seen[linkURL] = true
+				queue = append(queue, linkURL)
+			}
+		})
+	}
+
+	for msgURL := range msgNumbers {
+		msgURLs = append(msgURLs, msgURL)
+	}
+	sort.Slice(msgURLs, func(i, j int) bool { return msgNumbers[msgURLs[i]] < msgNumbers[msgURLs[j]] })
+	return
+}
+
+// Fetch each message page and write the gzipped mbox to the stream. Pages that fail are logged and left out so one
+// broken page doesn't lose the month.
+func writeHTMLMbox(w io.Writer, msgURLs []string, httpToString utils.HttpStringResponse) (err error) {
+	gz := gzip.NewWriter(w)
+
+	for _, msgURL := range msgURLs {
+		page, pageErr := httpToString(msgURL)
+		if pageErr != nil {
+			log.Printf("Skipping message page %s: %v", msgURL, pageErr)
+			continue
+		}
+		if _, err = io.WriteString(gz, parseMessagePage(msgURL, page).mbox()); err != nil {
+			return
+		}
+	}
+	return gz.Close()
+}
+
+// Rebuild the month mbox from its message pages and store it gzipped.
+func (mh *mhonarcSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		links   map[string]string
+		msgURLs []string
+	)
+
+	if links, err = mh.monthLinks(groupName); err != nil {
+		return
+	}
+	indexURL, ok := links[month.Format("2006-01")]
+	if !ok {
+		log.Printf("No mhonarc archive for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+	if msgURLs, err = mh.messagePageURLs(ctx, indexURL); err != nil {
+		return
+	}
+	if len(msgURLs) == 0 {
+		log.Printf("No message pages for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   indexURL,
+		MailingList: "mhonarc",
+		GroupName:   groupName,
+		StartDate:   month.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(month).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+	}
+	_, err = utils.StoreWriter(ctx, storage, month.Format("2006-01")+".mbox.gz", meta, func(w io.Writer) error {
+		return writeHTMLMbox(w, msgURLs, mh.httpToString)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Rebuilt %s for %s from %d message pages.", month.Format("2006-01"), groupName, len(msgURLs))
+	return
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mhonarc
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+)
+
+// Message page with the header comments MHonArc writes.
+func fakeMessage(subject, from, date, body string) string {
+	return fmt.Sprintf("<!--X-Subject: %s -->\n<!--X-From-R13: %s -->\n<!--X-Date: %s -->\n<!--X-Head-End-->\n<html><body>\n<!--X-Body-of-Message-->\n<pre>%s</pre>\n<!--X-Body-of-Message-End-->\n</body></html>",
+		subject, decodeR13(from), date, body)
+}
+
+// Debian style MHonArc archive with a June split over two date index pages and a thread index
+func fakeMHonArcServer() *httptest.Server {
+	pages := map[string]string{
+		"/": `<a href="lakota-council/">lakota-council</a> <a href="2021/">2021</a> <a href="https://www.debian.org/">Debian</a>`,
+		"/lakota-council/": `<ul>
+			<li>1876 <a href="1876/06/maillist.html">June</a> <a href="1876/06/threads.html">threads</a></li>
+			<li><a href="1876/07/threads.html">July</a></li>
+			<li><a href="../">Lists</a></li></ul>`,
+		"/lakota-council/1876/06/maillist.html": `<a href="threads.html">Thread index</a>
+			<ul><li><a href="msg00001.html">Greasy Grass</a></li><li><a href="msg00000.html">Council</a></li></ul>
+			<a href="mail2.html">Next page</a> <a href="/lakota-council/">Index</a>`,
+		"/lakota-council/1876/06/mail2.html": `<a href="maillist.html">Previous page</a>
+			<ul><li><a href="msg00010.html">Victory song</a></li></ul>`,
+		"/lakota-council/1876/06/threads.html": `<ul><li><a href="msg00000.html">Council</a><ul><li><a href="msg00001.html">Greasy Grass</a></li></ul></li>
+			<li><a href="msg00010.html">Victory song</a></li></ul>`,
+		"/lakota-council/1876/06/msg00000.html": fakeMessage("Council", "Tatanka Iyotake <sittingbull@lakota.org>", "Sat, 24 Jun 1876 09:00:00 -0600", "We gather."),
+		"/lakota-council/1876/06/msg00001.html": fakeMessage("Greasy Grass", "Tasunke Witko <crazyhorse@oglala.org>", "Sun, 25 Jun 1876 14:30:00 -0600", "From the hills we ride."),
+		"/lakota-council/1876/06/msg00010.html": fakeMessage("Victory song", "Tatanka Iyotake <sittingbull@lakota.org>", "Mon, 26 Jun 1876 20:00:00 -0600", "We sing."),
+		"/lakota-council/1876/07/threads.html":  `<p>No messages</p>`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+}
+
+func TestListGroups(t *testing.T) {
+	server := fakeMHonArcServer()
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		groups         []string
+		wantGroups     []string
+	}{
+		{
+			comparisonType: "Configured groups are kept",
+			groups:         []string{"oglala"},
+			wantGroups:     []string{"oglala"},
+		},
+		{
+			comparisonType: "List directories discovered without year directories",
+			wantGroups:     []string{"lakota-council"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, _ := source.New("mhonarc", source.Config{BaseURL: server.URL, Groups: test.groups})
+			gotGroups, gotErr := src.ListGroups(context.Background())
+			if gotErr != nil {
+				t.Errorf("Unexpected error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("Groups don't match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestMonths(t *testing.T) {
+	server := fakeMHonArcServer()
+	defer server.Close()
+	src, _ := source.New("mhonarc", source.Config{BaseURL: server.URL})
+	june := time.Date(1876, 6, 1, 0, 0, 0, 0, time.UTC)
+	july := time.Date(1876, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType string
+		startDate      time.Time
+		endDate        time.Time
+		wantMonths     []time.Time
+	}{
+		{
+			comparisonType: "Months linked from the group index",
+			startDate:      time.Date(1876, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDate:        time.Date(1877, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantMonths:     []time.Time{june, july},
+		},
+		{
+			comparisonType: "Months limited to the date range",
+			startDate:      july,
+			endDate:        time.Date(1876, 8, 1, 0, 0, 0, 0, time.UTC),
+			wantMonths:     []time.Time{july},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMonths, gotErr := src.Months(context.Background(), "lakota-council", test.startDate, test.endDate)
+			if gotErr != nil {
+				t.Errorf("Unexpected error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months don't match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+		})
+	}
+}
+
+func TestMessagePageURLs(t *testing.T) {
+	server := fakeMHonArcServer()
+	defer server.Close()
+	src, _ := source.New("mhonarc", source.Config{BaseURL: server.URL})
+	monthURL := server.URL + "/lakota-council/1876/06/"
+	want := []string{monthURL + "msg00000.html", monthURL + "msg00001.html", monthURL + "msg00010.html"}
+
+	got, err := src.(*mhonarcSource).messagePageURLs(context.Background(), monthURL+"maillist.html")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Message urls don't match.\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	server := fakeMHonArcServer()
+	defer server.Close()
+	rootDir, err := ioutil.TempDir("", "mhonarc")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	src, _ := source.New("mhonarc", source.Config{BaseURL: server.URL})
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "mhonarc-lakota-council"}
+
+	tests := []struct {
+		comparisonType string
+		month          time.Time
+		wantFromLines  []string
+	}{
+		{
+			comparisonType: "Month rebuilt from message pages in number order",
+			month:          time.Date(1876, 6, 1, 0, 0, 0, 0, time.UTC),
+			wantFromLines: []string{
+				"From sittingbull@lakota.org  Sat Jun 24 15:00:00 1876",
+				"From crazyhorse@oglala.org  Sun Jun 25 20:30:00 1876",
+				">From the hills we ride.",
+				"From sittingbull@lakota.org  Tue Jun 27 02:00:00 1876",
+			},
+		},
+		{
+			comparisonType: "Month without message pages not stored",
+			month:          time.Date(1876, 7, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, "lakota-council", test.month); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+
+			fileName := filepath.Join(rootDir, "mhonarc-lakota-council", test.month.Format("2006-01")+"-mhonarc-lakota-council.mbox.gz")
+			stored, openErr := os.Open(fileName)
+			if test.wantFromLines == nil {
+				if openErr == nil {
+					stored.Close()
+					t.Errorf("Empty month stored at %s", fileName)
+				}
+				return
+			}
+			if openErr != nil {
+				t.Fatalf("Stored month missing: %v", openErr)
+			}
+			defer stored.Close()
+			gz, gzErr := gzip.NewReader(stored)
+			if gzErr != nil {
+				t.Fatalf("Stored month not gzipped: %v", gzErr)
+			}
+			mbox, _ := ioutil.ReadAll(gz)
+
+			var gotFromLines []string
+			for _, line := range strings.Split(string(mbox), "\n") {
+				if strings.HasPrefix(line, "From ") || strings.HasPrefix(line, ">From ") {
+					gotFromLines = append(gotFromLines, line)
+				}
+			}
+			if !reflect.DeepEqual(gotFromLines, test.wantFromLines) {
+				t.Errorf("From lines don't match.\n got: %q\nwant: %q", gotFromLines, test.wantFromLines)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nntp
+
+/*
+Minimal NNTP client for the commands the source needs (RFC 3977).
+
+Greeting: 200 or 201
+LIST ACTIVE: 215 then lines of [GROUP] [HIGH] [LOW] [STATUS]
+GROUP [GROUP]: 211 [COUNT] [LOW] [HIGH] [GROUP]
+OVER [LOW]-[HIGH]: 224 then tab separated lines of [NUMBER] [SUBJECT] [FROM] [DATE] [MESSAGE-ID] [REFERENCES] [BYTES] [LINES]
+Servers from before RFC 3977 answer 500 to OVER and take XOVER with the same response.
+ARTICLE [NUMBER]: 220 then the article
+Multi-line responses end with a line holding a dot and lines that start with a dot get another one.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	nntpErr = errors.New("nntp")
+)
+
+// Overview line for one article
+type overview struct {
+	number int
+	from   string
+	date   time.Time
+}
+
+type client struct {
+	text *textproto.Conn
+	// OVER or XOVER for servers from before RFC 3977
+	overCmd string
+}
+
+// Connect to the server and read its greeting. The connection follows the context deadline when it has one.
+func dial(ctx context.Context, address string, useTLS bool) (c *client, err error) {
+	var (
+		conn   net.Conn
+		dialer net.Dialer
+	)
+
+	if conn, err = dialer.DialContext(ctx, "tcp", address); err != nil {
+		return nil, fmt.Errorf("%w dial %s: %v", nntpErr, address, err)
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c = &client{text: textproto.NewConn(conn), overCmd: "OVER"}
+	if _, _, err = c.text.ReadCodeLine(20); err != nil {
+		c.text.Close()
+		return nil, fmt.Errorf("%w greeting from %s: %v", nntpErr, address, err)
+	}
+	return
+}
+
+// Send the command and read the status line. Codes other than the expected one are errors.
+func (c *client) cmd(expectCode int, format string, args ...interface{}) (code int, message string, err error) {
+	var id uint
+
+	if id, err = c.text.Cmd(format, args...); err != nil {
+		return
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadCodeLine(expectCode)
+}
+
+// Names of the groups on the server.
+func (c *client) listGroups() (groupNames []string, err error) {
+	var lines []string
+
+	if _, _, err = c.cmd(215, "LIST ACTIVE"); err != nil {
+		return nil, fmt.Errorf("%w LIST ACTIVE: %v", nntpErr, err)
+	}
+	if lines, err = c.text.ReadDotLines(); err != nil {
+		return nil, fmt.Errorf("%w LIST ACTIVE read: %v", nntpErr, err)
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			groupNames = append(groupNames, fields[0])
+		}
+	}
+	return
+}
+
+// Select the group and return its article number range.
+func (c *client) group(groupName string) (low, high int, err error) {
+	var message string
+
+	if _, message, err = c.cmd(211, "GROUP %s", groupName); err != nil {
+		return 0, 0, fmt.Errorf("%w GROUP %s: %v", nntpErr, groupName, err)
+	}
+	// [COUNT] [LOW] [HIGH] [GROUP]
+	fields := strings.Fields(message)
+	if len(fields) < 3 {
+		return 0, 0, fmt.Errorf("%w GROUP %s response %q", nntpErr, groupName, message)
+	}
+	if low, err = strconv.Atoi(fields[1]); err == nil {
+		high, err = strconv.Atoi(fields[2])
+	}
+	if err != nil {
+		err = fmt.Errorf("%w GROUP %s response %q: %v", nntpErr, groupName, message, err)
+	}
+	return
+}
+
+// Parse an overview line. Articles with a date that can't be read have a zero date.
+func parseOverview(line string) (over overview, err error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 5 {
+		return over, fmt.Errorf("%w overview line %q", nntpErr, line)
+	}
+	if over.number, err = strconv.Atoi(fields[0]); err != nil {
+		return over, fmt.Errorf("%w overview number %q: %v", nntpErr, fields[0], err)
+	}
+	over.from = fields[2]
+	if date, dateErr := mail.ParseDate(fields[3]); dateErr == nil {
+		over.date = date.UTC()
+	}
+	return
+}
+
+// Overview of the articles from low to high in the selected group. Uses XOVER when the server doesn't know OVER.
+func (c *client) over(low, high int) (overviews []overview, err error) {
+	var (
+		lines []string
+		over  overview
+	)
+
+	_, _, err = c.cmd(224, "%s %d-%d", c.overCmd, low, high)
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code == 500 && c.overCmd == "OVER" {
+		c.overCmd = "XOVER"
+		_, _, err = c.cmd(224, "%s %d-%d", c.overCmd, low, high)
+	}
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code == 423 {
+		// No articles in the range
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %s %d-%d: %v", nntpErr, c.overCmd, low, high, err)
+	}
+
+	if lines, err = c.text.ReadDotLines(); err != nil {
+		return nil, fmt.Errorf("%w %s read: %v", nntpErr, c.overCmd, err)
+	}
+	for _, line := range lines {
+		if over, err = parseOverview(line); err != nil {
+			return
+		}
+		overviews = append(overviews, over)
+	}
+	return
+}
+
+// Get the article from the selected group. Missing articles, such as cancelled ones, return nil.
+func (c *client) article(number int) (article []byte, err error) {
+	_, _, err = c.cmd(220, "ARTICLE %d", number)
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code == 423 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w ARTICLE %d: %v", nntpErr, number, err)
+	}
+	if article, err = ioutil.ReadAll(c.text.DotReader()); err != nil {
+		err = fmt.Errorf("%w ARTICLE %d read: %v", nntpErr, number, err)
+	}
+	return
+}
+
+// Say goodbye and close the connection.
+func (c *client) quit() {
+	c.cmd(205, "QUIT")
+	c.text.Close()
+}
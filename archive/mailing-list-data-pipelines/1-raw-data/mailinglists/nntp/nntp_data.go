@@ -0,0 +1,465 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load newsgroups from NNTP servers such as news.gmane.io, where the history of many mailing lists survives.
+
+BaseURL is the server as nntp://[HOST]:[PORT] or nntps://[HOST]:[PORT] for TLS and defaults to news.gmane.io. Groups
+are newsgroup names such as gmane.comp.lang.go.general. When no groups are configured every group the server lists is
+loaded.
+
+Articles are read in number order after the high-water mark, the last article number already passed, which is kept
+in the cursor metadata of nntp-state.txt under the state prefix, outside the group subdirectory. Loading a month stores
+the new articles dated in it up to the first article dated after it and moves the mark to that point, so later months
+and later runs resume there without storing anything twice. Articles that arrive late with an earlier date, articles dated after the month that
+come before its last article and articles dated in the future are stored in their own month.
+
+The first run passes over the articles dated before its first month without storing them and keeps that month in the
+start date metadata of nntp-state.txt. Articles up to the mark are stored from the start date on, so a later run that
+starts earlier stores the months before the start date from the articles up to the mark without moving it.
+
+New articles are added to the end of the [YEAR]-[MONTH].mbox.gz file for their month, which records the mark it was
+stored up to in its cursor metadata. Articles up to that mark are left out when a run stopped before moving the mark
+for the group. With refresh never, months already stored at the ends of the range are skipped so use changed or
+always to add new articles to the current month.
+*/
+
+package nntp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr = errors.New("Storage failed")
+	baseURLErr = errors.New("base url")
+	stateErr   = errors.New("nntp state")
+)
+
+const (
+	defaultBaseURL = "nntp://news.gmane.io"
+	stateFile      = gcs.StatePrefix + "nntp-state.txt"
+	// Articles asked for in each overview request
+	overChunk = 1000
+)
+
+func init() {
+	source.Register("nntp", NewSource)
+}
+
+// NNTP version of the mailing list source
+type nntpSource struct {
+	address string
+	useTLS  bool
+	groups  []string
+	mu      sync.Mutex
+	// Overview after the high-water mark by group, loaded once per source
+	groupStates map[string]*groupState
+}
+
+// High-water mark and the overview of the articles after it for one group
+type groupState struct {
+	mark int
+	// First month stored. Articles up to the mark dated before it were passed over without storing them.
+	start time.Time
+	// Mark was read from storage rather than starting fresh
+	seen      bool
+	overviews []overview
+}
+
+// Create the NNTP source. BaseURL defaults to news.gmane.io on the standard port.
+func NewSource(config source.Config) (source.Source, error) {
+	var port string
+
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "nntp://" + baseURL
+	}
+	serverURL, err := url.Parse(baseURL)
+	if err != nil || serverURL.Hostname() == "" {
+		return nil, fmt.Errorf("%w %q needs a host: %v", baseURLErr, config.BaseURL, err)
+	}
+	switch serverURL.Scheme {
+	case "nntp", "news":
+		port = "119"
+	case "nntps":
+		port = "563"
+	default:
+		return nil, fmt.Errorf("%w %q scheme is not nntp or nntps", baseURLErr, config.BaseURL)
+	}
+	if serverURL.Port() != "" {
+		port = serverURL.Port()
+	}
+	return &nntpSource{
+		address:     net.JoinHostPort(serverURL.Hostname(), port),
+		useTLS:      serverURL.Scheme == "nntps",
+		groups:      config.Groups,
+		groupStates: make(map[string]*groupState),
+	}, nil
+}
+
+func (ns *nntpSource) Name() string {
+	return "nntp"
+}
+
+// Configured groups or every group the server lists when none are configured.
+func (ns *nntpSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	var c *client
+
+	if len(ns.groups) > 0 {
+		return ns.groups, nil
+	}
+	if c, err = dial(ctx, ns.address, ns.useTLS); err != nil {
+		return
+	}
+	defer c.quit()
+
+	if groupNames, err = c.listGroups(); err != nil {
+		return
+	}
+	sort.Strings(groupNames)
+	log.Printf("Discovered %d groups on %s.", len(groupNames), ns.address)
+	return
+}
+
+// Every month in the range. The articles after the high-water mark are only known once storage is read when fetching.
+func (ns *nntpSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	return source.MonthRange(startDate, endDate), nil
+}
+
+// Last article number passed and the first month stored for the group subdirectory. Not seen before the first run.
+// State stored before the start date was kept has a zero start.
+func readMark(ctx context.Context, storage gcs.Connection) (mark int, start time.Time, seen bool, err error) {
+	var info gcs.ObjectInfo
+
+	if info, seen, err = storage.Stat(ctx, stateFile); err != nil || !seen {
+		return
+	}
+	if mark, err = strconv.Atoi(info.Metadata[gcs.MetaCursor]); err != nil {
+		err = fmt.Errorf("%w cursor on %s: %v", stateErr, info.Name, err)
+		return
+	}
+	if startDate := info.Metadata[gcs.MetaStartDate]; startDate != "" {
+		if start, err = time.Parse("2006-01-02", startDate); err != nil {
+			err = fmt.Errorf("%w start date on %s: %v", stateErr, info.Name, err)
+		}
+	}
+	return
+}
+
+// Record the last article number passed and the first month stored for the group subdirectory.
+func (ns *nntpSource) writeMark(ctx context.Context, storage gcs.Connection, groupName string, mark int, start time.Time) (err error) {
+	meta := gcs.ObjectMeta{
+		ContentType: "text/plain",
+		Overwrite:   true,
+		SourceURL:   ns.groupURL(groupName),
+		MailingList: "nntp",
+		GroupName:   groupName,
+		FetchedAt:   time.Now(),
+		Cursor:      strconv.Itoa(mark),
+	}
+	if !start.IsZero() {
+		meta.StartDate = start.Format("2006-01-02")
+	}
+	if _, err = storage.Store(ctx, stateFile, strings.NewReader(meta.Cursor+"\n"), meta); err != nil {
+		err = fmt.Errorf("%w store: %v", stateErr, err)
+	}
+	return
+}
+
+func (ns *nntpSource) groupURL(groupName string) string {
+	scheme := "nntp"
+	if ns.useTLS {
+		scheme = "nntps"
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, ns.address, groupName)
+}
+
+// Overview of the articles from one number to another in number order.
+func overRange(ctx context.Context, c *client, from, to int) (overviews []overview, err error) {
+	var chunk []overview
+
+	for chunkStart := from; chunkStart <= to; chunkStart += overChunk {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunkEnd := chunkStart + overChunk - 1
+		if chunkEnd > to {
+			chunkEnd = to
+		}
+		if chunk, err = c.over(chunkStart, chunkEnd); err != nil {
+			return nil, err
+		}
+		overviews = append(overviews, chunk...)
+	}
+	sort.Slice(overviews, func(i, j int) bool { return overviews[i].number < overviews[j].number })
+	return
+}
+
+// Read the high-water mark and the overview of the articles after it once per group.
+func (ns *nntpSource) groupState(ctx context.Context, storage gcs.Connection, c *client, groupName string, low, high int) (state *groupState, err error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if state, ok := ns.groupStates[groupName]; ok {
+		return state, nil
+	}
+
+	state = &groupState{}
+	if state.mark, state.start, state.seen, err = readMark(ctx, storage); err != nil {
+		return nil, err
+	}
+	from := state.mark + 1
+	if from < low {
+		from = low
+	}
+	if state.overviews, err = overRange(ctx, c, from, high); err != nil {
+		return nil, err
+	}
+	log.Printf("%d nntp articles after article %d for %s.", len(state.overviews), state.mark, groupName)
+	ns.groupStates[groupName] = state
+	return
+}
+
+// Articles after the mark up to the first one dated on or after the end of the month, by year-month, and the new mark.
+// Articles dated after the month are passed and stored in their own month while a later article is dated in the month
+// or when they are dated after now, so they never hold the mark back. Articles dated before the start are passed over
+// for a later run that starts earlier. Articles without a readable date are skipped.
+func (state *groupState) monthArticles(month, now time.Time) (byMonth map[string][]overview, mark int) {
+	monthEnd := month.AddDate(0, 1, 0)
+	byMonth = make(map[string][]overview)
+	mark = state.mark
+
+	lastInMonth := -1
+	for i, over := range state.overviews {
+		if !over.date.Before(month) && over.date.Before(monthEnd) {
+			lastInMonth = i
+		}
+	}
+	for i, over := range state.overviews {
+		if over.number <= state.mark {
+			continue
+		}
+		if !over.date.Before(monthEnd) && !over.date.After(now) && i > lastInMonth {
+			break
+		}
+		mark = over.number
+		if over.date.IsZero() {
+			log.Printf("Skipping nntp article %d because its date can't be read.", over.number)
+			continue
+		}
+		if over.date.Before(state.start) {
+			continue
+		}
+		yearMonth := over.date.Format("2006-01")
+		byMonth[yearMonth] = append(byMonth[yearMonth], over)
+	}
+	return
+}
+
+// Articles up to the mark dated from the month to the start, by year-month, for a run that starts before earlier runs.
+func (state *groupState) earlierArticles(overviews []overview, month time.Time) (byMonth map[string][]overview) {
+	byMonth = make(map[string][]overview)
+	for _, over := range overviews {
+		if over.number > state.mark || over.date.Before(month) || !over.date.Before(state.start) {
+			continue
+		}
+		yearMonth := over.date.Format("2006-01")
+		byMonth[yearMonth] = append(byMonth[yearMonth], over)
+	}
+	return
+}
+
+// Write the article as an mboxrd entry. Lines that start with From after any > get one more >.
+func writeMboxArticle(w io.Writer, over overview, article []byte) (err error) {
+	sender := "MAILER-DAEMON"
+	if address, addrErr := mail.ParseAddress(over.from); addrErr == nil {
+		sender = address.Address
+	}
+	return utils.WriteMboxEntry(w, fmt.Sprintf("From %s %s", sender, over.date.Format(time.ANSIC)), string(article))
+}
+
+// Get each article and write the mbox to the stream. Articles removed from the server are skipped.
+func writeMonthMbox(w io.Writer, c *client, overviews []overview) (err error) {
+	var article []byte
+
+	for _, over := range overviews {
+		if article, err = c.article(over.number); err != nil {
+			return
+		}
+		if article == nil {
+			log.Printf("Skipping nntp article %d because it is no longer on the server.", over.number)
+			continue
+		}
+		if err = writeMboxArticle(w, over, article); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Mark the stored month file was stored up to. Zero when the month isn't stored yet.
+func storedMark(ctx context.Context, storage gcs.Connection, fileName string) (mark int, err error) {
+	info, exists, err := storage.Stat(ctx, fileName)
+	if err != nil || !exists || info.Metadata[gcs.MetaCursor] == "" {
+		return
+	}
+	if mark, err = strconv.Atoi(info.Metadata[gcs.MetaCursor]); err != nil {
+		err = fmt.Errorf("%w cursor on %s: %v", stateErr, info.Name, err)
+	}
+	return
+}
+
+// Add the articles for one year-month to its file and record the mark on it. Articles up to the mark the file was
+// stored up to are already in it.
+func (ns *nntpSource) storeMonth(ctx context.Context, storage gcs.Connection, c *client, groupName, yearMonth string, mark int, overviews []overview) (err error) {
+	var (
+		monthMark int
+		newOvers  []overview
+	)
+	articleMonth, _ := time.Parse("2006-01", yearMonth)
+	fileName := yearMonth + ".mbox.gz"
+
+	if monthMark, err = storedMark(ctx, storage, fileName); err != nil {
+		return
+	}
+	for _, over := range overviews {
+		if over.number > monthMark {
+			newOvers = append(newOvers, over)
+		}
+	}
+	if len(newOvers) == 0 {
+		log.Printf("Nntp articles for %s in %s already stored.", groupName, yearMonth)
+		return
+	}
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   ns.groupURL(groupName),
+		MailingList: "nntp",
+		GroupName:   groupName,
+		StartDate:   articleMonth.Format("2006-01-02"),
+		EndDate:     articleMonth.AddDate(0, 1, 0).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+		Cursor:      strconv.Itoa(mark),
+	}
+	_, err = utils.StoreAppend(ctx, storage, fileName, meta, func(w io.Writer) error {
+		return writeMonthMbox(w, c, newOvers)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Added %d nntp articles for %s to %s.", len(newOvers), groupName, yearMonth)
+	return
+}
+
+// Store the months from the month up to the start from the articles up to the mark, newest first, and move the start
+// back after each so an interrupted run picks up where it stopped. The mark doesn't move.
+func (ns *nntpSource) storeEarlierMonths(ctx context.Context, storage gcs.Connection, c *client, groupName string, state *groupState, low int, month time.Time) (err error) {
+	var overviews []overview
+
+	if overviews, err = overRange(ctx, c, low, state.mark); err != nil {
+		return
+	}
+	byMonth := state.earlierArticles(overviews, month)
+	for earlier := state.start.AddDate(0, -1, 0); !earlier.Before(month); earlier = earlier.AddDate(0, -1, 0) {
+		yearMonth := earlier.Format("2006-01")
+		if len(byMonth[yearMonth]) > 0 {
+			if err = ns.storeMonth(ctx, storage, c, groupName, yearMonth, state.mark, byMonth[yearMonth]); err != nil {
+				return
+			}
+		}
+		if err = ns.writeMark(ctx, storage, groupName, state.mark, earlier); err != nil {
+			return
+		}
+		ns.mu.Lock()
+		state.start = earlier
+		ns.mu.Unlock()
+	}
+	return
+}
+
+// Store the new articles for the month, and earlier months they arrived late for, then move the high-water mark. Months
+// before the start of earlier runs are stored from the articles already passed first.
+func (ns *nntpSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		c         *client
+		low, high int
+		state     *groupState
+	)
+
+	if c, err = dial(ctx, ns.address, ns.useTLS); err != nil {
+		return
+	}
+	defer c.quit()
+	if low, high, err = c.group(groupName); err != nil {
+		return
+	}
+	if state, err = ns.groupState(ctx, storage, c, groupName, low, high); err != nil {
+		return
+	}
+
+	ns.mu.Lock()
+	if !state.seen && state.start.IsZero() {
+		state.start = month
+	}
+	ns.mu.Unlock()
+	if state.seen && month.Before(state.start) {
+		if err = ns.storeEarlierMonths(ctx, storage, c, groupName, state, low, month); err != nil {
+			return
+		}
+	}
+
+	byMonth, mark := state.monthArticles(month, time.Now())
+	if mark == state.mark {
+		log.Printf("No new nntp articles for %s through %s.", groupName, month.Format("2006-01"))
+		return
+	}
+	yearMonths := make([]string, 0, len(byMonth))
+	for yearMonth := range byMonth {
+		yearMonths = append(yearMonths, yearMonth)
+	}
+	sort.Strings(yearMonths)
+
+	for _, yearMonth := range yearMonths {
+		if err = ns.storeMonth(ctx, storage, c, groupName, yearMonth, mark, byMonth[yearMonth]); err != nil {
+			return
+		}
+	}
+
+	if err = ns.writeMark(ctx, storage, groupName, mark, state.start); err != nil {
+		return
+	}
+	ns.mu.Lock()
+	state.mark, state.seen = mark, true
+	ns.mu.Unlock()
+	return
+}
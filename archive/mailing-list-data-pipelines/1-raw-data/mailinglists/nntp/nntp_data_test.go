@@ -0,0 +1,428 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nntp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const testGroup = "gmane.culture.haudenosaunee"
+
+type stubArticle struct {
+	date string
+	body string
+}
+
+// In-process NNTP server with one group. Servers that only know XOVER answer 500 to OVER.
+type stubServer struct {
+	listener  net.Listener
+	xoverOnly bool
+	mu        sync.Mutex
+	articles  map[int]stubArticle
+}
+
+func newStubServer(t *testing.T, xoverOnly bool) *stubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	stub := &stubServer{listener: listener, xoverOnly: xoverOnly, articles: make(map[int]stubArticle)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(textproto.NewConn(conn))
+		}
+	}()
+	return stub
+}
+
+func (stub *stubServer) addArticle(number int, date, body string) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.articles[number] = stubArticle{date: date, body: body}
+}
+
+func (stub *stubServer) numbers() (numbers []int) {
+	for number := range stub.articles {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return
+}
+
+func (stub *stubServer) serve(text *textproto.Conn) {
+	defer text.Close()
+	text.PrintfLine("200 stub ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		stub.mu.Lock()
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "LIST":
+			text.PrintfLine("215 list follows")
+			w := text.DotWriter()
+			fmt.Fprintf(w, "%s 8 1 y\ngmane.culture.lenape 0 1 y\n", testGroup)
+			w.Close()
+		case "GROUP":
+			if fields[1] != testGroup {
+				text.PrintfLine("411 no such group")
+				break
+			}
+			numbers := stub.numbers()
+			text.PrintfLine("211 %d %d %d %s", len(numbers), numbers[0], numbers[len(numbers)-1], testGroup)
+		case "OVER", "XOVER":
+			if stub.xoverOnly && fields[0] == "OVER" {
+				text.PrintfLine("500 unknown command")
+				break
+			}
+			var low, high int
+			fmt.Sscanf(fields[1], "%d-%d", &low, &high)
+			text.PrintfLine("224 overview follows")
+			w := text.DotWriter()
+			for _, number := range stub.numbers() {
+				if number >= low && number <= high {
+					fmt.Fprintf(w, "%d\tArticle %d\tJoseph Brant <thayendanegea@mohawk.org>\t%s\t<%d@mohawk.org>\t\t100\t3\n", number, number, stub.articles[number].date, number)
+				}
+			}
+			w.Close()
+		case "ARTICLE":
+			number, _ := strconv.Atoi(fields[1])
+			article, ok := stub.articles[number]
+			if !ok {
+				text.PrintfLine("423 no such article")
+				break
+			}
+			text.PrintfLine("220 %d <%d@mohawk.org>", number, number)
+			w := text.DotWriter()
+			fmt.Fprintf(w, "From: Joseph Brant <thayendanegea@mohawk.org>\nDate: %s\nSubject: Article %d\n\n%s\n", article.date, number, article.body)
+			w.Close()
+		case "QUIT":
+			text.PrintfLine("205 bye")
+			stub.mu.Unlock()
+			return
+		default:
+			text.PrintfLine("500 unknown command")
+		}
+		stub.mu.Unlock()
+	}
+}
+
+func TestParseOverview(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		line           string
+		wantOverview   overview
+		wantErr        bool
+	}{
+		{
+			comparisonType: "Overview with a date",
+			line:           "42\tGreat Law\tDeganawida <sachem@haudenosaunee.org>\tMon, 1 Mar 1142 12:00:00 +0100\t<42@haudenosaunee.org>\t\t100\t3",
+			wantOverview:   overview{number: 42, from: "Deganawida <sachem@haudenosaunee.org>", date: time.Date(1142, 3, 1, 11, 0, 0, 0, time.UTC)},
+		},
+		{
+			comparisonType: "Overview without a readable date",
+			line:           "43\tGreat Law\tDeganawida\tsometime\t<43@haudenosaunee.org>",
+			wantOverview:   overview{number: 43, from: "Deganawida"},
+		},
+		{
+			comparisonType: "Overview with too few fields",
+			line:           "44\tGreat Law",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotOverview, gotErr := parseOverview(test.line)
+			if (gotErr != nil) != test.wantErr {
+				t.Errorf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(gotOverview, test.wantOverview) {
+				t.Errorf("Overview doesn't match.\n got: %+v\nwant: %+v", gotOverview, test.wantOverview)
+			}
+		})
+	}
+}
+
+func TestListGroups(t *testing.T) {
+	stub := newStubServer(t, false)
+	defer stub.listener.Close()
+
+	src, err := source.New("nntp", source.Config{BaseURL: "nntp://" + stub.listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Source failed: %v", err)
+	}
+	gotGroups, err := src.ListGroups(context.Background())
+	if err != nil {
+		t.Fatalf("ListGroups failed: %v", err)
+	}
+	if wantGroups := []string{"gmane.culture.haudenosaunee", "gmane.culture.lenape"}; !reflect.DeepEqual(gotGroups, wantGroups) {
+		t.Errorf("Groups don't match.\n got: %v\nwant: %v", gotGroups, wantGroups)
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		baseURL        string
+		wantAddress    string
+		wantTLS        bool
+		wantErr        bool
+	}{
+		{
+			comparisonType: "Default server",
+			wantAddress:    "news.gmane.io:119",
+		},
+		{
+			comparisonType: "Host without a scheme",
+			baseURL:        "news.mohawk.org:1119",
+			wantAddress:    "news.mohawk.org:1119",
+		},
+		{
+			comparisonType: "TLS server",
+			baseURL:        "nntps://news.mohawk.org",
+			wantAddress:    "news.mohawk.org:563",
+			wantTLS:        true,
+		},
+		{
+			comparisonType: "Unknown scheme",
+			baseURL:        "https://news.mohawk.org",
+			wantErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, gotErr := NewSource(source.Config{BaseURL: test.baseURL})
+			if (gotErr != nil) != test.wantErr {
+				t.Fatalf("Error doesn't match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if ns := src.(*nntpSource); ns.address != test.wantAddress || ns.useTLS != test.wantTLS {
+				t.Errorf("Server doesn't match.\n got: %s tls %v\nwant: %s tls %v", ns.address, ns.useTLS, test.wantAddress, test.wantTLS)
+			}
+		})
+	}
+}
+
+func TestIncrementalLoads(t *testing.T) {
+	ctx := context.Background()
+	stub := newStubServer(t, true)
+	defer stub.listener.Close()
+	rootDir, err := ioutil.TempDir("", "nntp")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	subDir := filepath.Join(rootDir, "nntp-"+testGroup)
+
+	stub.addArticle(1, "Thu, 20 May 1779 10:00:00 +0000", "Before the load.")
+	stub.addArticle(2, "Thu, 3 Jun 1779 10:00:00 +0000", "Council at Oquaga.")
+	stub.addArticle(3, "Sun, 20 Jun 1779 10:00:00 +0000", "From the longhouse we speak.\n>From the river too.")
+	stub.addArticle(4, "Fri, 2 Jul 1779 10:00:00 +0000", "Summer council.")
+	stub.addArticle(5, "Wed, 30 Jun 1779 23:00:00 +0000", "Arrived late.")
+	stub.addArticle(6, "sometime", "No date.")
+	stub.addArticle(7, "Sun, 1 Aug 1779 10:00:00 +0000", "August.")
+
+	tests := []struct {
+		comparisonType string
+		newArticles    map[int]stubArticle
+		dropState      bool
+		startDate      string
+		endDate        string
+		wantMark       string
+		wantStart      string
+		wantSubjects   map[string][]string
+	}{
+		{
+			comparisonType: "First load skips articles before the load and keeps the month past an article dated after it",
+			startDate:      "1779-06-01",
+			endDate:        "1779-08-01",
+			wantMark:       "6",
+			wantStart:      "1779-06-01",
+			wantSubjects: map[string][]string{
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+			},
+		},
+		{
+			comparisonType: "Next load resumes after the mark",
+			newArticles:    map[int]stubArticle{8: {date: "Sun, 15 Aug 1779 10:00:00 +0000", body: "More August."}},
+			startDate:      "1779-08-01",
+			endDate:        "1779-10-01",
+			wantMark:       "8",
+			wantStart:      "1779-06-01",
+			wantSubjects: map[string][]string{
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+			},
+		},
+		{
+			comparisonType: "Load without new articles stores nothing",
+			startDate:      "1779-08-01",
+			endDate:        "1779-10-01",
+			wantMark:       "8",
+			wantStart:      "1779-06-01",
+			wantSubjects: map[string][]string{
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+			},
+		},
+		{
+			comparisonType: "Article dated after the load is stored in its own month and passed",
+			newArticles: map[int]stubArticle{
+				9:  {date: "Thu, 1 Jan 2037 10:00:00 +0000", body: "Clock set wrong."},
+				10: {date: "Mon, 13 Sep 1779 10:00:00 +0000", body: "September."},
+			},
+			startDate: "1779-09-01",
+			endDate:   "1779-10-01",
+			wantMark:  "10",
+			wantStart: "1779-06-01",
+			wantSubjects: map[string][]string{
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+				"1779-09-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 10"},
+				"2037-01-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 9"},
+			},
+		},
+		{
+			comparisonType: "Load that starts earlier stores the months before the first load without moving the mark",
+			newArticles:    map[int]stubArticle{11: {date: "Thu, 15 Apr 1779 10:00:00 +0000", body: "April."}},
+			startDate:      "1779-04-01",
+			endDate:        "1779-05-01",
+			wantMark:       "11",
+			wantStart:      "1779-04-01",
+			wantSubjects: map[string][]string{
+				"1779-04-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 11"},
+				"1779-05-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 1"},
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+				"1779-09-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 10"},
+				"2037-01-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 9"},
+			},
+		},
+		{
+			comparisonType: "Load that starts earlier again stores nothing",
+			startDate:      "1779-04-01",
+			endDate:        "1779-06-01",
+			wantMark:       "11",
+			wantStart:      "1779-04-01",
+			wantSubjects: map[string][]string{
+				"1779-04-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 11"},
+				"1779-05-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 1"},
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+				"1779-09-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 10"},
+				"2037-01-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 9"},
+			},
+		},
+		{
+			comparisonType: "Article that arrives late is added to the end of its stored month",
+			newArticles:    map[int]stubArticle{12: {date: "Fri, 25 Jun 1779 10:00:00 +0000", body: "Late June."}},
+			startDate:      "1779-09-01",
+			endDate:        "1779-10-01",
+			wantMark:       "12",
+			wantStart:      "1779-04-01",
+			wantSubjects: map[string][]string{
+				"1779-04-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 11"},
+				"1779-05-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 1"},
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5", "Subject: Article 12"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+				"1779-09-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 10"},
+				"2037-01-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 9"},
+			},
+		},
+		{
+			comparisonType: "Load after the state is lost leaves out the articles stored in each month",
+			dropState:      true,
+			startDate:      "1779-06-01",
+			endDate:        "1779-10-01",
+			wantMark:       "12",
+			wantStart:      "1779-06-01",
+			wantSubjects: map[string][]string{
+				"1779-04-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 11"},
+				"1779-05-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 1"},
+				"1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 2", "Subject: Article 3", ">From the longhouse we speak.", ">>From the river too.", "Subject: Article 5", "Subject: Article 12"},
+				"1779-07-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 4"},
+				"1779-08-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 7", "Subject: Article 8"},
+				"1779-09-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 10"},
+				"2037-01-nntp-gmane.culture.haudenosaunee.mbox.gz": {"Subject: Article 9"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			for number, article := range test.newArticles {
+				stub.addArticle(number, article.date, article.body)
+			}
+			src, err := source.New("nntp", source.Config{BaseURL: stub.listener.Addr().String(), Groups: []string{testGroup}})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "nntp-" + testGroup}
+			if test.dropState {
+				os.Remove(filepath.Join(rootDir, "state", "nntp-"+testGroup, "nntp-state.txt"))
+			}
+
+			if err = source.Load(ctx, src, storage, testGroup, test.startDate, test.endDate); err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			gotMark, gotStart, _, _ := readMark(ctx, storage)
+			if strconv.Itoa(gotMark) != test.wantMark {
+				t.Errorf("Mark doesn't match.\n got: %d\nwant: %s", gotMark, test.wantMark)
+			}
+			if gotStart.Format("2006-01-02") != test.wantStart {
+				t.Errorf("Start doesn't match.\n got: %v\nwant: %s", gotStart, test.wantStart)
+			}
+			gotSubjects, err := utils.StoredMboxLines(subDir, "Subject: ", ">")
+			if err != nil {
+				t.Fatalf("Stored articles failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotSubjects, test.wantSubjects) {
+				t.Errorf("Stored articles don't match.\n got: %v\nwant: %v", gotSubjects, test.wantSubjects)
+			}
+		})
+	}
+}
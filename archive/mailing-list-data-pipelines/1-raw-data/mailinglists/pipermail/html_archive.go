@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipermail
+
+/*
+Rebuild a month mbox from the Pipermail HTML message pages when there is no flat archive.
+
+Month message index:
+[BASE URL]/pipermail/[GROUP NAME]/[YEAR]-[MONTH NAME]/date.html
+Message pages linked from it as [6 DIGIT NUMBER].html have the subject in h1, the author name in b, the author email
+in the mailto link that also carries In-Reply-To, the date in i and the body in pre.
+*/
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	messagePageErr  = errors.New("message page")
+	messagePageLink = regexp.MustCompile(`^[0-9]+\.html$`)
+	// Pipermail page dates such as Mon Jan  6 00:00:00 EST 2003
+	messageDateLayouts = []string{"Mon Jan _2 15:04:05 MST 2006", "Mon Jan _2 15:04:05 2006"}
+)
+
+// Message details from a Pipermail message page
+type htmlMessage struct {
+	url       string
+	subject   string
+	author    string
+	email     string
+	date      string
+	inReplyTo string
+	body      string
+}
+
+// Absolute message page urls linked from the month date page in page order.
+func messagePageURLs(datePageURL string, dom *goquery.Document) (msgURLs []string) {
+	monthURL := datePageURL[:strings.LastIndex(datePageURL, "/")+1]
+	seen := make(map[string]bool)
+
+	dom.Find("a").Each(func(i int, s *goquery.Selection) {
+		href, ok := s.Attr("href")
+		if ok && messagePageLink.MatchString(href) && !seen[href] {
+			seen[href] = true
+			msgURLs = append(msgURLs, monthURL+href)
+		}
+	})
+	return
+}
+
+// Pull the message details from the page.
+func parseMessagePage(msgURL string, dom *goquery.Document) (msg htmlMessage) {
+	msg = htmlMessage{
+		url:     msgURL,
+		subject: strings.TrimSpace(dom.Find("h1").First().Text()),
+		author:  strings.TrimSpace(dom.Find("b").First().Text()),
+		date:    strings.TrimSpace(dom.Find("i").First().Text()),
+		body:    dom.Find("pre").First().Text(),
+	}
+	mailto := dom.Find(`a[href^="mailto:"]`).First()
+	msg.email = strings.TrimSpace(mailto.Text())
+	if href, ok := mailto.Attr("href"); ok {
+		if mailtoURL, err := url.Parse(href); err == nil {
+			msg.inReplyTo = mailtoURL.Query().Get("In-Reply-To")
+		}
+	}
+	return
+}
+
+// Write the message as an mbox entry like the ones in the flat archives.
+func (msg htmlMessage) writeMbox(w io.Writer) (err error) {
+	var sb strings.Builder
+
+	fromLineDate, dateHeader := msg.date, msg.date
+	for _, layout := range messageDateLayouts {
+		if msgDate, err := time.Parse(layout, msg.date); err == nil {
+			fromLineDate = msgDate.Format(time.ANSIC)
+			dateHeader = msgDate.Format(time.RFC1123Z)
+			break
+		}
+	}
+
+	fmt.Fprintf(&sb, "From: %s (%s)\n", msg.email, msg.author)
+	fmt.Fprintf(&sb, "Date: %s\n", dateHeader)
+	fmt.Fprintf(&sb, "Subject: %s\n", msg.subject)
+	if msg.inReplyTo != "" {
+		fmt.Fprintf(&sb, "In-Reply-To: %s\n", msg.inReplyTo)
+	}
+	fmt.Fprintf(&sb, "Archived-At: <%s>\n\n", msg.url)
+	sb.WriteString(msg.body)
+	return utils.WriteMboxEntry(w, fmt.Sprintf("From %s  %s", msg.email, fromLineDate), sb.String())
+}
+
+// Fetch each message page and write the gzipped mbox to the stream. A page that fails stops the month so it is left
+// unstored and fetched again on the next run.
+func writeHTMLMbox(w io.Writer, msgURLs []string, httpToDom utils.HttpDomResponse) (err error) {
+	var dom *goquery.Document
+	gz := gzip.NewWriter(w)
+
+	for _, msgURL := range msgURLs {
+		if dom, err = httpToDom(msgURL); err != nil {
+			return fmt.Errorf("%w %s: %v", messagePageErr, msgURL, err)
+		}
+		if err = parseMessagePage(msgURL, dom).writeMbox(gz); err != nil {
+			return
+		}
+	}
+	return gz.Close()
+}
+
+// Rebuild the month mbox from the message pages on the date page and store it gzipped.
+func (pm *pipermailSource) storeHTMLArchive(ctx context.Context, storage gcs.Connection, groupName string, month time.Time, datePage string) (err error) {
+	var dom *goquery.Document
+
+	datePageURL := pm.mailingListURL(groupName) + datePage
+	if dom, err = pm.httpToDom(datePageURL); err != nil {
+		return fmt.Errorf("%w: date page %s: %v", StorageErr, datePageURL, err)
+	}
+	msgURLs := messagePageURLs(datePageURL, dom)
+	if len(msgURLs) == 0 {
+		log.Printf("No message pages for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	meta := monthMeta(groupName, month)
+	meta.SourceURL = datePageURL
+	meta.FetchedAt = time.Now()
+	_, err = utils.StoreWriter(ctx, storage, month.Format("2006-01")+".txt.gz", meta, func(w io.Writer) error {
+		return writeHTMLMbox(w, msgURLs, pm.httpToDom)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", StorageErr, err)
+	}
+	log.Printf("Rebuilt %s for %s from %d message pages.", month.Format("2006-01"), groupName, len(msgURLs))
+	return
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipermail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const fakeMessagePage = `<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2//EN">
+<HTML>
+ <HEAD>
+   <TITLE> [Lakota] Vision at Slim Buttes</TITLE>
+ </HEAD>
+ <BODY BGCOLOR="#ffffff">
+   <H1>[Lakota] Vision at Slim Buttes</H1>
+    <B>Tasunke Witko</B>
+    <A HREF="mailto:lakota%40oglala.org?Subject=Re%3A%20%5BLakota%5D%20Vision&In-Reply-To=%3C1876.06@oglala.org%3E"
+       TITLE="[Lakota] Vision at Slim Buttes">crazyhorse at oglala.org
+       </A><BR>
+    <I>Sun Jun 25 14:30:00 MDT 1876</I>
+    <P><UL>
+        <LI>Previous message: <A HREF="000001.html">[Lakota] Greasy Grass</A></LI>
+    </UL>
+    <HR>
+<!--beginarticle-->
+<PRE>Hoka hey.
+From the hills we ride.
+&lt;end&gt;
+</PRE>
+<!--endarticle-->
+    <HR>
+</BODY>
+</HTML>`
+
+func TestMessagePageURLs(t *testing.T) {
+	dom, _ := goquery.NewDocumentFromReader(strings.NewReader(`<html><body>
+		<a href="thread.html">[ thread ]</a>
+		<ul>
+		<li><a href="000001.html">Greasy Grass</a></li>
+		<li><a href="000002.html">Vision at Slim Buttes</a></li>
+		<li><a href="000001.html">Greasy Grass again</a></li>
+		</ul>
+		<a href="https://list.org/">Mailman</a>
+		</body></html>`))
+
+	got := messagePageURLs("https://lists.oglala.org/pipermail/lakota/1876-June/date.html", dom)
+	want := []string{
+		"https://lists.oglala.org/pipermail/lakota/1876-June/000001.html",
+		"https://lists.oglala.org/pipermail/lakota/1876-June/000002.html",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Message page urls do not match.\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestParseMessagePage(t *testing.T) {
+	dom, _ := goquery.NewDocumentFromReader(strings.NewReader(fakeMessagePage))
+	msgURL := "https://lists.oglala.org/pipermail/lakota/1876-June/000002.html"
+
+	got := parseMessagePage(msgURL, dom)
+	want := htmlMessage{
+		url:       msgURL,
+		subject:   "[Lakota] Vision at Slim Buttes",
+		author:    "Tasunke Witko",
+		email:     "crazyhorse at oglala.org",
+		date:      "Sun Jun 25 14:30:00 MDT 1876",
+		inReplyTo: "<1876.06@oglala.org>",
+		body:      "Hoka hey.\nFrom the hills we ride.\n<end>\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Message does not match.\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestWriteMbox(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		msg            htmlMessage
+		want           string
+	}{
+		{
+			comparisonType: "Parsed date and mboxrd quoted From lines",
+			msg: htmlMessage{
+				url:       "https://lists.oglala.org/pipermail/lakota/1876-June/000002.html",
+				subject:   "[Lakota] Vision at Slim Buttes",
+				author:    "Tasunke Witko",
+				email:     "crazyhorse at oglala.org",
+				date:      "Sun Jun 25 14:30:00 MDT 1876",
+				inReplyTo: "<1876.06@oglala.org>",
+				body:      "Hoka hey.\nFrom the hills we ride.\n>From Paha Sapa.\n",
+			},
+			want: "From crazyhorse at oglala.org  Sun Jun 25 14:30:00 1876\n" +
+				"From: crazyhorse at oglala.org (Tasunke Witko)\n" +
+				"Date: Sun, 25 Jun 1876 14:30:00 +0000\n" +
+				"Subject: [Lakota] Vision at Slim Buttes\n" +
+				"In-Reply-To: <1876.06@oglala.org>\n" +
+				"Archived-At: <https://lists.oglala.org/pipermail/lakota/1876-June/000002.html>\n\n" +
+				"Hoka hey.\n>From the hills we ride.\n>>From Paha Sapa.\n\n",
+		},
+		{
+			comparisonType: "Unparsed date is kept",
+			msg: htmlMessage{
+				url:     "https://lists.oglala.org/pipermail/lakota/1876-June/000003.html",
+				subject: "Black Hills",
+				author:  "Makhpiya Luta",
+				email:   "redcloud at oglala.org",
+				date:    "Summer 1876",
+				body:    "Paha Sapa",
+			},
+			want: "From redcloud at oglala.org  Summer 1876\n" +
+				"From: redcloud at oglala.org (Makhpiya Luta)\n" +
+				"Date: Summer 1876\n" +
+				"Subject: Black Hills\n" +
+				"Archived-At: <https://lists.oglala.org/pipermail/lakota/1876-June/000003.html>\n\n" +
+				"Paha Sapa\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var sb strings.Builder
+			if err := test.msg.writeMbox(&sb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := sb.String(); got != test.want {
+				t.Errorf("Mbox does not match.\n got: %q\nwant: %q", got, test.want)
+			}
+		})
+	}
+}
@@ -13,7 +13,17 @@
 // limitations under the License.
 
 /*
-Access and load Pipermail data.
+Access and load Pipermail (Mailman 2) data from any host.
+
+Monthly archive url formats in order of preference:
+[BASE URL]/pipermail/[GROUP NAME]/[YEAR]-[MONTH NAME].txt.gz
+[BASE URL]/pipermail/[GROUP NAME]/[YEAR]-[MONTH NAME].txt
+[BASE URL]/pipermail/[GROUP NAME]/[YEAR]-[MONTH NAME]/date.html
+Plain text archives are gzipped when stored and months with only message pages are rebuilt into an mbox, so every
+month is stored as [YEAR]-[MONTH].txt.gz.
+
+When no groups are configured the public lists on the host are discovered from the archive index at
+[BASE URL]/pipermail/ and, if that has no lists, from the list overview at [BASE URL]/mailman/listinfo.
 */
 
 package pipermail
@@ -22,20 +32,32 @@ package pipermail
 // Add test of the specific page format expected and how to parse it
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
 var (
-	StorageErr = errors.New("Storage failed")
+	StorageErr   = errors.New("Storage failed")
+	discoveryErr = errors.New("list discovery")
+
+	// Relative links to a list directory on the archive index such as python-dev/
+	archiveDirLink = regexp.MustCompile(`^[^/?#:]+/$`)
 )
 
 func changeMonthToDigit(fileName string) (newName string, fileDate time.Time) {
@@ -47,47 +69,268 @@ func changeMonthToDigit(fileName string) (newName string, fileDate time.Time) {
 	return
 }
 
-// Get, parse and store Pipermail data in GCS.
-func GetPipermailData(ctx context.Context, storage gcs.Connection, groupName, startDateString, endDateString string, httpToDom utils.HttpDomResponse) (storeErr error) {
-	mailingListURL := fmt.Sprintf("https://mail.python.org/pipermail/%s/", groupName)
-	log.Printf("PIPERMAIL loading %s:", groupName)
+func init() {
+	source.Register("pipermail", NewSource)
+}
+
+// Pipermail version of the mailing list source
+type pipermailSource struct {
+	baseURL      string
+	groups       []string
+	httpToDom    utils.HttpDomResponse
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Archive links from each group index by year-month
+	links map[string]map[string]monthArchive
+}
+
+// Archive links for one month on the group index page
+type monthArchive struct {
+	// Flat archive such as 2003-January.txt.gz or 2003-January.txt
+	flatFile string
+	// Message index such as 2003-January/date.html
+	datePage string
+}
+
+// Create the Pipermail source. BaseURL defaults to the python.org host.
+func NewSource(config source.Config) (source.Source, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = "https://mail.python.org"
+	}
+	return &pipermailSource{
+		baseURL:      baseURL,
+		groups:       config.Groups,
+		httpToDom:    config.HttpToDom,
+		httpToReader: config.HttpToReader,
+		links:        make(map[string]map[string]monthArchive),
+	}, nil
+}
 
-	var (
-		dom                        *goquery.Document
-		err                        error
-		startDateTime, endDateTime time.Time
-	)
+func (pm *pipermailSource) Name() string {
+	return "pipermail"
+}
 
-	if dom, err = httpToDom(mailingListURL); err != nil {
-		return fmt.Errorf("HTTP dom error: %v", err)
+// Configured groups or the public lists discovered on the host when none are configured.
+func (pm *pipermailSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	if len(pm.groups) > 0 {
+		return pm.groups, nil
 	}
-	if startDateTime, err = utils.GetDateTimeType(startDateString); err != nil {
-		return fmt.Errorf("Start date in Pipermail error: %v", err)
+	if groupNames, err = pm.discoverArchiveIndex(); err != nil || len(groupNames) == 0 {
+		log.Printf("Using listinfo to discover lists on %s because the archive index had none.", pm.baseURL)
+		if groupNames, err = pm.discoverListinfo(); err != nil {
+			return
+		}
+	}
+	log.Printf("Discovered %d lists on %s.", len(groupNames), pm.baseURL)
+	return
+}
+
+// List directories linked from the pipermail archive index. Only lists with public archives are on it.
+func (pm *pipermailSource) discoverArchiveIndex() (groupNames []string, err error) {
+	var dom *goquery.Document
+
+	indexURL := fmt.Sprintf("%s/pipermail/", pm.baseURL)
+	if dom, err = pm.httpToDom(indexURL); err != nil {
+		return nil, fmt.Errorf("%w on %s: %v", discoveryErr, indexURL, err)
 	}
-	if endDateTime, err = utils.GetDateTimeType(endDateString); err != nil {
-		return fmt.Errorf("End date in Pipermail error: %v", err)
+	return uniqueLinkNames(dom, func(href string) string {
+		if archiveDirLink.MatchString(href) {
+			return strings.TrimSuffix(href, "/")
+		}
+		return ""
+	}), nil
+}
+
+// List names linked from the Mailman listinfo overview.
+func (pm *pipermailSource) discoverListinfo() (groupNames []string, err error) {
+	var dom *goquery.Document
+
+	listinfoURL := fmt.Sprintf("%s/mailman/listinfo", pm.baseURL)
+	if dom, err = pm.httpToDom(listinfoURL); err != nil {
+		return nil, fmt.Errorf("%w on %s: %v", discoveryErr, listinfoURL, err)
+	}
+	return uniqueLinkNames(dom, func(href string) string {
+		href = strings.TrimSuffix(href, "/")
+		if strings.Contains(href, "listinfo/") {
+			return path.Base(href)
+		}
+		return ""
+	}), nil
+}
+
+// Names from the page links in page order. The func returns an empty name for links to skip.
+func uniqueLinkNames(dom *goquery.Document, linkName func(href string) string) (names []string) {
+	seen := make(map[string]bool)
+
+	dom.Find("a").Each(func(i int, s *goquery.Selection) {
+		href, ok := s.Attr("href")
+		if !ok {
+			return
+		}
+		if name := linkName(href); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	})
+	return
+}
+
+func (pm *pipermailSource) mailingListURL(groupName string) string {
+	return fmt.Sprintf("%s/pipermail/%s/", pm.baseURL, groupName)
+}
+
+// Month of an archive link named like 2003-January.txt.gz or 2003-January/date.html.
+func archiveMonth(href string) (fileDate time.Time, ok bool) {
+	name := strings.SplitN(strings.SplitN(href, "/", 2)[0], ".", 2)[0]
+	nameParts := strings.Split(name, "-")
+	if len(nameParts) < 2 {
+		return
+	}
+	fileDate, err := time.Parse("2006-January", nameParts[0]+"-"+nameParts[1])
+	return fileDate, err == nil
+}
+
+// Get the archive links from the group index page by year-month. Gzip archives are preferred over plain text.
+// The index is only loaded once per group.
+func (pm *pipermailSource) archiveLinks(groupName string) (links map[string]monthArchive, err error) {
+	var dom *goquery.Document
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if links, ok := pm.links[groupName]; ok {
+		return links, nil
 	}
 
+	if dom, err = pm.httpToDom(pm.mailingListURL(groupName)); err != nil {
+		return nil, fmt.Errorf("HTTP dom error: %v", err)
+	}
+
+	links = make(map[string]monthArchive)
 	dom.Find("tr").Find("td").Find("a").Each(func(i int, s *goquery.Selection) {
-		filename, ok := s.Attr("href")
-		if ok {
-			check := strings.Split(filename, ".")
-			len := len(check) - 1
-			if check[len] == "gz" {
-				if strings.Split(filename, ":")[0] != "https" {
-					url := fmt.Sprintf("%v%v", mailingListURL, filename)
-					revisedFileName, fileDate := changeMonthToDigit(filename)
-					if utils.InTimeSpan(fileDate, startDateTime, endDateTime) {
-						if _, err = storage.StoreContentInBucket(ctx, revisedFileName, url, "url"); err != nil {
-							// Each func interface doesn't allow passing errors?
-							storeErr = fmt.Errorf("%w: %v", StorageErr, err)
-						}
-					}
-				}
-			}
+		href, ok := s.Attr("href")
+		if !ok || strings.Split(href, ":")[0] == "https" {
+			return
+		}
+		fileDate, ok := archiveMonth(href)
+		if !ok {
+			return
 		}
+		yearMonth := fileDate.Format("2006-01")
+		archive := links[yearMonth]
+		switch {
+		case strings.HasSuffix(href, ".gz"):
+			archive.flatFile = href
+		case strings.HasSuffix(href, ".txt") && !strings.HasSuffix(archive.flatFile, ".gz"):
+			archive.flatFile = href
+		case strings.HasSuffix(href, "/date.html"):
+			archive.datePage = href
+		default:
+			return
+		}
+		links[yearMonth] = archive
 	})
-	return storeErr
+	pm.links[groupName] = links
+	return
+}
+
+// Months with an archive link on the group index page in the date range.
+func (pm *pipermailSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var links map[string]monthArchive
+
+	if links, err = pm.archiveLinks(groupName); err != nil {
+		return
+	}
+	for yearMonth := range links {
+		fileDate, _ := time.Parse("2006-01", yearMonth)
+		if utils.InTimeSpan(fileDate, startDate, endDate) {
+			months = append(months, fileDate)
+		}
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+	return
+}
+
+// Provenance metadata for a month archive.
+func monthMeta(groupName string, fileDate time.Time) gcs.ObjectMeta {
+	return gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		MailingList: "pipermail",
+		GroupName:   groupName,
+		StartDate:   fileDate.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(fileDate).Format("2006-01-02"),
+	}
+}
+
+// Get and store the Pipermail archive for the month in GCS. Months without a flat archive, or where it fails, are
+// rebuilt from the message pages.
+func (pm *pipermailSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var links map[string]monthArchive
+
+	if links, err = pm.archiveLinks(groupName); err != nil {
+		return
+	}
+	archive, ok := links[month.Format("2006-01")]
+	if !ok {
+		log.Printf("No pipermail archive for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	if archive.flatFile != "" {
+		if err = pm.storeFlatArchive(ctx, storage, groupName, archive.flatFile); err == nil || archive.datePage == "" {
+			return
+		}
+		log.Printf("Rebuilding %s for %s from message pages because the archive failed: %v", month.Format("2006-01"), groupName, err)
+	}
+	return pm.storeHTMLArchive(ctx, storage, groupName, month, archive.datePage)
+}
+
+// Body that gzips a plain text archive as it is read. Closing it stops the gzip writer and closes the response.
+type gzipBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func (gb gzipBody) Close() error {
+	gb.PipeReader.Close()
+	return gb.body.Close()
+}
+
+// Get a plain text archive and gzip it while it is read.
+func (pm *pipermailSource) gzipReaderResponse(url string, requestHeader http.Header) (body io.ReadCloser, header http.Header, err error) {
+	var textBody io.ReadCloser
+
+	if textBody, header, err = pm.httpToReader(url, requestHeader); err != nil {
+		return
+	}
+	r, w := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(w)
+		if _, copyErr := io.Copy(gz, textBody); copyErr != nil {
+			w.CloseWithError(copyErr)
+			return
+		}
+		w.CloseWithError(gz.Close())
+	}()
+	return gzipBody{r, textBody}, header, nil
+}
+
+// Store a gzip archive as is or gzip a plain text archive while it streams into storage. Both go through StoreURL so
+// stored months are checked before the get and refreshed with a conditional get.
+func (pm *pipermailSource) storeFlatArchive(ctx context.Context, storage gcs.Connection, groupName, filename string) (err error) {
+	url := fmt.Sprintf("%v%v", pm.mailingListURL(groupName), filename)
+	revisedFileName, fileDate := changeMonthToDigit(filename)
+	meta := monthMeta(groupName, fileDate)
+
+	httpToReader := pm.httpToReader
+	if !strings.HasSuffix(filename, ".gz") {
+		httpToReader = pm.gzipReaderResponse
+		revisedFileName += ".gz"
+	}
+	if _, err = utils.StoreURL(ctx, storage, httpToReader, revisedFileName, url, meta); err != nil {
+		return fmt.Errorf("%w: %v", StorageErr, err)
+	}
+	return
 }
 
 func main() {
@@ -15,12 +15,24 @@
 package pipermail
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
 	"github.com/google/project-OCEAN/1-raw-data/utils"
 )
 
@@ -64,9 +76,49 @@ func TestChangeMonthToDigit(t *testing.T) {
 	}
 }
 
-func TestGetPipermailData(t *testing.T) {
+func TestMonths(t *testing.T) {
+	ctx := context.Background()
+	src, _ := NewSource(source.Config{HttpToDom: utils.FakeHttpDomResponse})
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		startDate      time.Time
+		endDate        time.Time
+		wantMonths     []time.Time
+	}{
+		{
+			comparisonType: "Test month on index page in range",
+			groupName:      "Pine-Leaf",
+			startDate:      time.Date(1851, 10, 1, 0, 0, 0, 0, time.UTC),
+			endDate:        time.Date(1851, 10, 31, 0, 0, 0, 0, time.UTC),
+			wantMonths:     []time.Time{time.Date(1851, 10, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			comparisonType: "Test month on index page out of range",
+			groupName:      "Pine-Leaf",
+			startDate:      time.Date(1856, 1, 1, 0, 0, 0, 0, time.UTC),
+			endDate:        time.Date(1856, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantMonths:     nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMonths, gotErr := src.Months(ctx, test.groupName, test.startDate, test.endDate)
+			if gotErr != nil {
+				t.Fatalf("Months error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months response does not match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
 	ctx := context.Background()
 	storage := utils.NewFakeStorageConnection("pipermail")
+	src, _ := source.New("pipermail", source.Config{HttpToDom: utils.FakeHttpDomResponse, HttpToReader: utils.FakeHttpReaderResponse})
 
 	tests := []struct {
 		comparisonType  string
@@ -74,7 +126,6 @@ func TestGetPipermailData(t *testing.T) {
 		groupName       string
 		startDateString string
 		endDateString   string
-		httpToDom       utils.HttpDomResponse
 		wantErr         error
 	}{
 		{
@@ -83,7 +134,6 @@ func TestGetPipermailData(t *testing.T) {
 			groupName:       "Pine-Leaf",
 			startDateString: "1851-10-01",
 			endDateString:   "1851-10-31",
-			httpToDom:       utils.FakeHttpDomResponse,
 			wantErr:         nil,
 		},
 		{
@@ -92,17 +142,299 @@ func TestGetPipermailData(t *testing.T) {
 			groupName:       "Space",
 			startDateString: "1963-06-01",
 			endDateString:   "1963-06-16",
-			httpToDom:       utils.FakeHttpDomResponse,
 			wantErr:         StorageErr,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.comparisonType, func(t *testing.T) {
-			if gotErr := GetPipermailData(ctx, test.gcs, test.groupName, test.startDateString, test.endDateString, test.httpToDom); !errors.Is(gotErr, test.wantErr) {
-				if gotErr == nil || !strings.Contains(gotErr.Error(), test.wantErr.Error()) {
-					t.Errorf("GetPipermailData response does not match.\n got: %v\nwant: %v", errors.Unwrap(gotErr), test.wantErr)
-				}
+			if gotErr := source.Load(ctx, src, test.gcs, test.groupName, test.startDateString, test.endDateString); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Load response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+		})
+	}
+}
+
+// Pages from two pipermail hosts. One has an archive index and the other only a listinfo overview.
+func fakeHostDomResponse(url string) (dom *goquery.Document, err error) {
+	var page string
+
+	switch url {
+	case "https://lists.kiowa.org/pipermail/":
+		page = `<html><body><table>
+			<tr><td><a href="?C=N;O=D">Name</a></td></tr>
+			<tr><td><a href="/">Parent Directory</a></td></tr>
+			<tr><td><a href="kiowa-five/">kiowa-five/</a></td></tr>
+			<tr><td><a href="lois-smoky/">lois-smoky/</a></td></tr>
+			</table></body></html>`
+	case "https://lists.kiowa.org/pipermail/kiowa-five/":
+		page = `<html><table>
+			<tr><td><a href="1927-May.txt.gz">[ Gzip'd Text 6 KB ]</a></td></tr>
+			<tr><td><a href="1928-January.txt.gz">[ Gzip'd Text 2 KB ]</a></td></tr>
+			</table></html>`
+	case "https://lists.comanche.org/mailman/listinfo":
+		page = `<html><body><table>
+			<tr><td><a href="listinfo/quanah-parker"><strong>Quanah-Parker</strong></a></td></tr>
+			<tr><td><a href="https://lists.comanche.org/mailman/listinfo/code-talkers/">Code-Talkers</a></td></tr>
+			<tr><td><a href="listinfo/quanah-parker">Quanah-Parker again</a></td></tr>
+			<tr><td><a href="admin">Admin</a></td></tr>
+			</table></body></html>`
+	default:
+		return nil, fmt.Errorf("not found: %s", url)
+	}
+	return goquery.NewDocumentFromReader(strings.NewReader(page))
+}
+
+func TestListGroups(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		comparisonType string
+		baseURL        string
+		groups         []string
+		wantGroups     []string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Configured groups are kept",
+			baseURL:        "https://lists.kiowa.org",
+			groups:         []string{"kiowa-five"},
+			wantGroups:     []string{"kiowa-five"},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Lists discovered from the archive index",
+			baseURL:        "https://lists.kiowa.org/",
+			wantGroups:     []string{"kiowa-five", "lois-smoky"},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Lists discovered from listinfo when there is no archive index",
+			baseURL:        "https://lists.comanche.org",
+			wantGroups:     []string{"quanah-parker", "code-talkers"},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Host without either page",
+			baseURL:        "https://lists.apache-nation.org",
+			wantErr:        discoveryErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, _ := NewSource(source.Config{BaseURL: test.baseURL, Groups: test.groups, HttpToDom: fakeHostDomResponse})
+			gotGroups, gotErr := src.ListGroups(ctx)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("ListGroups error does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("ListGroups response does not match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestMonthsOtherHost(t *testing.T) {
+	ctx := context.Background()
+	src, _ := NewSource(source.Config{BaseURL: "https://lists.kiowa.org", HttpToDom: fakeHostDomResponse})
+
+	gotMonths, gotErr := src.Months(ctx, "kiowa-five", time.Date(1927, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1929, 1, 1, 0, 0, 0, 0, time.UTC))
+	if gotErr != nil {
+		t.Fatalf("Months error: %v", gotErr)
+	}
+	wantMonths := []time.Time{time.Date(1927, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(1928, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if !reflect.DeepEqual(gotMonths, wantMonths) {
+		t.Errorf("Months response does not match.\n got: %v\nwant: %v", gotMonths, wantMonths)
+	}
+}
+
+// Pipermail host with a gzip month, a plain text month, a month with only message pages and a month with a broken gzip link.
+// The plain text month has an ETag and its gets are counted.
+func fakeArchiveServer(textGets *int32) *httptest.Server {
+	pages := map[string]string{
+		"/pipermail/lakota/": `<html><table>
+			<tr><td>June 1876:</td><td><a href="1876-June/date.html">[ Date ]</a></td><td><a href="1876-June.txt.gz">[ Gzip'd Text 1 KB ]</a></td></tr>
+			<tr><td>July 1876:</td><td><a href="1876-July/date.html">[ Date ]</a></td><td><a href="1876-July.txt">[ Text 1 KB ]</a></td></tr>
+			<tr><td>August 1876:</td><td><a href="1876-August/date.html">[ Date ]</a></td></tr>
+			<tr><td>September 1876:</td><td><a href="1876-September/date.html">[ Date ]</a></td><td><a href="1876-September.txt.gz">[ Gzip'd Text 1 KB ]</a></td></tr>
+			<tr><td>October 1876:</td><td><a href="1876-October/date.html">[ Date ]</a></td></tr>
+			</table></html>`,
+		"/pipermail/lakota/1876-July.txt":              "From sittingbull at hunkpapa.org  Sat Jul  1 00:00:00 1876\nSubject: Plain text month\n\n",
+		"/pipermail/lakota/1876-August/date.html":      `<html><ul><li><a href="000001.html">Rebuilt</a></li></ul></html>`,
+		"/pipermail/lakota/1876-August/000001.html":    `<html><h1>Rebuilt month</h1><b>Tatanka Iyotake</b><a href="mailto:lakota%40hunkpapa.org">sittingbull at hunkpapa.org</a><i>Tue Aug  1 00:00:00 MDT 1876</i><pre>From the pages</pre></html>`,
+		"/pipermail/lakota/1876-September/date.html":   `<html><ul><li><a href="000001.html">Fallback</a></li></ul></html>`,
+		"/pipermail/lakota/1876-September/000001.html": `<html><h1>Fallback month</h1><b>Tatanka Iyotake</b><a href="mailto:lakota%40hunkpapa.org">sittingbull at hunkpapa.org</a><i>Fri Sep  1 00:00:00 MDT 1876</i><pre>Broken gzip</pre></html>`,
+		"/pipermail/lakota/1876-October/date.html":     `<html><ul><li><a href="000001.html">Kept</a></li><li><a href="000002.html">Timed out</a></li></ul></html>`,
+		"/pipermail/lakota/1876-October/000001.html":   `<html><h1>Partial month</h1><b>Tatanka Iyotake</b><a href="mailto:lakota%40hunkpapa.org">sittingbull at hunkpapa.org</a><i>Sun Oct  1 00:00:00 MDT 1876</i><pre>Standing Rock</pre></html>`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipermail/lakota/1876-July.txt" {
+			atomic.AddInt32(textGets, 1)
+			w.Header().Set("ETag", `"Greasy-Grass"`)
+			if r.Header.Get("If-None-Match") == `"Greasy-Grass"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if r.URL.Path == "/pipermail/lakota/1876-June.txt.gz" {
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, "From sittingbull at hunkpapa.org  Thu Jun  1 00:00:00 1876\nSubject: Gzip month\n\n")
+			gz.Close()
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+}
+
+func TestFetchMonthArchiveTypes(t *testing.T) {
+	ctx := context.Background()
+	var textGets int32
+	server := fakeArchiveServer(&textGets)
+	defer server.Close()
+
+	rootDir, err := ioutil.TempDir("", "pipermail")
+	if err != nil {
+		t.Fatalf("Temp dir setup failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "pipermail-lakota"}
+	src, _ := NewSource(source.Config{BaseURL: server.URL, HttpToDom: utils.DomResponse, HttpToReader: utils.ReaderResponse})
+
+	tests := []struct {
+		comparisonType string
+		month          time.Time
+		wantFile       string
+		wantContent    string
+	}{
+		{
+			comparisonType: "Gzip archive stored as is",
+			month:          time.Date(1876, 6, 1, 0, 0, 0, 0, time.UTC),
+			wantFile:       "pipermail-lakota/1876-06-pipermail-lakota.txt.gz",
+			wantContent:    "Subject: Gzip month",
+		},
+		{
+			comparisonType: "Plain text archive gzipped with the same name",
+			month:          time.Date(1876, 7, 1, 0, 0, 0, 0, time.UTC),
+			wantFile:       "pipermail-lakota/1876-07-pipermail-lakota.txt.gz",
+			wantContent:    "Subject: Plain text month",
+		},
+		{
+			comparisonType: "Month rebuilt from message pages",
+			month:          time.Date(1876, 8, 1, 0, 0, 0, 0, time.UTC),
+			wantFile:       "pipermail-lakota/1876-08-pipermail-lakota.txt.gz",
+			wantContent:    "Subject: Rebuilt month",
+		},
+		{
+			comparisonType: "Broken gzip archive falls back to message pages",
+			month:          time.Date(1876, 9, 1, 0, 0, 0, 0, time.UTC),
+			wantFile:       "pipermail-lakota/1876-09-pipermail-lakota.txt.gz",
+			wantContent:    "Broken gzip",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, "lakota", test.month); gotErr != nil {
+				t.Fatalf("FetchMonth error: %v", gotErr)
+			}
+			f, err := os.Open(filepath.Join(rootDir, test.wantFile))
+			if err != nil {
+				t.Fatalf("Stored file missing: %v", err)
+			}
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("Stored file is not gzip: %v", err)
+			}
+			gotContent, _ := ioutil.ReadAll(gz)
+			if !strings.Contains(string(gotContent), test.wantContent) {
+				t.Errorf("Stored content does not match.\n got: %s\nwant: %v", gotContent, test.wantContent)
+			}
+		})
+	}
+}
+
+func TestFetchMonthFailedMessagePage(t *testing.T) {
+	ctx := context.Background()
+	var textGets int32
+	server := fakeArchiveServer(&textGets)
+	defer server.Close()
+
+	rootDir, err := ioutil.TempDir("", "pipermail")
+	if err != nil {
+		t.Fatalf("Temp dir setup failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "pipermail-lakota"}
+	// Fail the second message page like a timed out get
+	httpToDom := func(url string) (*goquery.Document, error) {
+		if strings.HasSuffix(url, "1876-October/000002.html") {
+			return nil, fmt.Errorf("timeout")
+		}
+		return utils.DomResponse(url)
+	}
+	src, _ := NewSource(source.Config{BaseURL: server.URL, HttpToDom: httpToDom, HttpToReader: utils.ReaderResponse})
+
+	if gotErr := src.FetchMonth(ctx, storage, "lakota", time.Date(1876, 10, 1, 0, 0, 0, 0, time.UTC)); !errors.Is(gotErr, StorageErr) {
+		t.Errorf("FetchMonth response does not match.\n got: %v\nwant: %v", gotErr, StorageErr)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, "pipermail-lakota/1876-10-pipermail-lakota.txt.gz")); !os.IsNotExist(err) {
+		t.Errorf("Month with a failed message page was stored: %v", err)
+	}
+}
+
+func TestFetchMonthPlainTextRefresh(t *testing.T) {
+	ctx := context.Background()
+	var textGets int32
+	server := fakeArchiveServer(&textGets)
+	defer server.Close()
+	july := time.Date(1876, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	rootDir, err := ioutil.TempDir("", "pipermail")
+	if err != nil {
+		t.Fatalf("Temp dir setup failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "pipermail-lakota"}
+	src, _ := NewSource(source.Config{BaseURL: server.URL, HttpToDom: utils.DomResponse, HttpToReader: utils.ReaderResponse})
+
+	tests := []struct {
+		comparisonType string
+		refresh        gcs.RefreshMode
+		wantGets       int32
+	}{
+		{
+			comparisonType: "First fetch gets and stores the month",
+			refresh:        gcs.RefreshNever,
+			wantGets:       1,
+		},
+		{
+			comparisonType: "Stored month is skipped without a get",
+			refresh:        gcs.RefreshNever,
+			wantGets:       1,
+		},
+		{
+			comparisonType: "Changed refresh asks with the stored ETag",
+			refresh:        gcs.RefreshChanged,
+			wantGets:       2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			storage.SetRefresh(test.refresh, true)
+			if gotErr := src.FetchMonth(ctx, storage, "lakota", july); gotErr != nil {
+				t.Fatalf("FetchMonth error: %v", gotErr)
+			}
+			if gotGets := atomic.LoadInt32(&textGets); gotGets != test.wantGets {
+				t.Errorf("Plain text gets do not match.\n got: %v\nwant: %v", gotGets, test.wantGets)
+			}
+			if _, err := os.Stat(filepath.Join(rootDir, "pipermail-lakota/1876-07-pipermail-lakota.txt.gz")); err != nil {
+				t.Errorf("Stored file missing: %v", err)
 			}
 		})
 	}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ponymail
+
+/*
+Discover lists and their active months through the Pony Mail JSON API.
+
+Lists on the host by domain with the number of emails in each:
+[BASE URL]/api/preferences.lua
+Quick stats for a list with its first and last year and month. Pony Mail Foal also returns the email count of each
+active month as YEAR-MONTH:
+[BASE URL]/api/stats.lua?list=[LIST]&domain=[DOMAIN]&quick
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	apiErr = errors.New("pony mail api")
+)
+
+// Preferences with the lists on the host
+type apiPreferences struct {
+	// Email count by list name by domain
+	Lists map[string]map[string]int `json:"lists"`
+}
+
+type apiStats struct {
+	FirstYear  int `json:"firstYear"`
+	FirstMonth int `json:"firstMonth"`
+	LastYear   int `json:"lastYear"`
+	LastMonth  int `json:"lastMonth"`
+	// Email count by YEAR-MONTH without zero padding
+	ActiveMonths map[string]int `json:"active_months"`
+}
+
+// Months with emails for a list. Months are only listed when the host returns active months, otherwise every month
+// from the first to the last is active.
+type listActivity struct {
+	firstMonth, lastMonth time.Time
+	months                map[time.Time]bool
+	empty                 bool
+}
+
+// Get and decode a JSON API response.
+func getAPI(httpToReader utils.HttpReaderResponse, apiURL string, value interface{}) (err error) {
+	var body io.ReadCloser
+
+	if body, _, err = httpToReader(apiURL, nil); err != nil {
+		return fmt.Errorf("%w get on %s: %v", apiErr, apiURL, err)
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(value); err != nil {
+		return fmt.Errorf("%w decode on %s: %v", apiErr, apiURL, err)
+	}
+	return
+}
+
+// List addresses on the host sorted by name. Only the org domain is listed when one is set.
+func (pm *ponyMailSource) discoverLists(ctx context.Context) (listAddresses []string, err error) {
+	var prefs apiPreferences
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = getAPI(pm.httpToReader, pm.baseURL+"/api/preferences.lua", &prefs); err != nil {
+		return
+	}
+	for domain, lists := range prefs.Lists {
+		if pm.domain != "" && domain != pm.domain {
+			continue
+		}
+		for listName := range lists {
+			listAddresses = append(listAddresses, listName+"@"+domain)
+		}
+	}
+	sort.Strings(listAddresses)
+	log.Printf("Discovered %d lists on %s.", len(listAddresses), pm.baseURL)
+	return
+}
+
+// Parse a YEAR-MONTH key such as 2021-3 into the first of the month.
+func parseActiveMonth(key string) (month time.Time, err error) {
+	var year, monthNum int
+
+	if _, err = fmt.Sscanf(key, "%d-%d", &year, &monthNum); err != nil {
+		return
+	}
+	if monthNum < 1 || monthNum > 12 {
+		err = fmt.Errorf("month %d out of range", monthNum)
+		return
+	}
+	return time.Date(year, time.Month(monthNum), 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// Find the months with emails from the list stats.
+func (pm *ponyMailSource) findActivity(listAddress string) (activity listActivity, err error) {
+	var stats apiStats
+
+	listName, domain := splitListAddress(listAddress)
+	statsURL := fmt.Sprintf("%s/api/stats.lua?list=%s&domain=%s&quick", pm.baseURL, url.QueryEscape(listName), url.QueryEscape(domain))
+	if err = getAPI(pm.httpToReader, statsURL, &stats); err != nil {
+		return
+	}
+
+	if len(stats.ActiveMonths) > 0 {
+		activity.months = make(map[time.Time]bool)
+		for key, count := range stats.ActiveMonths {
+			month, monthErr := parseActiveMonth(key)
+			if monthErr != nil {
+				return activity, fmt.Errorf("%w active month %q on %s: %v", apiErr, key, statsURL, monthErr)
+			}
+			if count > 0 {
+				activity.months[month] = true
+			}
+		}
+		if len(activity.months) == 0 {
+			activity.empty = true
+		}
+		return
+	}
+	if stats.FirstYear == 0 || stats.LastYear == 0 {
+		activity.empty = true
+		return
+	}
+	activity.firstMonth = time.Date(stats.FirstYear, time.Month(stats.FirstMonth), 1, 0, 0, 0, 0, time.UTC)
+	activity.lastMonth = time.Date(stats.LastYear, time.Month(stats.LastMonth), 1, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+// Report whether the list has emails in the month.
+func (activity listActivity) active(month time.Time) bool {
+	if activity.empty {
+		return false
+	}
+	if activity.months != nil {
+		return activity.months[month]
+	}
+	return !month.Before(activity.firstMonth) && !month.After(activity.lastMonth)
+}
+
+// Activity for the list, looked up once per source.
+func (pm *ponyMailSource) listActivity(listAddress string) (activity listActivity, err error) {
+	pm.mu.Lock()
+	activity, ok := pm.activity[listAddress]
+	pm.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if activity, err = pm.findActivity(listAddress); err != nil {
+		return
+	}
+	pm.mu.Lock()
+	pm.activity[listAddress] = activity
+	pm.mu.Unlock()
+	return
+}
+
+// List name and domain of a full list address.
+func splitListAddress(listAddress string) (listName, domain string) {
+	if idx := strings.LastIndex(listAddress, "@"); idx >= 0 {
+		return listAddress[:idx], listAddress[idx+1:]
+	}
+	return listAddress, ""
+}
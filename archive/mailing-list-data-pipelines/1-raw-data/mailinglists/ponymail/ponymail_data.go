@@ -0,0 +1,213 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load Apache Pony Mail data such as lists.apache.org through its monthly mbox downloads.
+
+Groups are entered as the full list address such as dev@httpd.apache.org. Set the org to a list domain such as
+httpd.apache.org to add it to groups entered without one and to limit discovery to that domain's lists.
+
+Monthly mbox url format where the month has no zero padding:
+[BASE URL]/api/mbox.lua?list=[LIST ADDRESS]&date=[YEAR]-[MONTH]
+
+The plain mbox is gzipped while it is stored so months use the same layout as the mailman source. Months already
+stored are checked before the download and refreshed with a conditional get.
+*/
+
+package ponymail
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr     = errors.New("Storage failed")
+	baseURLErr     = errors.New("base url")
+	listAddressErr = errors.New("list address")
+	mboxErr        = errors.New("pony mail mbox")
+)
+
+const defaultBaseURL = "https://lists.apache.org"
+
+// Url of the plain mbox for the list and month.
+func createMboxURL(baseURL, listAddress string, month time.Time) string {
+	return fmt.Sprintf("%s/api/mbox.lua?list=%s&date=%d-%d", baseURL, url.QueryEscape(listAddress), month.Year(), int(month.Month()))
+}
+
+func init() {
+	source.Register("ponymail", NewSource)
+}
+
+// Pony Mail version of the mailing list source
+type ponyMailSource struct {
+	baseURL string
+	// List domain added to groups entered without one
+	domain       string
+	groups       []string
+	httpToReader utils.HttpReaderResponse
+	mu           sync.Mutex
+	// Active months found through the API by list address
+	activity map[string]listActivity
+}
+
+// Create the Pony Mail source. BaseURL defaults to lists.apache.org and Org is the list domain.
+func NewSource(config source.Config) (source.Source, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	if parsedURL, err := url.Parse(baseURL); err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("%w %q needs a scheme and host: %v", baseURLErr, baseURL, err)
+	}
+	return &ponyMailSource{
+		baseURL:      baseURL,
+		domain:       strings.Trim(config.Org, "/"),
+		groups:       config.Groups,
+		httpToReader: config.HttpToReader,
+		activity:     make(map[string]listActivity),
+	}, nil
+}
+
+// Full list address for the group.
+func (pm *ponyMailSource) listAddress(groupName string) (listAddress string, err error) {
+	if strings.Contains(groupName, "@") {
+		return groupName, nil
+	}
+	if pm.domain == "" {
+		return "", fmt.Errorf("%w %s needs a domain. Enter the full address or set the org to the list domain.", listAddressErr, groupName)
+	}
+	return groupName + "@" + pm.domain, nil
+}
+
+func (pm *ponyMailSource) Name() string {
+	return "ponymail"
+}
+
+// Configured groups or the lists on the host from the Pony Mail API when none are configured.
+func (pm *ponyMailSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	if len(pm.groups) > 0 {
+		return pm.groups, nil
+	}
+	return pm.discoverLists(ctx)
+}
+
+// Months in the range with emails in the list stats. Every month in the range is returned when the API can't be
+// read so hosts without it still load.
+func (pm *ponyMailSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var listAddress string
+
+	if listAddress, err = pm.listAddress(groupName); err != nil {
+		return
+	}
+	activity, activityErr := pm.listActivity(listAddress)
+	if activityErr != nil {
+		log.Printf("Requesting every month for %s because active months were not found: %v", groupName, activityErr)
+		return source.MonthRange(startDate, endDate), nil
+	}
+	if activity.empty {
+		log.Printf("No emails archived for %s.", groupName)
+		return
+	}
+
+	for _, month := range source.MonthRange(startDate, endDate) {
+		if activity.active(month) {
+			months = append(months, month)
+		}
+	}
+	return
+}
+
+// Gzip the plain mbox into the stream.
+func gzipMbox(w io.Writer, mbox io.Reader) (err error) {
+	gz := gzip.NewWriter(w)
+	if _, err = io.Copy(gz, mbox); err != nil {
+		return fmt.Errorf("%w copy: %v", mboxErr, err)
+	}
+	return gz.Close()
+}
+
+type gzipBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func (gb gzipBody) Close() error {
+	gb.PipeReader.Close()
+	return gb.body.Close()
+}
+
+// Get the month mbox and gzip it while it is read. An empty mbox is returned as an error and noted in empty so nothing
+// is stored for the month.
+func (pm *ponyMailSource) gzipReaderResponse(empty *bool) utils.HttpReaderResponse {
+	return func(url string, requestHeader http.Header) (body io.ReadCloser, header http.Header, err error) {
+		var mboxBody io.ReadCloser
+
+		if mboxBody, header, err = pm.httpToReader(url, requestHeader); err != nil {
+			return
+		}
+		mbox := bufio.NewReader(mboxBody)
+		if _, peekErr := mbox.Peek(1); peekErr == io.EOF {
+			mboxBody.Close()
+			*empty = true
+			return nil, header, fmt.Errorf("%w on %s is empty", mboxErr, url)
+		}
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(gzipMbox(w, mbox))
+		}()
+		return gzipBody{r, mboxBody}, header, nil
+	}
+}
+
+func (pm *ponyMailSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var (
+		listAddress string
+		empty       bool
+	)
+
+	if listAddress, err = pm.listAddress(groupName); err != nil {
+		return
+	}
+	mboxURL := createMboxURL(pm.baseURL, listAddress, month)
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		MailingList: "ponymail",
+		GroupName:   groupName,
+		StartDate:   month.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(month).Format("2006-01-02"),
+	}
+	if _, err = utils.StoreURL(ctx, storage, pm.gzipReaderResponse(&empty), month.Format("2006-01")+".mbox.gz", mboxURL, meta); err != nil {
+		if empty {
+			log.Printf("No Pony Mail emails for %s in %s.", groupName, month.Format("2006-01"))
+			return nil
+		}
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	return
+}
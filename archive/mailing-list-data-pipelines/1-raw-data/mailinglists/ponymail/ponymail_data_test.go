@@ -0,0 +1,319 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ponymail
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+const wampumMbox = "From sachem@haudenosaunee.org Mon Mar  1 12:00:00 2021\nFrom: Deganawida <sachem@haudenosaunee.org>\nSubject: Great Law of Peace\n\nFive nations bury their weapons.\n\n"
+
+// Pony Mail style API with two domains. The wampum list has Foal active months, the council list only classic
+// first and last months and the longhouse list no emails.
+func fakePonyMailServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/preferences.lua", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login": {}, "lists": {"haudenosaunee.org": {"wampum": 12, "longhouse": 0, "council": 3}, "lenape.org": {"turtle": 5}}}`)
+	})
+	mux.HandleFunc("/api/stats.lua", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("list") + "@" + r.URL.Query().Get("domain") {
+		case "wampum@haudenosaunee.org":
+			fmt.Fprint(w, `{"firstYear": 2020, "firstMonth": 11, "lastYear": 2021, "lastMonth": 3, "active_months": {"2020-11": 4, "2021-1": 0, "2021-3": 8}}`)
+		case "council@haudenosaunee.org":
+			fmt.Fprint(w, `{"firstYear": 2019, "firstMonth": 7, "lastYear": 2019, "lastMonth": 9, "emails": []}`)
+		case "longhouse@haudenosaunee.org":
+			fmt.Fprint(w, `{"firstYear": 0, "lastYear": 0}`)
+		default:
+			http.Error(w, "list not found", http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/api/mbox.lua", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list") == "wampum@haudenosaunee.org" && r.URL.Query().Get("date") == "2021-3" {
+			if r.Header.Get("If-None-Match") == `"Hiawatha"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"Hiawatha"`)
+			fmt.Fprint(w, wampumMbox)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestListGroups(t *testing.T) {
+	ctx := context.Background()
+	server := fakePonyMailServer()
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		org            string
+		groups         []string
+		wantGroups     []string
+	}{
+		{
+			comparisonType: "Configured groups are kept",
+			groups:         []string{"wampum"},
+			wantGroups:     []string{"wampum"},
+		},
+		{
+			comparisonType: "Lists discovered on every domain",
+			wantGroups:     []string{"council@haudenosaunee.org", "longhouse@haudenosaunee.org", "turtle@lenape.org", "wampum@haudenosaunee.org"},
+		},
+		{
+			comparisonType: "Lists discovered on the org domain",
+			org:            "lenape.org",
+			wantGroups:     []string{"turtle@lenape.org"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, _ := NewSource(source.Config{BaseURL: server.URL, Org: test.org, Groups: test.groups, HttpToReader: utils.ReaderResponse})
+			gotGroups, gotErr := src.ListGroups(ctx)
+			if gotErr != nil {
+				t.Errorf("Unexpected error: %v", gotErr)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("Groups don't match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestMonths(t *testing.T) {
+	ctx := context.Background()
+	server := fakePonyMailServer()
+	defer server.Close()
+	src, _ := NewSource(source.Config{BaseURL: server.URL, Org: "haudenosaunee.org", HttpToReader: utils.ReaderResponse})
+
+	month := func(year int, month time.Month) time.Time { return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		startDate      time.Time
+		endDate        time.Time
+		wantMonths     []time.Time
+		wantErr        error
+	}{
+		{
+			comparisonType: "Only active months with emails",
+			groupName:      "wampum@haudenosaunee.org",
+			startDate:      month(2020, time.May),
+			endDate:        month(2021, time.June),
+			wantMonths:     []time.Time{month(2020, time.November), month(2021, time.March)},
+		},
+		{
+			comparisonType: "Months limited to the first and last months",
+			groupName:      "council",
+			startDate:      month(2019, time.August),
+			endDate:        month(2020, time.January),
+			wantMonths:     []time.Time{month(2019, time.August), month(2019, time.September)},
+		},
+		{
+			comparisonType: "List without emails has no months",
+			groupName:      "longhouse",
+			startDate:      month(2019, time.May),
+			endDate:        month(2021, time.June),
+		},
+		{
+			comparisonType: "Every month requested when the API fails",
+			groupName:      "hiawatha",
+			startDate:      month(2019, time.May),
+			endDate:        month(2019, time.July),
+			wantMonths:     []time.Time{month(2019, time.May), month(2019, time.June)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotMonths, gotErr := src.Months(ctx, test.groupName, test.startDate, test.endDate)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months don't match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+		})
+	}
+}
+
+func TestListAddress(t *testing.T) {
+	tests := []struct {
+		comparisonType  string
+		org             string
+		groupName       string
+		wantListAddress string
+		wantErr         error
+	}{
+		{
+			comparisonType:  "Full address is kept",
+			groupName:       "turtle@lenape.org",
+			wantListAddress: "turtle@lenape.org",
+		},
+		{
+			comparisonType:  "Org domain is added",
+			org:             "lenape.org",
+			groupName:       "turtle",
+			wantListAddress: "turtle@lenape.org",
+		},
+		{
+			comparisonType: "Group without a domain",
+			groupName:      "turtle",
+			wantErr:        listAddressErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, _ := NewSource(source.Config{Org: test.org})
+			gotListAddress, gotErr := src.(*ponyMailSource).listAddress(test.groupName)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error doesn't match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotListAddress != test.wantListAddress {
+				t.Errorf("List address doesn't match.\n got: %v\nwant: %v", gotListAddress, test.wantListAddress)
+			}
+		})
+	}
+}
+
+func TestFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	server := fakePonyMailServer()
+	defer server.Close()
+	rootDir, err := ioutil.TempDir("", "ponymail")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	src, _ := NewSource(source.Config{BaseURL: server.URL, Org: "haudenosaunee.org", HttpToReader: utils.ReaderResponse})
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "ponymail-wampum"}
+
+	tests := []struct {
+		comparisonType string
+		month          time.Time
+		wantMbox       string
+	}{
+		{
+			comparisonType: "Month mbox stored gzipped",
+			month:          time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantMbox:       wampumMbox,
+		},
+		{
+			comparisonType: "Empty month not stored",
+			month:          time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotErr := src.FetchMonth(ctx, storage, "wampum", test.month); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+
+			fileName := filepath.Join(rootDir, "ponymail-wampum", test.month.Format("2006-01")+"-ponymail-wampum.mbox.gz")
+			stored, openErr := os.Open(fileName)
+			if test.wantMbox == "" {
+				if openErr == nil {
+					stored.Close()
+					t.Errorf("Empty month stored at %s", fileName)
+				}
+				return
+			}
+			if openErr != nil {
+				t.Fatalf("Stored month missing: %v", openErr)
+			}
+			defer stored.Close()
+			gz, gzErr := gzip.NewReader(stored)
+			if gzErr != nil {
+				t.Fatalf("Stored month not gzipped: %v", gzErr)
+			}
+			gotMbox, _ := ioutil.ReadAll(gz)
+			if string(gotMbox) != test.wantMbox {
+				t.Errorf("Mbox doesn't match.\n got: %q\nwant: %q", gotMbox, test.wantMbox)
+			}
+		})
+	}
+}
+
+func TestFetchMonthStored(t *testing.T) {
+	ctx := context.Background()
+	server := fakePonyMailServer()
+	defer server.Close()
+	rootDir, err := ioutil.TempDir("", "ponymail")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "ponymail-wampum"}
+	march := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var gotHeaders []http.Header
+	httpToReader := func(url string, requestHeader http.Header) (io.ReadCloser, http.Header, error) {
+		gotHeaders = append(gotHeaders, requestHeader)
+		return utils.ReaderResponse(url, requestHeader)
+	}
+	src, _ := NewSource(source.Config{BaseURL: server.URL, Org: "haudenosaunee.org", HttpToReader: httpToReader})
+	if err = src.FetchMonth(ctx, storage, "wampum", march); err != nil {
+		t.Fatalf("Storage setup failed: %v", err)
+	}
+
+	tests := []struct {
+		comparisonType  string
+		refresh         gcs.RefreshMode
+		wantRequests    int
+		wantIfNoneMatch string
+	}{
+		{
+			comparisonType: "Stored month skipped without a request under never",
+			refresh:        gcs.RefreshNever,
+		},
+		{
+			comparisonType:  "Stored month requested with its ETag under changed",
+			refresh:         gcs.RefreshChanged,
+			wantRequests:    1,
+			wantIfNoneMatch: `"Hiawatha"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotHeaders = nil
+			storage.SetRefresh(test.refresh, false)
+			if gotErr := src.FetchMonth(ctx, storage, "wampum", march); gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+			if len(gotHeaders) != test.wantRequests {
+				t.Fatalf("Requests don't match.\n got: %v\nwant: %v", len(gotHeaders), test.wantRequests)
+			}
+			if test.wantRequests > 0 && gotHeaders[0].Get("If-None-Match") != test.wantIfNoneMatch {
+				t.Errorf("If-None-Match doesn't match.\n got: %v\nwant: %v", gotHeaders[0].Get("If-None-Match"), test.wantIfNoneMatch)
+			}
+		})
+	}
+}
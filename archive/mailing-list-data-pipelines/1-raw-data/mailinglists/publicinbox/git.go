@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publicinbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gitErr = errors.New("git")
+)
+
+// Commit that adds one message to an epoch
+type msgCommit struct {
+	gitDir string
+	sha    string
+	date   time.Time
+}
+
+// Run git and return its output. Stderr is added to the error.
+func runGit(ctx context.Context, args ...string) (output []byte, err error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	if output, err = cmd.Output(); err != nil {
+		err = fmt.Errorf("%w %s: %v: %s", gitErr, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// Mirror the epoch into the local directory or fetch what is new when it is already mirrored.
+func mirrorEpoch(ctx context.Context, epochURL, gitDir string) (err error) {
+	if _, statErr := os.Stat(gitDir); statErr == nil {
+		_, err = runGit(ctx, "--git-dir="+gitDir, "fetch", "--quiet", "--prune")
+		return
+	}
+	_, err = runGit(ctx, "clone", "--mirror", "--quiet", epochURL, gitDir)
+	return
+}
+
+// Stream the commits of the epoch oldest first. Public-inbox sets the author date of each commit from the message
+// Date header so that is the message date.
+func logCommits(ctx context.Context, gitDir string, each func(commit msgCommit)) (err error) {
+	var (
+		stdout io.ReadCloser
+		stderr bytes.Buffer
+	)
+
+	cmd := exec.CommandContext(ctx, "git", "--git-dir="+gitDir, "log", "--all", "--reverse", "--format=%H %at")
+	cmd.Stderr = &stderr
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return fmt.Errorf("%w log pipe on %s: %v", gitErr, gitDir, err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%w log on %s: %v", gitErr, gitDir, err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		seconds, parseErr := strconv.ParseInt(fields[1], 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		each(msgCommit{gitDir: gitDir, sha: fields[0], date: time.Unix(seconds, 0).UTC()})
+	}
+	// Drain what is left so git can exit before waiting on it
+	io.Copy(ioutil.Discard, stdout)
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("%w log on %s: %v: %s", gitErr, gitDir, err, strings.TrimSpace(stderr.String()))
+	}
+	return scanner.Err()
+}
+
+// Read the message added by each commit from one epoch and pass it on in commit order. Commits without a message,
+// such as deletions, are skipped.
+func readMessages(ctx context.Context, gitDir string, commits []msgCommit, each func(msg []byte) error) (err error) {
+	var (
+		stdin  io.WriteCloser
+		stdout io.ReadCloser
+		stderr bytes.Buffer
+		header string
+		size   int
+	)
+
+	cmd := exec.CommandContext(ctx, "git", "--git-dir="+gitDir, "cat-file", "--batch")
+	cmd.Stderr = &stderr
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return fmt.Errorf("%w cat-file pipe on %s: %v", gitErr, gitDir, err)
+	}
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return fmt.Errorf("%w cat-file pipe on %s: %v", gitErr, gitDir, err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%w cat-file on %s: %v", gitErr, gitDir, err)
+	}
+	// Ask for the message blob of each commit while the answers are read
+	go func() {
+		for _, commit := range commits {
+			if _, writeErr := fmt.Fprintf(stdin, "%s:m\n", commit.sha); writeErr != nil {
+				break
+			}
+		}
+		stdin.Close()
+	}()
+
+	reader := bufio.NewReader(stdout)
+	for range commits {
+		if header, err = reader.ReadString('\n'); err != nil {
+			err = fmt.Errorf("%w cat-file read on %s: %v", gitErr, gitDir, err)
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			// [COMMIT]:m missing
+			continue
+		}
+		if size, err = strconv.Atoi(fields[2]); err != nil {
+			err = fmt.Errorf("%w cat-file size on %s: %v", gitErr, gitDir, err)
+			break
+		}
+		msg := make([]byte, size+1)
+		if _, err = io.ReadFull(reader, msg); err != nil {
+			err = fmt.Errorf("%w cat-file read on %s: %v", gitErr, gitDir, err)
+			break
+		}
+		if err = each(msg[:size]); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	if err = cmd.Wait(); err != nil {
+		err = fmt.Errorf("%w cat-file on %s: %v: %s", gitErr, gitDir, err, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Access and load public-inbox archives such as lore.kernel.org from their v2 git epochs.
+
+Each list is a set of git repositories called epochs. Every commit adds one message as the blob m and the commit
+author date is the message date. The epochs are mirrored with the git command into a local directory, fetched again
+on later runs, and the messages are split by month into mbox files.
+
+Epoch url format:
+[BASE URL]/[LIST NAME]/git/[EPOCH NUMBER].git
+
+Epochs and lists on the host come from the grokmirror manifest:
+[BASE URL]/manifest.js.gz
+
+The base URL can also be a local directory holding [LIST NAME]/git/[EPOCH NUMBER].git.
+*/
+
+package publicinbox
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	storageErr  = errors.New("Storage failed")
+	manifestErr = errors.New("manifest")
+	// Manifest key for an epoch such as /lkml/git/0.git
+	epochPath = regexp.MustCompile(`^/?(.+)/git/([0-9]+)\.git$`)
+)
+
+const defaultBaseURL = "https://lore.kernel.org"
+
+// Epoch git directory under the base
+func epochLocation(baseURL, groupName string, epoch int) string {
+	return fmt.Sprintf("%s/%s/git/%d.git", baseURL, groupName, epoch)
+}
+
+// Local directories aren't urls
+func isLocal(baseURL string) bool {
+	return !strings.Contains(baseURL, "://")
+}
+
+// Epoch numbers for each list from epoch paths such as /lkml/git/0.git. Other paths are left out.
+func epochsFromPaths(paths []string) (epochs map[string][]int) {
+	epochs = make(map[string][]int)
+	for _, epochDir := range paths {
+		if match := epochPath.FindStringSubmatch(epochDir); match != nil {
+			epoch, _ := strconv.Atoi(match[2])
+			epochs[match[1]] = append(epochs[match[1]], epoch)
+		}
+	}
+	for _, listEpochs := range epochs {
+		sort.Ints(listEpochs)
+	}
+	return
+}
+
+// Epoch numbers for each list in the manifest.
+func parseManifest(r io.Reader) (epochs map[string][]int, err error) {
+	var (
+		manifest map[string]json.RawMessage
+		paths    []string
+	)
+
+	if err = json.NewDecoder(r).Decode(&manifest); err != nil {
+		return
+	}
+	for key := range manifest {
+		paths = append(paths, key)
+	}
+	return epochsFromPaths(paths), nil
+}
+
+func init() {
+	source.Register("publicinbox", NewSource)
+}
+
+// Public-inbox version of the mailing list source
+type publicInboxSource struct {
+	baseURL      string
+	groups       []string
+	httpToReader utils.HttpReaderResponse
+	// Directory the epochs are mirrored into
+	mirrorRoot string
+	mu         sync.Mutex
+	// Mirrored epoch git directories by group
+	epochDirs map[string][]string
+	// Message commits by group and year-month from the epochs walked in Months
+	monthCommits map[string]map[string][]msgCommit
+}
+
+// Create the public-inbox source. BaseURL defaults to lore.kernel.org. Epochs are mirrored under the temp directory
+// so later runs only fetch new messages.
+func NewSource(config source.Config) (source.Source, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	return &publicInboxSource{
+		baseURL:      baseURL,
+		groups:       config.Groups,
+		httpToReader: config.HttpToReader,
+		mirrorRoot:   filepath.Join(os.TempDir(), "ocean-public-inbox", strings.NewReplacer(":", "_", "/", "_").Replace(baseURL)),
+		epochDirs:    make(map[string][]string),
+		monthCommits: make(map[string]map[string][]msgCommit),
+	}, nil
+}
+
+func (pi *publicInboxSource) Name() string {
+	return "publicinbox"
+}
+
+// Epoch numbers for every list on the host. Local directories are globbed and hosts use the manifest.
+func (pi *publicInboxSource) hostEpochs() (epochs map[string][]int, err error) {
+	if isLocal(pi.baseURL) {
+		var gitDirs, paths []string
+		if gitDirs, err = filepath.Glob(filepath.Join(pi.baseURL, "*", "git", "*.git")); err != nil {
+			return
+		}
+		for _, gitDir := range gitDirs {
+			if relPath, relErr := filepath.Rel(pi.baseURL, gitDir); relErr == nil {
+				paths = append(paths, filepath.ToSlash(relPath))
+			}
+		}
+		return epochsFromPaths(paths), nil
+	}
+
+	var (
+		body io.ReadCloser
+		gz   *gzip.Reader
+	)
+	manifestURL := pi.baseURL + "/manifest.js.gz"
+	if body, _, err = pi.httpToReader(manifestURL, nil); err != nil {
+		return nil, fmt.Errorf("%w get on %s: %v", manifestErr, manifestURL, err)
+	}
+	defer body.Close()
+	if gz, err = gzip.NewReader(body); err != nil {
+		return nil, fmt.Errorf("%w gzip on %s: %v", manifestErr, manifestURL, err)
+	}
+	if epochs, err = parseManifest(gz); err != nil {
+		err = fmt.Errorf("%w decode on %s: %v", manifestErr, manifestURL, err)
+	}
+	return
+}
+
+// Configured groups or every list on the host.
+func (pi *publicInboxSource) ListGroups(ctx context.Context) (groupNames []string, err error) {
+	var epochs map[string][]int
+
+	if len(pi.groups) > 0 {
+		return pi.groups, nil
+	}
+	if epochs, err = pi.hostEpochs(); err != nil {
+		return
+	}
+	for groupName := range epochs {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	log.Printf("Discovered %d public-inbox lists on %s.", len(groupNames), pi.baseURL)
+	return
+}
+
+// Mirror every epoch of the group once per source and return the local git directories.
+func (pi *publicInboxSource) mirror(ctx context.Context, groupName string) (gitDirs []string, err error) {
+	var epochs map[string][]int
+
+	pi.mu.Lock()
+	gitDirs, ok := pi.epochDirs[groupName]
+	pi.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if epochs, err = pi.hostEpochs(); err != nil {
+		return
+	}
+	if len(epochs[groupName]) == 0 {
+		log.Printf("No public-inbox epochs for %s on %s.", groupName, pi.baseURL)
+	}
+	for _, epoch := range epochs[groupName] {
+		gitDir := filepath.Join(pi.mirrorRoot, groupName, fmt.Sprintf("%d.git", epoch))
+		if err = os.MkdirAll(filepath.Dir(gitDir), 0755); err != nil {
+			return nil, fmt.Errorf("%w mirror directory %s: %v", gitErr, filepath.Dir(gitDir), err)
+		}
+		if err = mirrorEpoch(ctx, epochLocation(pi.baseURL, groupName, epoch), gitDir); err != nil {
+			return nil, err
+		}
+		gitDirs = append(gitDirs, gitDir)
+	}
+
+	pi.mu.Lock()
+	pi.epochDirs[groupName] = gitDirs
+	pi.mu.Unlock()
+	return
+}
+
+// Months in the range with messages in any epoch. The commits for each month are kept so FetchMonth doesn't walk the
+// epochs again.
+func (pi *publicInboxSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error) {
+	var gitDirs []string
+
+	if gitDirs, err = pi.mirror(ctx, groupName); err != nil {
+		return
+	}
+	monthCommits := make(map[string][]msgCommit)
+	for _, gitDir := range gitDirs {
+		err = logCommits(ctx, gitDir, func(commit msgCommit) {
+			if utils.InTimeSpan(commit.date, startDate, endDate) {
+				yearMonth := commit.date.Format("2006-01")
+				monthCommits[yearMonth] = append(monthCommits[yearMonth], commit)
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+	for _, month := range source.MonthRange(startDate, endDate) {
+		if _, ok := monthCommits[month.Format("2006-01")]; ok {
+			months = append(months, month)
+		}
+	}
+
+	pi.mu.Lock()
+	pi.monthCommits[groupName] = monthCommits
+	pi.mu.Unlock()
+	return
+}
+
+// Message commits for the month kept by Months, or from every epoch if Months was not called.
+func (pi *publicInboxSource) commitsForMonth(ctx context.Context, groupName string, month time.Time) (commits []msgCommit, err error) {
+	var gitDirs []string
+
+	pi.mu.Lock()
+	monthCommits, ok := pi.monthCommits[groupName]
+	pi.mu.Unlock()
+	if ok {
+		return monthCommits[month.Format("2006-01")], nil
+	}
+
+	if gitDirs, err = pi.mirror(ctx, groupName); err != nil {
+		return
+	}
+	monthEnd := month.AddDate(0, 1, 0)
+	for _, gitDir := range gitDirs {
+		err = logCommits(ctx, gitDir, func(commit msgCommit) {
+			if utils.InTimeSpan(commit.date, month, monthEnd) {
+				commits = append(commits, commit)
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Write the message as an mboxrd entry. Lines that start with From after any > get one more >.
+func writeMboxMessage(w io.Writer, msg []byte) (err error) {
+	return utils.WriteMboxEntry(w, "From mboxrd@z Thu Jan  1 00:00:00 1970", string(msg))
+}
+
+// Read the messages for the commits epoch by epoch and write the gzipped mbox to the stream.
+func writeMonthMbox(ctx context.Context, w io.Writer, commits []msgCommit) (err error) {
+	var epochCommits []msgCommit
+	gz := gzip.NewWriter(w)
+
+	for idx, commit := range commits {
+		epochCommits = append(epochCommits, commit)
+		if idx+1 < len(commits) && commits[idx+1].gitDir == commit.gitDir {
+			continue
+		}
+		err = readMessages(ctx, commit.gitDir, epochCommits, func(msg []byte) error {
+			return writeMboxMessage(gz, msg)
+		})
+		if err != nil {
+			return
+		}
+		epochCommits = nil
+	}
+	return gz.Close()
+}
+
+// Split the month's messages out of the epochs and store them as a gzipped mbox.
+func (pi *publicInboxSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error) {
+	var commits []msgCommit
+
+	if commits, err = pi.commitsForMonth(ctx, groupName, month); err != nil {
+		return
+	}
+	if len(commits) == 0 {
+		log.Printf("No public-inbox messages for %s in %s.", groupName, month.Format("2006-01"))
+		return
+	}
+
+	meta := gcs.ObjectMeta{
+		ContentType: "application/x-gzip",
+		SourceURL:   fmt.Sprintf("%s/%s/", pi.baseURL, groupName),
+		MailingList: "publicinbox",
+		GroupName:   groupName,
+		StartDate:   month.Format("2006-01-02"),
+		EndDate:     utils.AddMonth(month).Format("2006-01-02"),
+		FetchedAt:   time.Now(),
+	}
+	_, err = utils.StoreWriter(ctx, storage, month.Format("2006-01")+".mbox.gz", meta, func(w io.Writer) error {
+		return writeMonthMbox(ctx, w, commits)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", storageErr, err)
+	}
+	log.Printf("Stored %d public-inbox messages for %s in %s.", len(commits), groupName, month.Format("2006-01"))
+	return
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publicinbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/mailinglists/source"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+// Message for a fixture epoch. Empty content records a deletion like public-inbox does.
+type fixtureMsg struct {
+	date    string
+	content string
+}
+
+// Build a public-inbox v2 epoch at [INBOX]/[GROUP]/git/[EPOCH].git where each commit replaces the blob m.
+func makeEpoch(t *testing.T, inboxDir, groupName string, epoch int, msgs []fixtureMsg) {
+	gitDir := filepath.Join(inboxDir, groupName, "git", fmt.Sprintf("%d.git", epoch))
+	git := func(env []string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = gitDir
+		cmd.Env = append(os.Environ(), env...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, output)
+		}
+	}
+
+	if err := os.MkdirAll(gitDir, 0755); err != nil {
+		t.Fatalf("Epoch directory failed: %v", err)
+	}
+	git(nil, "init", "--quiet")
+	for _, msg := range msgs {
+		env := []string{
+			"GIT_AUTHOR_NAME=Wilma Mankiller", "GIT_AUTHOR_EMAIL=chief@cherokee.org", "GIT_AUTHOR_DATE=" + msg.date,
+			"GIT_COMMITTER_NAME=public-inbox", "GIT_COMMITTER_EMAIL=inbox@cherokee.org", "GIT_COMMITTER_DATE=" + msg.date,
+		}
+		if msg.content == "" {
+			git(nil, "rm", "--quiet", "m")
+			if err := ioutil.WriteFile(filepath.Join(gitDir, "d"), []byte("deleted\n"), 0644); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			git(nil, "add", "d")
+		} else {
+			if err := ioutil.WriteFile(filepath.Join(gitDir, "m"), []byte(msg.content), 0644); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			git(nil, "add", "m")
+		}
+		git(env, "commit", "--quiet", "-m", "m")
+	}
+}
+
+// Inbox with two epochs of the Cherokee list. Epoch 1 ends with a deletion.
+func makeInbox(t *testing.T) (inboxDir string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	inboxDir, err := ioutil.TempDir("", "publicinbox")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	makeEpoch(t, inboxDir, "Cherokee", 0, []fixtureMsg{
+		{date: "1985-12-05T12:00:00Z", content: "From: Wilma Mankiller <chief@cherokee.org>\nDate: Thu, 05 Dec 1985 12:00:00 +0000\nSubject: Principal Chief\n\nFrom today I serve as Principal Chief.\n"},
+		{date: "1985-12-20T08:30:00Z", content: "From: Wilma Mankiller <chief@cherokee.org>\nDate: Fri, 20 Dec 1985 08:30:00 +0000\nSubject: Bell community project\n\nThe waterline in Bell is done.\n"},
+		{date: "1986-01-10T09:00:00Z", content: "From: Wilma Mankiller <chief@cherokee.org>\nDate: Fri, 10 Jan 1986 09:00:00 +0000\nSubject: Community development\n\n>From the council: approved.\n"},
+	})
+	makeEpoch(t, inboxDir, "Cherokee", 1, []fixtureMsg{
+		{date: "1986-01-25T15:00:00Z", content: "From: Wilma Mankiller <chief@cherokee.org>\nDate: Sat, 25 Jan 1986 15:00:00 +0000\nSubject: Re: Community development\n\nThank you.\n"},
+		{date: "1986-01-26T15:00:00Z"},
+	})
+	return
+}
+
+func TestParseManifest(t *testing.T) {
+	manifest := `{"/lkml/git/1.git": {}, "/lkml/git/0.git": {}, "/git/git/0.git": {}, "/pub/scm/git.git": {}}`
+	wantEpochs := map[string][]int{"lkml": {0, 1}, "git": {0}}
+
+	gotEpochs, err := parseManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotEpochs, wantEpochs) {
+		t.Errorf("Epochs do not match.\n got: %v\nwant: %v", gotEpochs, wantEpochs)
+	}
+}
+
+func TestListGroups(t *testing.T) {
+	var gzManifest bytes.Buffer
+	gz := gzip.NewWriter(&gzManifest)
+	gz.Write([]byte(`{"/Cherokee/git/0.git": {}, "/Osage/git/0.git": {}, "/Osage/git/1.git": {}}`))
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/manifest.js.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(gzManifest.Bytes())
+	}))
+	defer server.Close()
+	inboxDir := makeInbox(t)
+	defer os.RemoveAll(inboxDir)
+
+	tests := []struct {
+		comparisonType string
+		baseURL        string
+		groups         []string
+		wantGroups     []string
+	}{
+		{
+			comparisonType: "Test configured groups",
+			baseURL:        server.URL,
+			groups:         []string{"Seneca"},
+			wantGroups:     []string{"Seneca"},
+		},
+		{
+			comparisonType: "Test lists from the manifest",
+			baseURL:        server.URL,
+			wantGroups:     []string{"Cherokee", "Osage"},
+		},
+		{
+			comparisonType: "Test lists in a local directory",
+			baseURL:        inboxDir,
+			wantGroups:     []string{"Cherokee"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, err := source.New("publicinbox", source.Config{BaseURL: test.baseURL, Groups: test.groups, HttpToReader: utils.ReaderResponse})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			gotGroups, err := src.ListGroups(context.Background())
+			if err != nil {
+				t.Fatalf("ListGroups failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotGroups, test.wantGroups) {
+				t.Errorf("Groups do not match.\n got: %v\nwant: %v", gotGroups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestWriteMboxMessage(t *testing.T) {
+	var buf bytes.Buffer
+	msg := "Subject: Osage\n\nFrom: the agency\nFrom Pawhuska\n>From Fairfax\n"
+	wantMbox := "From mboxrd@z Thu Jan  1 00:00:00 1970\nSubject: Osage\n\nFrom: the agency\n>From Pawhuska\n>>From Fairfax\n\n"
+
+	if err := writeMboxMessage(&buf, []byte(msg)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if gotMbox := buf.String(); gotMbox != wantMbox {
+		t.Errorf("Mbox does not match.\n got: %q\nwant: %q", gotMbox, wantMbox)
+	}
+}
+
+func TestMonthsAndFetchMonth(t *testing.T) {
+	ctx := context.Background()
+	inboxDir := makeInbox(t)
+	defer os.RemoveAll(inboxDir)
+	rootDir, err := ioutil.TempDir("", "publicinbox-store")
+	if err != nil {
+		t.Fatalf("Temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	december := time.Date(1985, 12, 1, 0, 0, 0, 0, time.UTC)
+	january := time.Date(1986, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		comparisonType string
+		listFirst      bool
+		month          time.Time
+		wantMonths     []time.Time
+		wantSubjects   []string
+	}{
+		{
+			comparisonType: "Test months then a month across epochs",
+			listFirst:      true,
+			month:          january,
+			wantMonths:     []time.Time{december, january},
+			wantSubjects:   []string{"Subject: Community development", "Subject: Re: Community development"},
+		},
+		{
+			comparisonType: "Test month without listing first from the existing mirror",
+			month:          december,
+			wantSubjects:   []string{"Subject: Principal Chief", "Subject: Bell community project"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src, err := NewSource(source.Config{BaseURL: inboxDir})
+			if err != nil {
+				t.Fatalf("Source failed: %v", err)
+			}
+			src.(*publicInboxSource).mirrorRoot = filepath.Join(rootDir, "mirror")
+			storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "publicinbox-Cherokee"}
+
+			if test.listFirst {
+				gotMonths, err := src.Months(ctx, "Cherokee", time.Date(1985, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(1986, 3, 1, 0, 0, 0, 0, time.UTC))
+				if err != nil {
+					t.Fatalf("Months failed: %v", err)
+				}
+				if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+					t.Errorf("Months do not match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+				}
+			}
+			if err = src.FetchMonth(ctx, storage, "Cherokee", test.month); err != nil {
+				t.Fatalf("FetchMonth failed: %v", err)
+			}
+
+			yearMonth := test.month.Format("2006-01")
+			stored, err := os.Open(filepath.Join(rootDir, "publicinbox-Cherokee", yearMonth+"-publicinbox-Cherokee.mbox.gz"))
+			if err != nil {
+				t.Fatalf("Stored month missing: %v", err)
+			}
+			defer stored.Close()
+			gz, err := gzip.NewReader(stored)
+			if err != nil {
+				t.Fatalf("Stored month not gzipped: %v", err)
+			}
+			mbox, _ := ioutil.ReadAll(gz)
+
+			var gotSubjects []string
+			for _, line := range strings.Split(string(mbox), "\n") {
+				if strings.HasPrefix(line, "Subject: ") {
+					gotSubjects = append(gotSubjects, line)
+				}
+			}
+			if !reflect.DeepEqual(gotSubjects, test.wantSubjects) {
+				t.Errorf("Messages do not match.\n got: %v\nwant: %v", gotSubjects, test.wantSubjects)
+			}
+			if test.month == january && !strings.Contains(string(mbox), "\n>>From the council") {
+				t.Errorf("Quoted From line missing in:\n%s", mbox)
+			}
+		})
+	}
+}
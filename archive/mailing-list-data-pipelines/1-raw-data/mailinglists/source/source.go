@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This package defines the contract each mailing list archive type implements and the registry used to find them by name.
+
+Source packages register a factory in init so adding an archive type only needs a blank import in main:
+
+	func init() {
+		source.Register("pipermail", NewSource)
+	}
+
+Load runs a source the same way for every archive type: it asks the source which months it has in the date range
+and fetches each month into storage.
+*/
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var (
+	unknownSourceErr = fmt.Errorf("unknown source")
+	sourceConfigErr  = fmt.Errorf("source config")
+	dateRangeErr     = fmt.Errorf("date range")
+	listMonthsErr    = fmt.Errorf("list months")
+)
+
+// Source loads one mailing list archive type into storage.
+type Source interface {
+	// Name of the archive type. It matches the -mailinglist flag and prefixes the subdirectory.
+	Name() string
+	// Groups the source can load. Sources without discovery return the configured groups.
+	ListGroups(ctx context.Context) (groupNames []string, err error)
+	// Months with archive content for the group from the start date up to the end date, as the 1st of each month.
+	Months(ctx context.Context, groupName string, startDate, endDate time.Time) (months []time.Time, err error)
+	// Fetch one month of the group and store it.
+	FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) (err error)
+}
+
+// Settings passed to a source factory. Empty http funcs are set to the live versions in utils.
+type Config struct {
+	// Archive host url. Sources use their default host when empty.
+	BaseURL string
+	// Google Groups organization path such as /a/[DOMAIN] or the Pony Mail list domain
+	Org string
+	// Groups to load when the source can't discover them
+	Groups []string
+	// Number of workers to use for goroutines
+	Workers int
+	// Load all dates instead of a limited timespan
+	AllDateRun bool
+	// Max http requests per second across the source. No limit when 0.
+	RateLimit    float64
+	HttpToDom    utils.HttpDomResponse
+	HttpToReader utils.HttpReaderResponse
+	HttpToString utils.HttpStringResponse
+	// Posts such as GraphQL queries, limited with the rest of the requests
+	HttpPostToReader utils.HttpPostResponse
+}
+
+// Func pointer to create a source from its config
+type Factory func(config Config) (Source, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Make a source available by name. Called from the source package init and panics on duplicates like database/sql.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("source: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("source: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Names of the registered sources in sorted order.
+func Names() (names []string) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Create the registered source by name.
+func New(name string, config Config) (src Source, err error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		err = fmt.Errorf("%w %s is not an option. Registered sources are %v.", unknownSourceErr, name, Names())
+		return
+	}
+	if src, err = factory(config.withDefaults()); err != nil {
+		err = fmt.Errorf("%w for %s: %v", sourceConfigErr, name, err)
+	}
+	return
+}
+
+// Fill in the live http funcs and a worker count when they are not set.
+func (config Config) withDefaults() Config {
+	if config.HttpToDom == nil {
+		config.HttpToDom = utils.DomResponse
+	}
+	if config.HttpToReader == nil {
+		config.HttpToReader = utils.ReaderResponse
+	}
+	if config.HttpToString == nil {
+		config.HttpToString = utils.StringResponse
+	}
+	if config.HttpPostToReader == nil {
+		config.HttpPostToReader = utils.PostResponse
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.RateLimit > 0 {
+		config = config.withRateLimit(newLimiter(config.RateLimit))
+	}
+	return config
+}
+
+// Wrap the http funcs so every request waits its turn on the limiter.
+func (config Config) withRateLimit(limit *limiter) Config {
+	httpToDom, httpToReader, httpToString, httpPostToReader := config.HttpToDom, config.HttpToReader, config.HttpToString, config.HttpPostToReader
+
+	config.HttpToDom = func(url string) (*goquery.Document, error) {
+		limit.wait()
+		return httpToDom(url)
+	}
+	config.HttpToReader = func(url string, requestHeader http.Header) (io.ReadCloser, http.Header, error) {
+		limit.wait()
+		return httpToReader(url, requestHeader)
+	}
+	config.HttpToString = func(url string) (string, error) {
+		limit.wait()
+		return httpToString(url)
+	}
+	config.HttpPostToReader = func(url string, requestHeader http.Header, payload []byte) (io.ReadCloser, http.Header, error) {
+		limit.wait()
+		return httpPostToReader(url, requestHeader, payload)
+	}
+	return config
+}
+
+// Spaces requests evenly at the rate. Safe to share across worker goroutines.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSecond float64) *limiter {
+	return &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Block until the next request slot.
+func (limit *limiter) wait() {
+	limit.mu.Lock()
+	now := time.Now()
+	if limit.next.Before(now) {
+		limit.next = now
+	}
+	delay := limit.next.Sub(now)
+	limit.next = limit.next.Add(limit.interval)
+	limit.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Months from the start date up to the end date as the 1st of each month. The month of the end date is included when it is past the 1st.
+func MonthRange(startDate, endDate time.Time) (months []time.Time) {
+	month := time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for month.Before(endDate) {
+		months = append(months, month)
+		month = month.AddDate(0, 1, 0)
+	}
+	return
+}
+
+// Load the group for the date range by fetching each month the source has into storage.
+func Load(ctx context.Context, src Source, storage gcs.Connection, groupName, startDateString, endDateString string) (err error) {
+	var (
+		startDate, endDate time.Time
+		months             []time.Time
+	)
+
+	if startDate, err = utils.GetDateTimeType(startDateString); err != nil {
+		return fmt.Errorf("%w start date: %v", dateRangeErr, err)
+	}
+	if endDate, err = utils.GetDateTimeType(endDateString); err != nil {
+		return fmt.Errorf("%w end date: %v", dateRangeErr, err)
+	}
+	if !startDate.Before(endDate) {
+		return fmt.Errorf("%w start date %s is not before end date %s", dateRangeErr, startDateString, endDateString)
+	}
+
+	log.Printf("%s loading %s:", src.Name(), groupName)
+	if months, err = src.Months(ctx, groupName, startDate, endDate); err != nil {
+		return fmt.Errorf("%w for %s: %v", listMonthsErr, groupName, err)
+	}
+	for _, month := range months {
+		if err = src.FetchMonth(ctx, storage, groupName, month); err != nil {
+			// Wrap the source error so callers can check it
+			return fmt.Errorf("fetch month %s for %s: %w", month.Format("2006-01"), groupName, err)
+		}
+	}
+	return
+}
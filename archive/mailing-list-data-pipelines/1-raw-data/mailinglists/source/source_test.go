@@ -0,0 +1,275 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
+	"github.com/google/project-OCEAN/1-raw-data/utils"
+)
+
+var fakeFetchErr = fmt.Errorf("fake fetch")
+
+// Source that records the months it is asked to fetch
+type fakeSource struct {
+	config  Config
+	fetched []string
+}
+
+func (fake *fakeSource) Name() string { return "fake" }
+
+func (fake *fakeSource) ListGroups(ctx context.Context) ([]string, error) {
+	return fake.config.Groups, nil
+}
+
+func (fake *fakeSource) Months(ctx context.Context, groupName string, startDate, endDate time.Time) ([]time.Time, error) {
+	return MonthRange(startDate, endDate), nil
+}
+
+func (fake *fakeSource) FetchMonth(ctx context.Context, storage gcs.Connection, groupName string, month time.Time) error {
+	if groupName == "Wilma-Mankiller" && month.Month() == time.February {
+		return fakeFetchErr
+	}
+	fake.fetched = append(fake.fetched, month.Format("2006-01"))
+	return nil
+}
+
+func init() {
+	Register("fake", func(config Config) (Source, error) {
+		if config.BaseURL == "bad" {
+			return nil, fmt.Errorf("bad base url")
+		}
+		return &fakeSource{config: config}, nil
+	})
+}
+
+func TestNew(t *testing.T) {
+	var (
+		gotSrc Source
+		gotErr error
+	)
+
+	tests := []struct {
+		comparisonType string
+		name           string
+		config         Config
+		wantWorkers    int
+		wantErr        error
+	}{
+		{
+			comparisonType: "Registered source gets defaults",
+			name:           "fake",
+			config:         Config{Groups: []string{"Cherokee-Nation"}},
+			wantWorkers:    1,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Unknown source",
+			name:           "Sequoyah",
+			wantErr:        unknownSourceErr,
+		},
+		{
+			comparisonType: "Factory error",
+			name:           "fake",
+			config:         Config{BaseURL: "bad"},
+			wantErr:        sourceConfigErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if gotSrc, gotErr = New(test.name, test.config); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotErr == nil {
+				fake := gotSrc.(*fakeSource)
+				if fake.config.Workers != test.wantWorkers {
+					t.Errorf("Workers do not match.\n got: %d\nwant: %d", fake.config.Workers, test.wantWorkers)
+				}
+				if fake.config.HttpToDom == nil || fake.config.HttpToReader == nil || fake.config.HttpToString == nil || fake.config.HttpPostToReader == nil {
+					t.Errorf("Http funcs not set to defaults.")
+				}
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	found := false
+	for _, name := range Names() {
+		if name == "fake" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Registered source missing from names: %v", Names())
+	}
+}
+
+func TestMonthRange(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		startDate      string
+		endDate        string
+		wantMonths     []string
+	}{
+		{
+			comparisonType: "End date on the 1st excludes its month",
+			startDate:      "1985-12-14",
+			endDate:        "1986-03-01",
+			wantMonths:     []string{"1985-12", "1986-01", "1986-02"},
+		},
+		{
+			comparisonType: "End date past the 1st includes its month",
+			startDate:      "1985-12-01",
+			endDate:        "1986-01-02",
+			wantMonths:     []string{"1985-12", "1986-01"},
+		},
+		{
+			comparisonType: "Empty range",
+			startDate:      "1985-12-01",
+			endDate:        "1985-12-01",
+			wantMonths:     nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var gotMonths []string
+			startDate, _ := time.Parse("2006-01-02", test.startDate)
+			endDate, _ := time.Parse("2006-01-02", test.endDate)
+			for _, month := range MonthRange(startDate, endDate) {
+				gotMonths = append(gotMonths, month.Format("2006-01"))
+			}
+			if !reflect.DeepEqual(gotMonths, test.wantMonths) {
+				t.Errorf("Months do not match.\n got: %v\nwant: %v", gotMonths, test.wantMonths)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	storage := utils.NewFakeStorageConnection("source")
+
+	tests := []struct {
+		comparisonType string
+		groupName      string
+		startDate      string
+		endDate        string
+		wantFetched    []string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Fetch each month",
+			groupName:      "Cherokee-Nation",
+			startDate:      "1985-12-14",
+			endDate:        "1986-02-01",
+			wantFetched:    []string{"1985-12", "1986-01"},
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Start date not before end date",
+			groupName:      "Cherokee-Nation",
+			startDate:      "1986-02-01",
+			endDate:        "1985-12-14",
+			wantErr:        dateRangeErr,
+		},
+		{
+			comparisonType: "Bad date",
+			groupName:      "Cherokee-Nation",
+			startDate:      "Tahlequah",
+			endDate:        "1985-12-14",
+			wantErr:        dateRangeErr,
+		},
+		{
+			comparisonType: "Fetch error stops the load",
+			groupName:      "Wilma-Mankiller",
+			startDate:      "1986-01-01",
+			endDate:        "1986-04-01",
+			wantFetched:    []string{"1986-01"},
+			wantErr:        fakeFetchErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			src := &fakeSource{}
+			if gotErr := Load(ctx, src, storage, test.groupName, test.startDate, test.endDate); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Error response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if !reflect.DeepEqual(src.fetched, test.wantFetched) {
+				t.Errorf("Fetched months do not match.\n got: %v\nwant: %v", src.fetched, test.wantFetched)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		rateLimit      float64
+		requests       int
+		wantMinElapsed time.Duration
+	}{
+		{
+			comparisonType: "Requests spaced at the rate",
+			rateLimit:      100,
+			requests:       4,
+			wantMinElapsed: 30 * time.Millisecond,
+		},
+		{
+			comparisonType: "No limit",
+			rateLimit:      0,
+			requests:       4,
+			wantMinElapsed: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			config := Config{
+				RateLimit:    test.rateLimit,
+				HttpToString: utils.FakeHttpstringResponse,
+				HttpPostToReader: func(url string, requestHeader http.Header, payload []byte) (io.ReadCloser, http.Header, error) {
+					return ioutil.NopCloser(strings.NewReader("Menominee")), nil, nil
+				},
+			}.withDefaults()
+
+			// Gets and posts share the limit
+			start := time.Now()
+			for i := 0; i < test.requests; i++ {
+				var err error
+				if i%2 == 0 {
+					_, err = config.HttpToString("Ada-Deer")
+				} else {
+					_, _, err = config.HttpPostToReader("Ada-Deer", nil, nil)
+				}
+				if err != nil {
+					t.Errorf("Request error: %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < test.wantMinElapsed {
+				t.Errorf("Requests were not limited.\n got: %v\nwant at least: %v", elapsed, test.wantMinElapsed)
+			}
+		})
+	}
+}
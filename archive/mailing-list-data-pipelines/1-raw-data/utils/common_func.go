@@ -15,21 +15,38 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
 )
 
 var (
-	httpStrRespErr = fmt.Errorf("http string")
-	httpDomRespErr = fmt.Errorf("http dom")
-	dateFixErr     = fmt.Errorf("fix date")
-	dateParseErr   = fmt.Errorf("parse date")
-	splitMonthErr  = fmt.Errorf("split month")
+	httpStrRespErr     = fmt.Errorf("http string")
+	httpDomRespErr     = fmt.Errorf("http dom")
+	httpReadRespErr    = fmt.Errorf("http reader")
+	storeURLErr        = fmt.Errorf("store url")
+	notModifiedErr     = fmt.Errorf("not modified")
+	tooManyRequestsErr = fmt.Errorf("too many requests")
+	refreshErr         = fmt.Errorf("refresh")
+	dateFixErr         = fmt.Errorf("fix date")
+	dateParseErr       = fmt.Errorf("parse date")
+	splitMonthErr      = fmt.Errorf("split month")
+	storeAppendErr     = fmt.Errorf("store append")
 )
 
 //TODO - retry load if it fails
@@ -86,29 +103,312 @@ func DomResponse(url string) (dom *goquery.Document, err error) {
 	return
 }
 
+// Func pointer to create HTTP response body and return it as a stream with the response headers. Request headers allow conditional gets. Caller closes the reader.
+type HttpReaderResponse func(string, http.Header) (io.ReadCloser, http.Header, error)
+
+// Create HTTP response body and return it as a stream so large archives are not held in memory. Returns notModifiedErr for a 304 response
+// and tooManyRequestsErr for a 429 response. Responses that aren't ok come with their headers so callers can check rate limits.
+func ReaderResponse(url string, requestHeader http.Header) (body io.ReadCloser, header http.Header, err error) {
+	var request *http.Request
+
+	if request, err = http.NewRequest(http.MethodGet, url, nil); err != nil {
+		err = fmt.Errorf("%w request error: %v", httpReadRespErr, err)
+		return
+	}
+	return doReaderRequest(request, url, requestHeader)
+}
+
+// Func pointer to post the body and return the response body as a stream with the response headers. Caller closes the reader.
+type HttpPostResponse func(string, http.Header, []byte) (io.ReadCloser, http.Header, error)
+
+// Post the body and return the response body as a stream. Statuses are handled the same as ReaderResponse so posts that are
+// rate limited can be tried again the same way.
+func PostResponse(url string, requestHeader http.Header, payload []byte) (body io.ReadCloser, header http.Header, err error) {
+	var request *http.Request
+
+	if request, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(payload)); err != nil {
+		err = fmt.Errorf("%w request error: %v", httpReadRespErr, err)
+		return
+	}
+	return doReaderRequest(request, url, requestHeader)
+}
+
+// Send the request with the headers and return the body when the response is ok.
+func doReaderRequest(request *http.Request, url string, requestHeader http.Header) (body io.ReadCloser, header http.Header, err error) {
+	var response *http.Response
+
+	for name, values := range requestHeader {
+		request.Header[name] = values
+	}
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		err = fmt.Errorf("%w returned an error: %v", httpReadRespErr, err)
+		return
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, response.Header, nil
+	case http.StatusNotModified:
+		response.Body.Close()
+		return nil, response.Header, fmt.Errorf("%w: %s", notModifiedErr, url)
+	case http.StatusTooManyRequests:
+		response.Body.Close()
+		return nil, response.Header, fmt.Errorf("%w: %s", tooManyRequestsErr, url)
+	}
+	response.Body.Close()
+	header = response.Header
+	err = fmt.Errorf("%w returned status %s for url: %s", httpReadRespErr, response.Status, url)
+	return
+}
+
+// Check if the error is a rate limited response and how long it asked to wait with Retry-After in seconds or as a date.
+// The fallback is used when the response doesn't say.
+func RetryAfter(err error, header http.Header, fallback time.Duration) (wait time.Duration, limited bool) {
+	if !errors.Is(err, tooManyRequestsErr) {
+		return 0, false
+	}
+	retryAfter := header.Get("Retry-After")
+	if seconds, parseErr := strconv.Atoi(retryAfter); parseErr == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, parseErr := http.ParseTime(retryAfter); parseErr == nil {
+		if wait = time.Until(date); wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return fallback, true
+}
+
+// Fetch url content and stream it into storage. How existing files are handled depends on the storage refresh mode.
+// With changed, a conditional get uses the stored ETag and Last-Modified and the content checksum is compared before rewriting.
+// The url, fetch time and HTTP validators are added to the metadata for provenance.
+func StoreURL(ctx context.Context, storage gcs.Connection, httpToReader HttpReaderResponse, fileName, url string, meta gcs.ObjectMeta) (n int64, err error) {
+	var (
+		body                  io.ReadCloser
+		header, requestHeader http.Header
+		info                  gcs.ObjectInfo
+		exists                bool
+	)
+	mode, _ := storage.Refresh()
+
+	if info, exists, err = storage.Stat(ctx, fileName); err != nil {
+		err = fmt.Errorf("%w stat on %s: %v", storeURLErr, fileName, err)
+		return
+	}
+	if exists && mode == gcs.RefreshNever {
+		log.Printf("File %s already stored and skipped.", fileName)
+		return
+	}
+
+	requestHeader = http.Header{}
+	if exists && mode == gcs.RefreshChanged {
+		if etag := info.Metadata[gcs.MetaETag]; etag != "" {
+			requestHeader.Set("If-None-Match", etag)
+		}
+		if lastModified := info.Metadata[gcs.MetaLastModified]; lastModified != "" {
+			requestHeader.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	if body, header, err = httpToReader(url, requestHeader); err != nil {
+		if errors.Is(err, notModifiedErr) {
+			log.Printf("File %s not modified upstream and skipped.", fileName)
+			err = nil
+			return
+		}
+		err = fmt.Errorf("%w fetch on %s: %v", storeURLErr, url, err)
+		return
+	}
+	defer body.Close()
+
+	meta.SourceURL = url
+	meta.FetchedAt = time.Now()
+	meta.ETag = header.Get("ETag")
+	meta.LastModified = header.Get("Last-Modified")
+
+	if n, err = storeExisting(ctx, storage, fileName, body, meta, info, exists); err != nil {
+		err = fmt.Errorf("%w: %v", storeURLErr, err)
+	}
+	return
+}
+
+// Stream content into storage following the storage refresh mode for files that already exist.
+// Use when there is no upstream url to make a conditional get against.
+func StoreReader(ctx context.Context, storage gcs.Connection, fileName string, r io.Reader, meta gcs.ObjectMeta) (n int64, err error) {
+	var (
+		info   gcs.ObjectInfo
+		exists bool
+	)
+
+	if info, exists, err = storage.Stat(ctx, fileName); err != nil {
+		err = fmt.Errorf("%w stat on %s: %v", storeURLErr, fileName, err)
+		return
+	}
+	return storeExisting(ctx, storage, fileName, r, meta, info, exists)
+}
+
+// Stream what write produces into storage so the content is never held in memory. The store fails with the error
+// write returns. Waits for write to return so what it was using, such as a server connection, is free again.
+func StoreWriter(ctx context.Context, storage gcs.Connection, fileName string, meta gcs.ObjectMeta, write func(w io.Writer) error) (n int64, err error) {
+	r, w := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		w.CloseWithError(write(w))
+		close(written)
+	}()
+	n, err = StoreReader(ctx, storage, fileName, r, meta)
+	// Unblock the writer if storage returned before reading everything
+	r.Close()
+	<-written
+	return
+}
+
+// Add what write produces to the end of the stored file, or store it as a new file. The stored content is copied in
+// ahead of the new content so the file is replaced in one store. Files ending in .gz are unzipped and zipped again
+// around both, so write produces plain content. Only call it when there is something new to add.
+func StoreAppend(ctx context.Context, storage gcs.Connection, fileName string, meta gcs.ObjectMeta, write func(w io.Writer) error) (n int64, err error) {
+	var exists bool
+
+	if _, exists, err = storage.Stat(ctx, fileName); err != nil {
+		err = fmt.Errorf("%w stat on %s: %v", storeAppendErr, fileName, err)
+		return
+	}
+	meta.Overwrite = exists
+	return StoreWriter(ctx, storage, fileName, meta, func(w io.Writer) (err error) {
+		out := w
+		gzipped := strings.HasSuffix(fileName, ".gz")
+		gz := gzip.NewWriter(w)
+		if gzipped {
+			out = gz
+		}
+		if exists {
+			if err = copyStored(ctx, storage, fileName, gzipped, out); err != nil {
+				return
+			}
+		}
+		if err = write(out); err != nil {
+			return
+		}
+		if gzipped {
+			err = gz.Close()
+		}
+		return
+	})
+}
+
+// Copy the stored content of the file to w, unzipped when it is gzipped.
+func copyStored(ctx context.Context, storage gcs.Connection, fileName string, gzipped bool, w io.Writer) (err error) {
+	var (
+		stored io.ReadCloser
+		r      io.Reader
+	)
+
+	if stored, err = storage.Open(ctx, fileName); err != nil {
+		err = fmt.Errorf("%w open on %s: %v", storeAppendErr, fileName, err)
+		return
+	}
+	defer stored.Close()
+	r = stored
+	if gzipped {
+		if r, err = gzip.NewReader(stored); err != nil {
+			err = fmt.Errorf("%w unzip on %s: %v", storeAppendErr, fileName, err)
+			return
+		}
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		err = fmt.Errorf("%w copy of %s: %v", storeAppendErr, fileName, err)
+	}
+	return
+}
+
+// Write the message as an mboxrd entry after its From line. Lines that start with From after any > get one more >.
+func WriteMboxEntry(w io.Writer, fromLine, msg string) (err error) {
+	var sb strings.Builder
+
+	sb.WriteString(fromLine + "\n")
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			sb.WriteString(">")
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString("\n")
+	_, err = io.WriteString(w, sb.String())
+	return
+}
+
+// Store new files and decide if an existing file is rewritten. Files the caller asked to overwrite are always rewritten.
+// With changed, the content is spooled to a temp file to compare its SHA-256 to the stored checksum so unchanged
+// content is not rewritten.
+func storeExisting(ctx context.Context, storage gcs.Connection, fileName string, r io.Reader, meta gcs.ObjectMeta, info gcs.ObjectInfo, exists bool) (n int64, err error) {
+	var (
+		tmpFile *os.File
+		sum     string
+	)
+
+	if !exists || meta.Overwrite {
+		return storage.Store(ctx, fileName, r, meta)
+	}
+
+	switch mode, _ := storage.Refresh(); mode {
+	case gcs.RefreshAlways:
+		meta.Overwrite = true
+		return storage.Store(ctx, fileName, r, meta)
+	case gcs.RefreshChanged:
+		if tmpFile, err = ioutil.TempFile("", "ocean-refresh-"); err != nil {
+			err = fmt.Errorf("%w temp file error: %v", refreshErr, err)
+			return
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		contentHash := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(tmpFile, contentHash), r); err != nil {
+			err = fmt.Errorf("%w reading content for %s: %v", refreshErr, fileName, err)
+			return
+		}
+		if sum = hex.EncodeToString(contentHash.Sum(nil)); sum == info.Metadata[gcs.MetaSHA256] {
+			log.Printf("File %s content unchanged and skipped.", fileName)
+			return
+		}
+		if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+			err = fmt.Errorf("%w temp file error: %v", refreshErr, err)
+			return
+		}
+		log.Printf("File %s changed upstream and is being refreshed.", fileName)
+		meta.Overwrite = true
+		return storage.Store(ctx, fileName, tmpFile, meta)
+	}
+	log.Printf("File %s already stored and skipped.", fileName)
+	return
+}
+
 //Add subdirectory and date to filename
 func CreateFileName(mailingList, groupName, date string) (newFileName string, err error) {
+	return CreateSubDirFileName(mailingList, fmt.Sprintf("%s-%s", mailingList, groupName), date)
+}
+
+// Add the date to the filename stored in the subdirectory, for lists with a subdirectory other than [SOURCE]-[GROUP].
+func CreateSubDirFileName(mailingList, subDirectory, date string) (newFileName string, err error) {
 	var (
-		subDirFinal, fileType string
-		fileDate              time.Time
+		fileType string
+		fileDate time.Time
 	)
 
 	switch mailingList {
-	case "gg":
+	case "gg", "ggfeed":
 		fileType = "txt"
-	case "mailman":
+	case "discourse", "github", "groupsio", "imap", "import", "mailman", "mhonarc", "nntp", "ponymail", "publicinbox":
 		fileType = "mbox.gz"
 	case "pipermail":
 		fileType = "txt.gz"
 	}
 
-	subDirFinal = fmt.Sprintf("%s-%s", mailingList, groupName)
-
 	if fileDate, err = GetDateTimeType(date); err != nil {
 		err = fmt.Errorf("Start date in Common Func error: %v", err)
 	}
 
-	newFileName = fmt.Sprintf("%s/%04d-%02d-%s.%s", subDirFinal, fileDate.Year(), int(fileDate.Month()), subDirFinal, fileType)
+	newFileName = fmt.Sprintf("%s/%04d-%02d-%s.%s", subDirectory, fileDate.Year(), int(fileDate.Month()), subDirectory, fileType)
 	return
 }
 
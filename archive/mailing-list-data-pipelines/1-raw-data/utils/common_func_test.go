@@ -15,10 +15,21 @@
 package utils
 
 import (
+	"compress/gzip"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/project-OCEAN/1-raw-data/gcs"
 )
 
 func TestCreateFileName(t *testing.T) {
@@ -70,6 +81,77 @@ func TestCreateFileName(t *testing.T) {
 	}
 }
 
+func TestCreateSubDirFileName(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		mailingList    string
+		subDirectory   string
+		date           string
+		wantName       string
+	}{
+		{
+			comparisonType: "Custom subdirectory",
+			mailingList:    "mailman",
+			subDirectory:   "python-dev-archive",
+			date:           "1999-04-01",
+			wantName:       "python-dev-archive/1999-04-python-dev-archive.mbox.gz",
+		},
+		{
+			comparisonType: "Default subdirectory",
+			mailingList:    "pipermail",
+			subDirectory:   "pipermail-environmentalist",
+			date:           "1989-08-07",
+			wantName:       "pipermail-environmentalist/1989-08-pipermail-environmentalist.txt.gz",
+		},
+		{
+			comparisonType: "Google Groups feed subdirectory",
+			mailingList:    "ggfeed",
+			subDirectory:   "ggfeed-Liliuokalani",
+			date:           "1893-01-17",
+			wantName:       "ggfeed-Liliuokalani/1893-01-ggfeed-Liliuokalani.txt",
+		},
+		{
+			comparisonType: "Newsgroup subdirectory",
+			mailingList:    "nntp",
+			subDirectory:   "nntp-gmane.culture.haudenosaunee",
+			date:           "1779-06-20",
+			wantName:       "nntp-gmane.culture.haudenosaunee/1779-06-nntp-gmane.culture.haudenosaunee.mbox.gz",
+		},
+		{
+			comparisonType: "Groups.io subdirectory",
+			mailingList:    "groupsio",
+			subDirectory:   "groupsio-wiigwaas",
+			date:           "1850-04-02",
+			wantName:       "groupsio-wiigwaas/1850-04-groupsio-wiigwaas.mbox.gz",
+		},
+		{
+			comparisonType: "Mail folder subdirectory",
+			mailingList:    "imap",
+			subDirectory:   "imap-cherokee",
+			date:           "1821-06-03",
+			wantName:       "imap-cherokee/1821-06-imap-cherokee.mbox.gz",
+		},
+		{
+			comparisonType: "Imported dump subdirectory",
+			mailingList:    "import",
+			subDirectory:   "shawnee",
+			date:           "1810-08-20",
+			wantName:       "shawnee/1810-08-shawnee.mbox.gz",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotName, gotErr := CreateSubDirFileName(test.mailingList, test.subDirectory, test.date)
+			if gotErr != nil {
+				t.Fatalf("Unexpected error: %v", gotErr)
+			}
+			if gotName != test.wantName {
+				t.Errorf("Filename doesn't match.\n got: %v\nwant: %v", gotName, test.wantName)
+			}
+		})
+	}
+}
+
 func TestFixDates(t *testing.T) {
 	// Test passing in empty start, empty date, same date, start older than end, not a string
 	currentDate := time.Now()
@@ -303,3 +385,455 @@ func TestSplitDatesByMonth(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/busy" {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("ETag", `"Cliff-Palace"`)
+		if r.Header.Get("If-None-Match") == `"Cliff-Palace"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "Ancestral Puebloans built Mesa Verde.")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		url            string
+		header         http.Header
+		wantContent    string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test response body is streamed",
+			url:            server.URL + "/mesa-verde",
+			wantContent:    "Ancestral Puebloans built Mesa Verde.",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test conditional get not modified",
+			url:            server.URL + "/mesa-verde",
+			header:         http.Header{"If-None-Match": {`"Cliff-Palace"`}},
+			wantErr:        notModifiedErr,
+		},
+		{
+			comparisonType: "Test status not ok returns error",
+			url:            server.URL + "/missing",
+			wantErr:        httpReadRespErr,
+		},
+		{
+			comparisonType: "Test rate limited response returns error",
+			url:            server.URL + "/busy",
+			wantErr:        tooManyRequestsErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotBody, _, gotErr := ReaderResponse(test.url, test.header)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Fatalf("ReaderResponse error does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotBody != nil {
+				defer gotBody.Close()
+				gotContent, _ := ioutil.ReadAll(gotBody)
+				if strings.Compare(string(gotContent), test.wantContent) != 0 {
+					t.Errorf("ReaderResponse content does not match.\n got: %v\nwant: %v", string(gotContent), test.wantContent)
+				}
+			}
+		})
+	}
+}
+
+func TestPostResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/busy" {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		payload, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Content-Type"), payload)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		url            string
+		wantContent    string
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test payload and headers are posted",
+			url:            server.URL + "/chaco",
+			wantContent:    `application/json {"canyon":"Chaco"}`,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test rate limited post returns error",
+			url:            server.URL + "/busy",
+			wantErr:        tooManyRequestsErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotBody, _, gotErr := PostResponse(test.url, http.Header{"Content-Type": {"application/json"}}, []byte(`{"canyon":"Chaco"}`))
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Fatalf("PostResponse error does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			if gotBody != nil {
+				defer gotBody.Close()
+				gotContent, _ := ioutil.ReadAll(gotBody)
+				if string(gotContent) != test.wantContent {
+					t.Errorf("PostResponse content does not match.\n got: %v\nwant: %v", string(gotContent), test.wantContent)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		err            error
+		header         http.Header
+		wantWait       time.Duration
+		wantLimited    bool
+	}{
+		{
+			comparisonType: "Test wait in seconds",
+			err:            fmt.Errorf("%w: http://chaco.org", tooManyRequestsErr),
+			header:         http.Header{"Retry-After": {"120"}},
+			wantWait:       2 * time.Minute,
+			wantLimited:    true,
+		},
+		{
+			comparisonType: "Test date in the past waits nothing",
+			err:            tooManyRequestsErr,
+			header:         http.Header{"Retry-After": {"Wed, 21 Oct 1150 07:28:00 GMT"}},
+			wantLimited:    true,
+		},
+		{
+			comparisonType: "Test fallback without a header",
+			err:            tooManyRequestsErr,
+			header:         http.Header{},
+			wantWait:       time.Minute,
+			wantLimited:    true,
+		},
+		{
+			comparisonType: "Test other errors are not rate limited",
+			err:            httpReadRespErr,
+			header:         http.Header{"Retry-After": {"120"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			gotWait, gotLimited := RetryAfter(test.err, test.header, time.Minute)
+			if gotWait != test.wantWait || gotLimited != test.wantLimited {
+				t.Errorf("RetryAfter does not match.\n got: %v %v\nwant: %v %v", gotWait, gotLimited, test.wantWait, test.wantLimited)
+			}
+		})
+	}
+}
+
+func TestStoreURL(t *testing.T) {
+	ctx := context.Background()
+	storage := NewFakeStorageConnection("utils")
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		url            string
+		wantStored     bool
+		wantErr        error
+	}{
+		{
+			comparisonType: "Test url content is stored",
+			fileName:       "1050-01.mbox.gz",
+			url:            "https://en.wikipedia.org/wiki/Pine_Leaf",
+			wantStored:     true,
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test existing file is skipped without fetching",
+			fileName:       "1050-02-existing.mbox.gz",
+			url:            "https://en.wikipedia.org/wiki/Cahokia",
+			wantErr:        nil,
+		},
+		{
+			comparisonType: "Test fetch error",
+			fileName:       "1050-03.mbox.gz",
+			url:            "https://en.wikipedia.org/wiki/Cahokia",
+			wantErr:        storeURLErr,
+		},
+		{
+			comparisonType: "Test storage error",
+			fileName:       "1050-04.mbox.gz",
+			url:            "https://en.wikipedia.org/wiki/Susan_La_Flesche_Picotte",
+			wantStored:     true,
+			wantErr:        storeURLErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			if _, gotErr := StoreURL(ctx, storage, FakeHttpReaderResponse, test.fileName, test.url, gcs.ObjectMeta{MailingList: "pipermail", GroupName: "Pine-Leaf"}); !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("StoreURL response does not match.\n got: %v\nwant: %v", gotErr, test.wantErr)
+			}
+			gotMeta, gotStored := storage.StoredMeta[test.fileName]
+			if gotStored != test.wantStored {
+				t.Errorf("StoreURL store call does not match.\n got: %v\nwant: %v", gotStored, test.wantStored)
+			}
+			if gotStored {
+				if gotMeta.SourceURL != test.url || gotMeta.GroupName != "Pine-Leaf" || gotMeta.ETag != `"Monks-Mound"` || gotMeta.FetchedAt.IsZero() {
+					t.Errorf("StoreURL provenance does not match.\n got: %+v\nwant source url: %v", gotMeta, test.url)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreURLRefresh(t *testing.T) {
+	ctx := context.Background()
+	rootDir, err := ioutil.TempDir("", "ocean-utils")
+	if err != nil {
+		t.Fatalf("Temp directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "pipermail-Mesa-Verde"}
+	storedPath := filepath.Join(rootDir, "pipermail-Mesa-Verde", "1190-01-pipermail-Mesa-Verde.txt.gz")
+
+	// Upstream content and validators change between test cases
+	content, etag, requests := "", "", 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		comparisonType string
+		mode           gcs.RefreshMode
+		content        string
+		etag           string
+		wantContent    string
+		wantRequests   int
+	}{
+		{
+			comparisonType: "Test new file is stored",
+			mode:           gcs.RefreshNever,
+			content:        "Cliff Palace",
+			etag:           `"v1"`,
+			wantContent:    "Cliff Palace",
+			wantRequests:   1,
+		},
+		{
+			comparisonType: "Test never skips existing file without fetching",
+			mode:           gcs.RefreshNever,
+			content:        "Balcony House",
+			etag:           `"v2"`,
+			wantContent:    "Cliff Palace",
+			wantRequests:   0,
+		},
+		{
+			comparisonType: "Test changed skips file not modified upstream",
+			mode:           gcs.RefreshChanged,
+			content:        "Cliff Palace",
+			etag:           `"v1"`,
+			wantContent:    "Cliff Palace",
+			wantRequests:   1,
+		},
+		{
+			comparisonType: "Test changed rewrites file modified upstream",
+			mode:           gcs.RefreshChanged,
+			content:        "Balcony House",
+			etag:           `"v2"`,
+			wantContent:    "Balcony House",
+			wantRequests:   1,
+		},
+		{
+			comparisonType: "Test changed compares checksum without validators",
+			mode:           gcs.RefreshChanged,
+			content:        "Spruce Tree House",
+			etag:           "",
+			wantContent:    "Spruce Tree House",
+			wantRequests:   1,
+		},
+		{
+			comparisonType: "Test always rewrites file",
+			mode:           gcs.RefreshAlways,
+			content:        "Long House",
+			etag:           `"v2"`,
+			wantContent:    "Long House",
+			wantRequests:   1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			content, etag, requests = test.content, test.etag, 0
+			storage.SetRefresh(test.mode, false)
+			if _, err := StoreURL(ctx, storage, ReaderResponse, "1190-01.txt.gz", server.URL, gcs.ObjectMeta{}); err != nil {
+				t.Fatalf("StoreURL error: %v", err)
+			}
+			if gotContent, _ := ioutil.ReadFile(storedPath); strings.Compare(string(gotContent), test.wantContent) != 0 {
+				t.Errorf("Stored content does not match.\n got: %v\nwant: %v", string(gotContent), test.wantContent)
+			}
+			if requests != test.wantRequests {
+				t.Errorf("Upstream requests do not match.\n got: %v\nwant: %v", requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestWriteMboxEntry(t *testing.T) {
+	tests := []struct {
+		comparisonType string
+		msg            string
+		wantEntry      string
+	}{
+		{
+			comparisonType: "Test message without From lines",
+			msg:            "Subject: Cliff Palace\n\nBuilt from sandstone.\n\n\n",
+			wantEntry:      "From mesa@verde.org Mon Jan  2 15:04:05 1190\nSubject: Cliff Palace\n\nBuilt from sandstone.\n\n",
+		},
+		{
+			comparisonType: "Test From lines in the body get one more >",
+			msg:            "Subject: Spruce Tree House\n\nFrom the canyon rim.\n>From the alcove.\nFromage",
+			wantEntry:      "From mesa@verde.org Mon Jan  2 15:04:05 1190\nSubject: Spruce Tree House\n\n>From the canyon rim.\n>>From the alcove.\nFromage\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			var sb strings.Builder
+			if err := WriteMboxEntry(&sb, "From mesa@verde.org Mon Jan  2 15:04:05 1190", test.msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sb.String() != test.wantEntry {
+				t.Errorf("Entry does not match.\n got: %q\nwant: %q", sb.String(), test.wantEntry)
+			}
+		})
+	}
+}
+
+func TestStoreWriter(t *testing.T) {
+	ctx := context.Background()
+	rootDir, err := ioutil.TempDir("", "ocean-utils")
+	if err != nil {
+		t.Fatalf("Temp directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "mbox-Mesa-Verde"}
+	writeErr := errors.New("Balcony House")
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		write          func(w io.Writer) error
+		wantStored     bool
+		wantErr        bool
+	}{
+		{
+			comparisonType: "Test written content is stored",
+			fileName:       "1190-01.mbox",
+			write: func(w io.Writer) error {
+				_, err := io.WriteString(w, "Long House")
+				return err
+			},
+			wantStored: true,
+		},
+		{
+			comparisonType: "Test write error stops the store",
+			fileName:       "1190-02.mbox",
+			write: func(w io.Writer) error {
+				io.WriteString(w, "Square Tower House")
+				return writeErr
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			_, gotErr := StoreWriter(ctx, storage, test.fileName, gcs.ObjectMeta{}, test.write)
+			if (gotErr != nil) != test.wantErr {
+				t.Errorf("Error does not match.\n got: %v\nwant error: %v", gotErr, test.wantErr)
+			}
+			_, gotStored, _ := storage.Stat(ctx, test.fileName)
+			if gotStored != test.wantStored {
+				t.Errorf("Stored does not match.\n got: %v\nwant: %v", gotStored, test.wantStored)
+			}
+		})
+	}
+}
+
+func TestStoreAppend(t *testing.T) {
+	ctx := context.Background()
+	rootDir, err := ioutil.TempDir("", "ocean-utils")
+	if err != nil {
+		t.Fatalf("Temp directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage := &gcs.FileConnection{RootDir: rootDir, SubDirectory: "mbox-Mesa-Verde"}
+	storage.SetRefresh(gcs.RefreshNever, false)
+
+	tests := []struct {
+		comparisonType string
+		fileName       string
+		wantContent    string
+	}{
+		{
+			comparisonType: "Test content is appended to a plain file",
+			fileName:       "1190-01.mbox",
+			wantContent:    "Cliff Palace\nSpruce Tree House\n",
+		},
+		{
+			comparisonType: "Test content is appended inside a gzipped file",
+			fileName:       "1190-02.mbox.gz",
+			wantContent:    "Cliff Palace\nSpruce Tree House\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.comparisonType, func(t *testing.T) {
+			for _, line := range []string{"Cliff Palace\n", "Spruce Tree House\n"} {
+				if _, err := StoreAppend(ctx, storage, test.fileName, gcs.ObjectMeta{}, func(w io.Writer) error {
+					_, err := io.WriteString(w, line)
+					return err
+				}); err != nil {
+					t.Fatalf("StoreAppend error: %v", err)
+				}
+			}
+			stored, err := storage.Open(ctx, test.fileName)
+			if err != nil {
+				t.Fatalf("Open error: %v", err)
+			}
+			defer stored.Close()
+			var r io.Reader = stored
+			if strings.HasSuffix(test.fileName, ".gz") {
+				if r, err = gzip.NewReader(stored); err != nil {
+					t.Fatalf("Stored file not gzipped: %v", err)
+				}
+			}
+			if gotContent, _ := ioutil.ReadAll(r); string(gotContent) != test.wantContent {
+				t.Errorf("Content does not match.\n got: %q\nwant: %q", string(gotContent), test.wantContent)
+			}
+		})
+	}
+}
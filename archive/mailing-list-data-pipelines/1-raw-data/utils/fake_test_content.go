@@ -15,10 +15,16 @@
 package utils
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/google/project-OCEAN/1-raw-data/gcs"
@@ -29,6 +35,9 @@ type FakeStorageConnection struct {
 	gcs.StorageConnection
 	ProjectID  string
 	BucketName string
+	// Metadata passed to Store by filename
+	StoredMeta map[string]gcs.ObjectMeta
+	mu         sync.Mutex
 }
 
 // Create new fake StorageConnection object for tests based on the test being run
@@ -49,8 +58,48 @@ func (gcs *FakeStorageConnection) CheckFileExists(ctx context.Context, fileName
 	return true
 }
 
-// Simulate StoreGCS
-func (gcs *FakeStorageConnection) StoreContentInBucket(ctx context.Context, fileName, content, source string) (testVerifyCopyCalled int64, err error) {
+// Simulate ListExisting
+func (fake *FakeStorageConnection) ListExisting(ctx context.Context, subDirectory string) (existing map[string]gcs.ObjectInfo, err error) {
+	existing = make(map[string]gcs.ObjectInfo)
+	if strings.Contains(subDirectory, "environmentalist") {
+		return
+	}
+	fileName := fmt.Sprintf("%s/1851-10-%s.txt.gz", subDirectory, subDirectory)
+	existing[fileName] = gcs.ObjectInfo{Name: fileName}
+	return
+}
+
+// Simulate Stat
+func (fake *FakeStorageConnection) Stat(ctx context.Context, fileName string) (info gcs.ObjectInfo, exists bool, err error) {
+	if strings.Contains(fileName, "existing") {
+		return gcs.ObjectInfo{Name: fileName}, true, nil
+	}
+	return
+}
+
+// Simulate Open. Existing files return their filename as the content.
+func (fake *FakeStorageConnection) Open(ctx context.Context, fileName string) (r io.ReadCloser, err error) {
+	if strings.Contains(fileName, "existing") {
+		return ioutil.NopCloser(strings.NewReader(fileName)), nil
+	}
+	return nil, fmt.Errorf("%s", "Open")
+}
+
+// Simulate Store
+func (fake *FakeStorageConnection) Store(ctx context.Context, fileName string, r io.Reader, meta gcs.ObjectMeta) (testVerifyCopyCalled int64, err error) {
+	var contentBytes []byte
+
+	if contentBytes, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	content := string(contentBytes)
+
+	fake.mu.Lock()
+	if fake.StoredMeta == nil {
+		fake.StoredMeta = make(map[string]gcs.ObjectMeta)
+	}
+	fake.StoredMeta[fileName] = meta
+	fake.mu.Unlock()
 
 	if strings.Contains(content, "Leaf") {
 		return
@@ -70,73 +119,21 @@ func FakeHttpstringResponse(url string) (responseString string, err error) {
 	return
 }
 
+// Mock creating HTTP response body and return the url as the streamed content for tests
+func FakeHttpReaderResponse(url string, requestHeader http.Header) (body io.ReadCloser, header http.Header, err error) {
+	if strings.Contains(url, "Cahokia") {
+		err = fmt.Errorf("%s", "HTTP")
+		return
+	}
+	header = http.Header{"Etag": {`"Monks-Mound"`}, "Last-Modified": {"Mon, 02 Jan 1050 15:04:05 GMT"}}
+	return ioutil.NopCloser(strings.NewReader(url)), header, nil
+}
+
 // Mock creating HTTP response body and return as a dom for tests
 func FakeHttpDomResponse(url string) (dom *goquery.Document, err error) {
 	var exDomResponse string
 
 	switch url {
-	case "https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopics100":
-		exDomResponse = `
-				<html>
-				<head>
-					<title>My document</title>
-				</head>
-					<i>Showing 1-100 of 100 topics</i>
-				</html>
-		`
-	case "https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopicsLess":
-		exDomResponse = `
-				<html>
-				<head>
-					<title>My document</title>
-				</head>
-					<i>Showing 1-1 of 1 topics</i>
-				</html>
-		`
-	case "https://groups.google.com/forum/?_escaped_fragment_=forum/totalTopicsMissBody":
-		exDomResponse = `
-				<html>
-				<head>
-					<title>My document</title>
-				</head>
-				</html>
-		`
-	case "topicIDToRawMsgUrlMapTime":
-		exDomResponse = `
-			<html>
-			<table>
-			<tr><td class="subject"><a href="https://groups.google.com/d/topic/golang-checkins/8sv65_WCOS4" title="[tools] internal/lsp/cache: use gopls.mod for the workspace module if it exists">[tools] internal/lsp/cache: use gopls.mod for the workspace module if it exists</a></td><td class="lastPostDate">11:20 AM</td></tr>
-			</table>
-			</html>
-	`
-	case "topicIDToRawMsgUrlMapDate":
-		exDomResponse = `
-			<html>
-			<table>
-			<tr><td class="subject"><a href="https://groups.google.com/d/topic/golang-checkins/8sv65_WCOS4" title="[tools] internal/lsp/cache: use gopls.mod for the workspace module if it exists">[tools] internal/lsp/cache: use gopls.mod for the workspace module if it exists</a></td><td class="lastPostDate">9/27/18</td></tr>
-			</table>
-			</html>
-	`
-	case "abuseHiddenMsg":
-		exDomResponse = `
-			<html>
-			<table>
-			<tr><td class="subject"><a href="https://groups.google.com/d/topic/golang-checkins/8sv65_WCOS4" title="This topic has been hidden because it was flagged for abuse."><i>This topic has been hidden because it was flagged for abuse</i></a></td></tr>
-			</table>
-			</html>
-	`
-	case "msgIdsFromDom":
-		exDomResponse = `
-				<html>
-				<table>
-				<tr>
-				<td class="subject"><a href="https://en.wikipedia.org/wiki/Lili%CA%BBuokalani/d/msg/queen/Kamakaʻeha/1891">Lydia Liliʻu Loloku Walania Kamakaʻeha</a></td>
-				</tr>
-				</table>
-				</html>
-		`
-	case "rawMsgUrlWorker":
-		exDomResponse = `<a href="https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"></a>`
 	case "https://mail.python.org/pipermail/Pine-Leaf/":
 		exDomResponse = `
 			<html>
@@ -157,18 +154,42 @@ func FakeHttpDomResponse(url string) (dom *goquery.Document, err error) {
 	return goquery.NewDocumentFromReader(strings.NewReader(exDomResponse))
 }
 
-// Mock creating raw message url map from topic ids for tests on Google Groups mailing list load
-func FakeTopicIDToRawMsgUrlMap(org, groupName string, startDateTime, endDateTime time.Time, dom *goquery.Document) (rawMsgUrlMap map[string][]string, err error) {
-	switch groupName {
-	case "totalTopicsLess":
-		rawMsgUrlMap = map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}}
-	case "totalTopics100":
-		rawMsgUrlMap = map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}}
-		for i := 0; i < 100; i++ {
-			rawMsgUrlMap["1893-01.txt"] = append(rawMsgUrlMap["1893-01.txt"], "https://en.wikipedia.org/wiki/Lili%CA%BBuokalani")
+// Read the gzipped mbox files stored in a local storage directory and return the lines of each that start with one
+// of the prefixes by filename.
+func StoredMboxLines(dir string, prefixes ...string) (lines map[string][]string, err error) {
+	var (
+		files  []os.FileInfo
+		stored *os.File
+		gz     *gzip.Reader
+		mbox   []byte
+	)
+
+	lines = make(map[string][]string)
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".mbox.gz") {
+			continue
+		}
+		if stored, err = os.Open(filepath.Join(dir, file.Name())); err != nil {
+			return
+		}
+		if gz, err = gzip.NewReader(stored); err == nil {
+			mbox, err = ioutil.ReadAll(gz)
+		}
+		stored.Close()
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(mbox), "\n") {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(line, prefix) {
+					lines[file.Name()] = append(lines[file.Name()], line)
+					break
+				}
+			}
 		}
-	case "":
-		rawMsgUrlMap = map[string][]string{"1893-01.txt": []string{"https://en.wikipedia.org/wiki/Lili%CA%BBuokalani"}}
 	}
 	return
 }
@@ -33,6 +33,8 @@ from google.api_core.exceptions import BadRequest
 
 ALLOWED_FIELDS = set(['from', 'subject', 'date', 'message_id', 'in_reply_to', 'references', 'body_text', 'body_html', 'body_image', 'mailing_list', 'to', 'cc', 'raw_date_string', 'log', 'content_type', 'filename', 'time_stamp', 'original_url', 'flagged_abuse'])
 IGNORED_FIELDS = set(['delivered_to', 'received', 'mime_version', 'content_transfer_encoding'])
+# Objects the raw data load keeps outside the mailing list folders: replaced versions under previous/ and load cursors under state/
+SKIPPED_PREFIXES = ('previous/', 'state/')
 
 def get_filenames(storage_client, bucketname, filename=None, prefix=None):
     # Get list of filenames
@@ -43,6 +45,10 @@ def get_filenames(storage_client, bucketname, filename=None, prefix=None):
             return [filename]
     return list_bucket_filenames(storage_client, bucketname, prefix)
 
+def skip_filepath(filepath):
+    """Check if the Storage object is outside the mailing list folders and has no messages to load."""
+    return filepath.startswith(SKIPPED_PREFIXES)
+
 def list_bucket_filenames(storage_client, bucketname, prefix):
     """Get gcs bucket filename list"""
     blobs = storage_client.list_blobs(bucketname, prefix=prefix, delimiter=None)
@@ -459,6 +465,9 @@ def main(event, context):
     bq_folders = {'angular': 'angular_mailinglist' , 'golang':'golang_mailinglist', 'nodejs': 'nodejs_mailinglist', 'python':'python_mailinglist'}
     bucketname = event['bucket']
     filepath = event['name'] # this is the Storage filename and use it for doc name
+    if skip_filepath(filepath):
+        print('----skipping file: {}----'.format(filepath))
+        return
     prefix, filename = filepath.split("/")
     bq_prefix=prefix.split("-")[1]
 
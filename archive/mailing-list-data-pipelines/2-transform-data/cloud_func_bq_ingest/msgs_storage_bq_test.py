@@ -357,6 +357,32 @@ original_url: https://en.wikipedia.org/wiki/Ida_B._Wells'''
             got_msg_list= msb.get_msgs_from_gcs(test['client'], test['bucket_name'], test['filename'])
             self.assertEqual(want_msg_list[key], got_msg_list, "Get msg from gcs error")
 
+    def test_skip_filepath(self):
+        filepath_input = {
+            "test1": {
+                "comparison_type": "Test mailing list month file is loaded",
+                "filepath": "mailman-python/2021-03-mailman-python.mbox.gz"
+            },
+            "test2": {
+                "comparison_type": "Test previous version of a month file is skipped",
+                "filepath": "previous/mailman-python/2021-03-mailman-python.mbox.gz.20210401T000000Z"
+            },
+            "test3": {
+                "comparison_type": "Test load cursor state file is skipped",
+                "filepath": "state/nntp-comp.lang.python/nntp-state.txt"
+            }
+        }
+
+        want_skip = {
+            "test1": False,
+            "test2": True,
+            "test3": True,
+        }
+
+        for key, test in filepath_input.items():
+            got_skip = msb.skip_filepath(test["filepath"])
+            self.assertEqual(want_skip[key], got_skip, "Skip filepath error")
+
     def test_check_body_to(self):
         msg_input = {
             "test1": {
@@ -8,4 +8,5 @@ require (
 	github.com/googleapis/google-cloud-go-testing v0.0.0-20200911160855-bcd43fbb19e8
 	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
 	google.golang.org/api v0.31.0
+	gopkg.in/yaml.v2 v2.4.0
 )